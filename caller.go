@@ -9,49 +9,148 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/tcp-info/eventsocket"
 	"github.com/m-lab/traceroute-caller/hopannotation"
 	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/internal/localannotator"
+	"github.com/m-lab/traceroute-caller/internal/pubsubsink"
+	"github.com/m-lab/traceroute-caller/internal/reopen"
+	"github.com/m-lab/traceroute-caller/internal/schema"
 	"github.com/m-lab/traceroute-caller/internal/triggertrace"
 	"github.com/m-lab/traceroute-caller/parser"
 	"github.com/m-lab/traceroute-caller/tracer"
 	"github.com/m-lab/uuid-annotator/ipservice"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	scamperBin       = flag.String("scamper.bin", "/usr/local/bin/scamper", "The path to the scamper binary.")
+	scamperCandidate = flag.String("scamper.candidate-bin", "", "The path to a second scamper binary that runs alongside the first one for comparison (empty disables it).")
 	scamperTimeout   = flag.Duration("scamper.timeout", 900*time.Second, "Timeout duration in seconds for scamper to run a traceroute (min 1, max 3600).")
 	scamperTraceType = flagx.Enum{
 		Options: []string{"mda", "regular"},
 		Value:   "regular",
 	}
+	localAnnotationDBs  flagx.StringArray
+	scamperEnv          flagx.KeyValue
+	scamperTypeTimeouts flagx.KeyValue
 	scamperTracelbPTR   = flag.Bool("scamper.tracelb-ptr", true, "mda traceroute option: Look up DNS pointer records for IP addresses.")
 	scamperTracelbW     = flag.Int("scamper.tracelb-W", 25, "mda traceroute option: Wait time in 1/100ths of seconds between probes (min 15, max 200).")
-	tracerouteOutput    = flag.String("traceroute-output", "/var/spool/scamper1", "The path to store traceroute output.")
+	scamperProfile      = flag.String("scamper.profile", "", "The traceroute profile (fast, thorough, or low-impact) whose options are used unless set by other flags (default the historical options).")
+	scamperProtocol     = flag.String("scamper.protocol", "", "The probe method (scamper's -P option) (default chosen by the profile).")
+	scamperAttempts     = flag.Int("scamper.attempts", 0, "The number of attempts per probe (default chosen by the profile).")
+	scamperConfidence   = flag.Int("scamper.tracelb-confidence", 0, "mda traceroute option: The confidence level, 95 or 99 (default chosen by the profile).")
+	scamperGapLimit     = flag.Int("scamper.gap-limit", 0, "The number of consecutive unresponsive hops after which a traceroute stops (default chosen by the profile).")
+	scamperListName     = flag.String("scamper.list-name", "", "The list name reported in scamper's cycle-start and cycle-stop records (default chosen by scamper).")
+	scamperSlowTrace    = flag.Duration("scamper.slow-trace", 0, "Traceroutes taking at least this long attach their UUID as an exemplar to the trace time histogram (0 means only failed traceroutes do).")
+	scamperMaxOutput    = flag.Int64("scamper.max-output-bytes", 0, "The maximum size in bytes of scamper's output per traceroute.  Scamper is killed and the traceroute is truncated when it's exceeded (0 means unlimited).")
+	scamperPTRMode      = flag.String("scamper.ptr-mode", "", "Look up DNS pointer records for none or all hop addresses (default -scamper.tracelb-ptr for mda traceroutes and none for regular traceroutes).")
+	scamperArgsTemplate = flag.String("scamper.args-template", "", "Expert option: The scamper arguments, with {dst}, {timeout}, and {uuid} placeholders, that replace those built from the other scamper flags (e.g., '-o- -O json -I \"trace -P udp-paris {dst}\"').  They must write JSON to stdout and aren't otherwise checked.")
+	scamperSourceAddr   = flag.String("scamper.source-addr", "", "regular traceroute option: The source address of probes (default chosen by the kernel).")
+	tracerouteOutput    = flag.String("traceroute-output", "/var/spool/scamper1", "The path to store traceroute output (- writes traceroutes to stdout).")
+	tracerouteCollision = flag.String("traceroute-output-collision", "overwrite", "What to do when a traceroute would replace the file of another fresh traceroute: overwrite, skip, or suffix (write it to a uniquified filename).")
+	tracerouteLegacy    = flag.String("traceroute-output-legacy", "", "The path under which traceroute files are also linked (or copied) with the legacy filename scheme during ingestion migrations (empty disables it).")
+	tracerouteFileMode  = flag.Uint("traceroute-output-mode", 0, "The permission bits (e.g., 0640) of traceroute files (default 0444).")
+	tracerouteFileGroup = flag.Int("traceroute-output-gid", 0, "The group ID of traceroute files and directories (default unchanged).")
+	tracerouteIndex     = flag.String("traceroute-index", "", "The path under which to maintain a daily index (index.jsonl) of the traceroute files written (empty disables it).")
+	cookieWidth         = flag.Int("traceroute-output-cookie-width", tracer.DefaultCookieWidth, "The number of hexadecimal digits (16 to 32) that cookies are padded to in UUIDs.  Changing it renames traceroute files, so their consumers must expect the new width.")
+	tracerouteSockID    = flag.Bool("traceroute-sockid", false, "Record the socket ID (4-tuple) of the triggering connection in the metadata of traceroutes.")
+	traceWorkers        = flag.Int("trace-workers", 0, "Maximum number of triggers handled at the same time (0 means unlimited).")
+	traceQueueSize      = flag.Int("trace-queue-size", 0, "Maximum number of triggers queued while all workers are busy before triggers are dropped.")
+	preCheck            = flag.Bool("precheck", false, "Ping destinations before tracing them and skip the traceroutes to unreachable destinations.")
+	preCheckTimeout     = flag.Duration("precheck.timeout", 10*time.Second, "Maximum duration of the ping of a destination.")
+	pubsubProject       = flag.String("pubsub.project", "", "Google Cloud project of the Pub/Sub topic.")
+	pubsubTopic         = flag.String("pubsub.topic", "", "Pub/Sub topic to publish an event to for each completed traceroute (disabled if empty).")
+	pubsubRequired      = flag.Bool("pubsub.required", false, "Count traceroutes whose Pub/Sub events are dropped as failed (failures are only logged otherwise).")
+	dualStack           = flag.Bool("dual-stack", false, "Also trace the address of the other IP family of destinations whose host names resolve to both IPv4 and IPv6 addresses.")
 	hopAnnotationOutput = flag.String("hopannotation-output", "/var/spool/hopannotation1", "The path to store hop annotation output.")
+	nonGlobalHops       = flag.String("hopannotation-non-global", "annotate", "How hops that aren't globally routable (e.g., link-local) are handled: annotate, skip (archive without annotations), or tag (archive without annotations, tagged as non-global).")
+	annotateScope       = flag.String("hopannotation-scope", "all", "The hops of each traceroute whose annotations are requested: all, or endpoints (the destination and the farthest other responsive hop).  The other hops are archived without annotations.")
+	hopAnnotationOff    = flag.Bool("hopannotation-disable", false, "Disable annotating and archiving traceroute hops.")
+	combinedOutput      = flag.Bool("hopannotation-combined", false, "Write the hop annotations of each traceroute at the end of its traceroute file instead of in -hopannotation-output.")
+	minUsefulHops       = flag.Int("min-useful-hops", 0, "The minimum number of responsive hops for a traceroute to be archived (0 archives all traceroutes).")
+	dailyProbeBudget    = flag.Int("daily-probe-budget", 0, "The maximum number of probes sent by traceroutes per UTC day (0 means unlimited).")
+	probeRate           = flag.Int("probe-rate", 0, "The maximum number of probes per second sent by all traceroutes together (0 means unlimited).  Each scamper process is also limited to this rate with its -p option.")
+	triggerDebounce     = flag.Duration("trigger-debounce", 0, "How long to hold a traceroute so that further triggers for the same destination are collapsed into it (0 disables).")
+	sampleRate          = flag.Float64("sample-rate", 1, "The fraction of destinations (greater than 0 and at most 1) whose uncached traceroutes are run; the decision for a destination stands for an hour.")
+	breakerFailures     = flag.Int("breaker.failures", 0, "The number of consecutive traceroute failures that stop traceroutes for a while (0 disables the circuit breaker).")
+	breakerWindow       = flag.Duration("breaker.window", 5*time.Minute, "The period in which consecutive traceroute failures must happen to stop traceroutes.")
+	breakerCooldown     = flag.Duration("breaker.cooldown", 5*time.Minute, "The period during which traceroutes are stopped before a single traceroute is run to test recovery.")
+	scheduleTargets     = flag.String("schedule.targets", "", "The path to a file of target IP addresses, one per line, to trace periodically regardless of connections (empty disables scheduled tracing).")
+	scheduleInterval    = flag.Duration("schedule.interval", time.Hour, "The interval between rounds of scheduled traceroutes.  The target file is reloaded before every round.")
+	replayFile          = flag.String("replay", "", "The path to a file of connection events, in the JSONL format of the event socket, to replay instead of reading events from the event socket.  TRC exits once the traceroutes of the replayed events are archived.")
+	reannotateDir       = flag.String("reannotate", "", "The path to a directory of existing traceroute files whose hops to annotate again with the current annotator (e.g., after its data was updated).  TRC exits once the annotations are archived.")
+	reannotateWorkers   = flag.Int("reannotate.workers", 4, "The maximum number of traceroute files annotated at the same time with -reannotate.")
+	replaySpeed         = flag.Float64("replay.speed", 1, "The speed of replayed events relative to their timestamps (e.g., 10 replays ten times faster than real time).")
+	deadLetterDir       = flag.String("dead-letter-dir", "", "The path to write the raw output, error, and UUID of traceroutes that fail parsing or hop extraction to for later inspection (empty discards them).")
+	deadLetterMaxBytes  = flag.Int64("dead-letter-max-bytes", 64<<20, "The maximum size in bytes of the dead letters in -dead-letter-dir.  The oldest ones are removed when it's exceeded.")
+	selfTest            = flag.Bool("self-test", false, "Run a traceroute to -self-test.target at startup and exit if it can't be parsed (opt-in; skipped unless set).")
+	selfTestTarget      = flag.String("self-test.target", "127.0.0.1", "The known-good destination of the startup self-test traceroute.")
+	selfTestAnnotate    = flag.Bool("self-test.annotate", false, "Also annotate the hops of the startup self-test traceroute (unless hop annotation is disabled).")
+	debugAddress        = flag.String("debug.listen-address", "", "The address of the debug server that exposes /debug/cache (empty disables it).  Note that the cache reveals traced destinations.")
+	enablePprof         = flag.Bool("enable-pprof", false, "Serve the pprof handlers on -pprof.listen-address.  Disabled by default for security.")
+	pprofAddress        = flag.String("pprof.listen-address", "localhost:6060", "The address of the pprof server, which must differ from -prometheusx.listen-address.")
+	dumpSchema          = flag.Bool("dump-schema", false, "Print the JSON Schema of the traceroute metadata line, hop annotation, and traceroute index formats and exit.")
+	logFile             = flag.String("log-file", "", "The path to the log file (default stderr).  The file is reopened on SIGHUP.")
+	rotateMaxSize       = flag.Int64("rotate.max-size", 0, "The size in bytes that the log file and the traceroute index files are rotated at (0 disables size-based rotation).")
+	rotateMaxAge        = flag.Duration("rotate.max-age", 0, "The age that the log file and the traceroute index files are rotated at (0 disables time-based rotation).")
+	rotateMaxBackups    = flag.Int("rotate.max-backups", 0, "The number of rotated backups of each file to keep (0 keeps all of them).")
+	rotateCompress      = flag.Bool("rotate.compress", false, "Compress rotated backups with gzip.")
 	// Keeping IP cache flags capitalized for backward compatibility.
 	ipcEntryTimeout = flag.Duration("IPCacheTimeout", 10*time.Minute, "Timeout duration in seconds for an IP cache entry.")
 	ipcScanPeriod   = flag.Duration("IPCacheUpdatePeriod", 1*time.Minute, "IP cache scanning period in seconds.")
+	ipcRefreshAhead = flag.Duration("ipcache.refresh-ahead", 0, "Refresh hot IP cache entries in the background when they are hit within this duration of their expiry (0 disables refresh-ahead).")
+	ipcRefreshHits  = flag.Int("ipcache.refresh-min-hits", 1, "The number of cache hits after which an IP cache entry is hot and may be refreshed ahead of its expiry.")
+	ipcRefreshMax   = flag.Int("ipcache.refresh-workers", 1, "The maximum number of refresh-ahead traceroutes in progress at any time.")
+	ipcNegativeTTL  = flag.Duration("ipcache.negative-ttl", 0, "How long a failed traceroute (e.g., one that timed out) suppresses new traceroutes to the same IP address (0 disables negative caching).")
+	ipcNegativeMult = flag.Float64("ipcache.negative-ttl-multiplier", 1, "The factor that the negative TTL of a destination is multiplied by for each consecutive failure (1 disables escalation).")
+	ipcNegativeMax  = flag.Duration("ipcache.negative-ttl-max", 0, "The maximum escalated negative TTL (0 caps it at -IPCacheTimeout).")
+	ipcDisable      = flag.Bool("ipcache.disable", false, "Disable the IP cache so that every trigger runs a new traceroute (for debugging).")
 
 	// Variables to aid in testing of main().
 	ctx, cancel    = context.WithCancel(context.Background())
 	logFatal       = log.Fatal
 	errEnvArgs     = errors.New("failed to get args from environment")
 	errEventSocket = errors.New("tcpinfo.eventsocket value was empty")
+	errLogFile     = errors.New("failed to open log file")
 	errScamper     = errors.New("failed to create a new scamper instance")
+	errIndexer     = errors.New("failed to create the traceroute indexer")
+	errLocalDB     = errors.New("failed to load the local annotation databases")
 	errNewHandler  = errors.New("failed to create a triggertrace handler")
+	errDebugServer = errors.New("failed to start the debug server")
+	errMetrics     = errors.New("failed to start the metrics server")
+	errPprof       = errors.New("failed to start the pprof server")
+	errScheduler   = errors.New("failed to create a traceroute scheduler")
+	errSchema      = errors.New("failed to write the output schema")
+	errReplay      = errors.New("failed to replay connection events")
+	errSelfTest    = errors.New("startup self-test failed")
+	errPubSub      = errors.New("failed to create the Pub/Sub publisher")
+	errReannotate  = errors.New("failed to annotate existing traceroutes")
 )
 
 func init() {
 	flag.Var(&scamperTraceType, "scamper.trace-type", "Specify the type of traceroute (mda or regular) to run.")
+	flag.Var(&scamperTypeTimeouts, "scamper.timeout-by-type", "A timeout (TYPE=duration, e.g. mda=900s) of the traceroutes of a trace type that overrides -scamper.timeout.  Can be repeated.")
+	flag.Var(&scamperEnv, "scamper.env", "An environment variable (NAME=value) added to the environment of scamper processes.  Can be repeated.")
+	flag.Var(&localAnnotationDBs, "hopannotation-local-db", "The path to a local MaxMind or IPinfo database (.mmdb) to annotate hops with instead of the uuid-annotator.  Can be repeated, and databases are reloaded when they change.")
 }
 
 func main() {
@@ -61,16 +160,85 @@ func main() {
 	if err := flagx.ArgsFromEnv(flag.CommandLine); err != nil {
 		logFatal(fmt.Errorf("%v: %w", errEnvArgs, err))
 	}
-	if *eventsocket.Filename == "" {
+	if *dumpSchema {
+		if err := writeSchema(os.Stdout); err != nil {
+			logFatal(fmt.Errorf("%v: %w", errSchema, err))
+		}
+		return
+	}
+	if *eventsocket.Filename == "" && *replayFile == "" && *reannotateDir == "" {
 		logFatal(errEventSocket)
 	}
 
-	promSrv := prometheusx.MustServeMetrics()
+	// The log file and the traceroute index files can also rotate
+	// themselves.
+	rotation := reopen.Rotation{
+		MaxSize:    *rotateMaxSize,
+		MaxAge:     *rotateMaxAge,
+		MaxBackups: *rotateMaxBackups,
+		Compress:   *rotateCompress,
+	}
+	// Writers that should be reopened on SIGHUP so that external
+	// rotation tools can move their files out of the way.
+	var reopeners []reopen.Reopener
+	if *logFile != "" {
+		lf, err := reopen.OpenRotating(*logFile, 0644, rotation)
+		if err != nil {
+			logFatal(fmt.Errorf("%v: %w", errLogFile, err))
+		}
+		defer func() {
+			log.SetOutput(os.Stderr)
+			lf.Close()
+		}()
+		log.SetOutput(lf)
+		reopeners = append(reopeners, lf)
+	}
+	var indexer *tracer.Indexer
+	if *tracerouteIndex != "" && *reannotateDir == "" {
+		var err error
+		indexer, err = tracer.NewRotatingIndexer(*tracerouteIndex, rotation)
+		if err != nil {
+			logFatal(fmt.Errorf("%v: %w", errIndexer, err))
+		}
+		reopeners = append(reopeners, indexer)
+	}
+	if len(reopeners) > 0 {
+		go reopenOnSignal(ctx, syscall.SIGHUP, reopeners...)
+	}
+
+	// The metrics server only serves metrics; profiling is opt-in.
+	promSrv := &http.Server{
+		Addr:    *prometheusx.ListenAddress,
+		Handler: metricsMux(),
+	}
+	if err := httpx.ListenAndServeAsync(promSrv); err != nil {
+		logFatal(fmt.Errorf("%v: %w", errMetrics, err))
+	}
 	defer func() {
 		if err := promSrv.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
 			log.Printf("failed to shut down Prometheus server (error: %v)", err)
 		}
 	}()
+	if *enablePprof {
+		if *pprofAddress == *prometheusx.ListenAddress {
+			logFatal(fmt.Errorf("%v: %q is the address of the metrics server", errPprof, *pprofAddress))
+		}
+		pprofSrv := &http.Server{
+			Addr:    *pprofAddress,
+			Handler: pprofMux(),
+		}
+		if err := httpx.ListenAndServeAsync(pprofSrv); err != nil {
+			logFatal(fmt.Errorf("%v: %w", errPprof, err))
+		}
+		defer pprofSrv.Close()
+	}
+	if *reannotateDir != "" {
+		// Existing traceroutes are annotated without scamper.
+		if err := reannotate(ctx, *reannotateDir, *reannotateWorkers); err != nil {
+			logFatal(fmt.Errorf("%v: %w", errReannotate, err))
+		}
+		return
+	}
 
 	// The triggertrace package needs the following:
 	//   1. A traceroute tool for running traceroutes.
@@ -80,14 +248,67 @@ func main() {
 
 	// 1. The traceroute tool (scamper).
 	scamperCfg := tracer.ScamperConfig{
-		Binary:     *scamperBin,
-		OutputPath: *tracerouteOutput,
-		Timeout:    *scamperTimeout,
-		TraceType:  scamperTraceType.Value,
+		Binary:          *scamperBin,
+		OutputPath:      *tracerouteOutput,
+		Timeout:         *scamperTimeout,
+		TraceType:       scamperTraceType.Value,
+		FileMode:        os.FileMode(*tracerouteFileMode),
+		FileGroup:       *tracerouteFileGroup,
+		PTRMode:         *scamperPTRMode,
+		ListName:        *scamperListName,
+		SlowTrace:       *scamperSlowTrace,
+		ProbeRate:       *probeRate,
+		MaxOutputBytes:  *scamperMaxOutput,
+		CollisionPolicy: *tracerouteCollision,
+		Profile:         *scamperProfile,
+		Protocol:        *scamperProtocol,
+		Attempts:        *scamperAttempts,
+		GapLimit:        *scamperGapLimit,
+		Env:             scamperEnv.Get(),
+		LegacyLinkPath:  *tracerouteLegacy,
+		CookieWidth:     *cookieWidth,
+		ArgsTemplate:    *scamperArgsTemplate,
+	}
+	if *cookieWidth != tracer.DefaultCookieWidth {
+		log.Printf("warning: cookies are padded to %d hexadecimal digits instead of %d in UUIDs and traceroute filenames\n", *cookieWidth, tracer.DefaultCookieWidth)
+	}
+	for traceType, value := range scamperTypeTimeouts.Get() {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			logFatal(fmt.Errorf("%v: %s timeout: %w", errScamper, traceType, err))
+		}
+		if scamperCfg.TraceTypeTimeouts == nil {
+			scamperCfg.TraceTypeTimeouts = make(map[string]time.Duration)
+		}
+		scamperCfg.TraceTypeTimeouts[traceType] = timeout
+	}
+	if indexer != nil {
+		scamperCfg.Indexer = indexer
 	}
 	if scamperCfg.TraceType == "mda" {
 		scamperCfg.TracelbPTR = *scamperTracelbPTR
-		scamperCfg.TracelbWaitProbe = *scamperTracelbW
+		scamperCfg.TracelbConfidence = *scamperConfidence
+		// The wait probe flag has a default value, so it only
+		// overrides the profile when it's set.
+		if scamperCfg.Profile == "" || isFlagSet("scamper.tracelb-W") {
+			scamperCfg.TracelbWaitProbe = *scamperTracelbW
+		}
+	} else {
+		scamperCfg.SourceAddr = *scamperSourceAddr
+	}
+	var candidates map[string]ipcache.Tracer
+	if *scamperCandidate != "" {
+		// Label the outputs of both binaries so they can be told apart.
+		candidateCfg := scamperCfg
+		candidateCfg.Binary = *scamperCandidate
+		candidateCfg.Label = "candidate"
+		candidateCfg.LegacyLinkPath = "" // only for the primary traceroutes
+		candidate, err := tracer.NewScamper(candidateCfg)
+		if err != nil {
+			logFatal(fmt.Errorf("%v: %w", errScamper, err))
+		}
+		candidates = map[string]ipcache.Tracer{candidateCfg.Label: candidate}
+		scamperCfg.Label = "primary"
 	}
 	scamper, err := tracer.NewScamper(scamperCfg)
 	if err != nil {
@@ -101,20 +322,300 @@ func main() {
 	ipcCfg := ipcache.Config{
 		EntryTimeout: *ipcEntryTimeout,
 		ScanPeriod:   *ipcScanPeriod,
+		Label:        scamperCfg.Label,
+		// Refresh-ahead traceroutes go through the same rate and
+		// budget limits as other traceroutes.
+		RefreshAhead:   *ipcRefreshAhead,
+		RefreshMinHits: *ipcRefreshHits,
+		RefreshWorkers: *ipcRefreshMax,
+		NegativeTTL:    *ipcNegativeTTL,
+		// Chronically unreachable destinations are quarantined longer.
+		NegativeTTLMultiplier: *ipcNegativeMult,
+		NegativeTTLMax:        *ipcNegativeMax,
 	}
 	// 3. The traceroute parser.
 	newParser, err := parser.New(scamperTraceType.Value)
 	if err != nil {
 		logFatal(err)
 	}
-	// 4. The hop annotator.
-	haCfg := hopannotation.Config{
-		AnnotatorClient: ipservice.NewClient(*ipservice.SocketFilename),
-		OutputPath:      *hopAnnotationOutput,
+	// 4. The hop annotator (unless disabled).
+	haCfg, err := hopAnnotationConfig(ctx)
+	if err != nil {
+		logFatal(err)
+	}
+	// A zero SampleRate means no sampling in triggertrace.Config, so
+	// -sample-rate=0 can't be passed on as is.
+	if *sampleRate == 0 {
+		logFatal(fmt.Errorf("%v: -sample-rate must be greater than 0", errNewHandler))
+	}
+	hCfg := triggertrace.Config{
+		MinUsefulHops:      *minUsefulHops,
+		DisableAnnotation:  *hopAnnotationOff,
+		CombinedOutput:     *combinedOutput,
+		CandidateTracers:   candidates,
+		BreakerFailures:    *breakerFailures,
+		BreakerWindow:      *breakerWindow,
+		BreakerCooldown:    *breakerCooldown,
+		DailyProbeBudget:   *dailyProbeBudget,
+		TriggerDebounce:    *triggerDebounce,
+		DisableCache:       *ipcDisable,
+		SampleRate:         *sampleRate,
+		ProbeRate:          *probeRate,
+		RecordSockID:       *tracerouteSockID,
+		Workers:            *traceWorkers,
+		QueueSize:          *traceQueueSize,
+		PreCheck:           *preCheck,
+		PreCheckTimeout:    *preCheckTimeout,
+		CookieWidth:        *cookieWidth,
+		DeadLetterDir:      *deadLetterDir,
+		DeadLetterMaxBytes: *deadLetterMaxBytes,
+		AnnotateScope:      *annotateScope,
+	}
+	if *dualStack {
+		hCfg.DualStackResolver = triggertrace.LookupDualStack
 	}
-	traceHandler, err := triggertrace.NewHandler(ctx, scamper, ipcCfg, newParser, haCfg)
+	if *pubsubTopic != "" {
+		pub, err := pubsubsink.NewTopicPublisher(ctx, *pubsubProject, *pubsubTopic)
+		if err != nil {
+			logFatal(fmt.Errorf("%v: %w", errPubSub, err))
+		}
+		defer pub.Close()
+		// Queued events are published before the publisher is closed.
+		sink := pubsubsink.New(pub, pubsubsink.Config{})
+		defer sink.Close()
+		// Traceroute files are still written by scamper.
+		hCfg.Sinks = []triggertrace.SinkConfig{
+			{Name: "pubsub", Sink: sink, Required: *pubsubRequired},
+		}
+	}
+	traceHandler, err := triggertrace.NewHandler(ctx, scamper, ipcCfg, newParser, haCfg, hCfg)
 	if err != nil {
 		logFatal(fmt.Errorf("%v: %w", errNewHandler, err))
 	}
+	if *selfTest {
+		if err := runSelfTest(ctx, traceHandler, scamperCfg); err != nil {
+			logFatal(fmt.Errorf("%v: %w", errSelfTest, err))
+		}
+	}
+	if *scheduleTargets != "" {
+		scheduler, err := triggertrace.NewScheduler(traceHandler, *scheduleTargets, *scheduleInterval)
+		if err != nil {
+			logFatal(fmt.Errorf("%v: %w", errScheduler, err))
+		}
+		go scheduler.Run(ctx)
+	}
+	if *debugAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/cache", debugCacheHandler(traceHandler))
+		debugSrv := &http.Server{
+			Addr:    *debugAddress,
+			Handler: mux,
+		}
+		if err := httpx.ListenAndServeAsync(debugSrv); err != nil {
+			logFatal(fmt.Errorf("%v: %w", errDebugServer, err))
+		}
+		defer debugSrv.Close()
+	}
+	if *replayFile != "" {
+		if err := replay(ctx, traceHandler, *replayFile, *replaySpeed); err != nil {
+			logFatal(fmt.Errorf("%v: %w", errReplay, err))
+		}
+		return
+	}
 	eventsocket.MustRun(ctx, *eventsocket.Filename, traceHandler)
 }
+
+// replay replays the connection events in the named file through the
+// handler and waits for the resulting traceroutes to be archived.
+func replay(ctx context.Context, h *triggertrace.Handler, path string, speed float64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := triggertrace.Replay(ctx, h, f, speed)
+	if err != nil {
+		return err
+	}
+	log.Printf("replayed %d events from %q, waiting for traceroutes to complete\n", n, path)
+	h.Wait()
+	return nil
+}
+
+// runSelfTest runs the startup self-test traceroute through the
+// handler's pipeline with a scamper instance configured like the given
+// one that writes to a temporary directory instead of the archive.
+func runSelfTest(ctx context.Context, h *triggertrace.Handler, cfg tracer.ScamperConfig) error {
+	dir, err := ioutil.TempDir("", "trc-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	cfg.OutputPath = dir
+	cfg.Indexer = nil
+	cfg.LegacyLinkPath = ""
+	s, err := tracer.NewScamper(cfg)
+	if err != nil {
+		return err
+	}
+	return h.SelfTest(ctx, s, *selfTestTarget, *selfTestAnnotate)
+}
+
+// hopAnnotationConfig returns the hop annotation configuration, which
+// has no annotator client if hop annotation is disabled.
+func hopAnnotationConfig(ctx context.Context) (hopannotation.Config, error) {
+	haCfg := hopannotation.Config{}
+	if *hopAnnotationOff {
+		return haCfg, nil
+	}
+	if len(localAnnotationDBs) > 0 {
+		local, err := localannotator.New(ctx, localannotator.Config{Paths: localAnnotationDBs})
+		if err != nil {
+			return haCfg, fmt.Errorf("%v: %w", errLocalDB, err)
+		}
+		haCfg.AnnotatorClient = local
+	} else {
+		haCfg.AnnotatorClient = ipservice.NewClient(*ipservice.SocketFilename)
+	}
+	haCfg.OutputPath = *hopAnnotationOutput
+	haCfg.NonGlobalHops = *nonGlobalHops
+	return haCfg, nil
+}
+
+// reannotate annotates the hops of the existing traceroute files under
+// the given directory again with the configured hop annotator and
+// archives their annotations.
+func reannotate(ctx context.Context, dir string, workers int) error {
+	p, err := parser.New(scamperTraceType.Value)
+	if err != nil {
+		return err
+	}
+	haCfg, err := hopAnnotationConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if haCfg.AnnotatorClient == nil {
+		return errors.New("hop annotation is disabled")
+	}
+	haCfg.ReplaceFiles = true
+	ha, err := hopannotation.New(ctx, haCfg)
+	if err != nil {
+		return err
+	}
+	stats, err := triggertrace.Reannotate(ctx, dir, p, ha, workers)
+	if err != nil {
+		return err
+	}
+	log.Printf("reannotated traceroute files in %q: %+v\n", dir, stats)
+	return nil
+}
+
+// isFlagSet returns whether the named flag was set on the command line
+// or in the environment.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// writeSchema writes the JSON Schema of the output formats, generated
+// from their types, to w.
+func writeSchema(w io.Writer) error {
+	doc := schema.Document(map[string]interface{}{
+		"Metadata":       tracer.Metadata{},
+		"HopAnnotation1": hopannotation.HopAnnotation1{},
+		"IndexRecord":    tracer.IndexRecord{},
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// cacheEntryLister is the interface for obtaining the traceroute cache
+// entries.
+type cacheEntryLister interface {
+	CacheEntries() []ipcache.Entry
+}
+
+// debugCacheEntry is the JSON representation of a traceroute cache entry.
+type debugCacheEntry struct {
+	IP               string
+	UUID             string
+	InsertionTime    time.Time
+	ExpiresInSeconds float64
+}
+
+// debugCacheHandler returns an HTTP handler that responds to GET requests
+// with the current traceroute cache entries in JSON format.
+func debugCacheHandler(cl cacheEntryLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		now := time.Now()
+		entries := []debugCacheEntry{}
+		for _, e := range cl.CacheEntries() {
+			entries = append(entries, debugCacheEntry{
+				IP:               e.IP,
+				UUID:             e.UUID,
+				InsertionTime:    e.Timestamp,
+				ExpiresInSeconds: e.ExpiresAt.Sub(now).Seconds(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.Printf("failed to write cache entries (error: %v)\n", err)
+		}
+	}
+}
+
+// metricsMux returns the handlers of the metrics server: only the
+// Prometheus metrics.  They're served in the OpenMetrics format to
+// scrapers that ask for it since exemplars (e.g., the UUIDs of
+// traceroutes) are only served in this format.
+func metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	))
+	return mux
+}
+
+// pprofMux returns the handlers of the pprof server.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// reopenOnSignal reopens all of the given writers every time the
+// specified signal is received.  It returns when ctx is cancelled.
+func reopenOnSignal(ctx context.Context, sig os.Signal, reopeners ...reopen.Reopener) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sig)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			log.Printf("received %v, reopening %d writer(s)\n", sig, len(reopeners))
+			for _, r := range reopeners {
+				if err := r.Reopen(); err != nil {
+					log.Printf("failed to reopen writer (error: %v)\n", err)
+				}
+			}
+		}
+	}
+}
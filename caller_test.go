@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/internal/reopen"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type strFlag struct {
@@ -171,6 +180,528 @@ func TestMainNewHandler(t *testing.T) {
 	main()
 }
 
+// TestMainSampleRate tests that main() fails when the sample rate is
+// zero rather than tracing every destination.
+func TestMainSampleRate(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errNewHandler)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*sampleRate = 1
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", sockPath},
+		{"-traceroute-output", testDir},
+		{"-hopannotation-output", testDir},
+		{"-sample-rate", "0"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+// TestMainScheduler tests that main() fails when the target file of
+// scheduled traceroutes is invalid.
+func TestMainScheduler(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errScheduler)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*scheduleTargets = ""
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-scamper.tracelb-W", "15"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", sockPath},
+		{"-traceroute-output", testDir},
+		{"-hopannotation-output", testDir},
+		{"-schedule.targets", "/non-existent/targets"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+// TestMainIndexer tests that main() fails when the traceroute index
+// path is invalid.
+func TestMainIndexer(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errIndexer)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*tracerouteIndex = ""
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-scamper.tracelb-W", "15"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", sockPath},
+		{"-traceroute-output", testDir},
+		{"-hopannotation-output", testDir},
+		{"-traceroute-index", "/dev/null/index"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+func TestMainLocalDB(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errLocalDB)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		localAnnotationDBs = nil
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-scamper.tracelb-W", "15"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", sockPath},
+		{"-traceroute-output", testDir},
+		{"-hopannotation-output", testDir},
+		{"-hopannotation-local-db", "/dev/null/GeoLite2-City.mmdb"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+// TestMainReplay tests that main() replays connection events from a
+// file instead of connecting to the eventsocket server.
+func TestMainReplay(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("main() = %v, want nil", r)
+		}
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*replayFile = ""
+		*replaySpeed = 1
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-scamper.tracelb-W", "15"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", ""},
+		{"-traceroute-output", testDir},
+		{"-hopannotation-output", testDir},
+		{"-replay", "internal/triggertrace/testdata/replay.jsonl"},
+		{"-replay.speed", "100"},
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+func TestMainReplayError(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errReplay)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*replayFile = ""
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-scamper.tracelb-W", "15"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", sockPath},
+		{"-traceroute-output", testDir},
+		{"-hopannotation-output", testDir},
+		{"-replay", "/dev/null/events.jsonl"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+// TestMainReannotate tests that main() annotates existing traceroutes
+// without scamper or the eventsocket server.
+func TestMainReannotate(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("main() = %v, want nil", r)
+		}
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*reannotateDir = ""
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/dev/null/scamper"},
+		{"-scamper.trace-type", "mda"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", ""},
+		{"-hopannotation-output", testDir},
+		{"-reannotate", "internal/triggertrace/testdata/reannotate"},
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+func TestMainReannotateError(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errReannotate)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*reannotateDir = ""
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/dev/null/scamper"},
+		{"-scamper.trace-type", "mda"},
+		{"-prometheusx.listen-address", ":0"},
+		{"-tcpinfo.eventsocket", ""},
+		{"-hopannotation-output", testDir},
+		{"-reannotate", "/dev/null/traceroutes"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+// TestMainPprofAddress tests that main() fails when the pprof server
+// would share the address of the metrics server.
+func TestMainPprofAddress(t *testing.T) {
+	saveOSArgs := os.Args
+	logFatal = func(args ...interface{}) { panic(args[0]) }
+	defer func() {
+		r := recover()
+		checkError(t, r, errPprof)
+		logFatal = log.Fatal
+		os.Args = saveOSArgs
+		*enablePprof = false
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	*enablePprof = true
+	for _, arg := range []strFlag{
+		{"-scamper.bin", "/bin/echo"},
+		{"-scamper.trace-type", "mda"},
+		{"-prometheusx.listen-address", "localhost:0"},
+		{"-tcpinfo.eventsocket", sockPath},
+		{"-hopannotation-output", testDir},
+		{"-pprof.listen-address", "localhost:0"}, // should cause failure
+	} {
+		os.Args = append(os.Args, arg.flag, arg.value)
+	}
+	main()
+}
+
+// TestMainSelfTest tests that main() fails when the startup self-test
+// traceroute can't be parsed and proceeds when it can.
+func TestMainSelfTest(t *testing.T) {
+	for _, test := range []struct {
+		binary string
+		want   error
+	}{
+		{"/bin/echo", errSelfTest}, // echo's output isn't a traceroute
+		{"internal/triggertrace/testdata/scamper", nil},
+	} {
+		func() {
+			saveOSArgs := os.Args
+			logFatal = func(args ...interface{}) { panic(args[0]) }
+			defer func() {
+				r := recover()
+				if test.want != nil {
+					checkError(t, r, test.want)
+				} else if r != nil {
+					t.Errorf("main() = %v, want nil", r)
+				}
+				logFatal = log.Fatal
+				os.Args = saveOSArgs
+				*selfTest = false
+				*replayFile = ""
+			}()
+
+			ctx, cancel = context.WithCancel(context.Background())
+			*selfTest = true
+			for _, arg := range []strFlag{
+				{"-scamper.bin", test.binary},
+				{"-scamper.trace-type", "mda"},
+				{"-scamper.tracelb-W", "15"},
+				{"-prometheusx.listen-address", ":0"},
+				{"-tcpinfo.eventsocket", ""},
+				{"-traceroute-output", testDir},
+				{"-hopannotation-output", testDir},
+				{"-replay", "internal/triggertrace/testdata/replay.jsonl"},
+				{"-replay.speed", "100"},
+			} {
+				os.Args = append(os.Args, arg.flag, arg.value)
+			}
+			main()
+		}()
+	}
+}
+
+// TestReopenOnSignal tests that receiving SIGHUP causes writers to
+// reopen their files so that a new file handle is used after rotation.
+func TestReopenOnSignal(t *testing.T) {
+	path := filepath.Join(testDir, "reopen.log")
+	f, err := reopen.Open(path, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %q (error: %v)", path, err)
+	}
+	defer f.Close()
+	sigCtx, sigCancel := context.WithCancel(context.Background())
+	defer sigCancel()
+	sigDone := make(chan struct{})
+	go func() {
+		reopenOnSignal(sigCtx, syscall.SIGHUP, f)
+		close(sigDone)
+	}()
+	// Give reopenOnSignal() time to register for the signal.
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := f.Write([]byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	// The new handle is used once the file reappears at its original path.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q was not reopened after SIGHUP", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := f.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{rotated: "old\n", path: "new\n"} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("ReadFile(%q) = %q, want %q", file, b, want)
+		}
+	}
+
+	sigCancel()
+	select {
+	case <-sigDone:
+	case <-time.After(2 * time.Second):
+		t.Errorf("reopenOnSignal() still running after context was cancelled")
+	}
+}
+
+type fakeEntryLister struct {
+	entries []ipcache.Entry
+}
+
+func (fel *fakeEntryLister) CacheEntries() []ipcache.Entry {
+	return fel.entries
+}
+
+// TestDebugCacheHandler tests that the /debug/cache handler returns
+// cache entries as JSON and only responds to GET requests.
+func TestDebugCacheHandler(t *testing.T) {
+	now := time.Now().UTC()
+	fel := &fakeEntryLister{
+		entries: []ipcache.Entry{
+			{IP: "1.2.3.4", UUID: "host_123_0000000000000001", Timestamp: now, ExpiresAt: now.Add(10 * time.Minute)},
+		},
+	}
+	srv := httptest.NewServer(debugCacheHandler(fel))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var got []debugCacheEntry
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d entries, want 1", len(got))
+	}
+	if got[0].IP != "1.2.3.4" || got[0].UUID != "host_123_0000000000000001" || !got[0].InsertionTime.Equal(now) {
+		t.Errorf("got entry %+v, want %+v", got[0], fel.entries[0])
+	}
+	if got[0].ExpiresInSeconds <= 0 || got[0].ExpiresInSeconds > 600 {
+		t.Errorf("got ExpiresInSeconds %v, want (0, 600]", got[0].ExpiresInSeconds)
+	}
+}
+
+// TestMetricsExemplars tests that the metrics server serves exemplars
+// to scrapers that ask for the OpenMetrics format.
+func TestMetricsExemplars(t *testing.T) {
+	counter := promauto.NewCounter(prometheus.CounterOpts{
+		Name: "test_metrics_exemplars_total",
+		Help: "A counter with an exemplar",
+	})
+	counter.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"uuid": "test-uuid"})
+	srv := httptest.NewServer(metricsMux())
+	defer srv.Close()
+	tests := []struct {
+		accept       string
+		wantExemplar bool
+	}{
+		{"", false},
+		{"application/openmetrics-text; version=0.0.1", true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(string(body), `test_metrics_exemplars_total 1.0 # {uuid="test-uuid"}`); got != test.wantExemplar {
+			t.Errorf("Accept %q: got exemplar %v, want %v:\n%s", test.accept, got, test.wantExemplar, body)
+		}
+	}
+}
+
+// TestPprof tests that the pprof handlers are only served by the pprof
+// server and that the metrics server always exports the Go runtime
+// metrics.
+func TestPprof(t *testing.T) {
+	get := func(srv *httptest.Server, path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	metricsSrv := httptest.NewServer(metricsMux())
+	defer metricsSrv.Close()
+	pprofSrv := httptest.NewServer(pprofMux())
+	defer pprofSrv.Close()
+	code, body := get(metricsSrv, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", code, http.StatusOK)
+	}
+	for _, metric := range []string{"go_goroutines", "go_gc_duration_seconds", "go_memstats_heap_alloc_bytes", "process_cpu_seconds_total"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("/metrics doesn't have %s", metric)
+		}
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+		if code, _ := get(metricsSrv, path); code != http.StatusNotFound {
+			t.Errorf("GET %s on metrics server status = %d, want %d", path, code, http.StatusNotFound)
+		}
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/goroutine"} {
+		if code, _ := get(pprofSrv, path); code != http.StatusOK {
+			t.Errorf("GET %s on pprof server status = %d, want %d", path, code, http.StatusOK)
+		}
+	}
+}
+
+// TestWriteSchema tests that the schema of the output formats describes
+// the fields of their types.
+func TestWriteSchema(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSchema(&buf); err != nil {
+		t.Fatalf("writeSchema() = %v, want nil", err)
+	}
+	var doc struct {
+		Definitions map[string]struct {
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to unmarshal schema (error: %v)", err)
+	}
+	for def, fields := range map[string][]string{
+		"Metadata":       {"UUID", "TracerouteCallerVersion", "CachedResult", "CachedUUID"},
+		"HopAnnotation1": {"ID", "Timestamp", "Annotations"},
+		"IndexRecord":    {"Filename", "UUID", "Destination", "Timestamp", "CachedResult"},
+	} {
+		for _, field := range fields {
+			if _, ok := doc.Definitions[def].Properties[field]; !ok {
+				t.Errorf("schema of %s has no %s field", def, field)
+			}
+		}
+	}
+}
+
 func checkError(t *testing.T, r interface{}, want error) {
 	t.Helper()
 	if r == nil {
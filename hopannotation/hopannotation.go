@@ -25,10 +25,13 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/m-lab/traceroute-caller/parser"
 	// TODO: These should both be in a common location containing API definitions.
 	"github.com/m-lab/uuid-annotator/annotator"
 	"github.com/m-lab/uuid-annotator/ipservice"
@@ -70,10 +73,27 @@ var (
 )
 
 // HopAnnotation1 is the datatype that is written to the hop annotation file.
+// Extensions holds the ICMP extensions (e.g., MPLS label stacks) of the
+// hop's replies and RTT the round-trip time statistics of its replies;
+// RTT is left out for hops without replies.  A hop is only archived once a
+// day, so both come from the first traceroute that found the hop that
+// day and later traceroutes through the hop aren't reflected.
+// NonGlobal is set for hops that aren't globally routable when they are
+// tagged (see Config.NonGlobalHops).
 type HopAnnotation1 struct {
 	ID          string
 	Timestamp   time.Time
 	Annotations *annotator.ClientAnnotations
+	Extensions  []parser.ICMPExt `json:",omitempty"`
+	RTT         *parser.RTTStats `json:",omitempty"`
+	NonGlobal   bool             `json:",omitempty"`
+}
+
+// HopDetails holds the data of the hops of a traceroute, keyed by hop
+// address, that is archived along with their annotations.
+type HopDetails struct {
+	Extensions map[string][]parser.ICMPExt // ICMP extensions of replies
+	RTTs       map[string]*parser.RTTStats // round-trip times of replies
 }
 
 // Config contains configuration parameters of a hop cache.
@@ -82,14 +102,28 @@ type HopAnnotation1 struct {
 type Config struct {
 	AnnotatorClient ipservice.Client
 	OutputPath      string
+	// NonGlobalHops specifies how hops that aren't globally routable
+	// (see IsGlobal) are handled:
+	// "annotate" requests their annotations like other hops, "skip"
+	// archives them without annotations, and "tag" archives them
+	// without annotations but tagged as non-global.  Skipped and
+	// tagged hops aren't sent to the annotator.  Empty (default)
+	// means "annotate".
+	NonGlobalHops string
+	// ReplaceFiles replaces existing hop annotation files (e.g., when
+	// the hops of existing traceroutes are annotated again) instead
+	// of failing to write them.
+	ReplaceFiles bool
 }
 
 // HopCache is the cache of hop annotations.
 type HopCache struct {
-	hops       map[string]bool  // hop addresses being handled or already handled
+	hops       map[string]bool  // hop addresses being handled or already handled (false if archived without annotations because out of scope)
 	hopsLock   sync.Mutex       // hop cache lock
 	annotator  ipservice.Client // function for getting hop annotations
 	outputPath string           // path to directory for writing hop annotations
+	nonGlobal  string           // how non-global hops are handled
+	replace    bool             // whether existing files are replaced
 	hour       int32            // the hour (between 0 and 23) when cache resetter last checked time
 }
 
@@ -111,10 +145,20 @@ func New(ctx context.Context, haCfg Config) (*HopCache, error) {
 	if ctx == nil || haCfg.AnnotatorClient == nil || haCfg.OutputPath == "" {
 		return nil, fmt.Errorf("%v: %+v", errInvalidConfig, haCfg)
 	}
+	nonGlobal := haCfg.NonGlobalHops
+	switch nonGlobal {
+	case "":
+		nonGlobal = "annotate"
+	case "annotate", "skip", "tag":
+	default:
+		return nil, fmt.Errorf("%v: %q: invalid non-global hop handling", errInvalidConfig, nonGlobal)
+	}
 	hc := &HopCache{
 		hops:       make(map[string]bool, 10000), // based on observation
 		annotator:  haCfg.AnnotatorClient,
 		outputPath: haCfg.OutputPath,
+		nonGlobal:  nonGlobal,
+		replace:    haCfg.ReplaceFiles,
 	}
 	// Start a cache resetter goroutine to reset the cache every day
 	// at midnight.  For now, we use atomic read/write operations for
@@ -152,22 +196,69 @@ func (hc *HopCache) Reset() {
 	hc.hops = make(map[string]bool, len(hc.hops)+len(hc.hops)/4)
 }
 
-// Annotate annotates new hops found in the hops argument.  It aggregates
-// the errors and returns all of them instead of returning after encountering
-// the first error.
+// Annotate annotates new hops found in the hops argument.  New hops that
+// the annotator doesn't annotate (e.g., private addresses) get an
+// annotation with missing geolocation so that they're still archived.
+// It aggregates the errors and returns all of them instead of returning
+// after encountering the first error.
 func (hc *HopCache) Annotate(ctx context.Context, hops []string, traceStartTime time.Time) (map[string]*annotator.ClientAnnotations, []error) {
-	if err := ctx.Err(); err != nil {
-		return nil, []error{err}
+	return hc.annotate(ctx, hops, nil, traceStartTime)
+}
+
+// AnnotateScoped is like Annotate but only requests the annotations of
+// the new hops in scope.  New hops that aren't in scope are archived
+// without annotations like skipped non-global hops.  They aren't
+// archived without annotations again that day, but they're annotated
+// and archived again if they're in the scope of a later traceroute.
+func (hc *HopCache) AnnotateScoped(ctx context.Context, hops []string, scope map[string]bool, traceStartTime time.Time) (map[string]*annotator.ClientAnnotations, []error) {
+	if scope == nil {
+		scope = map[string]bool{}
 	}
+	return hc.annotate(ctx, hops, scope, traceStartTime)
+}
 
-	// Validate all hop IP addresses.
-	allErrs := []error{}
+// AnnotateTrace annotates all of the hops in the hops argument that are
+// in scope, or all of them if scope is nil, whether or not they were
+// already annotated today.  Unlike Annotate, it doesn't insert the
+// hops in the hop cache, so it's meant for annotations that are kept
+// with a single traceroute rather than archived once a day.
+func (hc *HopCache) AnnotateTrace(ctx context.Context, hops []string, scope map[string]bool) (map[string]*annotator.ClientAnnotations, []error) {
+	if allErrs := validateHops(ctx, hops); allErrs != nil {
+		return nil, allErrs
+	}
+	seen := make(map[string]bool, len(hops))
+	var traceHops []string
+	for _, hop := range hops {
+		if !seen[hop] {
+			seen[hop] = true
+			traceHops = append(traceHops, hop)
+		}
+	}
+	if len(traceHops) == 0 {
+		return nil, nil
+	}
+	return hc.annotateHops(ctx, traceHops, scope)
+}
+
+// validateHops returns the error of the given context, if any, or the
+// errors of the given hops that aren't valid IP addresses, if any.
+func validateHops(ctx context.Context, hops []string) []error {
+	if err := ctx.Err(); err != nil {
+		return []error{err}
+	}
+	var allErrs []error
 	for _, hop := range hops {
 		if net.ParseIP(hop) == nil {
 			allErrs = append(allErrs, fmt.Errorf("%w: %v", ErrParseHopIP, hop))
 		}
 	}
-	if len(allErrs) != 0 {
+	return allErrs
+}
+
+// annotate annotates new hops found in the hops argument that are in
+// scope, or all of them if scope is nil.
+func (hc *HopCache) annotate(ctx context.Context, hops []string, scope map[string]bool, traceStartTime time.Time) (map[string]*annotator.ClientAnnotations, []error) {
+	if allErrs := validateHops(ctx, hops); allErrs != nil {
 		return nil, allErrs
 	}
 
@@ -176,14 +267,25 @@ func (hc *HopCache) Annotate(ctx context.Context, hops []string, traceStartTime
 	// midnight has passed and we have a new empty cache. Therefore,
 	// the remaining hops in the hops slice will be inserted in the new
 	// cache and added to newHops which is the behavior we want.
+	// Hops that are out of scope are inserted as not annotated so that
+	// they're still annotated when they're in scope.
 	var newHops []string
 	yyyymmdd := traceStartTime.Format("-20060102")
 	hc.hopsLock.Lock()
 	for _, hop := range hops {
-		if !hc.hops[hop+yyyymmdd] {
-			hopAnnotationOps.WithLabelValues("hopcache", "inserted").Inc()
+		annotated, archived := hc.hops[hop+yyyymmdd]
+		switch {
+		case annotated:
+		case scope == nil || scope[hop]:
+			if !archived {
+				hopAnnotationOps.WithLabelValues("hopcache", "inserted").Inc()
+			}
 			hc.hops[hop+yyyymmdd] = true
 			newHops = append(newHops, hop)
+		case !archived:
+			hopAnnotationOps.WithLabelValues("hopcache", "inserted").Inc()
+			hc.hops[hop+yyyymmdd] = false
+			newHops = append(newHops, hop)
 		}
 	}
 	hc.hopsLock.Unlock()
@@ -191,13 +293,88 @@ func (hc *HopCache) Annotate(ctx context.Context, hops []string, traceStartTime
 	if len(newHops) == 0 {
 		return nil, nil
 	}
+	return hc.annotateHops(ctx, newHops, scope)
+}
+
+// annotateHops annotates the given hops that are in scope, or all of
+// them if scope is nil.  The other hops get nil annotations so that
+// they're archived without annotations.
+func (hc *HopCache) annotateHops(ctx context.Context, newHops []string, scope map[string]bool) (map[string]*annotator.ClientAnnotations, []error) {
+	// Non-global hops are archived without requesting annotations
+	// unless they're annotated like other hops.
+	var nonGlobalHops []string
+	if hc.nonGlobal != "annotate" {
+		globalHops := newHops[:0:0]
+		for _, hop := range newHops {
+			if IsGlobal(hop) {
+				globalHops = append(globalHops, hop)
+			} else {
+				nonGlobalHops = append(nonGlobalHops, hop)
+			}
+		}
+		newHops = globalHops
+	}
+	// So are hops that aren't in scope.
+	var outOfScopeHops []string
+	if scope != nil {
+		scopedHops := newHops[:0:0]
+		for _, hop := range newHops {
+			if scope[hop] {
+				scopedHops = append(scopedHops, hop)
+			} else {
+				outOfScopeHops = append(outOfScopeHops, hop)
+			}
+		}
+		newHops = scopedHops
+	}
 
 	// Annotate the new hops.
-	newAnnotations, err := hc.annotator.Annotate(ctx, newHops)
-	if err != nil {
-		return nil, []error{err}
+	var newAnnotations map[string]*annotator.ClientAnnotations
+	if len(newHops) > 0 {
+		var err error
+		newAnnotations, err = hc.annotator.Annotate(ctx, newHops)
+		if err != nil {
+			return nil, []error{err}
+		}
 	}
 	hopAnnotationOps.WithLabelValues("hopcache", "annotated").Add(float64(len(newAnnotations)))
+	if len(nonGlobalHops) > 0 {
+		if newAnnotations == nil {
+			newAnnotations = make(map[string]*annotator.ClientAnnotations, len(nonGlobalHops))
+		}
+		hopAnnotationOps.WithLabelValues("hopcache", "nonglobal").Add(float64(len(nonGlobalHops)))
+		for _, hop := range nonGlobalHops {
+			newAnnotations[hop] = nil
+		}
+	}
+	if len(outOfScopeHops) > 0 {
+		if newAnnotations == nil {
+			newAnnotations = make(map[string]*annotator.ClientAnnotations, len(outOfScopeHops))
+		}
+		hopAnnotationOps.WithLabelValues("hopcache", "outofscope").Add(float64(len(outOfScopeHops)))
+		for _, hop := range outOfScopeHops {
+			newAnnotations[hop] = nil
+		}
+	}
+	// Hops without annotations (e.g., private addresses) or without
+	// geolocation are still archived but with missing geolocation.
+	for _, hop := range newHops {
+		switch a := newAnnotations[hop]; {
+		case a == nil:
+			if newAnnotations == nil {
+				newAnnotations = make(map[string]*annotator.ClientAnnotations, len(newHops))
+			}
+			hopAnnotationOps.WithLabelValues("hopcache", "unannotated").Inc()
+			newAnnotations[hop] = &annotator.ClientAnnotations{
+				Geo: &annotator.Geolocation{Missing: true},
+			}
+		case a.Geo == nil:
+			// The annotator's annotations are left untouched.
+			withGeo := *a
+			withGeo.Geo = &annotator.Geolocation{Missing: true}
+			newAnnotations[hop] = &withGeo
+		}
+	}
 	return newAnnotations, nil
 }
 
@@ -205,12 +382,19 @@ func (hc *HopCache) Annotate(ctx context.Context, hops []string, traceStartTime
 // annotations in parallel for speed.  It aggregates the errors and returns
 // all of them instead of returning after encountering the first error.
 func (hc *HopCache) WriteAnnotations(annotations map[string]*annotator.ClientAnnotations, traceStartTime time.Time) []error {
+	return hc.WriteAnnotationsWithDetails(annotations, HopDetails{}, traceStartTime)
+}
+
+// WriteAnnotationsWithDetails is like WriteAnnotations but also writes
+// out the given details (e.g., ICMP extensions and round-trip times) of
+// each hop.
+func (hc *HopCache) WriteAnnotationsWithDetails(annotations map[string]*annotator.ClientAnnotations, details HopDetails, traceStartTime time.Time) []error {
 	// Write the annotations in parallel.
 	var wg sync.WaitGroup
 	errChan := make(chan error, len(annotations))
 	for hop, annotation := range annotations {
 		wg.Add(1)
-		go hc.writeAnnotation(&wg, hop, annotation, traceStartTime, errChan)
+		go hc.writeAnnotation(&wg, hop, annotation, details, traceStartTime, errChan)
 	}
 	wg.Wait()
 	close(errChan)
@@ -222,7 +406,7 @@ func (hc *HopCache) WriteAnnotations(annotations map[string]*annotator.ClientAnn
 }
 
 // writeAnnotation writes the given hop annotations to a file.
-func (hc *HopCache) writeAnnotation(wg *sync.WaitGroup, hop string, annotation *annotator.ClientAnnotations, traceStartTime time.Time, errChan chan<- error) {
+func (hc *HopCache) writeAnnotation(wg *sync.WaitGroup, hop string, annotation *annotator.ClientAnnotations, details HopDetails, traceStartTime time.Time, errChan chan<- error) {
 	defer wg.Done()
 
 	// Get a file path.
@@ -233,23 +417,97 @@ func (hc *HopCache) writeAnnotation(wg *sync.WaitGroup, hop string, annotation *
 	}
 
 	// Write to the file.
+	b, err := hc.marshalAnnotation(hop, annotation, details, traceStartTime)
+	if err != nil {
+		errChan <- err
+		return
+	}
+	write := writeFile
+	if hc.replace {
+		write = replaceFile
+	}
+	if err := write(filepath, b, 0444); err != nil {
+		hopAnnotationErrors.WithLabelValues("hopannotation", "writefile").Inc()
+		errChan <- fmt.Errorf("%w (error: %v)", ErrWriteMarshal, err)
+		return
+	}
+	hopAnnotationOps.WithLabelValues("hopannotation", "written").Inc()
+}
+
+// MarshalAnnotations returns the given hop annotations (and details, if
+// any) as JSONL records, one HopAnnotation1 per line in
+// the order of the hop addresses, so that they can be written along with
+// their traceroute instead of in separate files.  It aggregates the
+// errors like WriteAnnotations.
+func (hc *HopCache) MarshalAnnotations(annotations map[string]*annotator.ClientAnnotations, details HopDetails, traceStartTime time.Time) ([]byte, []error) {
+	hops := make([]string, 0, len(annotations))
+	for hop := range annotations {
+		hops = append(hops, hop)
+	}
+	sort.Strings(hops)
+	var records []byte
+	var allErrs []error
+	for _, hop := range hops {
+		b, err := hc.marshalAnnotation(hop, annotations[hop], details, traceStartTime)
+		if err != nil {
+			allErrs = append(allErrs, err)
+			continue
+		}
+		records = append(append(records, b...), '\n')
+	}
+	return records, allErrs
+}
+
+// marshalAnnotation returns the JSON record of the given hop annotation.
+func (hc *HopCache) marshalAnnotation(hop string, annotation *annotator.ClientAnnotations, details HopDetails, traceStartTime time.Time) ([]byte, error) {
 	yyyymmdd := traceStartTime.Format("20060102")
 	b, err := json.Marshal(HopAnnotation1{
 		ID:          fmt.Sprintf("%s_%s_%s", yyyymmdd, hostname, hop),
 		Timestamp:   traceStartTime,
 		Annotations: annotation,
+		Extensions:  details.Extensions[hop],
+		RTT:         details.RTTs[hop],
+		NonGlobal:   hc.nonGlobal == "tag" && !IsGlobal(hop),
 	})
 	if err != nil {
 		hopAnnotationErrors.WithLabelValues("hopannotation", "marshal").Inc()
-		errChan <- fmt.Errorf("%w (error: %v)", ErrMarshalAnnotation, err)
-		return
+		return nil, fmt.Errorf("%w (error: %v)", ErrMarshalAnnotation, err)
 	}
-	if err := writeFile(filepath, b, 0444); err != nil {
-		hopAnnotationErrors.WithLabelValues("hopannotation", "writefile").Inc()
-		errChan <- fmt.Errorf("%w (error: %v)", ErrWriteMarshal, err)
-		return
+	return b, nil
+}
+
+// replaceFile writes data to the named file with the given permissions.
+// Unlike ioutil.WriteFile, it replaces existing files even if they are
+// read-only (see Config.ReplaceFiles) by writing data to a temporary
+// file in the same directory and renaming it.
+func replaceFile(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
 	}
-	hopAnnotationOps.WithLabelValues("hopannotation", "written").Inc()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// IsGlobal returns true if the given hop address is globally routable.
+// Link-local (169.254/16 and fe80::/10), loopback, multicast, and
+// unspecified addresses aren't.  Private and shared addresses (e.g.,
+// 10/8 and 100.64/10) are because they are routable within networks.
+func IsGlobal(hop string) bool {
+	ip := net.ParseIP(hop)
+	return ip != nil && ip.IsGlobalUnicast()
 }
 
 // generateAnnotationFilepath returns the full pathname of a hop
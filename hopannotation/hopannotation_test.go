@@ -1,9 +1,16 @@
 package hopannotation
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -37,10 +44,12 @@ var (
 
 type fakeAnnotator struct {
 	annotateCalls int32
+	lastHops      []string // hops of the last Annotate call
 }
 
 func (fa *fakeAnnotator) Annotate(ctx context.Context, hops []string) (map[string]*annotator.ClientAnnotations, error) {
 	atomic.AddInt32(&fa.annotateCalls, 1)
+	fa.lastHops = hops
 	if len(hops) > 0 && hops[0] == errorOnIP {
 		return nil, errForced
 	}
@@ -84,6 +93,14 @@ func TestNew(t *testing.T) {
 	if _, err := New(context.TODO(), haCfg); !strings.Contains(err.Error(), errInvalidConfig.Error()) {
 		t.Fatalf("New() = %v, want %v", err, errInvalidConfig)
 	}
+	haCfg = Config{
+		AnnotatorClient: &fakeAnnotator{},
+		OutputPath:      "./testdata",
+		NonGlobalHops:   "drop",
+	}
+	if _, err := New(context.TODO(), haCfg); err == nil || !strings.Contains(err.Error(), errInvalidConfig.Error()) {
+		t.Fatalf("New() = %v, want %v", err, errInvalidConfig)
+	}
 
 	// Change ticker duration to 100ms to avoid waiting a long time for
 	// the resetter goroutine to notice passage of midnight or cancelled
@@ -175,6 +192,71 @@ func TestAnnotate(t *testing.T) {
 	}
 }
 
+func TestAnnotateScoped(t *testing.T) {
+	hopCache, fa := newHopCache(context.TODO(), t, "./testdata")
+	now := time.Now()
+	hops := []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"}
+	annotations, allErrs := hopCache.AnnotateScoped(context.TODO(), hops, map[string]bool{"5.6.7.8": true, "9.10.11.12": true}, now)
+	if allErrs != nil {
+		t.Fatalf("AnnotateScoped() = %v, want nil", allErrs)
+	}
+	if !reflect.DeepEqual(fa.lastHops, []string{"5.6.7.8", "9.10.11.12"}) {
+		t.Errorf("AnnotateScoped() requested annotations of %v, want [5.6.7.8 9.10.11.12]", fa.lastHops)
+	}
+	// Hops that aren't in scope are archived without annotations.
+	if len(annotations) != 3 || annotations["1.2.3.4"] != nil || annotations["5.6.7.8"] == nil || annotations["9.10.11.12"] == nil {
+		t.Errorf("AnnotateScoped() = %+v, want annotations of in-scope hops only", annotations)
+	}
+
+	// Without any hop in scope, the annotator isn't called.
+	hopCache.Reset()
+	annotations, allErrs = hopCache.AnnotateScoped(context.TODO(), hops, nil, now)
+	if allErrs != nil || len(annotations) != 3 || fa.annotateCalls != 1 {
+		t.Errorf("AnnotateScoped() = %+v, %v with %d Annotate calls, want 3 unannotated hops, nil with 1 call", annotations, allErrs, fa.annotateCalls)
+	}
+
+	// A hop that was out of scope (e.g., an intermediate hop) isn't
+	// archived without annotations again but is annotated once it's
+	// in scope (e.g., the endpoint of another traceroute).
+	annotations, allErrs = hopCache.AnnotateScoped(context.TODO(), hops, nil, now)
+	if allErrs != nil || len(annotations) != 0 {
+		t.Errorf("AnnotateScoped() = %+v, %v, want no annotations, nil", annotations, allErrs)
+	}
+	annotations, allErrs = hopCache.AnnotateScoped(context.TODO(), hops, map[string]bool{"1.2.3.4": true}, now)
+	if allErrs != nil || len(annotations) != 1 || annotations["1.2.3.4"] == nil {
+		t.Errorf("AnnotateScoped() = %+v, %v, want the annotation of 1.2.3.4, nil", annotations, allErrs)
+	}
+	if !reflect.DeepEqual(fa.lastHops, []string{"1.2.3.4"}) {
+		t.Errorf("AnnotateScoped() requested annotations of %v, want [1.2.3.4]", fa.lastHops)
+	}
+	annotations, allErrs = hopCache.Annotate(context.TODO(), hops, now)
+	if allErrs != nil || len(annotations) != 2 || annotations["1.2.3.4"] != nil {
+		t.Errorf("Annotate() = %+v, %v, want the annotations of the other 2 hops, nil", annotations, allErrs)
+	}
+}
+
+func TestAnnotateTrace(t *testing.T) {
+	hopCache, fa := newHopCache(context.TODO(), t, "./testdata")
+	hops := []string{"1.2.3.4", "5.6.7.8", "1.2.3.4"}
+	if _, allErrs := hopCache.Annotate(context.TODO(), hops, time.Now()); allErrs != nil {
+		t.Fatalf("Annotate() = %v, want nil", allErrs)
+	}
+	// Hops already annotated today are annotated again but aren't
+	// inserted in the hop cache.
+	for i := 0; i < 2; i++ {
+		annotations, allErrs := hopCache.AnnotateTrace(context.TODO(), hops, nil)
+		if allErrs != nil || len(annotations) != 2 {
+			t.Errorf("AnnotateTrace() = %+v, %v, want 2 annotations, nil", annotations, allErrs)
+		}
+		if !reflect.DeepEqual(fa.lastHops, []string{"1.2.3.4", "5.6.7.8"}) {
+			t.Errorf("AnnotateTrace() requested annotations of %v, want [1.2.3.4 5.6.7.8]", fa.lastHops)
+		}
+	}
+	if _, allErrs := hopCache.AnnotateTrace(context.TODO(), []string{"bad"}, nil); allErrs == nil {
+		t.Error("AnnotateTrace() = nil, want error")
+	}
+}
+
 func TestWriteAnnotations(t *testing.T) {
 	// Mock writeFile.
 	saveWriteFile := writeFile
@@ -205,3 +287,134 @@ func TestWriteAnnotations(t *testing.T) {
 	annotations, _ := hopCache.Annotate(ctx, []string{"1.1.1.1", "2.2.2.2"}, now)
 	hopCache.WriteAnnotations(annotations, now)
 }
+
+// fixtureAnnotator returns the annotations in a fixture file and
+// doesn't annotate hops that aren't in the fixture.
+func TestReplaceFiles(t *testing.T) {
+	saveWriteFile := writeFile
+	writeFile = func(string, []byte, fs.FileMode) error {
+		t.Error("writeFile() called, want existing files replaced")
+		return nil
+	}
+	defer func() { writeFile = saveWriteFile }()
+
+	dir := t.TempDir()
+	hopCache, err := New(context.TODO(), Config{AnnotatorClient: &fakeAnnotator{}, OutputPath: dir, ReplaceFiles: true})
+	if err != nil {
+		t.Fatalf("failed to create hop cache: %v", err)
+	}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		hopCache.Reset()
+		annotations, allErrs := hopCache.Annotate(context.TODO(), []string{"1.2.3.4"}, now)
+		if allErrs != nil {
+			t.Fatalf("Annotate() = %v, want nil", allErrs)
+		}
+		if allErrs := hopCache.WriteAnnotations(annotations, now); allErrs != nil {
+			t.Fatalf("write %d: WriteAnnotations() = %v, want nil", i+1, allErrs)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, now.Format("2006/01/02"), "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got files %v, want 1 (error: %v)", files, err)
+	}
+	if fi, err := os.Stat(files[0]); err != nil || fi.Mode().Perm() != 0444 {
+		t.Errorf("got file %v (error: %v), want a read-only file", fi, err)
+	}
+}
+
+type fixtureAnnotator struct {
+	annotations map[string]*annotator.ClientAnnotations
+}
+
+func (fa *fixtureAnnotator) Annotate(ctx context.Context, hops []string) (map[string]*annotator.ClientAnnotations, error) {
+	m := make(map[string]*annotator.ClientAnnotations)
+	for _, hop := range hops {
+		if a, ok := fa.annotations[hop]; ok {
+			m[hop] = a
+		}
+	}
+	return m, nil
+}
+
+func TestWriteGeoAnnotations(t *testing.T) {
+	content, err := ioutil.ReadFile("./testdata/annotations/geo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa := &fixtureAnnotator{}
+	if err := json.Unmarshal(content, &fa.annotations); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	hopCache, err := New(context.TODO(), Config{AnnotatorClient: fa, OutputPath: dir})
+	if err != nil {
+		t.Fatalf("failed to create hop cache: %v", err)
+	}
+	now := time.Date(2021, time.December, 1, 2, 3, 4, 0, time.UTC)
+	annotations, errs := hopCache.Annotate(context.TODO(), []string{"1.2.3.4", "5.6.7.8", "10.0.0.1"}, now)
+	if errs != nil {
+		t.Fatalf("Annotate() = %v, want nil", errs)
+	}
+	if errs := hopCache.WriteAnnotations(annotations, now); errs != nil {
+		t.Fatalf("WriteAnnotations() = %v, want nil", errs)
+	}
+
+	tests := []struct {
+		hop  string
+		want annotator.Geolocation
+	}{
+		{"1.2.3.4", *fa.annotations["1.2.3.4"].Geo},
+		{"5.6.7.8", annotator.Geolocation{Missing: true}},  // network only
+		{"10.0.0.1", annotator.Geolocation{Missing: true}}, // private address
+	}
+	for _, test := range tests {
+		filename := filepath.Join(dir, "2021/12/01", fmt.Sprintf("20211201T020304Z_%s_%s.json", hostname, test.hop))
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("hop %v wasn't archived (error: %v)", test.hop, err)
+		}
+		// None of the hops have replies.
+		if bytes.Contains(b, []byte(`"RTT"`)) {
+			t.Errorf("hop %v has an RTT: %s", test.hop, b)
+		}
+		var got HopAnnotation1
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Annotations == nil || got.Annotations.Geo == nil {
+			t.Fatalf("hop %v has no geolocation: %s", test.hop, b)
+		}
+		if *got.Annotations.Geo != test.want {
+			t.Errorf("hop %v geolocation = %+v, want %+v", test.hop, *got.Annotations.Geo, test.want)
+		}
+		if want := fa.annotations[test.hop]; want != nil && !reflect.DeepEqual(got.Annotations.Network, want.Network) {
+			t.Errorf("hop %v network = %+v, want %+v", test.hop, got.Annotations.Network, want.Network)
+		}
+	}
+}
+
+func TestIsGlobal(t *testing.T) {
+	tests := []struct {
+		hop  string
+		want bool
+	}{
+		{"1.2.3.4", true},
+		{"2001:4860::8888", true},
+		{"169.254.1.1", false},
+		{"fe80::1", false},
+		{"10.1.2.3", true},
+		{"192.168.0.1", true},
+		{"fd00::1", true},
+		{"100.64.0.1", true},
+		{"127.0.0.1", false},
+		{"224.0.0.1", false},
+		{"::", false},
+		{"not-an-ip", false},
+	}
+	for _, test := range tests {
+		if got := IsGlobal(test.hop); got != test.want {
+			t.Errorf("IsGlobal(%q) = %v, want %v", test.hop, got, test.want)
+		}
+	}
+}
@@ -5,21 +5,85 @@ package ipcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/m-lab/uuid"
+	"github.com/m-lab/traceroute-caller/tracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var (
+	cacheEntries = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ipcache_entries",
+			Help: "The number of entries in the IP cache as of the last scan",
+		},
+		[]string{"tracer"},
+	)
+	cacheEntryAge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ipcache_entry_age_seconds",
+			Help: "The age of the oldest and newest entries in the IP cache as of the last scan",
+		},
+		[]string{"tracer", "entry"},
+	)
+	cacheRefreshes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ipcache_refreshes_total",
+			Help: "The number of refresh-ahead traceroutes by result (completed, failed, or skipped_busy)",
+		},
+		[]string{"tracer", "result"},
+	)
+	negativeHits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ipcache_negative_hits_total",
+			Help: "The number of traceroutes that weren't run because a recent traceroute to the same IP address failed",
+		},
+		[]string{"tracer"},
+	)
+)
+
+// ErrNotTraced is wrapped by the errors of traceroute tools that didn't
+// run a traceroute for reasons that have nothing to do with its
+// destination (e.g., an open circuit breaker or an exhausted probe
+// budget).  Such failures are neither cached nor held against the
+// destination.
+var ErrNotTraced = errors.New("traceroute not run")
+
+// Default refresh-ahead configuration values.
+const (
+	defaultRefreshMinHits = 1
+	defaultRefreshWorkers = 1
+)
+
+// RefreshSuffix is the suffix of the UUIDs of refresh-ahead traceroutes
+// (see Config.RefreshAhead).  A refresh has the UUID of the cache hit
+// that triggered it with this suffix, and that UUID as its campaign ID
+// (see tracer.WithCampaignID).  Consumers can thus recognize refreshes,
+// as well as copies of refreshed traceroutes by their cached UUID, and
+// find the connection that triggered them.
+const RefreshSuffix = "_refresh"
+
 // Tracer is the generic interface for all things that can perform a traceroute.
+// TraceContext should stop the traceroute and return an error when
+// the context is cancelled.
 type Tracer interface {
-	Trace(remoteIP, cookie, uuid string, t time.Time) ([]byte, error)
-	CachedTrace(cookie, uuid string, t time.Time, cachedTrace []byte) error
+	TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error)
+	CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTrace []byte) error
 	DontTrace()
 }
 
+// ConfigHasher is the interface for traceroute tools whose configuration
+// can change while they run (e.g., tracer.Scamper).
+type ConfigHasher interface {
+	ConfigHash() string
+}
+
 // Config contains configuration parameters of an IP cache.
 // These parameters are presented to the user as IPCacheTimeout and
 // IPCacheUpdatePeriod flags.  But these are confusing flag names because
@@ -31,14 +95,83 @@ type Tracer interface {
 type Config struct {
 	EntryTimeout time.Duration // IPCacheTimeout flag
 	ScanPeriod   time.Duration // IPCacheUpdatePeriod flag
+	// Label is the label of the traceroute tool when multiple tools
+	// run side by side, each with its own cache.  It's used to label
+	// the cache metrics.
+	Label string
+	// RefreshAhead, if not zero, enables refresh-ahead: a cache hit
+	// within RefreshAhead of the expiry of a hot entry (see
+	// RefreshMinHits) starts a background traceroute that replaces the
+	// entry once it completes, so that the cache stays warm for
+	// long-lived flows.  It must be less than EntryTimeout.
+	RefreshAhead time.Duration
+	// RefreshMinHits is the number of cache hits after which an entry
+	// is hot and may be refreshed (default 1).  Cold entries simply
+	// expire.
+	RefreshMinHits int
+	// RefreshWorkers is the maximum number of refresh-ahead traceroutes
+	// in progress at any time (default 1).  Refreshes beyond that limit
+	// are skipped.
+	RefreshWorkers int
+	// NegativeTTL is how long a failed traceroute (e.g., one that timed
+	// out) stays in the cache so that traceroutes to the same IP
+	// address fail immediately instead of hammering an unreachable
+	// destination.  Zero (default) removes failed traceroutes from the
+	// cache as soon as they fail.  Failed traceroutes are never served
+	// as cached traceroutes.  Failures that the destination didn't
+	// cause (e.g., see ErrNotTraced) are always removed.
+	NegativeTTL time.Duration
+	// NegativeTTLMultiplier escalates the negative TTL of destinations
+	// that fail repeatedly: the Nth consecutive failure is kept for
+	// NegativeTTL * NegativeTTLMultiplier^(N-1).  A successful
+	// traceroute resets it.  Zero (default) or one keeps failures for
+	// NegativeTTL.
+	NegativeTTLMultiplier float64
+	// NegativeTTLMax caps escalated negative TTLs.  Zero (default)
+	// caps them at EntryTimeout or NegativeTTL, whichever is longer.
+	NegativeTTLMax time.Duration
+	// CookieWidth is the number of hexadecimal digits that cookies are
+	// padded to in the UUIDs of traceroutes (see
+	// tracer.UUIDFromCookie).  Zero (default) means
+	// tracer.DefaultCookieWidth.
+	CookieWidth int
+	// ConfigHash, if not nil, returns the hash of the current
+	// configuration of the traceroute tool (see ConfigHasher).  It's
+	// part of the cache key so that traceroutes run with a previous
+	// configuration aren't served once it changes.
+	ConfigHash func() string
+}
+
+// Entry describes an entry in the IP cache.  It is a snapshot and does
+// not change when the cache is modified.
+type Entry struct {
+	IP        string    // remote IP address of the traceroute
+	UUID      string    // UUID of the cached traceroute
+	Timestamp time.Time // time the entry was inserted in the cache
+	ExpiresAt time.Time // time after which the entry will be removed
+}
+
+// Fetch describes how a traceroute was obtained by FetchTraceInfo.
+type Fetch struct {
+	Cached  bool      // true if the traceroute was served from the cache
+	Time    time.Time // time the traceroute (or its copy) was saved with
+	CopyErr error     // error saving the copy of a cached traceroute, if any
 }
 
 // cachedTrace is a single entry in the cache of traceroute results.
 type cachedTrace struct {
-	timeStamp time.Time
-	data      []byte
-	dataReady chan struct{}
-	err       error
+	ip         string
+	hash       string // configuration hash of the traceroute tool
+	uuid       string
+	timeStamp  time.Time
+	data       []byte
+	dataReady  chan struct{}
+	err        error
+	cancel     context.CancelFunc // cancels the traceroute in progress
+	hits       int                // number of times the entry was served from the cache
+	refreshing bool               // true while a refresh-ahead traceroute is in progress
+	negative   bool               // true if the traceroute failed
+	negTTL     time.Duration      // lifetime of the entry if the traceroute failed
 }
 
 // IPCache contains a list of all the IP addresses that we have traced to
@@ -46,8 +179,24 @@ type cachedTrace struct {
 // location repeatedly at a high frequency.
 type IPCache struct {
 	cache     map[string]*cachedTrace
+	running   map[string]*cachedTrace // traceroutes in progress
 	cacheLock sync.Mutex
 	tracetool Tracer
+	timeout   time.Duration   // entry timeout
+	label     string          // tracer label of metrics
+	ctx       context.Context // context of refresh-ahead traceroutes
+	ahead     time.Duration   // refresh-ahead window (zero disables refresh-ahead)
+	minHits   int             // number of hits after which an entry is hot
+	refreshes chan struct{}   // semaphore limiting refresh-ahead traceroutes
+	negTTL    time.Duration   // lifetime of first failures (zero removes them)
+	negMult   float64         // negative TTL multiplier of consecutive failures
+	negMax    time.Duration   // maximum negative TTL
+	failures  map[string]failureState
+	width     int           // cookie width of UUIDs
+	confHash  func() string // nil if entries don't depend on the configuration
+	// nQuarantined is the number of failures counted as quarantined
+	// (see updateQuarantine).
+	nQuarantined int
 }
 
 // New creates and returns an IPCache. It also starts up a background
@@ -59,9 +208,49 @@ func New(ctx context.Context, tracetool Tracer, ipcCfg Config) (*IPCache, error)
 	if ipcCfg.EntryTimeout == 0 || ipcCfg.ScanPeriod == 0 {
 		return nil, fmt.Errorf("invalid IP cache configuration: %+v", ipcCfg)
 	}
+	if ipcCfg.RefreshAhead < 0 || ipcCfg.RefreshAhead >= ipcCfg.EntryTimeout || ipcCfg.RefreshMinHits < 0 || ipcCfg.RefreshWorkers < 0 {
+		return nil, fmt.Errorf("invalid IP cache refresh-ahead configuration: %+v", ipcCfg)
+	}
+	if ipcCfg.NegativeTTL < 0 {
+		return nil, fmt.Errorf("invalid IP cache negative TTL: %v", ipcCfg.NegativeTTL)
+	}
+	if m := ipcCfg.NegativeTTLMultiplier; m < 0 || (m > 0 && m < 1) || math.IsNaN(m) || math.IsInf(m, 0) || ipcCfg.NegativeTTLMax < 0 || (ipcCfg.NegativeTTLMax > 0 && ipcCfg.NegativeTTLMax < ipcCfg.NegativeTTL) {
+		return nil, fmt.Errorf("invalid IP cache negative TTL escalation: %v multiplier, %v max", ipcCfg.NegativeTTLMultiplier, ipcCfg.NegativeTTLMax)
+	}
+	if err := tracer.ValidateCookieWidth(ipcCfg.CookieWidth); err != nil {
+		return nil, err
+	}
+	if ipcCfg.NegativeTTLMultiplier == 0 {
+		ipcCfg.NegativeTTLMultiplier = 1
+	}
+	if ipcCfg.NegativeTTLMax == 0 {
+		ipcCfg.NegativeTTLMax = ipcCfg.EntryTimeout
+		if ipcCfg.NegativeTTL > ipcCfg.NegativeTTLMax {
+			ipcCfg.NegativeTTLMax = ipcCfg.NegativeTTL
+		}
+	}
+	if ipcCfg.RefreshMinHits == 0 {
+		ipcCfg.RefreshMinHits = defaultRefreshMinHits
+	}
+	if ipcCfg.RefreshWorkers == 0 {
+		ipcCfg.RefreshWorkers = defaultRefreshWorkers
+	}
 	ipc := &IPCache{
 		cache:     make(map[string]*cachedTrace),
+		running:   make(map[string]*cachedTrace),
 		tracetool: tracetool,
+		timeout:   ipcCfg.EntryTimeout,
+		label:     ipcCfg.Label,
+		ctx:       ctx,
+		ahead:     ipcCfg.RefreshAhead,
+		minHits:   ipcCfg.RefreshMinHits,
+		refreshes: make(chan struct{}, ipcCfg.RefreshWorkers),
+		negTTL:    ipcCfg.NegativeTTL,
+		negMult:   ipcCfg.NegativeTTLMultiplier,
+		negMax:    ipcCfg.NegativeTTLMax,
+		failures:  make(map[string]failureState),
+		width:     ipcCfg.CookieWidth,
+		confHash:  ipcCfg.ConfigHash,
 	}
 	go func() {
 		ticker := time.NewTicker(ipcCfg.ScanPeriod)
@@ -70,59 +259,261 @@ func New(ctx context.Context, tracetool Tracer, ipcCfg Config) (*IPCache, error)
 			if ctx.Err() != nil {
 				return
 			}
-			// Must hold lock while performing GC.
-			ipc.cacheLock.Lock()
-			for k, v := range ipc.cache {
-				if now.Sub(v.timeStamp) > ipcCfg.EntryTimeout {
-					// Note that if there is a traceroute in progress, the events
-					// waiting for it to complete will still get the result
-					// and save it.  But this allows a new traceroute to be started
-					// on the same IP address.
-					delete(ipc.cache, k)
-				}
-			}
-			ipc.cacheLock.Unlock()
+			ipc.scan(now)
 		}
 	}()
 	return ipc, nil
 }
 
+// scan removes expired entries from the IP cache and updates the cache
+// metrics.  Timestamps of the remaining entries are copied while holding
+// the lock and the metrics are computed after releasing it.
+func (ic *IPCache) scan(now time.Time) {
+	// Must hold lock while performing GC.
+	ic.cacheLock.Lock()
+	timeStamps := make([]time.Time, 0, len(ic.cache))
+	for k, v := range ic.cache {
+		if now.Sub(v.timeStamp) > ic.lifetime(v) {
+			// Note that if there is a traceroute in progress, the events
+			// waiting for it to complete will still get the result
+			// and save it.  But this allows a new traceroute to be started
+			// on the same IP address.
+			delete(ic.cache, k)
+			continue
+		}
+		timeStamps = append(timeStamps, v.timeStamp)
+	}
+	ic.updateQuarantine(now)
+	ic.cacheLock.Unlock()
+
+	cacheEntries.WithLabelValues(ic.label).Set(float64(len(timeStamps)))
+	var oldest, newest time.Duration
+	for i, ts := range timeStamps {
+		age := now.Sub(ts)
+		if i == 0 || age > oldest {
+			oldest = age
+		}
+		if i == 0 || age < newest {
+			newest = age
+		}
+	}
+	cacheEntryAge.WithLabelValues(ic.label, "oldest").Set(oldest.Seconds())
+	cacheEntryAge.WithLabelValues(ic.label, "newest").Set(newest.Seconds())
+}
+
 // FetchTrace checks the IP cache to determine if a recent traceroute to
 // the remote IP exists or not. If a traceroute exists, it will be used.
 // Otherwise, it calls the tracetool to run a new traceroute.
-func (ic *IPCache) FetchTrace(remoteIP, cookie string) ([]byte, error) {
+//
+// The UUID of the traceroute is derived from the cookie unless ctx
+// carries a UUID (see tracer.WithUUID).
+//
+// The traceroute is cancelled if ctx is cancelled (e.g., on shutdown) or
+// if a newer traceroute to the same remote IP supersedes it, which can
+// happen when the cache entry of a long running traceroute expires.
+//
+// Failed traceroutes aren't cached but, if NegativeTTL is configured
+// and the remote IP caused the failure, the remote IP is quarantined:
+// traceroutes to it fail with the same error until the quarantine ends.
+// Truncated traceroutes aren't cached either and are returned along
+// with tracer.ErrTraceTruncated, even to the triggers that waited for
+// them, but they don't quarantine the remote IP.
+func (ic *IPCache) FetchTrace(ctx context.Context, remoteIP, cookie string) ([]byte, error) {
+	data, _, err := ic.FetchTraceInfo(ctx, remoteIP, cookie)
+	return data, err
+}
+
+// FetchTraceInfo is like FetchTrace but also describes how the
+// traceroute was obtained.
+func (ic *IPCache) FetchTraceInfo(ctx context.Context, remoteIP, cookie string) ([]byte, Fetch, error) {
 	// Get a globally unique identifier for the given cookie.
 	// For example, if cookie is "4418bb", we want something like:
 	// "fd73893d272d_1633013267_unsafe_00000000004418BB".
 	c, err := strconv.ParseUint(cookie, 16, 64)
 	if err != nil {
-		return nil, err
+		return nil, Fetch{}, err
+	}
+	uuid := tracer.UUIDFromCookie(c, ic.width)
+	if u := tracer.UUIDFromContext(ctx); u != "" {
+		uuid = u
 	}
-	uuid := uuid.FromCookie(c)
 
-	cachedTrace, existed := ic.getEntry(remoteIP)
+	cachedTrace, existed := ic.getEntry(remoteIP, uuid)
 	if existed {
 		<-cachedTrace.dataReady
-		if cachedTrace.err != nil {
+		if cachedTrace.err != nil && !cachedTrace.truncated() {
+			negativeHits.WithLabelValues(ic.label).Inc()
 			ic.tracetool.DontTrace()
-			return nil, cachedTrace.err
+			return nil, Fetch{Cached: true}, cachedTrace.err
+		}
+		fetch := Fetch{Cached: true, Time: time.Now()}
+		fetch.CopyErr = ic.tracetool.CachedTraceContext(ctx, cookie, uuid, fetch.Time, cachedTrace.data)
+		if cachedTrace.err != nil {
+			// Triggers that waited for a truncated traceroute get
+			// what's left of it, like the trigger that ran it.
+			return cachedTrace.data, fetch, cachedTrace.err
 		}
-		_ = ic.tracetool.CachedTrace(cookie, uuid, time.Now(), cachedTrace.data)
-		return cachedTrace.data, nil
+		ic.hit(cachedTrace, remoteIP, cookie, uuid)
+		return cachedTrace.data, fetch, nil
+	}
+	traceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ic.startRunning(remoteIP, cachedTrace, cancel)
+	cachedTrace.data, cachedTrace.err = ic.tracetool.TraceContext(traceCtx, remoteIP, cookie, uuid, cachedTrace.timeStamp)
+	ic.stopRunning(remoteIP, cachedTrace)
+	if cachedTrace.err != nil {
+		ic.fail(remoteIP, cachedTrace, cachedTrace.err)
+	} else {
+		ic.succeed(remoteIP)
 	}
-	cachedTrace.data, cachedTrace.err = ic.tracetool.Trace(remoteIP, cookie, uuid, cachedTrace.timeStamp)
 	close(cachedTrace.dataReady)
-	return cachedTrace.data, cachedTrace.err
+	return cachedTrace.data, Fetch{Time: cachedTrace.timeStamp}, cachedTrace.err
+}
+
+// fail records that the traceroute of the given entry to the given IP
+// address failed with err: the entry is removed from the cache or, if
+// negative caching is enabled and the destination caused the failure,
+// kept until the end of the quarantine of its destination.  Triggers
+// waiting for the traceroute still get its error.
+func (ic *IPCache) fail(ip string, entry *cachedTrace, err error) {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	if ic.cache[ip] != entry {
+		return
+	}
+	if ic.negTTL == 0 || entry.truncated() || !destinationFailure(err) {
+		delete(ic.cache, ip)
+		return
+	}
+	entry.negative = true
+	entry.negTTL = time.Since(entry.timeStamp) + ic.quarantine(ip, time.Now())
+}
+
+// truncated returns true if the traceroute of the entry was truncated
+// but still has output.  Truncated traceroutes aren't cached but aren't
+// failures either: they don't quarantine their destination.
+func (entry *cachedTrace) truncated() bool {
+	return errors.Is(entry.err, tracer.ErrTraceTruncated) && len(entry.data) > 0
+}
+
+// destinationFailure returns true if the given traceroute error may be
+// caused by the destination (e.g., the traceroute failed or timed out)
+// rather than by the traceroute caller (e.g., the traceroute wasn't run
+// or was cancelled on shutdown).
+func destinationFailure(err error) bool {
+	return !errors.Is(err, ErrNotTraced) && !errors.Is(err, context.Canceled) && !errors.Is(err, tracer.ErrTraceNotStarted)
+}
+
+// lifetime returns how long after its timestamp the given entry expires.
+func (ic *IPCache) lifetime(entry *cachedTrace) time.Duration {
+	if entry.negative {
+		return entry.negTTL
+	}
+	return ic.timeout
+}
+
+// hit records a cache hit on the given entry and, if the entry is hot
+// and about to expire, starts a refresh-ahead traceroute to the given IP
+// address.  The refresh has the UUID of the hit with RefreshSuffix so
+// that it doesn't overwrite the cached traceroute of the hit.
+func (ic *IPCache) hit(entry *cachedTrace, remoteIP, cookie, uuid string) {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	entry.hits++
+	if ic.ahead == 0 || entry.refreshing || entry.hits < ic.minHits || ic.cache[remoteIP] != entry {
+		return
+	}
+	if time.Since(entry.timeStamp) < ic.timeout-ic.ahead {
+		return
+	}
+	select {
+	case ic.refreshes <- struct{}{}:
+	default:
+		cacheRefreshes.WithLabelValues(ic.label, "skipped_busy").Inc()
+		return
+	}
+	entry.refreshing = true
+	go ic.refreshEntry(entry, remoteIP, cookie, uuid)
+}
+
+// refreshEntry runs a new traceroute to the given IP address on behalf
+// of the hit with the given UUID and, if it succeeds, replaces the given
+// cache entry with its result.  Until then, the entry keeps being
+// served from the cache.  Refreshes aren't traceroutes in progress to
+// the IP address (see startRunning): they neither supersede a traceroute
+// started after the entry expired nor are superseded by it.
+func (ic *IPCache) refreshEntry(old *cachedTrace, remoteIP, cookie, hitUUID string) {
+	defer func() { <-ic.refreshes }()
+	uuid := hitUUID + RefreshSuffix
+	entry := &cachedTrace{
+		ip:        remoteIP,
+		hash:      ic.configHash(),
+		uuid:      uuid,
+		timeStamp: time.Now(),
+		dataReady: make(chan struct{}),
+	}
+	traceCtx := tracer.WithCampaignID(tracer.WithUUID(ic.ctx, uuid), hitUUID)
+	entry.data, entry.err = ic.tracetool.TraceContext(traceCtx, remoteIP, cookie, uuid, entry.timeStamp)
+	close(entry.dataReady)
+
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	old.refreshing = false
+	if entry.err != nil {
+		cacheRefreshes.WithLabelValues(ic.label, "failed").Inc()
+		return
+	}
+	cacheRefreshes.WithLabelValues(ic.label, "completed").Inc()
+	ic.forgive(remoteIP)
+	// The old entry may have expired in the meantime, in which case
+	// the refreshed one is still worth caching, but a traceroute
+	// started since then is more recent.
+	if cur, ok := ic.cache[remoteIP]; (!ok || cur == old) && entry.hash == ic.configHash() {
+		ic.cache[remoteIP] = entry
+	}
+}
+
+// startRunning records that a traceroute to the given IP address is in
+// progress.  If an older traceroute to the same IP address is still in
+// progress, it is superseded and therefore cancelled.
+func (ic *IPCache) startRunning(ip string, entry *cachedTrace, cancel context.CancelFunc) {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	if old, ok := ic.running[ip]; ok {
+		old.cancel()
+	}
+	entry.cancel = cancel
+	ic.running[ip] = entry
+}
+
+// stopRunning records that the traceroute to the given IP address has
+// finished unless it has already been superseded by a newer traceroute.
+func (ic *IPCache) stopRunning(ip string, entry *cachedTrace) {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	if ic.running[ip] == entry {
+		delete(ic.running, ip)
+	}
 }
 
 // getEntry returns the entry in the IP cache corresponding to the given
-// IP address. If the entry doesn't exist, a new one is created.
-func (ic *IPCache) getEntry(ip string) (*cachedTrace, bool) {
+// IP address. If the entry doesn't exist, a new one is created for the
+// traceroute with the given UUID.  Failed entries are replaced as soon
+// as they expire rather than at the next scan, and entries of previous
+// configurations of the traceroute tool as soon as it changes.
+func (ic *IPCache) getEntry(ip, uuid string) (*cachedTrace, bool) {
 	ic.cacheLock.Lock()
 	defer ic.cacheLock.Unlock()
-	_, existed := ic.cache[ip]
+	hash := ic.configHash()
+	v, existed := ic.cache[ip]
+	if existed && ((v.negative && time.Since(v.timeStamp) > v.negTTL) || v.hash != hash) {
+		existed = false
+	}
 	if !existed {
 		ic.cache[ip] = &cachedTrace{
+			ip:        ip,
+			hash:      hash,
+			uuid:      uuid,
 			timeStamp: time.Now(),
 			dataReady: make(chan struct{}),
 		}
@@ -130,6 +521,15 @@ func (ic *IPCache) getEntry(ip string) (*cachedTrace, bool) {
 	return ic.cache[ip], existed
 }
 
+// configHash returns the hash of the current configuration of the
+// traceroute tool or an empty string if it isn't known.
+func (ic *IPCache) configHash() string {
+	if ic.confHash == nil {
+		return ""
+	}
+	return ic.confHash()
+}
+
 // NumEntries returns the number of entries currently in the IP cache.
 // The primary use of this is for testing.
 func (ic *IPCache) NumEntries() int {
@@ -137,3 +537,44 @@ func (ic *IPCache) NumEntries() int {
 	defer ic.cacheLock.Unlock()
 	return len(ic.cache)
 }
+
+// Lookup returns the UUID and expiry time of the cached traceroute to
+// the given IP address, if any, without running a traceroute or
+// otherwise affecting the entry (e.g., its lifetime or refresh-ahead).
+// The traceroute may still be in progress.  The expiry time may be in
+// the past if the entry hasn't been removed by a scan yet, which
+// happens at the next scan.  It is safe to call concurrently with other
+// cache operations.  Failed traceroutes and those run with a previous
+// configuration of the traceroute tool aren't reported.
+func (ic *IPCache) Lookup(ip string) (cachedUUID string, expiresAt time.Time, ok bool) {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	v, ok := ic.cache[ip]
+	if !ok || v.negative || v.hash != ic.configHash() {
+		return "", time.Time{}, false
+	}
+	return v.uuid, v.timeStamp.Add(ic.timeout), true
+}
+
+// Entries returns a snapshot of the entries currently in the IP cache
+// except failed traceroutes and those run with a previous configuration
+// of the traceroute tool.  It is safe to call concurrently with other
+// cache operations.
+func (ic *IPCache) Entries() []Entry {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	hash := ic.configHash()
+	entries := make([]Entry, 0, len(ic.cache))
+	for _, v := range ic.cache {
+		if v.negative || v.hash != hash {
+			continue
+		}
+		entries = append(entries, Entry{
+			IP:        v.ip,
+			UUID:      v.uuid,
+			Timestamp: v.timeStamp,
+			ExpiresAt: v.timeStamp.Add(ic.timeout),
+		})
+	}
+	return entries
+}
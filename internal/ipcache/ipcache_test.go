@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/tracer"
 )
 
 func init() {
@@ -23,12 +25,12 @@ type fakeTracer struct {
 	nCachedTrace int
 }
 
-func (ft *fakeTracer) Trace(remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+func (ft *fakeTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
 	ft.nTrace++
 	return []byte("fake traceroute data to " + remoteIP), nil
 }
 
-func (ft *fakeTracer) CachedTrace(cookie, uuid string, t time.Time, cachedTest []byte) error {
+func (ft *fakeTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
 	ft.nCachedTrace++
 	return nil
 }
@@ -77,7 +79,7 @@ func TestFetchTrace(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		data, err := ipCache.FetchTrace(test.remoteIP, test.cookie)
+		data, err := ipCache.FetchTrace(context.TODO(), test.remoteIP, test.cookie)
 		if test.wantErr {
 			if err == nil {
 				t.Errorf("FetchTrace(%s) = nil, want error", test.remoteIP)
@@ -107,6 +109,590 @@ func TestFetchTrace(t *testing.T) {
 	}
 }
 
+func TestFetchTraceInfo(t *testing.T) {
+	ipCfg := ipcache.Config{
+		EntryTimeout: time.Minute,
+		ScanPeriod:   time.Minute,
+	}
+	ipCache, err := ipcache.New(context.Background(), &fakeTracer{}, ipCfg)
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	for i, wantCached := range []bool{false, true, true} {
+		_, fetch, err := ipCache.FetchTraceInfo(context.TODO(), "1.1.1.1", fmt.Sprintf("%x", i+1))
+		if err != nil {
+			t.Fatalf("FetchTraceInfo() = %v, want nil", err)
+		}
+		if fetch.Cached != wantCached {
+			t.Errorf("fetch %d: Cached = %v, want %v", i+1, fetch.Cached, wantCached)
+		}
+		if fetch.Time.IsZero() {
+			t.Errorf("fetch %d: Time is zero", i+1)
+		}
+	}
+}
+
+// blockingTracer blocks every traceroute until its context is cancelled.
+type blockingTracer struct {
+	started chan string
+}
+
+func (bt *blockingTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	bt.started <- remoteIP
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (bt *blockingTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
+	return nil
+}
+
+func (bt *blockingTracer) DontTrace() {}
+
+func TestFetchTraceCancel(t *testing.T) {
+	bt := &blockingTracer{started: make(chan string, 2)}
+	ipCfg := ipcache.Config{
+		EntryTimeout: 100 * time.Millisecond,
+		ScanPeriod:   10 * time.Millisecond,
+	}
+	ipCache, err := ipcache.New(context.Background(), bt, ipCfg)
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+
+	// Cancelling the context (e.g., on shutdown) cancels the traceroute.
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := ipCache.FetchTrace(ctx, "1.1.1.1", "abcde")
+		errChan <- err
+	}()
+	<-bt.started
+	cancel()
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("FetchTrace() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FetchTrace() was not cancelled")
+	}
+
+	// A newer traceroute to the same IP address supersedes the older one
+	// after the older one's cache entry has expired.
+	go func() {
+		_, err := ipCache.FetchTrace(context.Background(), "2.2.2.2", "abcde")
+		errChan <- err
+	}()
+	<-bt.started
+	time.Sleep(ipCfg.EntryTimeout + 5*ipCfg.ScanPeriod)
+	if n := ipCache.NumEntries(); n != 0 {
+		t.Fatalf("got %d entries in IP cache, want 0", n)
+	}
+	newCtx, newCancel := context.WithCancel(context.Background())
+	defer newCancel()
+	go func() {
+		_, _ = ipCache.FetchTrace(newCtx, "2.2.2.2", "bcdef")
+	}()
+	<-bt.started
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("FetchTrace() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("superseded FetchTrace() was not cancelled")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ipCfg := ipcache.Config{
+		EntryTimeout: time.Minute,
+		ScanPeriod:   time.Second,
+	}
+	ipCache, err := ipcache.New(ctx, &fakeTracer{}, ipCfg)
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	if entries := ipCache.Entries(); len(entries) != 0 {
+		t.Fatalf("Entries() = %+v, want none", entries)
+	}
+	before := time.Now()
+	if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "10f3d"); err != nil {
+		t.Fatalf("FetchTrace() = %v, want nil", err)
+	}
+	// A cached traceroute shouldn't change the entry.
+	if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "abcde"); err != nil {
+		t.Fatalf("FetchTrace() = %v, want nil", err)
+	}
+	entries := ipCache.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Entries() = %+v, want one entry", entries)
+	}
+	e := entries[0]
+	if e.IP != "1.1.1.1" {
+		t.Errorf("Entries()[0].IP = %q, want %q", e.IP, "1.1.1.1")
+	}
+	if !strings.HasSuffix(e.UUID, "_0000000000010F3D") {
+		t.Errorf("Entries()[0].UUID = %q, want suffix %q", e.UUID, "_0000000000010F3D")
+	}
+	if e.Timestamp.Before(before) || e.Timestamp.After(time.Now()) {
+		t.Errorf("Entries()[0].Timestamp = %v, want between %v and now", e.Timestamp, before)
+	}
+	if got := e.ExpiresAt.Sub(e.Timestamp); got != ipCfg.EntryTimeout {
+		t.Errorf("Entries()[0] expires after %v, want %v", got, ipCfg.EntryTimeout)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ft := &fakeTracer{}
+	ipCache, err := ipcache.New(ctx, ft, ipcache.Config{EntryTimeout: 200 * time.Millisecond, ScanPeriod: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	if _, _, ok := ipCache.Lookup("1.1.1.1"); ok {
+		t.Error("Lookup() = true before any traceroute, want false")
+	}
+	if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "10f3d"); err != nil {
+		t.Fatalf("FetchTrace() = %v, want nil", err)
+	}
+	entry := ipCache.Entries()[0]
+	uuid, expiresAt, ok := ipCache.Lookup("1.1.1.1")
+	if !ok || uuid != entry.UUID || !expiresAt.Equal(entry.ExpiresAt) {
+		t.Errorf("Lookup() = %q, %v, %v, want %q, %v, true", uuid, expiresAt, ok, entry.UUID, entry.ExpiresAt)
+	}
+	if _, _, ok := ipCache.Lookup("2.2.2.2"); ok {
+		t.Error("Lookup(2.2.2.2) = true, want false")
+	}
+
+	// Lookups neither run traceroutes nor keep the entry alive: it's
+	// evicted by the first scan after it expires.
+	for {
+		_, _, ok := ipCache.Lookup("1.1.1.1")
+		if !ok {
+			break
+		}
+		if time.Now().After(entry.ExpiresAt.Add(time.Second)) {
+			t.Fatal("entry wasn't evicted after it expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if time.Now().Before(entry.ExpiresAt) {
+		t.Errorf("entry evicted before it expired at %v", entry.ExpiresAt)
+	}
+	if ft.nTrace != 1 || ft.nCachedTrace != 0 {
+		t.Errorf("got %d traceroutes and %d cached traceroutes, want 1 and 0", ft.nTrace, ft.nCachedTrace)
+	}
+}
+
+func TestContextUUID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ipCache, err := ipcache.New(ctx, &fakeTracer{}, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Second})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	if _, err := ipCache.FetchTrace(tracer.WithUUID(ctx, "site1-1"), "1.1.1.1", "10f3d"); err != nil {
+		t.Fatalf("FetchTrace() = %v, want nil", err)
+	}
+	if entries := ipCache.Entries(); len(entries) != 1 || entries[0].UUID != "site1-1" {
+		t.Errorf("Entries() = %+v, want one entry with UUID %q", entries, "site1-1")
+	}
+}
+
+// countingTracer is a fakeTracer that is safe for concurrent use and
+// records the UUIDs and campaign IDs of its traceroutes.
+type countingTracer struct {
+	mu          sync.Mutex
+	uuids       []string
+	campaignIDs []string
+}
+
+func (ct *countingTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.uuids = append(ct.uuids, uuid)
+	ct.campaignIDs = append(ct.campaignIDs, tracer.CampaignIDFromContext(ctx))
+	return []byte("fake traceroute data to " + remoteIP), nil
+}
+
+func (ct *countingTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
+	return nil
+}
+
+func (ct *countingTracer) DontTrace() {}
+
+func (ct *countingTracer) traces() []string {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return append([]string(nil), ct.uuids...)
+}
+
+func TestConfigHash(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hash := "params1"
+	ft := &fakeTracer{}
+	ipCache, err := ipcache.New(ctx, ft, ipcache.Config{
+		EntryTimeout: time.Minute,
+		ScanPeriod:   time.Second,
+		ConfigHash:   func() string { return hash },
+	})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	// The second traceroute comes from the cache but the third one is
+	// run again because the configuration changed in between.  The
+	// fourth one comes from the cache again.
+	for i, h := range []string{"params1", "params1", "params2", "params2"} {
+		hash = h
+		if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", fmt.Sprintf("%x", i+1)); err != nil {
+			t.Fatalf("FetchTrace() = %v, want nil", err)
+		}
+		if _, _, ok := ipCache.Lookup("1.1.1.1"); !ok {
+			t.Errorf("Lookup() = false after traceroute %d, want true", i+1)
+		}
+	}
+	if ft.nTrace != 2 || ft.nCachedTrace != 2 {
+		t.Errorf("got %d traceroutes and %d cached traceroutes, want 2 and 2", ft.nTrace, ft.nCachedTrace)
+	}
+	// Traceroutes run with a previous configuration aren't reported.
+	hash = "params3"
+	if _, _, ok := ipCache.Lookup("1.1.1.1"); ok {
+		t.Error("Lookup() = true after a configuration change, want false")
+	}
+	if entries := ipCache.Entries(); len(entries) != 0 {
+		t.Errorf("Entries() = %+v after a configuration change, want none", entries)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, cfg := range []ipcache.Config{
+		{EntryTimeout: time.Minute, ScanPeriod: time.Hour, RefreshAhead: -time.Second},
+		{EntryTimeout: time.Minute, ScanPeriod: time.Hour, RefreshAhead: time.Minute},
+		{EntryTimeout: time.Minute, ScanPeriod: time.Hour, RefreshAhead: time.Second, RefreshWorkers: -1},
+	} {
+		if _, err := ipcache.New(ctx, &countingTracer{}, cfg); err == nil {
+			t.Errorf("New(%+v) = nil, want error", cfg)
+		}
+	}
+
+	// Entries are in the refresh-ahead window 50ms after being cached
+	// and are hot after two hits.
+	ct := &countingTracer{}
+	ipCache, err := ipcache.New(ctx, ct, ipcache.Config{
+		EntryTimeout:   200 * time.Millisecond,
+		ScanPeriod:     time.Hour,
+		RefreshAhead:   150 * time.Millisecond,
+		RefreshMinHits: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	fetch := func(ip, cookie string) {
+		if _, err := ipCache.FetchTrace(ctx, ip, cookie); err != nil {
+			t.Fatalf("FetchTrace() = %v, want nil", err)
+		}
+	}
+	fetch("1.1.1.1", "1") // hot
+	fetch("1.1.1.1", "2")
+	fetch("2.2.2.2", "3") // cold
+	time.Sleep(100 * time.Millisecond)
+	fetch("1.1.1.1", "4")
+	fetch("2.2.2.2", "5")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ct.traces()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got traceroutes %v, want a refresh of 1.1.1.1", ct.traces())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Give a refresh of the cold entry a chance to show up.
+	time.Sleep(20 * time.Millisecond)
+	traces := ct.traces()
+	if len(traces) != 3 || !strings.HasSuffix(traces[2], ipcache.RefreshSuffix) {
+		t.Fatalf("got traceroutes %v, want 3 with the last one refreshed", traces)
+	}
+	// The refresh belongs to the campaign of the hit that triggered it.
+	ct.mu.Lock()
+	campaignID := ct.campaignIDs[2]
+	ct.mu.Unlock()
+	if campaignID+ipcache.RefreshSuffix != traces[2] {
+		t.Errorf("got refresh %q with campaign ID %q, want the UUID of the hit", traces[2], campaignID)
+	}
+	for _, e := range ipCache.Entries() {
+		if refreshed := strings.HasSuffix(e.UUID, ipcache.RefreshSuffix); refreshed != (e.IP == "1.1.1.1") {
+			t.Errorf("got entry %+v, want only 1.1.1.1 refreshed", e)
+		}
+	}
+}
+
+// gatedTracer is a fakeTracer whose refresh-ahead traceroutes block
+// until they're released or cancelled and report how they ended.
+type gatedTracer struct {
+	started chan struct{}
+	release chan struct{}
+	ended   chan error
+}
+
+func (gt *gatedTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	if !strings.HasSuffix(uuid, ipcache.RefreshSuffix) {
+		return []byte("fake traceroute data to " + remoteIP), nil
+	}
+	gt.started <- struct{}{}
+	select {
+	case <-gt.release:
+		gt.ended <- nil
+		return []byte("refreshed traceroute data to " + remoteIP), nil
+	case <-ctx.Done():
+		gt.ended <- ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+func (gt *gatedTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
+	return nil
+}
+
+func (gt *gatedTracer) DontTrace() {}
+
+func TestRefreshAheadNotSuperseded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gt := &gatedTracer{started: make(chan struct{}, 1), release: make(chan struct{}), ended: make(chan error, 1)}
+	ipCache, err := ipcache.New(ctx, gt, ipcache.Config{
+		EntryTimeout: 200 * time.Millisecond,
+		ScanPeriod:   10 * time.Millisecond,
+		RefreshAhead: 150 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	fetch := func(cookie string) {
+		if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", cookie); err != nil {
+			t.Fatalf("FetchTrace() = %v, want nil", err)
+		}
+	}
+	fetch("1")
+	time.Sleep(100 * time.Millisecond)
+	fetch("2") // starts a refresh
+	<-gt.started
+	// The entry expires while the refresh is in progress and a new
+	// traceroute to the same IP address runs, which must not cancel
+	// the refresh.
+	time.Sleep(200 * time.Millisecond)
+	fetch("3")
+	close(gt.release)
+	if err := <-gt.ended; err != nil {
+		t.Errorf("refresh ended with %v, want nil", err)
+	}
+}
+
+// failingTracer is a fakeTracer whose first nFailures traceroutes time
+// out with partial output or fail with err if it's not nil.
+type failingTracer struct {
+	fakeTracer
+	nFailures  int
+	nDontTrace int
+	err        error
+}
+
+func (ft *failingTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	data, _ := ft.fakeTracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+	if ft.nTrace <= ft.nFailures {
+		if ft.err != nil {
+			return nil, ft.err
+		}
+		return data[:4], fmt.Errorf("%w: signal: killed", tracer.ErrTraceKilled)
+	}
+	return data, nil
+}
+
+func (ft *failingTracer) DontTrace() {
+	ft.nDontTrace++
+}
+
+func TestFailedTraces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := ipcache.New(ctx, &failingTracer{}, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour, NegativeTTL: -1}); err == nil {
+		t.Errorf("New() = nil, want error")
+	}
+
+	// A traceroute that timed out isn't served from the cache: the
+	// next one is run again.
+	ft := &failingTracer{nFailures: 1}
+	ipCache, err := ipcache.New(ctx, ft, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "1"); !errors.Is(err, tracer.ErrTraceKilled) {
+		t.Fatalf("FetchTrace() = %v, want %v", err, tracer.ErrTraceKilled)
+	}
+	if _, _, ok := ipCache.Lookup("1.1.1.1"); ok || ipCache.NumEntries() != 0 {
+		t.Errorf("failed traceroute was cached")
+	}
+	data, err := ipCache.FetchTrace(ctx, "1.1.1.1", "2")
+	if err != nil || string(data) != "fake traceroute data to 1.1.1.1" {
+		t.Errorf("FetchTrace() = %q, %v, want complete traceroute", data, err)
+	}
+	if ft.nTrace != 2 || ft.nCachedTrace != 0 {
+		t.Errorf("got %d traceroutes and %d cached traceroutes, want 2 and 0", ft.nTrace, ft.nCachedTrace)
+	}
+
+	// With negative caching, traceroutes to the same IP address fail
+	// without being run until the failure expires.
+	ft = &failingTracer{nFailures: 1}
+	ipCache, err = ipcache.New(ctx, ft, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour, NegativeTTL: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	for _, cookie := range []string{"1", "2"} {
+		if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", cookie); !errors.Is(err, tracer.ErrTraceKilled) {
+			t.Fatalf("FetchTrace() = %v, want %v", err, tracer.ErrTraceKilled)
+		}
+	}
+	if ft.nTrace != 1 || ft.nCachedTrace != 0 || ft.nDontTrace != 1 {
+		t.Errorf("got %d traceroutes, %d cached traceroutes, and %d skipped, want 1, 0, and 1", ft.nTrace, ft.nCachedTrace, ft.nDontTrace)
+	}
+	if _, _, ok := ipCache.Lookup("1.1.1.1"); ok || len(ipCache.Entries()) != 0 {
+		t.Errorf("failed traceroute was reported as cached")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "3"); err != nil {
+		t.Errorf("FetchTrace() = %v, want nil", err)
+	}
+	if ft.nTrace != 2 {
+		t.Errorf("got %d traceroutes, want 2", ft.nTrace)
+	}
+
+	// Failures that the destination didn't cause aren't cached even
+	// with negative caching.
+	for _, failure := range []error{
+		fmt.Errorf("%w: circuit breaker is open", ipcache.ErrNotTraced),
+		fmt.Errorf("%w: signal: killed", context.Canceled),
+		fmt.Errorf("%w: fork/exec: no such file", tracer.ErrTraceNotStarted),
+	} {
+		ft = &failingTracer{nFailures: 1, err: failure}
+		ipCache, err = ipcache.New(ctx, ft, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour, NegativeTTL: time.Minute})
+		if err != nil {
+			t.Fatalf("failed to create an IP cache: %v", err)
+		}
+		if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "1"); !errors.Is(err, failure) {
+			t.Fatalf("FetchTrace() = %v, want %v", err, failure)
+		}
+		if ipCache.NumEntries() != 0 {
+			t.Errorf("%v: failed traceroute was cached", failure)
+		}
+		if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "2"); err != nil || ft.nTrace != 2 {
+			t.Errorf("%v: FetchTrace() = %v with %d traceroutes, want nil with 2", failure, err, ft.nTrace)
+		}
+	}
+}
+
+func TestTruncatedTraces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A truncated traceroute is returned but not served from the
+	// cache: the next one is run again.
+	s, err := tracer.NewScamper(tracer.ScamperConfig{
+		Binary:           "../../tracer/testdata/flood",
+		OutputPath:       t.TempDir(),
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+		MaxOutputBytes:   1000,
+	})
+	if err != nil {
+		t.Fatalf("NewScamper() = %v, want nil", err)
+	}
+	ipCache, err := ipcache.New(ctx, s, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	for _, cookie := range []string{"1", "2"} {
+		data, err := ipCache.FetchTrace(ctx, "10.1.1.1", cookie)
+		if !errors.Is(err, tracer.ErrTraceTruncated) || len(data) == 0 {
+			t.Fatalf("FetchTrace() = %d bytes, %v, want truncated traceroute", len(data), err)
+		}
+		if _, _, ok := ipCache.Lookup("10.1.1.1"); ok || ipCache.NumEntries() != 0 {
+			t.Errorf("truncated traceroute was cached")
+		}
+	}
+}
+
+// truncatingTracer is a fakeTracer whose traceroutes are truncated
+// once they're released.
+type truncatingTracer struct {
+	fakeTracer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (tt *truncatingTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	data, _ := tt.fakeTracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+	close(tt.started)
+	<-tt.release
+	return data[:4], fmt.Errorf("%w: output exceeded 4 bytes", tracer.ErrTraceTruncated)
+}
+
+func TestTruncatedTracesWaiters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Triggers waiting for a truncated traceroute get what's left of
+	// it and the destination isn't quarantined.
+	tt := &truncatingTracer{started: make(chan struct{}), release: make(chan struct{})}
+	ipCache, err := ipcache.New(ctx, tt, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour, NegativeTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to create an IP cache: %v", err)
+	}
+	type result struct {
+		data  []byte
+		fetch ipcache.Fetch
+		err   error
+	}
+	results := make(chan result, 2)
+	fetch := func(cookie string) {
+		data, fetch, err := ipCache.FetchTraceInfo(ctx, "1.1.1.1", cookie)
+		results <- result{data, fetch, err}
+	}
+	go fetch("1")
+	<-tt.started
+	go fetch("2")
+	// Give the second trigger time to wait for the traceroute.
+	time.Sleep(100 * time.Millisecond)
+	close(tt.release)
+	var nCached int
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if !errors.Is(r.err, tracer.ErrTraceTruncated) || string(r.data) != "fake" {
+			t.Errorf("FetchTraceInfo() = %q, %v, want truncated traceroute", r.data, r.err)
+		}
+		if r.fetch.Cached {
+			nCached++
+		}
+	}
+	if nCached != 1 || tt.nCachedTrace != 1 {
+		t.Errorf("got %d cached fetches and %d cached traceroutes, want 1 and 1", nCached, tt.nCachedTrace)
+	}
+	if ipCache.NumEntries() != 0 {
+		t.Errorf("truncated traceroute was cached")
+	}
+	// The next traceroute runs.
+	tt.started, tt.release = make(chan struct{}), make(chan struct{})
+	close(tt.release)
+	if _, err := ipCache.FetchTrace(ctx, "1.1.1.1", "3"); !errors.Is(err, tracer.ErrTraceTruncated) || tt.nTrace != 2 {
+		t.Errorf("FetchTrace() = %v with %d traceroutes, want %v with 2", err, tt.nTrace, tracer.ErrTraceTruncated)
+	}
+}
+
 func randomDelay() {
 	// Uniform 0 to 20 usec.
 	time.Sleep(time.Duration(rand.Intn(20000)) * time.Nanosecond)
@@ -120,7 +706,7 @@ type pausingTracer struct {
 	successes            int64
 }
 
-func (pt *pausingTracer) Trace(remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+func (pt *pausingTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
 	randomDelay()
 	if remoteIP == pt.traceToBlock || remoteIP == pt.traceToBlockAndError {
 		<-pt.ctx.Done()
@@ -132,7 +718,7 @@ func (pt *pausingTracer) Trace(remoteIP, cookie, uuid string, t time.Time) ([]by
 	return []byte("fake traceroute data to " + remoteIP), nil
 }
 
-func (pt *pausingTracer) CachedTrace(cookie, uuid string, t time.Time, cachedTest []byte) error {
+func (pt *pausingTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
 	randomDelay()
 	atomic.AddInt64(&pt.successes, 1)
 	return nil
@@ -172,7 +758,7 @@ func TestCacheWithBlockedTests(t *testing.T) {
 	for i := 0; i < 1000; i++ {
 		go func(j int) {
 			randomDelay()
-			data, err := c.FetchTrace(fmt.Sprintf("%d", j), "abcde")
+			data, err := c.FetchTrace(context.TODO(), fmt.Sprintf("%d", j), "abcde")
 			wantData := fmt.Sprintf("fake traceroute data to %d", j)
 			if j == justError || j == blockThenError {
 				if err == nil {
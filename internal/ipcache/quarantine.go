@@ -0,0 +1,101 @@
+package ipcache
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var quarantined = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "ipcache_quarantined_destinations",
+		Help: "The number of destinations whose traceroutes aren't run because they failed recently",
+	},
+	[]string{"tracer"},
+)
+
+// failureState tracks the consecutive traceroute failures of a
+// destination.
+type failureState struct {
+	count   int       // number of consecutive failures
+	until   time.Time // end of the quarantine of the last failure
+	counted bool      // true if counted as quarantined
+}
+
+// negativeTTL returns how long the given consecutive failure of a
+// destination is kept in the cache: NegativeTTL multiplied by the
+// multiplier for each previous consecutive failure and capped at the
+// maximum negative TTL.
+func (ic *IPCache) negativeTTL(failures int) time.Duration {
+	ttl := float64(ic.negTTL) * math.Pow(ic.negMult, float64(failures-1))
+	if ttl >= float64(ic.negMax) {
+		return ic.negMax
+	}
+	return time.Duration(ttl)
+}
+
+// quarantine records another consecutive failure of the given IP
+// address at time now and returns how long it is quarantined.  The
+// cache lock must be held.
+func (ic *IPCache) quarantine(ip string, now time.Time) time.Duration {
+	state := ic.failures[ip]
+	state.count++
+	ttl := ic.negativeTTL(state.count)
+	state.until = now.Add(ttl)
+	if !state.counted {
+		state.counted = true
+		ic.nQuarantined++
+		quarantined.WithLabelValues(ic.label).Inc()
+	}
+	ic.failures[ip] = state
+	return ttl
+}
+
+// succeed records that a traceroute to the given IP address succeeded.
+func (ic *IPCache) succeed(ip string) {
+	ic.cacheLock.Lock()
+	defer ic.cacheLock.Unlock()
+	ic.forgive(ip)
+}
+
+// forgive resets the consecutive failures of the given IP address.  The
+// cache lock must be held.
+func (ic *IPCache) forgive(ip string) {
+	state, ok := ic.failures[ip]
+	if !ok {
+		return
+	}
+	delete(ic.failures, ip)
+	if state.counted {
+		ic.nQuarantined--
+		quarantined.WithLabelValues(ic.label).Dec()
+	}
+}
+
+// updateQuarantine recounts the quarantined destinations as of now.
+// Between scans, the count is kept up to date as destinations fail and
+// succeed but quarantines that ended are still counted.  Failures are
+// forgotten once their destination hasn't failed for the maximum
+// negative TTL after its quarantine ended so that they don't
+// accumulate.  The gauge is only changed by the difference so that
+// caches with the same label add up.  The cache lock must be held.
+func (ic *IPCache) updateQuarantine(now time.Time) {
+	n := 0
+	for k, state := range ic.failures {
+		switch {
+		case now.Before(state.until):
+			n++
+			state.counted = true
+		case now.Sub(state.until) > ic.negMax:
+			delete(ic.failures, k)
+			continue
+		default:
+			state.counted = false
+		}
+		ic.failures[k] = state
+	}
+	quarantined.WithLabelValues(ic.label).Add(float64(n - ic.nQuarantined))
+	ic.nQuarantined = n
+}
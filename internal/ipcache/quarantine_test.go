@@ -0,0 +1,144 @@
+package ipcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyTracer fails its traceroutes while failing is true.
+type flakyTracer struct {
+	mu      sync.Mutex
+	failing bool
+	nTrace  int
+}
+
+func (ft *flakyTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.nTrace++
+	if ft.failing {
+		return nil, errors.New("forced traceroute error")
+	}
+	return []byte("fake traceroute data to " + remoteIP), nil
+}
+
+func (ft *flakyTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
+	return nil
+}
+
+func (ft *flakyTracer) DontTrace() {}
+
+func (ft *flakyTracer) set(failing bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.failing = failing
+}
+
+func (ft *flakyTracer) traces() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.nTrace
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, cfg := range []Config{
+		{NegativeTTL: time.Second, NegativeTTLMultiplier: 0.5},
+		{NegativeTTL: time.Second, NegativeTTLMultiplier: -1},
+		{NegativeTTL: time.Second, NegativeTTLMax: -1},
+		{NegativeTTL: time.Second, NegativeTTLMax: time.Millisecond},
+	} {
+		cfg.EntryTimeout, cfg.ScanPeriod = time.Minute, time.Hour
+		if _, err := New(ctx, &flakyTracer{}, cfg); err == nil {
+			t.Errorf("New(%+v) = nil, want error", cfg)
+		}
+	}
+
+	ft := &flakyTracer{failing: true}
+	ic, err := New(ctx, ft, Config{
+		EntryTimeout:          time.Minute,
+		ScanPeriod:            time.Hour,
+		NegativeTTL:           40 * time.Millisecond,
+		NegativeTTLMultiplier: 2,
+		NegativeTTLMax:        100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	for i, want := range []time.Duration{40, 80, 100, 100} {
+		if got := ic.negativeTTL(i + 1); got != want*time.Millisecond {
+			t.Errorf("negativeTTL(%d) = %v, want %v", i+1, got, want*time.Millisecond)
+		}
+	}
+
+	// Each consecutive failure quarantines the destination longer.
+	fetch := func() error {
+		_, err := ic.FetchTrace(ctx, "1.1.1.1", "1")
+		return err
+	}
+	var prev time.Duration
+	for i, ttl := range []time.Duration{40 * time.Millisecond, 80 * time.Millisecond, 100 * time.Millisecond} {
+		if err := fetch(); err == nil {
+			t.Fatalf("failure %d: FetchTrace() = nil, want error", i+1)
+		}
+		if n := ft.traces(); n != i+1 {
+			t.Fatalf("failure %d: got %d traceroutes, want %d", i+1, n, i+1)
+		}
+		if got := promtest.ToFloat64(quarantined.WithLabelValues("")); got != 1 {
+			t.Errorf("failure %d: got %v quarantined destinations, want 1", i+1, got)
+		}
+		// The destination is still quarantined after the previous
+		// (shorter) quarantine.
+		time.Sleep(prev)
+		if err := fetch(); err == nil || ft.traces() != i+1 {
+			t.Fatalf("failure %d: traceroute wasn't suppressed after %v (error: %v)", i+1, prev, err)
+		}
+		time.Sleep(ttl - prev + 20*time.Millisecond)
+		prev = ttl
+	}
+
+	// A success resets the quarantine.
+	ft.set(false)
+	if err := fetch(); err != nil {
+		t.Fatalf("FetchTrace() = %v, want nil", err)
+	}
+	if got := promtest.ToFloat64(quarantined.WithLabelValues("")); got != 0 {
+		t.Errorf("got %v quarantined destinations, want 0", got)
+	}
+	ic.cacheLock.Lock()
+	delete(ic.cache, "1.1.1.1")
+	ic.cacheLock.Unlock()
+	ft.set(true)
+	if err := fetch(); err == nil {
+		t.Fatal("FetchTrace() = nil, want error")
+	}
+	ic.cacheLock.Lock()
+	state := ic.failures["1.1.1.1"]
+	ic.cacheLock.Unlock()
+	if state.count != 1 || time.Until(state.until) > 40*time.Millisecond {
+		t.Errorf("got %d failures quarantined for %v, want 1 for at most 40ms", state.count, time.Until(state.until))
+	}
+
+	// Quarantines that ended are no longer counted after a scan and
+	// failures are eventually forgotten.
+	ic.scan(time.Now().Add(50 * time.Millisecond))
+	if got := promtest.ToFloat64(quarantined.WithLabelValues("")); got != 0 || len(ic.failures) != 1 {
+		t.Errorf("got %v quarantined destinations and %d failures, want 0 and 1", got, len(ic.failures))
+	}
+	if err := fetch(); err == nil {
+		t.Fatal("FetchTrace() = nil, want error")
+	}
+	if got := promtest.ToFloat64(quarantined.WithLabelValues("")); got != 1 {
+		t.Errorf("got %v quarantined destinations, want 1", got)
+	}
+	ic.scan(time.Now().Add(time.Second))
+	if len(ic.failures) != 0 {
+		t.Errorf("got %d failures, want 0", len(ic.failures))
+	}
+}
@@ -0,0 +1,51 @@
+package ipcache
+
+import (
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScan(t *testing.T) {
+	now := time.Date(2021, time.October, 1, 12, 0, 0, 0, time.UTC)
+	ic := &IPCache{
+		cache: map[string]*cachedTrace{
+			"1.1.1.1": {timeStamp: now.Add(-90 * time.Second)}, // expired
+			"2.2.2.2": {timeStamp: now.Add(-50 * time.Second)}, // oldest
+			"3.3.3.3": {timeStamp: now.Add(-20 * time.Second)},
+			"4.4.4.4": {timeStamp: now.Add(-5 * time.Second)}, // newest
+		},
+		running: make(map[string]*cachedTrace),
+		timeout: time.Minute,
+	}
+	ic.scan(now)
+	if got := ic.NumEntries(); got != 3 {
+		t.Errorf("NumEntries() = %d, want 3", got)
+	}
+	for _, test := range []struct {
+		entry string
+		want  float64
+	}{
+		{"oldest", 50},
+		{"newest", 5},
+	} {
+		if got := promtest.ToFloat64(cacheEntryAge.WithLabelValues("", test.entry)); got != test.want {
+			t.Errorf("%s entry age = %v, want %v", test.entry, got, test.want)
+		}
+	}
+	if got := promtest.ToFloat64(cacheEntries.WithLabelValues("")); got != 3 {
+		t.Errorf("entries = %v, want 3", got)
+	}
+
+	// All entries expire.
+	ic.scan(now.Add(time.Hour))
+	for _, entry := range []string{"oldest", "newest"} {
+		if got := promtest.ToFloat64(cacheEntryAge.WithLabelValues("", entry)); got != 0 {
+			t.Errorf("%s entry age = %v, want 0", entry, got)
+		}
+	}
+	if got := promtest.ToFloat64(cacheEntries.WithLabelValues("")); got != 0 {
+		t.Errorf("entries = %v, want 0", got)
+	}
+}
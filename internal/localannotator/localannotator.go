@@ -0,0 +1,368 @@
+// Package localannotator annotates IP addresses with local MaxMind or
+// IPinfo databases (.mmdb files) instead of the uuid-annotator service.
+// It implements the ipservice.Client interface so that it can be used
+// as the annotator client of hop caches (see hopannotation.Config) in
+// deployments without network access to the service or with too many
+// hops for it.
+//
+// The following database formats are supported:
+//   - MaxMind GeoIP2/GeoLite2 City and Country databases for
+//     geolocation.
+//   - MaxMind GeoLite2 ASN databases for Autonomous System Numbers.
+//   - IPinfo country, ASN, and country_asn databases for both.
+//
+// Several databases can be used together (e.g., a City and an ASN
+// database) in which case the annotations of an IP address combine the
+// data found in all of them.  Databases are reloaded when their files
+// change.
+package localannotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrNoDatabase means no database was configured.
+	ErrNoDatabase = errors.New("no annotation database")
+	// ErrLoadDatabase means a database could not be loaded.
+	ErrLoadDatabase = errors.New("failed to load annotation database")
+	// ErrParseIP means an IP address could not be parsed.
+	ErrParseIP = errors.New("failed to parse IP address")
+
+	reloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "local_annotator_reloads_total",
+			Help: "The number of reloads of local annotation databases",
+		},
+		[]string{"outcome"},
+	)
+
+	// Package testing aid.
+	defaultCheckInterval = time.Minute
+)
+
+// Config contains configuration parameters of a local annotator.
+type Config struct {
+	// Paths are the paths of the database files.
+	Paths []string
+	// CheckInterval is how often the database files are checked for
+	// changes.  Zero (default) checks every minute.
+	CheckInterval time.Duration
+}
+
+// Annotator annotates IP addresses with local databases.
+type Annotator struct {
+	mu  sync.RWMutex
+	dbs []*database
+}
+
+// database is a loaded database file.
+type database struct {
+	path    string
+	modTime time.Time
+	size    int64
+	reader  *maxminddb.Reader
+	ipinfo  bool // IPinfo (rather than MaxMind) format
+	hasGeo  bool // the database has geolocation data
+	hasASN  bool // the database has ASN data
+}
+
+// New loads the configured databases and returns a new Annotator.  It
+// returns an error if any database cannot be loaded.  It also starts a
+// goroutine that reloads databases whose files have changed.  The
+// goroutine terminates when ctx is cancelled.
+func New(ctx context.Context, cfg Config) (*Annotator, error) {
+	if len(cfg.Paths) == 0 {
+		return nil, ErrNoDatabase
+	}
+	a := &Annotator{}
+	for _, path := range cfg.Paths {
+		db, err := load(path)
+		if err != nil {
+			return nil, err
+		}
+		a.dbs = append(a.dbs, db)
+	}
+	interval := cfg.CheckInterval
+	if interval == 0 {
+		interval = defaultCheckInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.Reload()
+			}
+		}
+	}()
+	return a, nil
+}
+
+// load loads the named database file.  The file is read into memory
+// rather than mapped so that it can be replaced while it's in use.
+func load(path string) (*database, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q (error: %v)", ErrLoadDatabase, path, err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q (error: %v)", ErrLoadDatabase, path, err)
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q (error: %v)", ErrLoadDatabase, path, err)
+	}
+	db := &database{
+		path:    path,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		reader:  reader,
+	}
+	dbType := strings.ToLower(reader.Metadata.DatabaseType)
+	switch {
+	case strings.HasPrefix(dbType, "ipinfo"):
+		db.ipinfo = true
+		db.hasGeo = strings.Contains(dbType, "country") || strings.Contains(dbType, "lite")
+		db.hasASN = strings.Contains(dbType, "asn") || strings.Contains(dbType, "lite")
+	case strings.HasSuffix(dbType, "-asn") || strings.HasSuffix(dbType, "-isp"):
+		db.hasASN = true
+	case strings.HasSuffix(dbType, "-city") || strings.HasSuffix(dbType, "-country") || strings.HasSuffix(dbType, "-enterprise"):
+		db.hasGeo = true
+	default:
+		return nil, fmt.Errorf("%w %q (error: unsupported database type %q)", ErrLoadDatabase, path, reader.Metadata.DatabaseType)
+	}
+	return db, nil
+}
+
+// Reload reloads the databases whose files have changed since they were
+// loaded.  If a database cannot be reloaded, the loaded one is kept.
+func (a *Annotator) Reload() {
+	a.mu.RLock()
+	dbs := append([]*database(nil), a.dbs...)
+	a.mu.RUnlock()
+	changed := false
+	for i, db := range dbs {
+		fi, err := os.Stat(db.path)
+		if err != nil || (fi.ModTime().Equal(db.modTime) && fi.Size() == db.size) {
+			continue
+		}
+		newDB, err := load(db.path)
+		if err != nil {
+			reloads.WithLabelValues("error").Inc()
+			log.Printf("failed to reload annotation database, keeping the loaded one (error: %v)\n", err)
+			continue
+		}
+		reloads.WithLabelValues("success").Inc()
+		log.Printf("reloaded annotation database %q\n", db.path)
+		dbs[i] = newDB
+		changed = true
+	}
+	if changed {
+		a.mu.Lock()
+		a.dbs = dbs
+		a.mu.Unlock()
+	}
+}
+
+// Annotate returns the annotations of the given IP addresses.  Each IP
+// address gets annotations with the data of all databases.  Addresses
+// that aren't in any database with geolocation (or ASN) data get
+// geolocation (or network) annotations marked missing rather than an
+// error, like the uuid-annotator service does.
+func (a *Annotator) Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	annotations := make(map[string]*annotator.ClientAnnotations, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: %q", ErrParseIP, s)
+		}
+		ann := &annotator.ClientAnnotations{}
+		for _, db := range a.dbs {
+			if err := db.annotate(ip, ann); err != nil {
+				return nil, err
+			}
+		}
+		annotations[s] = ann
+	}
+	return annotations, nil
+}
+
+// annotate adds the data of the given IP address in this database to
+// ann.  Data that's already in ann (from a previous database) is kept.
+func (db *database) annotate(ip net.IP, ann *annotator.ClientAnnotations) error {
+	var geo *annotator.Geolocation
+	var network *annotator.Network
+	if db.ipinfo {
+		var rec ipinfoRecord
+		ipnet, ok, err := db.reader.LookupNetwork(ip, &rec)
+		if err != nil {
+			return err
+		}
+		if ok {
+			geo, network = rec.geo(), rec.network(ipnet)
+		}
+	} else {
+		var rec maxmindRecord
+		ipnet, ok, err := db.reader.LookupNetwork(ip, &rec)
+		if err != nil {
+			return err
+		}
+		if ok {
+			geo, network = rec.geo(), rec.network(ipnet)
+		}
+	}
+	if db.hasGeo && (ann.Geo == nil || ann.Geo.Missing) {
+		if geo == nil {
+			geo = &annotator.Geolocation{Missing: true}
+		}
+		ann.Geo = geo
+	}
+	if db.hasASN && (ann.Network == nil || ann.Network.Missing) {
+		if network == nil {
+			network = &annotator.Network{Missing: true}
+		}
+		ann.Network = network
+	}
+	return nil
+}
+
+// maxmindRecord is a record of a MaxMind database.
+type maxmindRecord struct {
+	City struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code      string `maxminddb:"code"`
+		GeoNameID uint   `maxminddb:"geoname_id"`
+	} `maxminddb:"continent"`
+	Country struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
+		Latitude       float64 `maxminddb:"latitude"`
+		Longitude      float64 `maxminddb:"longitude"`
+		MetroCode      uint    `maxminddb:"metro_code"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	ASNumber uint   `maxminddb:"autonomous_system_number"`
+	ASName   string `maxminddb:"autonomous_system_organization"`
+}
+
+// geo returns the geolocation in the record or nil if there is none.
+// It follows the uuid-annotator's conversion of MaxMind records.
+func (r *maxmindRecord) geo() *annotator.Geolocation {
+	if r.City.GeoNameID == 0 && r.Country.GeoNameID == 0 && r.Continent.GeoNameID == 0 {
+		return nil
+	}
+	geo := &annotator.Geolocation{
+		ContinentCode:    r.Continent.Code,
+		CountryCode:      r.Country.IsoCode,
+		CountryName:      r.Country.Names["en"],
+		MetroCode:        int64(r.Location.MetroCode),
+		City:             r.City.Names["en"],
+		PostalCode:       r.Postal.Code,
+		Latitude:         r.Location.Latitude,
+		Longitude:        r.Location.Longitude,
+		AccuracyRadiusKm: int64(r.Location.AccuracyRadius),
+	}
+	if len(r.Subdivisions) > 0 {
+		geo.Subdivision1ISOCode = r.Subdivisions[0].IsoCode
+		geo.Subdivision1Name = r.Subdivisions[0].Names["en"]
+		if len(r.Subdivisions) > 1 {
+			geo.Subdivision2ISOCode = r.Subdivisions[1].IsoCode
+			geo.Subdivision2Name = r.Subdivisions[1].Names["en"]
+		}
+	}
+	return geo
+}
+
+// network returns the network in the record or nil if there is none.
+func (r *maxmindRecord) network(ipnet *net.IPNet) *annotator.Network {
+	if r.ASNumber == 0 {
+		return nil
+	}
+	return &annotator.Network{
+		CIDR:     ipnet.String(),
+		ASNumber: uint32(r.ASNumber),
+		ASName:   r.ASName,
+	}
+}
+
+// ipinfoRecord is a record of an IPinfo database.  The country field
+// is a country code in some databases and a country name in others.
+type ipinfoRecord struct {
+	Country       string `maxminddb:"country"`
+	CountryCode   string `maxminddb:"country_code"`
+	CountryName   string `maxminddb:"country_name"`
+	Continent     string `maxminddb:"continent"`
+	ContinentCode string `maxminddb:"continent_code"`
+	ASN           string `maxminddb:"asn"`
+	ASName        string `maxminddb:"as_name"`
+}
+
+// geo returns the geolocation in the record or nil if there is none.
+func (r *ipinfoRecord) geo() *annotator.Geolocation {
+	code, name := r.CountryCode, r.CountryName
+	if len(r.Country) == 2 && code == "" {
+		code = r.Country
+	} else if name == "" {
+		name = r.Country
+	}
+	continent := r.ContinentCode
+	if continent == "" && len(r.Continent) == 2 {
+		continent = r.Continent
+	}
+	if code == "" && name == "" && continent == "" {
+		return nil
+	}
+	return &annotator.Geolocation{
+		ContinentCode: continent,
+		CountryCode:   code,
+		CountryName:   name,
+	}
+}
+
+// network returns the network in the record or nil if there is none.
+func (r *ipinfoRecord) network(ipnet *net.IPNet) *annotator.Network {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(r.ASN, "AS"), 10, 32)
+	if err != nil || asn == 0 {
+		return nil
+	}
+	return &annotator.Network{
+		CIDR:     ipnet.String(),
+		ASNumber: uint32(asn),
+		ASName:   r.ASName,
+	}
+}
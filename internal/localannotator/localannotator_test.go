@@ -0,0 +1,172 @@
+package localannotator
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The test database is MaxMind's GeoIP2-City-Test.mmdb.  Networks are
+// listed in https://github.com/maxmind/MaxMind-DB/blob/main/source-data/GeoIP2-City-Test.json.
+const testDB = "testdata/GeoIP2-City-Test.mmdb"
+
+func TestNew(t *testing.T) {
+	garbage := filepath.Join(t.TempDir(), "garbage.mmdb")
+	if err := ioutil.WriteFile(garbage, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		paths []string
+		want  error
+	}{
+		{nil, ErrNoDatabase},
+		{[]string{"testdata/non-existent.mmdb"}, ErrLoadDatabase},
+		{[]string{testDB, garbage}, ErrLoadDatabase},
+		{[]string{testDB}, nil},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		if _, err := New(ctx, Config{Paths: test.paths}); !errors.Is(err, test.want) {
+			t.Errorf("New(%v) = %v, want %v", test.paths, err, test.want)
+		}
+		cancel()
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := New(ctx, Config{Paths: []string{testDB}})
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	if _, err := a.Annotate(ctx, []string{"2.125.160.216", "not-an-ip"}); !errors.Is(err, ErrParseIP) {
+		t.Errorf("Annotate() = %v, want %v", err, ErrParseIP)
+	}
+	annotations, err := a.Annotate(ctx, []string{"2.125.160.216", "1.1.1.1"})
+	if err != nil {
+		t.Fatalf("Annotate() = %v, want nil", err)
+	}
+	if len(annotations) != 2 {
+		t.Fatalf("Annotate() returned %d annotations, want 2", len(annotations))
+	}
+	geo := annotations["2.125.160.216"].Geo
+	if geo == nil || geo.Missing {
+		t.Fatalf("2.125.160.216: Geo = %+v, want a geolocation", geo)
+	}
+	if geo.CountryCode != "GB" || geo.Subdivision1ISOCode != "ENG" || math.Abs(geo.Latitude-51.75) > .01 || math.Abs(geo.Longitude - -1.25) > .01 {
+		t.Errorf("2.125.160.216: Geo = %+v, want GB, ENG, 51.75, -1.25", geo)
+	}
+	// The City database has no ASN data.
+	if n := annotations["2.125.160.216"].Network; n != nil {
+		t.Errorf("2.125.160.216: Network = %+v, want nil", n)
+	}
+	// Addresses that aren't in the database are missing, not errors.
+	if geo := annotations["1.1.1.1"].Geo; geo == nil || !geo.Missing {
+		t.Errorf("1.1.1.1: Geo = %+v, want missing", geo)
+	}
+}
+
+func TestReload(t *testing.T) {
+	content, err := ioutil.ReadFile(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	write := func(b []byte, mtime time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write(content, start)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := New(ctx, Config{Paths: []string{path}, CheckInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	loaded := a.dbs[0]
+
+	// Unchanged files aren't reloaded.
+	a.Reload()
+	if a.dbs[0] != loaded {
+		t.Error("Reload() reloaded an unchanged database")
+	}
+	// Invalid files are ignored.
+	errs := promtest.ToFloat64(reloads.WithLabelValues("error"))
+	write([]byte("corrupt"), start.Add(time.Minute))
+	a.Reload()
+	if a.dbs[0] != loaded {
+		t.Error("Reload() replaced the database with a corrupt one")
+	}
+	if got := promtest.ToFloat64(reloads.WithLabelValues("error")) - errs; got != 1 {
+		t.Errorf("got %v reload errors, want 1", got)
+	}
+	if _, err := a.Annotate(ctx, []string{"2.125.160.216"}); err != nil {
+		t.Errorf("Annotate() = %v, want nil", err)
+	}
+	// Changed files are reloaded.
+	successes := promtest.ToFloat64(reloads.WithLabelValues("success"))
+	write(content, start.Add(2*time.Minute))
+	a.Reload()
+	if a.dbs[0] == loaded {
+		t.Error("Reload() didn't reload a changed database")
+	}
+	if got := promtest.ToFloat64(reloads.WithLabelValues("success")) - successes; got != 1 {
+		t.Errorf("got %v reloads, want 1", got)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("1.2.3.0/24")
+	mm := &maxmindRecord{ASNumber: 15169, ASName: "GOOGLE"}
+	if got := mm.network(ipnet); got == nil || got.CIDR != "1.2.3.0/24" || got.ASNumber != 15169 || got.ASName != "GOOGLE" {
+		t.Errorf("maxmind network() = %+v", got)
+	}
+	if got := (&maxmindRecord{}).network(ipnet); got != nil {
+		t.Errorf("maxmind network() = %+v, want nil", got)
+	}
+
+	tests := []struct {
+		rec         ipinfoRecord
+		wantGeo     *annotator.Geolocation
+		wantNetwork *annotator.Network
+	}{
+		{ipinfoRecord{}, nil, nil},
+		{
+			// country_asn databases.
+			ipinfoRecord{Country: "US", CountryName: "United States", Continent: "NA", ASN: "AS15169", ASName: "Google LLC"},
+			&annotator.Geolocation{ContinentCode: "NA", CountryCode: "US", CountryName: "United States"},
+			&annotator.Network{CIDR: "1.2.3.0/24", ASNumber: 15169, ASName: "Google LLC"},
+		},
+		{
+			// Lite databases.
+			ipinfoRecord{Country: "United States", CountryCode: "US", Continent: "North America", ContinentCode: "NA", ASN: "bad"},
+			&annotator.Geolocation{ContinentCode: "NA", CountryCode: "US", CountryName: "United States"},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		if got := test.rec.geo(); (got == nil) != (test.wantGeo == nil) || (got != nil && *got != *test.wantGeo) {
+			t.Errorf("ipinfo %+v: geo() = %+v, want %+v", test.rec, got, test.wantGeo)
+		}
+		got := test.rec.network(ipnet)
+		if (got == nil) != (test.wantNetwork == nil) || (got != nil && (got.CIDR != test.wantNetwork.CIDR || got.ASNumber != test.wantNetwork.ASNumber || got.ASName != test.wantNetwork.ASName)) {
+			t.Errorf("ipinfo %+v: network() = %+v, want %+v", test.rec, got, test.wantNetwork)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Package pubsubsink publishes an event for each completed traceroute
+// to a Pub/Sub topic so that real-time pipelines don't have to wait for
+// traceroute files to be archived.
+//
+// Events are queued, published in batches, and retried on transient
+// errors in the background.  When publishing falls behind (e.g., Pub/Sub
+// is unavailable), events are dropped rather than blocking traceroutes.
+package pubsubsink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/triggertrace"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrPermanent marks publish errors that aren't worth retrying.
+	ErrPermanent = errors.New("permanent publish error")
+	// ErrDropped means an event was dropped because the queue was full
+	// or the sink was closed.
+	ErrDropped = errors.New("event dropped")
+
+	events = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pubsubsink_events_total",
+			Help: "The number of traceroute events by result (published, dropped, or failed)",
+		},
+		[]string{"result"},
+	)
+	publishRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pubsubsink_publish_retries_total",
+			Help: "The number of retried publish calls",
+		},
+	)
+)
+
+// Default configuration values.
+const (
+	defaultBatchSize    = 100
+	defaultBatchDelay   = time.Second
+	defaultQueueSize    = 1000
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 100 * time.Millisecond
+	publishTimeout      = 10 * time.Second
+)
+
+// Publisher is the interface for publishing messages to a Pub/Sub topic.
+// Publish should return an error that matches ErrPermanent if publishing
+// the messages again wouldn't help.
+type Publisher interface {
+	Publish(ctx context.Context, msgs [][]byte) error
+}
+
+// Event is the JSON event published for each completed traceroute.
+type Event struct {
+	UUID      string
+	RemoteIP  string
+	Timestamp time.Time
+	Cached    bool
+	FilePath  string `json:",omitempty"` // empty if the traceroute wasn't written
+}
+
+// Config contains configuration parameters of a sink.  Zero values
+// select the defaults.
+type Config struct {
+	BatchSize    int           // maximum number of events per publish call (default 100)
+	BatchDelay   time.Duration // maximum time an event waits for its batch to fill (default 1s)
+	QueueSize    int           // maximum number of queued events (default 1000)
+	MaxRetries   int           // maximum number of retries of a batch (default 3)
+	RetryBackoff time.Duration // delay before the first retry, doubled for each retry (default 100ms)
+}
+
+// Sink publishes the events of completed traceroutes.
+type Sink struct {
+	pub      Publisher
+	cfg      Config
+	queue    chan []byte
+	closedMu sync.RWMutex
+	closed   bool
+	done     chan struct{}
+}
+
+// New returns a new sink that publishes events with the given publisher
+// until it's closed.
+func New(pub Publisher, cfg Config) *Sink {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.BatchDelay <= 0 {
+		cfg.BatchDelay = defaultBatchDelay
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	s := &Sink{
+		pub:   pub,
+		cfg:   cfg,
+		queue: make(chan []byte, cfg.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// OnComplete queues the event of the given traceroute result.  It's
+// meant to be used as triggertrace.Config.OnComplete and never blocks.
+// Results of traceroutes that couldn't be obtained are ignored.
+func (s *Sink) OnComplete(result triggertrace.TraceResult) {
+	_ = s.enqueue(result)
+}
+
+// Write queues the event of the given traceroute result like OnComplete
+// so that the sink can be used as a triggertrace.Sink.  The payload
+// isn't published.  It returns ErrDropped if the event was dropped.
+func (s *Sink) Write(ctx context.Context, result triggertrace.TraceResult, payload []byte) error {
+	return s.enqueue(result)
+}
+
+// enqueue queues the event of the given traceroute result.
+func (s *Sink) enqueue(result triggertrace.TraceResult) error {
+	if result.Outcome == triggertrace.OutcomeError {
+		return nil
+	}
+	msg, err := json.Marshal(Event{
+		UUID:      result.UUID,
+		RemoteIP:  result.Destination.RemoteIP,
+		Timestamp: result.Time,
+		Cached:    result.Outcome == triggertrace.OutcomeCached,
+		FilePath:  result.FilePath,
+	})
+	if err != nil {
+		events.WithLabelValues("failed").Inc()
+		return err
+	}
+	s.closedMu.RLock()
+	defer s.closedMu.RUnlock()
+	if s.closed {
+		events.WithLabelValues("dropped").Inc()
+		return ErrDropped
+	}
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		events.WithLabelValues("dropped").Inc()
+		return ErrDropped
+	}
+}
+
+// Close publishes the queued events and stops the sink.  Events of
+// traceroutes that complete afterwards are dropped.
+func (s *Sink) Close() {
+	s.closedMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.closedMu.Unlock()
+	<-s.done
+}
+
+// run publishes queued events in batches until the queue is closed.
+func (s *Sink) run() {
+	defer close(s.done)
+	var batch [][]byte
+	var timeout <-chan time.Time
+	flush := func() {
+		if len(batch) > 0 {
+			s.publish(batch)
+		}
+		batch, timeout = nil, nil
+	}
+	for {
+		select {
+		case msg, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timeout = time.After(s.cfg.BatchDelay)
+			}
+			if len(batch) >= s.cfg.BatchSize {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+// publish publishes the given batch, retrying transient errors with
+// exponential backoff.
+func (s *Sink) publish(batch [][]byte) {
+	backoff := s.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err := s.pub.Publish(ctx, batch)
+		cancel()
+		if err == nil {
+			events.WithLabelValues("published").Add(float64(len(batch)))
+			return
+		}
+		if errors.Is(err, ErrPermanent) || attempt >= s.cfg.MaxRetries {
+			log.Printf("failed to publish %d traceroute events (error: %v)\n", len(batch), err)
+			events.WithLabelValues("failed").Add(float64(len(batch)))
+			return
+		}
+		publishRetries.Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
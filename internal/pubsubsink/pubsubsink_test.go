@@ -0,0 +1,196 @@
+package pubsubsink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/triggertrace"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakePublisher records the batches it publishes.  The first nFailures
+// calls fail with err.
+type fakePublisher struct {
+	mu        sync.Mutex
+	batches   [][][]byte
+	calls     int
+	nFailures int
+	err       error
+	block     chan struct{} // if not nil, Publish waits for it to be closed
+}
+
+func (fp *fakePublisher) Publish(ctx context.Context, msgs [][]byte) error {
+	if fp.block != nil {
+		<-fp.block
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.calls++
+	if fp.calls <= fp.nFailures {
+		return fp.err
+	}
+	fp.batches = append(fp.batches, msgs)
+	return nil
+}
+
+func (fp *fakePublisher) events(t *testing.T) []Event {
+	t.Helper()
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	var events []Event
+	for _, batch := range fp.batches {
+		for _, msg := range batch {
+			var e Event
+			if err := json.Unmarshal(msg, &e); err != nil {
+				t.Fatalf("failed to unmarshal event %q (error: %v)", msg, err)
+			}
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func result(i int, outcome string) triggertrace.TraceResult {
+	return triggertrace.TraceResult{
+		UUID:        fmt.Sprintf("uuid%d", i),
+		Destination: triggertrace.Destination{RemoteIP: fmt.Sprintf("10.0.0.%d", i)},
+		Outcome:     outcome,
+		FilePath:    fmt.Sprintf("/traces/uuid%d.jsonl", i),
+		Time:        time.Date(2021, time.December, 1, 0, 0, i, 0, time.UTC),
+	}
+}
+
+func TestOnComplete(t *testing.T) {
+	fp := &fakePublisher{}
+	s := New(fp, Config{BatchSize: 2, BatchDelay: time.Hour})
+	published := promtest.ToFloat64(events.WithLabelValues("published"))
+	outcomes := []string{triggertrace.OutcomeFresh, triggertrace.OutcomeCached, triggertrace.OutcomeError, triggertrace.OutcomeFresh, triggertrace.OutcomeCached}
+	for i, outcome := range outcomes {
+		s.OnComplete(result(i, outcome))
+	}
+	s.Close()
+
+	// One event per completed traceroute, published in batches of 2.
+	var want []Event
+	for i, outcome := range outcomes {
+		if outcome == triggertrace.OutcomeError {
+			continue
+		}
+		r := result(i, outcome)
+		want = append(want, Event{UUID: r.UUID, RemoteIP: r.Destination.RemoteIP, Timestamp: r.Time, Cached: outcome == triggertrace.OutcomeCached, FilePath: r.FilePath})
+	}
+	if got := fp.events(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %+v, want %+v", got, want)
+	}
+	if len(fp.batches) != 2 {
+		t.Errorf("got %d batches, want 2", len(fp.batches))
+	}
+	if n := promtest.ToFloat64(events.WithLabelValues("published")) - published; n != 4 {
+		t.Errorf("got %v published events, want 4", n)
+	}
+	// Events after Close are dropped.
+	dropped := promtest.ToFloat64(events.WithLabelValues("dropped"))
+	s.OnComplete(result(9, triggertrace.OutcomeFresh))
+	if n := promtest.ToFloat64(events.WithLabelValues("dropped")) - dropped; n != 1 {
+		t.Errorf("got %v dropped events, want 1", n)
+	}
+}
+
+func TestBatchDelay(t *testing.T) {
+	fp := &fakePublisher{}
+	s := New(fp, Config{BatchSize: 100, BatchDelay: 10 * time.Millisecond})
+	defer s.Close()
+	s.OnComplete(result(1, triggertrace.OutcomeFresh))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fp.events(t)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a partial batch to be published")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		nFailures   int
+		err         error
+		wantEvents  int
+		wantRetries float64
+	}{
+		{2, errors.New("transient error"), 1, 2},
+		{5, errors.New("transient error"), 0, 3},
+		{1, fmt.Errorf("%w: not found", ErrPermanent), 0, 0},
+	}
+	for i, test := range tests {
+		fp := &fakePublisher{nFailures: test.nFailures, err: test.err}
+		retries := promtest.ToFloat64(publishRetries)
+		failed := promtest.ToFloat64(events.WithLabelValues("failed"))
+		s := New(fp, Config{MaxRetries: 3, RetryBackoff: time.Millisecond})
+		s.OnComplete(result(1, triggertrace.OutcomeFresh))
+		s.Close()
+		if n := len(fp.events(t)); n != test.wantEvents {
+			t.Errorf("test %d: got %d events, want %d", i, n, test.wantEvents)
+		}
+		if n := promtest.ToFloat64(publishRetries) - retries; n != test.wantRetries {
+			t.Errorf("test %d: got %v retries, want %v", i, n, test.wantRetries)
+		}
+		if n := promtest.ToFloat64(events.WithLabelValues("failed")) - failed; n != float64(1-test.wantEvents) {
+			t.Errorf("test %d: got %v failed events, want %d", i, n, 1-test.wantEvents)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	// While Pub/Sub is unavailable, events that don't fit in the queue
+	// are dropped without blocking.
+	fp := &fakePublisher{block: make(chan struct{})}
+	s := New(fp, Config{BatchSize: 1, QueueSize: 2})
+	dropped := promtest.ToFloat64(events.WithLabelValues("dropped"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			s.OnComplete(result(i, triggertrace.OutcomeFresh))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnComplete() blocked")
+	}
+	close(fp.block)
+	s.Close()
+	// One event is being published and two are queued.
+	got := len(fp.events(t))
+	if got < 2 || got > 3 {
+		t.Errorf("got %d events, want 2 or 3", got)
+	}
+	if n := promtest.ToFloat64(events.WithLabelValues("dropped")) - dropped; int(n) != 10-got {
+		t.Errorf("got %v dropped events, want %d", n, 10-got)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var _ triggertrace.Sink = &Sink{}
+	fp := &fakePublisher{}
+	s := New(fp, Config{BatchSize: 1})
+	if err := s.Write(context.TODO(), result(1, triggertrace.OutcomeFresh), []byte("trace")); err != nil {
+		t.Errorf("Write() = %v, want nil", err)
+	}
+	if err := s.Write(context.TODO(), result(2, triggertrace.OutcomeError), nil); err != nil {
+		t.Errorf("Write() = %v, want nil", err)
+	}
+	s.Close()
+	if err := s.Write(context.TODO(), result(3, triggertrace.OutcomeFresh), []byte("trace")); !errors.Is(err, ErrDropped) {
+		t.Errorf("Write() = %v, want %v", err, ErrDropped)
+	}
+	if got := fp.events(t); len(got) != 1 || got[0].UUID != "uuid1" {
+		t.Errorf("got events %+v, want uuid1 only", got)
+	}
+}
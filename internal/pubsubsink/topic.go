@@ -0,0 +1,51 @@
+package pubsubsink
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// TopicPublisher is a Publisher that publishes messages to a Google
+// Cloud Pub/Sub topic.
+type TopicPublisher struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+// NewTopicPublisher returns a publisher to the given topic of the given
+// Google Cloud project.
+func NewTopicPublisher(ctx context.Context, project, topic string) (*TopicPublisher, error) {
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client (error: %w)", err)
+	}
+	return &TopicPublisher{client: client, topic: client.Topic(topic)}, nil
+}
+
+// Publish publishes the given messages and waits for the server to
+// acknowledge them.  The Pub/Sub client batches them as it sees fit
+// and already retries transient failures, so its errors match
+// ErrPermanent unless ctx is done.
+func (tp *TopicPublisher) Publish(ctx context.Context, msgs [][]byte) error {
+	results := make([]*pubsub.PublishResult, len(msgs))
+	for i, msg := range msgs {
+		results[i] = tp.topic.Publish(ctx, &pubsub.Message{Data: msg})
+	}
+	for _, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrPermanent, err)
+		}
+	}
+	return nil
+}
+
+// Close flushes the messages being published and releases the client.
+func (tp *TopicPublisher) Close() error {
+	tp.topic.Stop()
+	return tp.client.Close()
+}
@@ -0,0 +1,113 @@
+// Package reopen provides a file writer that can close and reopen its
+// underlying file on demand.  This allows external log rotation tools
+// to move a file out of the way and then signal traceroute-caller
+// (typically with SIGHUP) to resume writing to a fresh file at the
+// original path.  Files can also rotate themselves, optionally
+// compressing rotated backups, so that no external tool is needed.
+package reopen
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reopener is the interface implemented by writers that can reopen
+// their underlying targets.
+type Reopener interface {
+	Reopen() error
+}
+
+// File is an append-only file writer that is safe for concurrent use
+// and can be reopened.
+type File struct {
+	path   string
+	perm   os.FileMode
+	rot    Rotation
+	file   *os.File
+	size   int64     // size of the open file
+	opened time.Time // time the file was opened
+	fileMu sync.Mutex
+
+	archiving sync.WaitGroup // backups being compressed and pruned
+	archiveMu sync.Mutex     // serializes archiving of backups
+}
+
+// Open opens (or creates) the file at the given path for appending and
+// returns a new File.
+func Open(path string, perm os.FileMode) (*File, error) {
+	f := &File{
+		path: path,
+		perm: perm,
+	}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write writes p to the currently open file, rotating it first if
+// needed.
+func (f *File) Write(p []byte) (int, error) {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	// A failed rotation doesn't fail the write as long as there's
+	// still a file to write to.
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return 0, err
+			}
+			log.Printf("%v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the currently open file (if any) and opens the file at
+// the original path.  If the file has been moved or removed, a new file
+// is created.
+func (f *File) Reopen() error {
+	newFile, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return fmt.Errorf("failed to open %q (error: %v)", f.path, err)
+	}
+	var size int64
+	if fi, err := newFile.Stat(); err == nil {
+		size = fi.Size()
+	}
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	oldFile := f.file
+	f.file, f.size, f.opened = newFile, size, time.Now()
+	if oldFile != nil {
+		return oldFile.Close()
+	}
+	return nil
+}
+
+// Close closes the currently open file and waits for rotated backups
+// to be archived.
+func (f *File) Close() error {
+	defer f.archiving.Wait()
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Name returns the path of the file.
+func (f *File) Name() string {
+	return f.path
+}
@@ -0,0 +1,207 @@
+package reopen_test
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/reopen"
+)
+
+func TestOpen(t *testing.T) {
+	if _, err := reopen.Open("/non-existent/dir/file.log", 0644); err == nil {
+		t.Error("Open() = nil, want error")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReopen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.log")
+	f, err := reopen.Open(path, 0644)
+	if err != nil {
+		t.Fatalf("Open() = %v, want nil", err)
+	}
+	if f.Name() != path {
+		t.Errorf("Name() = %q, want %q", f.Name(), path)
+	}
+	if _, err := f.Write([]byte("before\n")); err != nil {
+		t.Fatalf("Write() = %v, want nil", err)
+	}
+
+	// Emulate an external rotation tool.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("Reopen() = %v, want nil", err)
+	}
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write() = %v, want nil", err)
+	}
+	for file, want := range map[string]string{rotated: "before\n", path: "after\n"} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("ReadFile(%q) = %q, want %q", file, b, want)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	if _, err := f.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	for _, rot := range []reopen.Rotation{{MaxSize: -1}, {MaxAge: -time.Second}, {MaxBackups: -1}} {
+		if _, err := reopen.OpenRotating(filepath.Join(t.TempDir(), "file.log"), 0644, rot); err == nil {
+			t.Errorf("OpenRotating(%+v) = nil, want error", rot)
+		}
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.jsonl")
+	// Files that aren't backups are never pruned.
+	others := []string{path + ".tmp", path + ".lock", path + ".0.gz"}
+	for _, other := range others {
+		if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := reopen.OpenRotating(path, 0644, reopen.Rotation{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("OpenRotating() = %v, want nil", err)
+	}
+	// Each write but the first one goes past the size threshold and
+	// rotates the file.  Only the two most recent backups are kept.
+	lines := []string{"line1\n", "line2\n", "line3\n", "line4\n"}
+	for _, line := range lines {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() = %v, want nil", err)
+		}
+	}
+	// Backups are archived in the background until the file is closed.
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "line4\n" {
+		t.Errorf("ReadFile(%q) = %q, want %q", path, b, "line4\n")
+	}
+	backups, err := reopen.Backups(path)
+	if err != nil {
+		t.Fatalf("Backups() = %v, want nil", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got backups %v, want 2", backups)
+	}
+	for i, backup := range backups {
+		if got, want := gunzip(t, backup), lines[i+1]; got != want {
+			t.Errorf("backup %s = %q, want %q", backup, got, want)
+		}
+	}
+	if uncompressed, _ := filepath.Glob(filepath.Join(dir, "index.jsonl.*Z")); len(uncompressed) != 0 {
+		t.Errorf("got uncompressed backups %v, want none", uncompressed)
+	}
+	for _, other := range others {
+		if _, err := os.Stat(other); err != nil {
+			t.Errorf("Stat(%q) = %v, want nil", other, err)
+		}
+	}
+}
+
+func TestRotateArchiveError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.log")
+	// A non-empty directory named like an older backup can't be
+	// pruned.
+	if err := os.MkdirAll(filepath.Join(path+".20000101T000000.000000000Z", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := reopen.OpenRotating(path, 0644, reopen.Rotation{MaxSize: 1, MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("OpenRotating() = %v, want nil", err)
+	}
+	for _, line := range []string{"old\n", "new\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() = %v, want nil", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new\n" {
+		t.Errorf("ReadFile(%q) = %q, want %q", path, b, "new\n")
+	}
+}
+
+func TestRotateMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.log")
+	f, err := reopen.OpenRotating(path, 0644, reopen.Rotation{MaxAge: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenRotating() = %v, want nil", err)
+	}
+	defer f.Close()
+	for _, line := range []string{"old\n", "new\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() = %v, want nil", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "file.log.*"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("got backups %v (error: %v), want 1", backups, err)
+	}
+	for file, want := range map[string]string{backups[0]: "old\n", path: "new\n"} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("ReadFile(%q) = %q, want %q", file, b, want)
+		}
+	}
+}
+
+// gunzip returns the uncompressed content of the named gzip file.
+func gunzip(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return string(b)
+}
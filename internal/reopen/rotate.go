@@ -0,0 +1,176 @@
+package reopen
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat is the format of the time in the names of rotated
+// backups.  Backup names sort chronologically.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// Rotation configures how a File rotates its file by itself, without
+// an external rotation tool.  The zero value disables rotation.
+type Rotation struct {
+	MaxSize    int64         // rotate before the file exceeds this many bytes (0 disables size-based rotation)
+	MaxAge     time.Duration // rotate once the file has been written to for this long (0 disables time-based rotation)
+	MaxBackups int           // number of rotated backups to keep (0 keeps all of them)
+	Compress   bool          // compress rotated backups with gzip
+}
+
+// Validate returns an error if the configuration is invalid.
+func (r Rotation) Validate() error {
+	if r.MaxSize < 0 || r.MaxAge < 0 || r.MaxBackups < 0 {
+		return fmt.Errorf("invalid rotation configuration: %+v", r)
+	}
+	return nil
+}
+
+// enabled returns true if the file is rotated at all.
+func (r Rotation) enabled() bool {
+	return r.MaxSize > 0 || r.MaxAge > 0
+}
+
+// OpenRotating is like Open but the returned File also rotates its file
+// according to the given configuration.  Rotated backups are in the
+// same directory, named after the file with the rotation time appended
+// (e.g., index.jsonl.20211201T120000.000000000Z.gz) so that they don't
+// look like files of the original type.
+func OpenRotating(path string, perm os.FileMode, rot Rotation) (*File, error) {
+	if err := rot.Validate(); err != nil {
+		return nil, err
+	}
+	f := &File{
+		path: path,
+		perm: perm,
+		rot:  rot,
+	}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// shouldRotate returns true if the file has to be rotated before n more
+// bytes are written to it.  Empty files are never rotated.
+func (f *File) shouldRotate(n int) bool {
+	if f.size == 0 || !f.rot.enabled() {
+		return false
+	}
+	return (f.rot.MaxSize > 0 && f.size+int64(n) > f.rot.MaxSize) ||
+		(f.rot.MaxAge > 0 && time.Since(f.opened) >= f.rot.MaxAge)
+}
+
+// rotate moves the current file to a backup and opens a new file at the
+// original path.  The backup is then compressed and the backups pruned
+// in the background so that writers aren't blocked.  It must be called
+// with fileMu held.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	backup := f.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	renameErr := os.Rename(f.path, backup)
+	newFile, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return fmt.Errorf("failed to open %q (error: %v)", f.path, err)
+	}
+	f.file, f.size, f.opened = newFile, 0, time.Now()
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate %q (error: %v)", f.path, renameErr)
+	}
+	f.archiving.Add(1)
+	go f.archive(backup)
+	return nil
+}
+
+// archive compresses the given backup (if configured) and prunes the
+// backups.  Errors are only logged because the rotation itself has
+// already succeeded.
+func (f *File) archive(backup string) {
+	defer f.archiving.Done()
+	// Backups are archived one at a time so that pruning never
+	// removes a backup that's being compressed.
+	f.archiveMu.Lock()
+	defer f.archiveMu.Unlock()
+	if f.rot.Compress {
+		if err := compress(backup, f.perm); err != nil {
+			log.Printf("failed to archive %q (error: %v)\n", backup, err)
+		}
+	}
+	if err := f.prune(); err != nil {
+		log.Printf("failed to prune backups of %q (error: %v)\n", f.path, err)
+	}
+}
+
+// prune removes the oldest backups beyond the maximum number of backups.
+func (f *File) prune() error {
+	if f.rot.MaxBackups == 0 {
+		return nil
+	}
+	backups, err := Backups(f.path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.rot.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the rotated backups of the file at the given path,
+// oldest first.  Only files named like backups (see OpenRotating) are
+// returned, whether or not they're compressed.
+func Backups(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// compress replaces the named file with a gzip-compressed copy with the
+// .gz extension.
+func compress(path string, perm os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return fmt.Errorf("failed to compress %q (error: %v)", path, err)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,146 @@
+// Package schema generates JSON Schemas of the output formats of
+// traceroute-caller from their Go types so that the schemas are always
+// in sync with the output.
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Draft is the JSON Schema draft that generated schemas conform to.
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// Schema is a JSON Schema.
+type Schema map[string]interface{}
+
+// Document returns a JSON Schema document with a definition for each of
+// the given values' types, keyed by name.
+func Document(defs map[string]interface{}) Schema {
+	definitions := make(map[string]Schema, len(defs))
+	for name, v := range defs {
+		definitions[name] = Generate(v)
+	}
+	return Schema{
+		"$schema":     Draft,
+		"definitions": definitions,
+	}
+}
+
+// Generate returns the JSON Schema of the JSON encoding of v's type.
+// Struct fields follow encoding/json's rules: they're named by their
+// json tags, fields tagged "-" and unexported fields are left out, and
+// only fields without omitempty are required.
+func Generate(v interface{}) Schema {
+	return generate(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+// generate returns the schema of t.  Types being generated are tracked
+// in seen so that recursive types don't recurse forever.
+func generate(t reflect.Type, seen map[reflect.Type]bool) Schema {
+	if t == nil {
+		return Schema{}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType):
+		// Custom encodings can be anything.
+		return Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Byte slices are base64 encoded.
+			return Schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return Schema{"type": "array", "items": generate(t.Elem(), seen)}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": generate(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return Schema{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		return generateStruct(t, seen)
+	}
+	return Schema{}
+}
+
+// generateStruct returns the schema of struct type t.
+func generateStruct(t reflect.Type, seen map[reflect.Type]bool) Schema {
+	properties := Schema{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name, opts := parseTag(f.Tag.Get("json"))
+		if name == "-" && opts == "" {
+			continue
+		}
+		// Untagged embedded structs have their fields promoted.
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded := generate(ft, seen)
+				if props, ok := embedded["properties"].(Schema); ok {
+					for k, v := range props {
+						properties[k] = v
+					}
+				}
+				if req, ok := embedded["required"].([]string); ok {
+					required = append(required, req...)
+				}
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = generate(f.Type, seen)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			required = append(required, name)
+		}
+	}
+	return Schema{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// parseTag splits a json struct tag into its name and options.
+func parseTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i != -1 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
@@ -0,0 +1,120 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/hopannotation"
+	"github.com/m-lab/traceroute-caller/internal/schema"
+	"github.com/m-lab/traceroute-caller/tracer"
+)
+
+type inner struct {
+	Value float64
+}
+
+type recursive struct {
+	Name     string
+	Children []recursive
+}
+
+type sample struct {
+	inner
+	Count     int
+	Optional  string `json:",omitempty"`
+	Renamed   bool   `json:"renamed"`
+	Ignored   string `json:"-"`
+	Time      time.Time
+	Bytes     []byte
+	Labels    map[string]string
+	Recursive *recursive
+	private   int
+}
+
+func TestGenerate(t *testing.T) {
+	got := schema.Generate(sample{})
+	// Round trip through JSON to compare plain values.
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	props := s["properties"].(map[string]interface{})
+	want := map[string]string{
+		"Value":     "number",
+		"Count":     "integer",
+		"Optional":  "string",
+		"renamed":   "boolean",
+		"Time":      "string",
+		"Bytes":     "string",
+		"Labels":    "object",
+		"Recursive": "object",
+	}
+	if len(props) != len(want) {
+		t.Errorf("got %d properties, want %d: %v", len(props), len(want), props)
+	}
+	for name, typ := range want {
+		p, ok := props[name].(map[string]interface{})
+		if !ok {
+			t.Errorf("property %q is missing", name)
+			continue
+		}
+		if p["type"] != typ {
+			t.Errorf("property %q has type %v, want %v", name, p["type"], typ)
+		}
+	}
+	required := map[string]bool{}
+	for _, r := range s["required"].([]interface{}) {
+		required[r.(string)] = true
+	}
+	if required["Optional"] || !required["Count"] || !required["Value"] {
+		t.Errorf("required = %v, want all properties except Optional", s["required"])
+	}
+}
+
+func TestDocument(t *testing.T) {
+	doc := schema.Document(map[string]interface{}{
+		"Metadata":       tracer.Metadata{},
+		"HopAnnotation1": hopannotation.HopAnnotation1{},
+	})
+	if doc["$schema"] != schema.Draft {
+		t.Errorf("$schema = %v, want %v", doc["$schema"], schema.Draft)
+	}
+	defs := doc["definitions"].(map[string]schema.Schema)
+	tests := []struct {
+		def    string
+		fields []string
+	}{
+		{"Metadata", []string{"UUID", "TracerouteCallerVersion", "CachedResult", "CachedUUID", "TracerLabel"}},
+		{"HopAnnotation1", []string{"ID", "Timestamp", "Annotations", "RTT"}},
+	}
+	for _, test := range tests {
+		props := defs[test.def]["properties"].(schema.Schema)
+		var got []string
+		for _, field := range test.fields {
+			if _, ok := props[field]; ok {
+				got = append(got, field)
+			}
+		}
+		if !reflect.DeepEqual(got, test.fields) {
+			t.Errorf("%s has fields %v, want %v", test.def, got, test.fields)
+		}
+	}
+	// Hops without replies have no RTT.
+	for _, field := range defs["HopAnnotation1"]["required"].([]string) {
+		if field == "RTT" {
+			t.Errorf("HopAnnotation1 requires RTT: %v", defs["HopAnnotation1"]["required"])
+		}
+	}
+	// Nested annotator types are described too.
+	annotations := defs["HopAnnotation1"]["properties"].(schema.Schema)["Annotations"].(schema.Schema)
+	geo := annotations["properties"].(schema.Schema)["Geo"].(schema.Schema)
+	if _, ok := geo["properties"].(schema.Schema)["City"]; !ok {
+		t.Errorf("Annotations.Geo has no City: %v", geo)
+	}
+}
@@ -0,0 +1,133 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Circuit breaker states.  The values are exported by the breaker state
+// gauge.
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+var (
+	// ErrBreakerOpen means a traceroute was not run because the
+	// circuit breaker is open.
+	ErrBreakerOpen = fmt.Errorf("%w: circuit breaker is open", ipcache.ErrNotTraced)
+
+	breakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "triggertrace_breaker_state",
+			Help: "The state of the traceroute circuit breaker (0: closed, 1: open, 2: half-open)",
+		},
+		[]string{"tracer"},
+	)
+)
+
+// breaker is a traceroute tool that wraps another traceroute tool and
+// stops running traceroutes after too many consecutive failures.
+// After a cooldown period, it lets a single traceroute through to test
+// whether the wrapped tool has recovered.
+type breaker struct {
+	ipcache.Tracer
+	label     string
+	failures  int           // consecutive failures that open the breaker
+	window    time.Duration // period in which the failures must happen
+	cooldown  time.Duration // time the breaker stays open
+	now       func() time.Time
+	mu        sync.Mutex
+	state     int
+	nFailures int       // number of consecutive failures
+	firstFail time.Time // time of the first of the consecutive failures
+	openedAt  time.Time // time the breaker was last opened
+}
+
+// newBreaker returns a new circuit breaker that wraps the given
+// traceroute tool.
+func newBreaker(tracetool ipcache.Tracer, label string, failures int, window, cooldown time.Duration) *breaker {
+	breakerState.WithLabelValues(label).Set(breakerClosed)
+	return &breaker{
+		Tracer:   tracetool,
+		label:    label,
+		failures: failures,
+		window:   window,
+		cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+// TraceContext runs a traceroute with the wrapped traceroute tool unless
+// the breaker is open, in which case it returns ErrBreakerOpen.
+func (b *breaker) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	if !b.allow() {
+		tracesSkipped.WithLabelValues("breaker_open").Inc()
+		return nil, ErrBreakerOpen
+	}
+	data, err := b.Tracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+	b.record(err)
+	return data, err
+}
+
+// allow returns true if a traceroute can be run.  When the cooldown
+// period of an open breaker has passed, it returns true once and moves
+// the breaker to the half-open state.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	}
+	// A traceroute is already testing recovery.
+	return false
+}
+
+// record updates the state of the breaker based on the outcome of a
+// traceroute.  All errors, including killed traceroutes, count as
+// failures.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if err == nil {
+		b.nFailures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	if b.state == breakerHalfOpen {
+		b.openedAt = now
+		b.setState(breakerOpen)
+		return
+	}
+	if b.nFailures == 0 || now.Sub(b.firstFail) > b.window {
+		b.nFailures = 0
+		b.firstFail = now
+	}
+	b.nFailures++
+	if b.state == breakerClosed && b.nFailures >= b.failures {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// setState sets the state of the breaker and its gauge.  It must be
+// called with b.mu held.
+func (b *breaker) setState(state int) {
+	b.state = state
+	breakerState.WithLabelValues(b.label).Set(float64(state))
+}
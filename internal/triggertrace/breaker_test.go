@@ -0,0 +1,135 @@
+package triggertrace
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2021, time.October, 1, 12, 0, 0, 0, time.UTC)
+	tracer := &fakeTracer{}
+	b := newBreaker(tracer, "test", 3, time.Minute, 5*time.Minute)
+	b.now = func() time.Time { return now }
+
+	trace := func(ip string) error {
+		_, err := b.TraceContext(context.TODO(), ip, "1", "", now)
+		return err
+	}
+	wantState := func(want float64) {
+		t.Helper()
+		if got := promtest.ToFloat64(breakerState.WithLabelValues("test")); got != want {
+			t.Fatalf("breaker state = %v, want %v", got, want)
+		}
+	}
+
+	// Failures outside of the window don't open the breaker.
+	for i := 0; i < 4; i++ {
+		if err := trace(forceTracerouteErr); err == nil || errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("TraceContext() = %v, want forced error", err)
+		}
+		now = now.Add(40 * time.Second)
+	}
+	wantState(breakerClosed)
+	// A success resets the consecutive failures.
+	if err := trace("3.4.5.6"); err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+
+	// Consecutive failures within the window open the breaker.
+	for i := 0; i < 3; i++ {
+		if err := trace(forceTracerouteErr); errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("TraceContext() = %v, want forced error", err)
+		}
+	}
+	wantState(breakerOpen)
+	skipped := promtest.ToFloat64(tracesSkipped.WithLabelValues("breaker_open"))
+	nTraces := tracer.Traces()
+	if err := trace("3.4.5.6"); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("TraceContext() = %v, want %v", err, ErrBreakerOpen)
+	}
+	if n := tracer.Traces(); n != nTraces {
+		t.Fatalf("tracer.Traces() = %d, want %d", n, nTraces)
+	}
+	if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("breaker_open")) - skipped; n != 1 {
+		t.Fatalf("got %v breaker_open skips, want 1", n)
+	}
+
+	// After the cooldown, a failed trial reopens the breaker.
+	now = now.Add(5 * time.Minute)
+	if !b.allow() {
+		t.Fatal("allow() = false, want true")
+	}
+	wantState(breakerHalfOpen)
+	if b.allow() {
+		t.Fatal("allow() = true during trial, want false")
+	}
+	b.record(errors.New("killed"))
+	wantState(breakerOpen)
+	if err := trace("3.4.5.6"); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("TraceContext() = %v, want %v", err, ErrBreakerOpen)
+	}
+
+	// After the cooldown, a successful trial closes the breaker.
+	now = now.Add(5 * time.Minute)
+	if err := trace("3.4.5.6"); err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+	wantState(breakerClosed)
+	if err := trace("3.4.5.6"); err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+}
+
+func TestNewHandlerBreaker(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	for _, hCfg := range []Config{
+		{BreakerFailures: -1},
+		{BreakerFailures: 3, BreakerCooldown: time.Minute},
+		{BreakerFailures: 3, BreakerWindow: time.Minute},
+	} {
+		if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", hCfg); err == nil {
+			t.Errorf("NewHandler(%+v) = nil, want error", hCfg)
+		}
+	}
+	hCfg := Config{BreakerFailures: 3, BreakerWindow: time.Minute, BreakerCooldown: time.Minute}
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", hCfg); err != nil {
+		t.Errorf("NewHandler() = %v, want nil", err)
+	}
+}
+
+func TestSkippedTracesNotCached(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	open := newBreaker(&fakeTracer{}, "test-cache", 1, time.Minute, time.Hour)
+	open.TraceContext(ctx, forceTracerouteErr, "1", "", time.Now())
+	exhausted := &budgetTracer{Tracer: &fakeTracer{}, budget: &probeBudget{limit: 1, used: 1, day: timeNow().UTC().Truncate(24 * time.Hour)}}
+	tests := []struct {
+		tracetool ipcache.Tracer
+		wantErr   error
+	}{
+		{open, ErrBreakerOpen},
+		{exhausted, ErrProbeBudget},
+	}
+	for _, test := range tests {
+		// Traceroutes that weren't run don't hold the destination
+		// back once the breaker closes or the budget resets.
+		ipCache, err := ipcache.New(ctx, test.tracetool, ipcache.Config{EntryTimeout: time.Minute, ScanPeriod: time.Hour, NegativeTTL: time.Minute})
+		if err != nil {
+			t.Fatalf("ipcache.New() = %v, want nil", err)
+		}
+		if _, err := ipCache.FetchTrace(ctx, "3.4.5.6", "1"); !errors.Is(err, test.wantErr) || !errors.Is(err, ipcache.ErrNotTraced) {
+			t.Fatalf("FetchTrace() = %v, want %v", err, test.wantErr)
+		}
+		if n := ipCache.NumEntries(); n != 0 {
+			t.Errorf("%v: got %d cache entries, want 0", test.wantErr, n)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package triggertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/m-lab/traceroute-caller/tracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrProbeBudget means a traceroute was not run because the daily
+	// probe budget has been exhausted.
+	ErrProbeBudget = fmt.Errorf("%w: daily probe budget exhausted", ipcache.ErrNotTraced)
+
+	probesUsed = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "triggertrace_probes_used",
+			Help: "The number of probes sent by traceroutes since midnight UTC",
+		},
+	)
+
+	// Variables to aid in black-box testing.
+	timeNow = time.Now
+)
+
+// defaultProbeEstimate is the number of probes charged to traceroutes
+// that don't report how many probes they sent until a traceroute does.
+const defaultProbeEstimate = 100
+
+// probeBudget keeps track of the number of probes sent by traceroutes
+// during the current UTC day.
+type probeBudget struct {
+	limit     int
+	mu        sync.Mutex
+	day       time.Time // midnight UTC of the current day
+	used      int
+	maxProbes int // the largest number of probes reported by a traceroute
+	parser    ParseTracer
+}
+
+// exhausted returns true if the budget of the current day has been used
+// up.  It resets the budget when the day rolls over.
+func (pb *probeBudget) exhausted() bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.rollover()
+	return pb.used >= pb.limit
+}
+
+// charge adds the number of probes sent by the given traceroute, which
+// failed with traceErr if not nil, to the budget of the current day.
+// Traceroutes that failed or timed out may have sent probes without
+// reporting how many, so they are conservatively charged the largest
+// number of probes reported by a traceroute so far (or
+// defaultProbeEstimate if none has).  Traceroutes that weren't run or
+// started aren't charged.
+func (pb *probeBudget) charge(rawData []byte, traceErr error) {
+	if errors.Is(traceErr, ipcache.ErrNotTraced) || errors.Is(traceErr, tracer.ErrTraceNotStarted) {
+		return
+	}
+	probes, ok := pb.probes(rawData)
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	switch {
+	case ok && probes > pb.maxProbes:
+		pb.maxProbes = probes
+	case !ok && pb.maxProbes > 0:
+		probes = pb.maxProbes
+	case !ok:
+		probes = defaultProbeEstimate
+	}
+	pb.rollover()
+	pb.used += probes
+	probesUsed.Set(float64(pb.used))
+}
+
+// probes returns the number of probes sent by the given traceroute and
+// false if it's unknown.
+func (pb *probeBudget) probes(rawData []byte) (int, bool) {
+	parsedData, err := pb.parser.ParseRawData(rawData)
+	if err != nil {
+		return 0, false
+	}
+	pc, ok := parsedData.(parser.ProbeCounter)
+	if !ok {
+		return 0, false
+	}
+	return pc.ProbeCount(), true
+}
+
+// rollover resets the budget if the UTC day has changed.  It must be
+// called with pb.mu held.
+func (pb *probeBudget) rollover() {
+	day := timeNow().UTC().Truncate(24 * time.Hour)
+	if !day.Equal(pb.day) {
+		pb.day = day
+		pb.used = 0
+		probesUsed.Set(0)
+	}
+}
+
+// budgetTracer is a traceroute tool that wraps another traceroute tool
+// and doesn't run traceroutes once the probe budget is exhausted.
+// Cached traceroutes don't send probes so they are not affected.
+// Traceroutes that are already running when the budget is exhausted
+// are not stopped so the budget can be exceeded slightly.
+type budgetTracer struct {
+	ipcache.Tracer
+	budget *probeBudget
+}
+
+// TraceContext runs a traceroute with the wrapped traceroute tool unless
+// the probe budget is exhausted, in which case it returns ErrProbeBudget.
+func (bt *budgetTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	if bt.budget.exhausted() {
+		tracesSkipped.WithLabelValues("probe_budget").Inc()
+		return nil, ErrProbeBudget
+	}
+	data, err := bt.Tracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+	bt.budget.charge(data, err)
+	return data, err
+}
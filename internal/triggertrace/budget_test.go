@@ -0,0 +1,107 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/m-lab/traceroute-caller/tracer"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDailyProbeBudget(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+	now := time.Date(2021, time.October, 1, 23, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{DailyProbeBudget: -1}); err == nil {
+		t.Fatalf("NewHandler() = nil, want error")
+	}
+
+	// The traceroute in ./testdata/valid.jsonl sent 71 probes.
+	tracer := &fakeTracer{}
+	handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", Config{DailyProbeBudget: 100})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	skipped := promtest.ToFloat64(tracesSkipped.WithLabelValues("probe_budget"))
+	tests := []struct {
+		ip          string
+		nextDay     bool
+		wantTraces  int32
+		wantCached  int32
+		wantSkipped float64
+		wantUsed    float64
+	}{
+		{"1.1.1.1", false, 1, 0, 0, 71},
+		{"2.2.2.2", false, 2, 0, 0, 142}, // the budget wasn't exhausted before this traceroute
+		{"3.3.3.3", false, 2, 0, 1, 142}, // the budget is exhausted
+		{"1.1.1.1", false, 2, 1, 1, 142}, // cached traceroutes are still written
+		{"4.4.4.4", true, 3, 1, 1, 71},   // a new day resets the budget
+	}
+	for i, test := range tests {
+		if test.nextDay {
+			now = now.Add(2 * time.Hour)
+		}
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.ip})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+		if n := tracer.Traces(); n != test.wantTraces {
+			t.Errorf("%d: tracer.Traces() = %d, want %d", i, n, test.wantTraces)
+		}
+		if n := tracer.TracesCached(); n != test.wantCached {
+			t.Errorf("%d: tracer.TracesCached() = %d, want %d", i, n, test.wantCached)
+		}
+		if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("probe_budget")) - skipped; n != test.wantSkipped {
+			t.Errorf("%d: got %v skipped traceroutes, want %v", i, n, test.wantSkipped)
+		}
+		if n := promtest.ToFloat64(probesUsed); n != test.wantUsed {
+			t.Errorf("%d: got %v probes used, want %v", i, n, test.wantUsed)
+		}
+	}
+}
+
+func TestProbeBudgetFailures(t *testing.T) {
+	now := time.Date(2021, time.October, 1, 23, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	newParser, err := parser.New("mda")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The traceroute in ./testdata/valid.jsonl sent 71 probes.
+	budget := &probeBudget{limit: 1000, parser: newParser}
+	bt := &budgetTracer{Tracer: &fakeTracer{}, budget: budget}
+	tests := []struct {
+		ip       string
+		wantUsed int
+	}{
+		{forceTracerouteErr, defaultProbeEstimate}, // no traceroute reported its probes yet
+		{"1.1.1.1", defaultProbeEstimate + 71},
+		{forceTracerouteErr, defaultProbeEstimate + 142}, // the largest number of probes so far
+		{forceParseErr, defaultProbeEstimate + 213},      // the number of probes is unknown
+	}
+	for i, test := range tests {
+		bt.TraceContext(context.TODO(), test.ip, "1", "uuid", now)
+		if budget.used != test.wantUsed {
+			t.Errorf("%d: got %d probes used, want %d", i, budget.used, test.wantUsed)
+		}
+	}
+	// Traceroutes that weren't run or started didn't send probes.
+	for _, err := range []error{ipcache.ErrNotTraced, ErrProbeBudget, tracer.ErrTraceNotStarted} {
+		budget.charge(nil, err)
+	}
+	if want := defaultProbeEstimate + 213; budget.used != want {
+		t.Errorf("got %d probes used, want %d", budget.used, want)
+	}
+}
@@ -0,0 +1,169 @@
+package triggertrace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/tracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultDeadLetterMaxBytes is the default maximum size of the
+// dead-letter directory.
+const defaultDeadLetterMaxBytes = 64 << 20
+
+var deadLettersTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "triggertrace_dead_letters_total",
+		Help: "The number of traceroutes that failed parsing or hop extraction by stage and whether they were written to the dead-letter directory",
+	},
+	[]string{"stage", "result"},
+)
+
+// errNoHops is the error of dead letters of traceroutes whose hops
+// couldn't be extracted.
+var errNoHops = errors.New("failed to extract hops")
+
+// deadLetter is the first line of a dead-letter file.  The raw output
+// of the traceroute tool follows it unchanged.
+type deadLetter struct {
+	UUID     string
+	RemoteIP string
+	Stage    string // "parse" or "extract"
+	Error    string
+	Time     time.Time
+}
+
+// deadLetters writes the traceroutes that couldn't be parsed or whose
+// hops couldn't be extracted to a directory for later inspection (e.g.,
+// to diagnose scamper version or parser bugs).  The oldest files are
+// removed so that the directory stays within its maximum size.
+type deadLetters struct {
+	dir string
+	max int64      // maximum size in bytes of the files in dir
+	mu  sync.Mutex // serializes writes and removals
+}
+
+// newDeadLetters returns a deadLetters that writes to dir, which is
+// created if needed, and keeps it within max bytes (the default if
+// zero).
+func newDeadLetters(dir string, max int64) (*deadLetters, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("%d: invalid maximum dead-letter directory size", max)
+	}
+	if max == 0 {
+		max = defaultDeadLetterMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+	return &deadLetters{dir: dir, max: max}, nil
+}
+
+// deadLetter writes the raw output of the traceroute with the given UUID
+// to remoteIP that failed at the given stage with cause to the
+// dead-letter directory (if any) unless it's a cached traceroute.
+func (h *Handler) deadLetter(cached bool, uuid, remoteIP, stage string, cause error, rawData []byte) {
+	if h.deadLetters == nil || cached {
+		return
+	}
+	h.deadLetters.write(uuid, remoteIP, stage, cause, rawData)
+}
+
+// write writes the raw output of the traceroute with the given UUID to
+// remoteIP that failed at the given stage with cause.  Successful writes
+// are metered with an exemplar carrying the UUID so that they can be
+// found from the metrics.  Failures are metered and logged.
+func (dl *deadLetters) write(uuid, remoteIP, stage string, cause error, rawData []byte) {
+	now := time.Now().UTC()
+	header, _ := json.Marshal(deadLetter{
+		UUID:     uuid,
+		RemoteIP: remoteIP,
+		Stage:    stage,
+		Error:    cause.Error(),
+		Time:     now,
+	})
+	letter := append(append(header, '\n'), rawData...)
+	if int64(len(letter)) > dl.max {
+		deadLettersTotal.WithLabelValues(stage, "too_large").Inc()
+		log.Printf("not writing dead letter of %q (%d bytes, max: %d)\n", uuid, len(letter), dl.max)
+		return
+	}
+	name := uuid
+	if tracer.ValidateUUID(name) != nil {
+		name = "unknown"
+	}
+	filename := filepath.Join(dl.dir, fmt.Sprintf("%s_%s_%s.txt", now.Format("20060102T150405.000000000Z"), name, stage))
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if err := ioutil.WriteFile(filename, letter, 0644); err != nil {
+		deadLettersTotal.WithLabelValues(stage, "error").Inc()
+		log.Printf("failed to write dead letter %q (error: %v)\n", filename, err)
+		return
+	}
+	c := deadLettersTotal.WithLabelValues(stage, "written")
+	if ea, ok := c.(prometheus.ExemplarAdder); ok && uuid != "" && len("uuid")+len(uuid) <= prometheus.ExemplarMaxRunes {
+		ea.AddWithExemplar(1, prometheus.Labels{"uuid": uuid})
+	} else {
+		c.Inc()
+	}
+	dl.prune()
+}
+
+// prune removes the oldest dead letters of the dead-letter directory
+// until they are within its maximum size.  Filenames start with their
+// time so the oldest files sort first.  Other files (e.g., if the
+// directory is shared) are neither counted nor removed.  The lock must
+// be held.
+func (dl *deadLetters) prune() {
+	entries, err := ioutil.ReadDir(dl.dir)
+	if err != nil {
+		log.Printf("failed to read dead-letter directory (error: %v)\n", err)
+		return
+	}
+	var files []os.FileInfo
+	for _, f := range entries {
+		if isDeadLetter(f) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	for _, f := range files {
+		if total <= dl.max {
+			return
+		}
+		if err := os.Remove(filepath.Join(dl.dir, f.Name())); err != nil {
+			log.Printf("failed to remove dead letter (error: %v)\n", err)
+			continue
+		}
+		total -= f.Size()
+	}
+}
+
+// isDeadLetter returns true if the given file is a dead letter, i.e., a
+// regular file named like the files that write creates.
+func isDeadLetter(f os.FileInfo) bool {
+	if !f.Mode().IsRegular() {
+		return false
+	}
+	for _, pattern := range []string{"*_parse.txt", "*_extract.txt"} {
+		if ok, _ := filepath.Match(pattern, f.Name()); ok {
+			return true
+		}
+	}
+	return false
+}
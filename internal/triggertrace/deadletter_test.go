@@ -0,0 +1,118 @@
+package triggertrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+func TestDeadLetters(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{DeadLetterDir: t.TempDir(), DeadLetterMaxBytes: -1}); err == nil {
+		t.Error("NewHandler() = nil, want error")
+	}
+	extractErrData, err := ioutil.ReadFile("testdata/extract-error.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dstIP     string
+		wantStage string
+		wantData  []byte
+	}{
+		{"3.4.5.6", "", nil},
+		{forceParseErr, "parse", []byte("forced parse error")},
+		{forceExtractErr, "extract", extractErrData},
+	}
+	for i, test := range tests {
+		dir := t.TempDir()
+		handler, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{DeadLetterDir: dir})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP, Cookie: int64(i + 1)})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.wantStage == "" {
+			if len(files) != 0 {
+				t.Errorf("%s: got %d dead letters, want 0", test.dstIP, len(files))
+			}
+			continue
+		}
+		if len(files) != 1 {
+			t.Fatalf("%s: got %d dead letters, want 1", test.dstIP, len(files))
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The error context is followed by the original bytes.
+		lines := bytes.SplitN(content, []byte("\n"), 2)
+		var dl deadLetter
+		if err := json.Unmarshal(lines[0], &dl); err != nil {
+			t.Fatalf("%s: failed to unmarshal dead letter header %q (error: %v)", test.dstIP, lines[0], err)
+		}
+		if dl.Stage != test.wantStage || dl.RemoteIP != test.dstIP || dl.Error == "" || dl.UUID == "" || !strings.Contains(files[0].Name(), dl.UUID+"_"+test.wantStage) {
+			t.Errorf("%s: got dead letter %q with header %+v", test.dstIP, files[0].Name(), dl)
+		}
+		if len(lines) != 2 || !bytes.Equal(lines[1], test.wantData) {
+			t.Errorf("%s: got dead letter data %q, want %q", test.dstIP, lines[1], test.wantData)
+		}
+	}
+
+	// The oldest dead letters are removed to keep the directory within
+	// its maximum size and letters larger than that aren't written.
+	// Other files aren't counted or removed.
+	dir := t.TempDir()
+	other := filepath.Join(dir, "20000101T000000Z_trace.jsonl")
+	if err := ioutil.WriteFile(other, bytes.Repeat([]byte("x"), 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dls, err := newDeadLetters(dir, 1000)
+	if err != nil {
+		t.Fatalf("newDeadLetters() = %v, want nil", err)
+	}
+	for i := 0; i < 5; i++ {
+		dls.write(fmt.Sprintf("uuid%d", i), "1.2.3.4", "parse", errors.New("forced error"), bytes.Repeat([]byte("x"), 300))
+	}
+	dls.write("uuid5", "1.2.3.4", "parse", errors.New("forced error"), bytes.Repeat([]byte("x"), 1000))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	var names []string
+	for _, f := range files {
+		if f.Name() == filepath.Base(other) {
+			continue
+		}
+		total += f.Size()
+		names = append(names, f.Name())
+	}
+	if total > 1000 || len(names) != 2 || !strings.Contains(names[0], "uuid3") || !strings.Contains(names[1], "uuid4") {
+		t.Errorf("got dead letters %v (%d bytes), want those of uuid3 and uuid4", names, total)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("other file removed from the dead-letter directory (error: %v)", err)
+	}
+}
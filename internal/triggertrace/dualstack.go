@@ -0,0 +1,149 @@
+package triggertrace
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/m-lab/traceroute-caller/tracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tracesByFamily = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_traces_total",
+			Help: "The number of traceroutes requested by the trigger handler by IP family",
+		},
+		[]string{"family"},
+	)
+	dualStackLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_dualstack_lookups_total",
+			Help: "The number of dual-stack lookups by result",
+		},
+		[]string{"result"},
+	)
+)
+
+// LookupDualStack is a Config.DualStackResolver that resolves the
+// remote IP to its host names and those to their addresses using the
+// default resolver.  Host names that fail to resolve are ignored.
+func LookupDualStack(ctx context.Context, remoteIP string) ([]string, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, remoteIP)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, name := range names {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.IP.String())
+		}
+	}
+	return addrs, nil
+}
+
+// ipFamily returns the IP family ("ipv4" or "ipv6") of the given
+// address.
+func ipFamily(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// traceDualStack runs a traceroute to the given destination and, if
+// dual-stack tracing is enabled and the destination has an address of
+// the other IP family, to that address at the same time.
+func (h *Handler) traceDualStack(ctx context.Context, dest Destination, collapsed ...Destination) {
+	defer func() {
+		if h.done != nil {
+			close(h.done)
+		}
+	}()
+	alt, ok := h.altDestination(ctx, &dest)
+	if !ok {
+		h.traceAnnotateAndArchive(ctx, dest, collapsed...)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.traceAnnotateAndArchive(ctx, alt)
+	}()
+	h.traceAnnotateAndArchive(ctx, dest, collapsed...)
+	wg.Wait()
+}
+
+// altDestination returns the destination of the other IP family that's
+// associated with dest by Config.DualStackResolver, if any.  Both dest
+// and the returned destination get the same campaign ID, which is the
+// UUID of dest.  The returned destination has the same cookie as dest
+// but its own UUID (the campaign ID suffixed with its IP family) so its
+// traceroute is written to its own file.
+func (h *Handler) altDestination(ctx context.Context, dest *Destination) (Destination, bool) {
+	if h.cfg.DualStackResolver == nil {
+		return Destination{}, false
+	}
+	addrs, err := h.cfg.DualStackResolver(ctx, dest.RemoteIP)
+	if err != nil {
+		dualStackLookups.WithLabelValues("error").Inc()
+		log.Printf("context %p: failed to look up the addresses of %q (error: %v)\n", ctx, dest.RemoteIP, err)
+		return Destination{}, false
+	}
+	family := ipFamily(dest.RemoteIP)
+	var altIP string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || !ip.IsGlobalUnicast() || ipFamily(addr) == family || h.isLocalIP(ip) {
+			continue
+		}
+		altIP = ip.String()
+		break
+	}
+	if altIP == "" {
+		dualStackLookups.WithLabelValues("single_stack").Inc()
+		return Destination{}, false
+	}
+	campaign := dest.UUID
+	if campaign == "" {
+		c, err := strconv.ParseUint(dest.Cookie, 16, 64)
+		if err != nil {
+			dualStackLookups.WithLabelValues("error").Inc()
+			log.Printf("context %p: failed to derive a campaign ID from cookie %q (error: %v)\n", ctx, dest.Cookie, err)
+			return Destination{}, false
+		}
+		campaign = tracer.UUIDFromCookie(c, h.cfg.CookieWidth)
+	}
+	altUUID := campaign + "_" + ipFamily(altIP)
+	if err := tracer.ValidateUUID(altUUID); err != nil {
+		dualStackLookups.WithLabelValues("error").Inc()
+		log.Printf("context %p: failed to derive a UUID for %q (error: %v)\n", ctx, altIP, err)
+		return Destination{}, false
+	}
+	dualStackLookups.WithLabelValues("dual_stack").Inc()
+	dest.CampaignID = campaign
+	alt := *dest
+	alt.RemoteIP = altIP
+	alt.UUID = altUUID
+	return alt, true
+}
+
+// isLocalIP returns true if the given IP address is one of the local
+// IP addresses.
+func (h *Handler) isLocalIP(ip net.IP) bool {
+	for _, local := range h.LocalIPs {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
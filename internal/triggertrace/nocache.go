@@ -0,0 +1,69 @@
+package triggertrace
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/tracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cacheDisabled = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "triggertrace_cache_disabled",
+		Help: "Whether the traceroute cache of a traceroute tool is disabled (1) or not (0)",
+	},
+	[]string{"tracer"},
+)
+
+// uncachedTracer is a FetchTracer that runs a new traceroute for every
+// fetch instead of going through a traceroute cache.  Concurrent fetches
+// to the same destination are not collapsed into a single traceroute
+// so each of them runs its own (TriggerDebounce still collapses
+// triggers before they get here).
+type uncachedTracer struct {
+	tracetool ipcache.Tracer
+	width     int // cookie width of UUIDs
+}
+
+// newUncachedTracer returns an uncachedTracer for the given traceroute
+// tool and cookie width and meters that its cache is disabled.
+func newUncachedTracer(tracetool ipcache.Tracer, label string, width int) *uncachedTracer {
+	cacheDisabled.WithLabelValues(label).Set(1)
+	return &uncachedTracer{tracetool: tracetool, width: width}
+}
+
+// FetchTrace runs a traceroute to remoteIP and returns it.
+func (ut *uncachedTracer) FetchTrace(ctx context.Context, remoteIP, cookie string) ([]byte, error) {
+	data, _, err := ut.FetchTraceInfo(ctx, remoteIP, cookie)
+	return data, err
+}
+
+// FetchTraceInfo is like FetchTrace but also describes the traceroute,
+// which is never cached.
+func (ut *uncachedTracer) FetchTraceInfo(ctx context.Context, remoteIP, cookie string) ([]byte, ipcache.Fetch, error) {
+	c, err := strconv.ParseUint(cookie, 16, 64)
+	if err != nil {
+		return nil, ipcache.Fetch{}, err
+	}
+	uuid := tracer.UUIDFromCookie(c, ut.width)
+	if u := tracer.UUIDFromContext(ctx); u != "" {
+		uuid = u
+	}
+	fetch := ipcache.Fetch{Time: time.Now()}
+	data, err := ut.tracetool.TraceContext(ctx, remoteIP, cookie, uuid, fetch.Time)
+	return data, fetch, err
+}
+
+// Entries returns nil because there's no cache.
+func (ut *uncachedTracer) Entries() []ipcache.Entry {
+	return nil
+}
+
+// Lookup returns false because there's no cache.
+func (ut *uncachedTracer) Lookup(ip string) (string, time.Time, bool) {
+	return "", time.Time{}, false
+}
@@ -0,0 +1,73 @@
+package triggertrace
+
+import (
+	"context"
+	"sync"
+)
+
+// workPool runs functions on a fixed number of worker goroutines.
+// Functions that can't be run or queued right away are rejected
+// rather than buffered without limit.
+type workPool struct {
+	mu     sync.Mutex // serializes submissions with closing the queue
+	closed bool       // true once ctx is done
+	queue  chan poolWork
+}
+
+// poolWork is a queued function along with the function that is called
+// instead if the pool shuts down before it's run.
+type poolWork struct {
+	run  func()
+	drop func()
+}
+
+// newWorkPool returns a pool of the given number of workers that
+// queues up to queueLen functions while all workers are busy.  When
+// ctx is done, the pool stops accepting functions and the workers drop
+// the queued ones and exit.
+func newWorkPool(ctx context.Context, workers, queueLen int) *workPool {
+	p := &workPool{queue: make(chan poolWork, queueLen)}
+	for i := 0; i < workers; i++ {
+		go p.work(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.closed = true
+		close(p.queue)
+	}()
+	return p
+}
+
+// work runs queued functions until the queue is closed.  Once ctx is
+// done, the remaining functions are dropped instead so that whoever
+// waits for them isn't left hanging.
+func (p *workPool) work(ctx context.Context) {
+	for w := range p.queue {
+		if ctx.Err() != nil {
+			w.drop()
+			continue
+		}
+		w.run()
+	}
+}
+
+// submit queues run to be run by a worker or, if the pool shuts down
+// first, drop to be called instead (right away if it has already shut
+// down).  It returns false if all workers are busy and the queue is
+// full, in which case neither is called.
+func (p *workPool) submit(run, drop func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		drop()
+		return true
+	}
+	select {
+	case p.queue <- poolWork{run: run, drop: drop}:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingTracer is a fakeTracer whose traceroutes don't complete until
+// release is closed.
+type blockingTracer struct {
+	*fakeTracer
+	release chan struct{}
+}
+
+func (bt *blockingTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	<-bt.release
+	return bt.fakeTracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+}
+
+func TestWorkers(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	for _, cfg := range []Config{{Workers: -1}, {Workers: 1, QueueSize: -1}} {
+		if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", cfg); err == nil {
+			t.Errorf("NewHandler(%+v) = nil, want error", cfg)
+		}
+	}
+
+	// Flood the handler with triggers to different destinations while
+	// all traceroutes are blocked.  At most workers+queueSize of them
+	// are accepted and the rest are dropped.
+	const workers, queueSize, triggers = 4, 8, 1000
+	bt := &blockingTracer{fakeTracer: &fakeTracer{}, release: make(chan struct{})}
+	handler, err := newHandlerWithTracer(bt, &fakeAnnotator{}, "mda", Config{Workers: workers, QueueSize: queueSize})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	dropped := promtest.ToFloat64(tracesSkipped.WithLabelValues("dropped_overload"))
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < triggers; i++ {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Cookie: int64(i + 1)})
+		handler.Close(context.TODO(), time.Now(), uuid)
+	}
+	if n := runtime.NumGoroutine() - goroutines; n > workers+queueSize {
+		t.Errorf("got %d more goroutines after %d triggers, want at most %d", n, triggers, workers+queueSize)
+	}
+	close(bt.release)
+	handler.Wait()
+	traces := int(bt.Traces())
+	if traces < queueSize || traces > workers+queueSize {
+		t.Errorf("tracer.Traces() = %d, want between %d and %d", traces, queueSize, workers+queueSize)
+	}
+	if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("dropped_overload")) - dropped; int(n) != triggers-traces {
+		t.Errorf("got %v dropped triggers, want %d", n, triggers-traces)
+	}
+}
+
+func TestWorkPoolShutdown(t *testing.T) {
+	// Functions still queued when the pool shuts down are dropped so
+	// that waiting for them doesn't hang.
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newWorkPool(ctx, 1, 2)
+	var wg sync.WaitGroup
+	var ran, dropped int32
+	release := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		if !p.submit(func() {
+			defer wg.Done()
+			<-release
+			atomic.AddInt32(&ran, 1)
+		}, func() {
+			defer wg.Done()
+			atomic.AddInt32(&dropped, 1)
+		}) {
+			t.Fatalf("submit() = false, want true")
+		}
+		// Let the worker pick up the first function.
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	// Functions submitted after the shutdown are dropped right away.
+	wg.Add(1)
+	p.submit(func() { t.Error("function run after shutdown") }, func() {
+		defer wg.Done()
+		atomic.AddInt32(&dropped, 1)
+	})
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for queued functions")
+	}
+	if ran != 1 || dropped != 3 {
+		t.Errorf("got %d functions run and %d dropped, want 1 and 3", ran, dropped)
+	}
+}
@@ -0,0 +1,66 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrUnreachable means a traceroute was not run because its
+	// destination didn't answer the reachability pre-check.
+	ErrUnreachable = fmt.Errorf("%w: destination unreachable", ipcache.ErrNotTraced)
+
+	preChecks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_prechecks_total",
+			Help: "The number of reachability pre-checks by result",
+		},
+		[]string{"result"},
+	)
+)
+
+// Pinger is the interface for traceroute tools that can check whether
+// a destination is reachable (e.g., tracer.Scamper).
+type Pinger interface {
+	Ping(ctx context.Context, remoteIP string) (bool, error)
+}
+
+// preCheckTracer is a traceroute tool that wraps another traceroute
+// tool and only runs traceroutes to destinations that answer a ping.
+// Cached traceroutes don't send probes so they are not affected.
+type preCheckTracer struct {
+	ipcache.Tracer
+	pinger  Pinger
+	timeout time.Duration // zero leaves the timeout to the pinger
+}
+
+// TraceContext runs a traceroute with the wrapped traceroute tool if the
+// destination is reachable and returns ErrUnreachable otherwise.  If the
+// pre-check fails, the traceroute is run anyway.
+func (pt *preCheckTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	pingCtx := ctx
+	if pt.timeout > 0 {
+		var cancel context.CancelFunc
+		pingCtx, cancel = context.WithTimeout(ctx, pt.timeout)
+		defer cancel()
+	}
+	reachable, err := pt.pinger.Ping(pingCtx, remoteIP)
+	switch {
+	case err != nil:
+		preChecks.WithLabelValues("error").Inc()
+		log.Printf("context %p: failed to check whether %q is reachable (error: %v)\n", ctx, remoteIP, err)
+	case !reachable:
+		preChecks.WithLabelValues("unreachable").Inc()
+		tracesSkipped.WithLabelValues("unreachable_skipped").Inc()
+		return nil, ErrUnreachable
+	default:
+		preChecks.WithLabelValues("reachable").Inc()
+	}
+	return pt.Tracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+}
@@ -0,0 +1,81 @@
+package triggertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakePinger is a fakeTracer whose destinations are reachable unless
+// they're listed in unreachable.  Pinging forcePingErr fails.
+type fakePinger struct {
+	*fakeTracer
+	unreachable map[string]bool
+}
+
+var forcePingErr = "55.55.55.55" // force a failure pinging a destination
+
+func (fp *fakePinger) Ping(ctx context.Context, remoteIP string) (bool, error) {
+	if remoteIP == forcePingErr {
+		return false, errors.New("forced ping error")
+	}
+	return !fp.unreachable[remoteIP], nil
+}
+
+func TestPreCheck(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// Traceroute tools must support pre-checks.
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{PreCheck: true}); err == nil {
+		t.Errorf("NewHandler() = nil, want error")
+	}
+	if _, err := newHandlerWithTracer(&fakePinger{fakeTracer: &fakeTracer{}}, &fakeAnnotator{}, "mda", Config{PreCheckTimeout: -1}); err == nil {
+		t.Errorf("NewHandler() = nil, want error")
+	}
+
+	tests := []struct {
+		preCheck    bool
+		dstIP       string
+		wantTraces  int32
+		wantSkipped float64
+	}{
+		{false, "4.5.6.7", 1, 0}, // unreachable but pre-checks are disabled
+		{true, "3.4.5.6", 1, 0},
+		{true, "4.5.6.7", 0, 1},
+		{true, forcePingErr, 1, 0},
+	}
+	for i, test := range tests {
+		fp := &fakePinger{fakeTracer: &fakeTracer{}, unreachable: map[string]bool{"4.5.6.7": true}}
+		var result TraceResult
+		handler, err := newHandlerWithTracer(fp, &fakeAnnotator{}, "mda", Config{
+			PreCheck:        test.preCheck,
+			PreCheckTimeout: time.Second,
+			OnComplete:      func(r TraceResult) { result = r },
+		})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		skipped := promtest.ToFloat64(tracesSkipped.WithLabelValues("unreachable_skipped"))
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP, Cookie: 1})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+		if n := fp.Traces(); n != test.wantTraces {
+			t.Errorf("test %d: tracer.Traces() = %d, want %d", i, n, test.wantTraces)
+		}
+		if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("unreachable_skipped")) - skipped; n != test.wantSkipped {
+			t.Errorf("test %d: got %v unreachable traceroutes, want %v", i, n, test.wantSkipped)
+		}
+		if wantErr := test.wantTraces == 0; errors.Is(result.Err, ErrUnreachable) != wantErr {
+			t.Errorf("test %d: result.Err = %v, want ErrUnreachable: %v", i, result.Err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rateWindow is the period over which the current probe rate is measured.
+const rateWindow = time.Minute
+
+var (
+	probeRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "triggertrace_probe_rate",
+			Help: "The number of probes per second sent by traceroutes that completed in the last minute",
+		},
+	)
+	probeRateLimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "triggertrace_probe_rate_limit",
+			Help: "The maximum number of probes per second that traceroutes may send (0 means unlimited)",
+		},
+	)
+)
+
+// probeSample is the number of probes sent by a traceroute that
+// completed at a given time.
+type probeSample struct {
+	t      time.Time
+	probes int
+}
+
+// rateLimiter spaces out traceroute launches so that all traceroutes
+// together send no more than rate probes per second on average.  The
+// number of probes sent by a traceroute is only known when it
+// completes, so each launch reserves the average number of probes of
+// previous traceroutes and the difference is settled on completion.
+// Until a traceroute completes, each launch reserves one second worth
+// of probes.
+type rateLimiter struct {
+	rate     float64 // probes per second
+	mu       sync.Mutex
+	next     time.Time // the earliest time of the next launch
+	estimate float64   // the average number of probes per traceroute
+	samples  []probeSample
+	parser   ParseTracer
+}
+
+// newRateLimiter returns a new rateLimiter that allows rate probes per
+// second.
+func newRateLimiter(rate int, parser ParseTracer) *rateLimiter {
+	probeRateLimit.Set(float64(rate))
+	return &rateLimiter{
+		rate:     float64(rate),
+		estimate: float64(rate),
+		parser:   parser,
+	}
+}
+
+// reserve waits until a traceroute can be launched and returns the
+// number of probes reserved for it.  It returns an error if ctx is
+// done before then.
+func (rl *rateLimiter) reserve(ctx context.Context) (float64, error) {
+	rl.mu.Lock()
+	now := timeNow()
+	launch := rl.next
+	if launch.Before(now) {
+		launch = now
+	}
+	reserved := rl.estimate
+	rl.next = launch.Add(rl.duration(reserved))
+	rl.mu.Unlock()
+
+	wait := launch.Sub(now)
+	if wait <= 0 {
+		return reserved, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		rl.settle(reserved, 0)
+		return 0, ctx.Err()
+	case <-timer.C:
+		return reserved, nil
+	}
+}
+
+// settle replaces the reserved number of probes of a traceroute with
+// the number of probes it actually sent.
+func (rl *rateLimiter) settle(reserved float64, probes int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.next = rl.next.Add(rl.duration(float64(probes) - reserved))
+	if probes == 0 {
+		return
+	}
+	// Exponentially weighted moving average.
+	rl.estimate = 0.8*rl.estimate + 0.2*float64(probes)
+	now := timeNow()
+	rl.samples = append(rl.samples, probeSample{t: now, probes: probes})
+	total := 0
+	i := 0
+	for _, s := range rl.samples {
+		if now.Sub(s.t) < rateWindow {
+			rl.samples[i] = s
+			i++
+			total += s.probes
+		}
+	}
+	rl.samples = rl.samples[:i]
+	probeRate.Set(float64(total) / rateWindow.Seconds())
+}
+
+// probes returns the number of probes sent by the given traceroute or
+// 0 if it's unknown.
+func (rl *rateLimiter) probes(rawData []byte) int {
+	parsedData, err := rl.parser.ParseRawData(rawData)
+	if err != nil {
+		return 0
+	}
+	pc, ok := parsedData.(parser.ProbeCounter)
+	if !ok {
+		return 0
+	}
+	return pc.ProbeCount()
+}
+
+// duration returns the time it takes to send the given number of probes.
+func (rl *rateLimiter) duration(probes float64) time.Duration {
+	return time.Duration(probes / rl.rate * float64(time.Second))
+}
+
+// rateTracer is a traceroute tool that wraps another traceroute tool
+// and spaces out its traceroutes according to a probe rate limit.
+// Cached traceroutes don't send probes so they are not affected.
+type rateTracer struct {
+	ipcache.Tracer
+	limiter *rateLimiter
+}
+
+// TraceContext waits until the probe rate limit allows a traceroute and
+// runs it with the wrapped traceroute tool.  If ctx is done while
+// waiting, the traceroute isn't run.
+func (rt *rateTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	reserved, err := rt.limiter.reserve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ipcache.ErrNotTraced, err)
+	}
+	data, err := rt.Tracer.TraceContext(ctx, remoteIP, cookie, uuid, t)
+	probes := 0
+	if err == nil {
+		probes = rt.limiter.probes(data)
+	}
+	rt.limiter.settle(reserved, probes)
+	return data, err
+}
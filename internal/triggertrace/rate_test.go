@@ -0,0 +1,73 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeRate(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{ProbeRate: -1}); err == nil {
+		t.Fatalf("NewHandler() = nil, want error")
+	}
+
+	// The traceroute in ./testdata/valid.jsonl sent 71 probes so, at
+	// 710 probes per second, traceroutes after the first one are
+	// launched 100ms apart.
+	tests := []struct {
+		rate        int
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{0, 0, 100 * time.Millisecond},
+		{710, 200 * time.Millisecond, 2 * time.Second},
+	}
+	for _, test := range tests {
+		tracer := &fakeTracer{}
+		handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", Config{ProbeRate: test.rate})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			uuid := fmt.Sprintf("%05d", i)
+			handler.done = make(chan struct{})
+			handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: fmt.Sprintf("1.1.1.%d", i+1)})
+			handler.Close(context.TODO(), time.Now(), uuid)
+			waitForTrace(t, handler)
+		}
+		if d := time.Since(start); d < test.minDuration || d > test.maxDuration {
+			t.Errorf("rate %d: 3 traceroutes took %v, want between %v and %v", test.rate, d, test.minDuration, test.maxDuration)
+		}
+		if n := tracer.Traces(); n != 3 {
+			t.Errorf("rate %d: tracer.Traces() = %d, want 3", test.rate, n)
+		}
+	}
+	if got := promtest.ToFloat64(probeRateLimit); got != 710 {
+		t.Errorf("probe rate limit = %v, want 710", got)
+	}
+	if got, want := promtest.ToFloat64(probeRate), 3*71/rateWindow.Seconds(); got != want {
+		t.Errorf("probe rate = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	rl := newRateLimiter(1, nil)
+	if _, err := rl.reserve(context.Background()); err != nil {
+		t.Fatalf("reserve() = %v, want nil", err)
+	}
+	// The next launch is a second away.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := rl.reserve(ctx); err == nil {
+		t.Fatalf("reserve() = nil, want error")
+	}
+}
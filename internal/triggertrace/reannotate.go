@@ -0,0 +1,108 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/m-lab/traceroute-caller/parser"
+)
+
+// ReannotateStats counts the traceroute files processed by Reannotate.
+type ReannotateStats struct {
+	Files     int // traceroute files found
+	Annotated int // files whose hops were all annotated and archived
+	Skipped   int // files that couldn't be read or parsed or have no hops
+	Failed    int // files whose hops couldn't all be annotated
+}
+
+// Reannotate annotates the hops of the existing traceroute files (i.e.,
+// .jsonl files) under dir again with ha, e.g., after the annotator data
+// was updated, and archives their annotations like the handler does
+// without running any traceroutes.  If ha replaces existing files (see
+// hopannotation.Config.ReplaceFiles), annotations of hops that already
+// have one are replaced, so reannotating again is harmless.  At most
+// workers files (min 1) are processed at the same time so that the
+// annotator isn't overwhelmed.  Files that can't be read or parsed are
+// logged and skipped.  Reannotate stops early when ctx is done.
+func Reannotate(ctx context.Context, dir string, p parser.TracerouteParser, ha AnnotateAndArchiver, workers int) (ReannotateStats, error) {
+	var stats ReannotateStats
+	if workers < 1 {
+		return stats, fmt.Errorf("%d: invalid number of workers", workers)
+	}
+	var (
+		statsMu sync.Mutex
+		wg      sync.WaitGroup
+	)
+	files := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				result := reannotateFile(ctx, path, p, ha)
+				statsMu.Lock()
+				switch result {
+				case outcomeCompleted:
+					stats.Annotated++
+				case outcomeAnnotateError:
+					stats.Failed++
+				default:
+					stats.Skipped++
+				}
+				statsMu.Unlock()
+			}
+		}()
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".jsonl") {
+			return nil
+		}
+		select {
+		case files <- path:
+			stats.Files++
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(files)
+	wg.Wait()
+	return stats, err
+}
+
+// reannotateFile annotates the hops of the named traceroute file and
+// archives their annotations.  It returns the outcome of the traceroute
+// (see the outcome constants).
+func reannotateFile(ctx context.Context, path string, p parser.TracerouteParser, ha AnnotateAndArchiver) string {
+	rawData, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("failed to read traceroute file %q (error: %v)\n", path, err)
+		return outcomeTraceError
+	}
+	parsedData, err := p.ParseRawData(rawData)
+	if err != nil {
+		log.Printf("skipping traceroute file %q (error: %v)\n", path, err)
+		return outcomeParseError
+	}
+	hops := parsedData.ExtractHops()
+	if len(hops) == 0 {
+		log.Printf("skipping traceroute file %q without hops\n", path)
+		return outcomeExtractError
+	}
+	if !annotateAndArchive(ctx, ctx, ha, parsedData, hops, annotateScopeAll, "", "") {
+		return outcomeAnnotateError
+	}
+	return outcomeCompleted
+}
@@ -0,0 +1,74 @@
+package triggertrace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/traceroute-caller/hopannotation"
+	"github.com/m-lab/traceroute-caller/parser"
+)
+
+func TestReannotate(t *testing.T) {
+	newParser, err := parser.New("mda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	newHopCache := func() *hopannotation.HopCache {
+		t.Helper()
+		ha, err := hopannotation.New(context.TODO(), hopannotation.Config{AnnotatorClient: &fakeAnnotator{}, OutputPath: dir, ReplaceFiles: true})
+		if err != nil {
+			t.Fatalf("hopannotation.New() = %v, want nil", err)
+		}
+		return ha
+	}
+	if _, err := Reannotate(context.TODO(), "./testdata/reannotate", newParser, newHopCache(), 0); err == nil {
+		t.Error("Reannotate() = nil, want error")
+	}
+
+	// ./testdata/reannotate has a valid traceroute, a traceroute whose
+	// hops can't be annotated, a traceroute without hops, a file that
+	// isn't a traceroute, and a file that isn't a .jsonl file.
+	want := ReannotateStats{Files: 4, Annotated: 1, Skipped: 2, Failed: 1}
+	var annotations map[string][]byte
+	for i := 0; i < 2; i++ {
+		// Each run has its own hop cache like separate invocations.
+		stats, err := Reannotate(context.TODO(), "./testdata/reannotate", newParser, newHopCache(), 2)
+		if err != nil {
+			t.Fatalf("Reannotate() = %v, want nil", err)
+		}
+		if stats != want {
+			t.Errorf("run %d: Reannotate() = %+v, want %+v", i, stats, want)
+		}
+		// The traceroute in ./testdata/valid.jsonl has 13 responsive
+		// hops and running again replaces their annotations.
+		files, err := filepath.Glob(filepath.Join(dir, "2021/10/28/*.json"))
+		if err != nil || len(files) != 13 {
+			t.Fatalf("run %d: got annotation files %v, want 13 (error: %v)", i, files, err)
+		}
+		got := make(map[string][]byte)
+		for _, f := range files {
+			if got[f], err = ioutil.ReadFile(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for f, b := range annotations {
+			if string(got[f]) != string(b) {
+				t.Errorf("run %d: %s = %s, want %s", i, f, got[f], b)
+			}
+		}
+		annotations = got
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if _, err := Reannotate(ctx, "./testdata/reannotate", newParser, newHopCache(), 1); err == nil {
+		t.Error("Reannotate() = nil with a cancelled context, want error")
+	}
+	if _, err := Reannotate(context.TODO(), "./testdata/non-existent", newParser, newHopCache(), 1); !os.IsNotExist(err) {
+		t.Errorf("Reannotate() = %v, want a not-exist error", err)
+	}
+}
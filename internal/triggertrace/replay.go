@@ -0,0 +1,65 @@
+package triggertrace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+)
+
+// Replay reads connection events from r and passes them to handler as
+// the event socket client would, so that the whole pipeline (tracer,
+// cache, annotator) can be exercised without real traffic.  Events are
+// in the JSONL format of the event socket (eventsocket.FlowEvent), so
+// recorded event streams can be replayed as is.
+//
+// The time between events is that between their timestamps divided by
+// speed (e.g., 2 replays twice as fast as real time).  Events that go
+// back in time are replayed immediately.  Replay returns the number of
+// events replayed and stops at the first malformed event or when ctx
+// is cancelled.
+func Replay(ctx context.Context, handler eventsocket.Handler, r io.Reader, speed float64) (int, error) {
+	if speed <= 0 {
+		return 0, fmt.Errorf("%v: invalid replay speed", speed)
+	}
+	var n int
+	var start, first time.Time
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event eventsocket.FlowEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return n, fmt.Errorf("line %d: invalid event (error: %v)", line, err)
+		}
+		if event.Event != eventsocket.Open && event.Event != eventsocket.Close {
+			return n, fmt.Errorf("line %d: unknown event type %v", line, event.Event)
+		}
+		if start.IsZero() {
+			start, first = time.Now(), event.Timestamp
+		}
+		offset := time.Duration(float64(event.Timestamp.Sub(first)) / speed)
+		if wait := time.Until(start.Add(offset)); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return n, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if event.Event == eventsocket.Open {
+			handler.Open(ctx, event.Timestamp, event.UUID, event.ID)
+		} else {
+			handler.Close(ctx, event.Timestamp, event.UUID)
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return n, fmt.Errorf("failed to read events (error: %v)", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,68 @@
+package triggertrace
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	tracer := &fakeTracer{}
+	handler, err := newHandler(tracer)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+
+	// Invalid replays.
+	tests := []struct {
+		events string
+		speed  float64
+		want   int
+	}{
+		{"", 0, 0},
+		{`{"Event":0,"UUID":"u"}` + "\nnot an event\n", 1, 1},
+		{`{"Event":7,"UUID":"u"}` + "\n", 1, 0},
+	}
+	for _, test := range tests {
+		if n, err := Replay(context.Background(), handler, strings.NewReader(test.events), test.speed); err == nil || n != test.want {
+			t.Errorf("Replay(%q, %v) = %d, %v, want %d, error", test.events, test.speed, n, err, test.want)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, err := os.Open("testdata/replay.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := Replay(ctx, handler, f, 1); err == nil || n != 1 {
+		t.Errorf("Replay() = %d, %v, want 1, error", n, err)
+	}
+
+	// The events in ./testdata/replay.jsonl span 5 seconds and trigger
+	// two traceroutes and a cached traceroute.
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	n, err := Replay(context.Background(), handler, f, 10)
+	if err != nil || n != 6 {
+		t.Fatalf("Replay() = %d, %v, want 6, nil", n, err)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Replay() took %v, want about 500ms", d)
+	}
+	handler.Wait()
+	if got := tracer.Traces(); got != 2 {
+		t.Errorf("tracer.Traces() = %d, want 2", got)
+	}
+	if got := tracer.TracesCached(); got != 1 {
+		t.Errorf("tracer.TracesCached() = %d, want 1", got)
+	}
+}
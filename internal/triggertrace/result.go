@@ -0,0 +1,81 @@
+package triggertrace
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+)
+
+// Traceroute outcomes reported in TraceResult.
+const (
+	OutcomeFresh  = "fresh"  // a new traceroute was run
+	OutcomeCached = "cached" // the traceroute was obtained from the cache
+	OutcomeError  = "error"  // the traceroute couldn't be obtained
+)
+
+// TraceResult describes the result of a traceroute that was triggered by
+// a closed connection.
+type TraceResult struct {
+	UUID        string        // UUID of the traceroute
+	Destination Destination   // destination of the traceroute
+	Outcome     string        // one of the Outcome constants
+	Err         error         // error if Outcome is OutcomeError
+	FilePath    string        // path to the traceroute file (empty if not written)
+	Duration    time.Duration // time it took to obtain the traceroute
+	Time        time.Time     // time of the traceroute (zero if unknown)
+}
+
+// Filenamer is the interface for traceroute tools that can report the
+// name of the file that a traceroute is written to.
+type Filenamer interface {
+	FilenameContext(ctx context.Context, cookie string, t time.Time) (string, error)
+}
+
+// complete fills in the details of the given result that are known
+// from how the traceroute was fetched, writes the traceroute to the
+// sinks if it was obtained, and invokes the OnComplete callback (if
+// any).  It returns the error of the first required sink that failed,
+// if any.
+func (h *Handler) complete(ctx context.Context, result *TraceResult, fetch ipcache.Fetch, written bool, payload []byte) error {
+	result.Time = fetch.Time
+	switch {
+	case fetch.CopyErr != nil && result.Err == nil:
+		// Failed to save a cached traceroute.
+		result.Err = fetch.CopyErr
+		written = false
+	case fetch.Cached:
+		result.Outcome = OutcomeCached
+	default:
+		result.Outcome = OutcomeFresh
+	}
+	if fn, ok := h.tracetool.(Filenamer); ok && written && result.Err == nil && !fetch.Time.IsZero() {
+		result.FilePath, _ = fn.FilenameContext(withDestination(ctx, result.Destination), result.Destination.Cookie, fetch.Time)
+	}
+	if result.Err != nil {
+		result.Outcome = OutcomeError
+	}
+	var err error
+	if result.Outcome != OutcomeError {
+		if err = h.writeSinks(ctx, *result, payload); err != nil {
+			result.Err = err
+			result.Outcome = OutcomeError
+		}
+	}
+	if h.cfg.OnComplete != nil {
+		h.onComplete(ctx, *result)
+	}
+	return err
+}
+
+// onComplete invokes the OnComplete callback.  Panics in the callback
+// are logged and otherwise ignored.
+func (h *Handler) onComplete(ctx context.Context, result TraceResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("context %p: OnComplete callback panicked (error: %v)\n", ctx, r)
+		}
+	}()
+	h.cfg.OnComplete(result)
+}
@@ -0,0 +1,28 @@
+package triggertrace
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// sampleWindow is how long the sampling decision for a destination
+// stands.  Decisions are made again in each window so that sampled-out
+// destinations aren't left out forever.
+const sampleWindow = time.Hour
+
+// sampled returns true if the traceroute to the given destination
+// triggered at time t should be run with the configured sampling rate.
+// The decision is a hash of the destination and the sampling window
+// of t so it's the same for all triggers of a destination within a
+// window instead of flip-flopping.
+func (cfg Config) sampled(remoteIP string, t time.Time) bool {
+	if cfg.SampleRate == 0 || cfg.SampleRate >= 1 {
+		return true
+	}
+	key := make([]byte, 8, 8+len(remoteIP))
+	binary.BigEndian.PutUint64(key, uint64(t.UTC().Truncate(sampleWindow).Unix()))
+	sum := sha256.Sum256(append(key, remoteIP...))
+	return float64(binary.BigEndian.Uint64(sum[:8])) < cfg.SampleRate*math.MaxUint64
+}
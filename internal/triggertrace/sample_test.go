@@ -0,0 +1,95 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSampleRate(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	for _, rate := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{SampleRate: rate}); err == nil {
+			t.Errorf("NewHandler(%v) = nil, want error", rate)
+		}
+	}
+
+	// The traced fraction of many destinations approximates the rate
+	// and the decision for a destination is stable within a window.
+	now := time.Date(2021, time.December, 1, 10, 0, 0, 0, time.UTC)
+	for _, rate := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		cfg := Config{SampleRate: rate}
+		n, traced := 10000, 0
+		for i := 0; i < n; i++ {
+			ip := fmt.Sprintf("10.%d.%d.1", i/256, i%256)
+			sampled := cfg.sampled(ip, now)
+			if sampled {
+				traced++
+			}
+			if cfg.sampled(ip, now.Add(59*time.Minute)) != sampled {
+				t.Fatalf("rate %v: decision for %q changed within a window", rate, ip)
+			}
+		}
+		want := rate
+		if rate == 0 {
+			want = 1
+		}
+		if got := float64(traced) / float64(n); math.Abs(got-want) > 0.02 {
+			t.Errorf("rate %v: traced %v of destinations, want %v", rate, got, want)
+		}
+	}
+
+	// Find a destination that's sampled out in one window but not in
+	// the next one.
+	cfg := Config{SampleRate: 0.5}
+	var ip string
+	for i := 0; ip == "" && i < 256; i++ {
+		candidate := fmt.Sprintf("3.4.5.%d", i)
+		if cfg.sampled(candidate, now) && !cfg.sampled(candidate, now.Add(time.Hour)) {
+			ip = candidate
+		}
+	}
+	if ip == "" {
+		t.Fatal("failed to find a destination to test with")
+	}
+	tracer := &fakeTracer{}
+	handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", cfg)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	skipped := promtest.ToFloat64(tracesSkipped.WithLabelValues("sampled_out"))
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), now, "00000", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: ip, Cookie: 1})
+	handler.Close(context.TODO(), now, "00000")
+	waitForTrace(t, handler)
+	// Sampled out but cached.
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), now.Add(time.Hour), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: ip, Cookie: 2})
+	handler.Close(context.TODO(), now.Add(time.Hour), "00001")
+	waitForTrace(t, handler)
+	if tracer.Traces() != 1 || tracer.TracesCached() != 1 {
+		t.Errorf("got %d traceroutes and %d cached traceroutes, want 1 and 1", tracer.Traces(), tracer.TracesCached())
+	}
+	// Sampled out and not cached.
+	other := "3.4.6.1"
+	for i := 2; cfg.sampled(other, now.Add(time.Hour)); i++ {
+		other = fmt.Sprintf("3.4.6.%d", i)
+	}
+	handler.Open(context.TODO(), now.Add(time.Hour), "00002", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: other, Cookie: 3})
+	handler.Close(context.TODO(), now.Add(time.Hour), "00002")
+	handler.Wait()
+	if n := tracer.Traces(); n != 1 {
+		t.Errorf("tracer.Traces() = %d, want 1", n)
+	}
+	if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("sampled_out")) - skipped; n != 1 {
+		t.Errorf("got %v sampled-out triggers, want 1", n)
+	}
+}
@@ -0,0 +1,149 @@
+package triggertrace
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scheduledRounds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_scheduled_rounds_total",
+			Help: "The number of rounds of scheduled traceroutes",
+		},
+		[]string{"outcome"},
+	)
+	scheduledTargets = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "triggertrace_scheduled_targets",
+			Help: "The number of targets of scheduled traceroutes",
+		},
+	)
+
+	// scheduledCookie is the cookie of the last scheduled traceroute.
+	// Scheduled traceroutes don't have sockets so they get cookies with
+	// the most significant bit set to avoid colliding with the (much
+	// smaller) cookies of sockets.
+	scheduledCookie = uint64(1) << 63
+)
+
+// Scheduler periodically runs traceroutes to a fixed list of targets,
+// regardless of connection events, through the handler's cache,
+// annotation, and archiving path.
+type Scheduler struct {
+	handler   *Handler
+	path      string
+	interval  time.Duration
+	targets   []string
+	roundDone chan struct{} // For testing.
+}
+
+// NewScheduler returns a new Scheduler that runs traceroutes to the
+// targets in the file at path every interval.  The file contains one
+// IP address per line.  Empty lines and lines starting with # are
+// ignored.
+func NewScheduler(h *Handler, path string, interval time.Duration) (*Scheduler, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%v: invalid schedule interval", interval)
+	}
+	s := &Scheduler{
+		handler:  h,
+		path:     path,
+		interval: interval,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the targets from the file.  If the file cannot be read
+// or has an invalid target, the current targets are left unchanged.
+// The file is also reloaded before every round.
+func (s *Scheduler) Reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open target file %q (error: %v)", s.path, err)
+	}
+	defer f.Close()
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if net.ParseIP(line) == nil {
+			return fmt.Errorf("%s:%d: invalid target %q", s.path, n, line)
+		}
+		targets = append(targets, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read target file %q (error: %v)", s.path, err)
+	}
+	s.targets = targets
+	scheduledTargets.Set(float64(len(targets)))
+	return nil
+}
+
+// Run runs a round of traceroutes immediately and then every interval
+// until ctx is cancelled.  A round is skipped if the previous round is
+// still running.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var running int32
+	for {
+		if atomic.CompareAndSwapInt32(&running, 0, 1) {
+			go func() {
+				defer atomic.StoreInt32(&running, 0)
+				s.round(ctx)
+			}()
+		} else {
+			scheduledRounds.WithLabelValues("overlapped").Inc()
+			log.Printf("skipping scheduled round because the previous round is still running\n")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round reloads the targets and runs a traceroute to each of them.
+func (s *Scheduler) round(ctx context.Context) {
+	if err := s.Reload(); err != nil {
+		scheduledRounds.WithLabelValues("reload_error").Inc()
+		log.Printf("failed to reload scheduled targets, using previous targets (error: %v)\n", err)
+	}
+	var wg sync.WaitGroup
+	for _, target := range s.targets {
+		dest := Destination{
+			RemoteIP: target,
+			Cookie:   strconv.FormatUint(atomic.AddUint64(&scheduledCookie, 1), 16),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handler.traceAnnotateAndArchive(ctx, dest)
+		}()
+	}
+	wg.Wait()
+	scheduledRounds.WithLabelValues("completed").Inc()
+	if s.roundDone != nil {
+		s.roundDone <- struct{}{}
+	}
+}
@@ -0,0 +1,100 @@
+package triggertrace
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScheduler(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	tracer := &fakeTracer{}
+	handler, err := newHandler(tracer)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	targetFile := filepath.Join(t.TempDir(), "targets")
+	writeTargets := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(targetFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Invalid schedules.
+	if _, err := NewScheduler(handler, targetFile, time.Second); err == nil {
+		t.Error("NewScheduler() = nil, want error for missing target file")
+	}
+	writeTargets("1.1.1.1\nnot-an-ip\n")
+	if _, err := NewScheduler(handler, targetFile, time.Second); err == nil {
+		t.Error("NewScheduler() = nil, want error for invalid target")
+	}
+	writeTargets("# targets\n1.1.1.1\n\n2.2.2.2\n")
+	if _, err := NewScheduler(handler, targetFile, 0); err == nil {
+		t.Error("NewScheduler() = nil, want error for invalid interval")
+	}
+
+	s, err := NewScheduler(handler, targetFile, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewScheduler() = %v, want nil", err)
+	}
+	if got := promtest.ToFloat64(scheduledTargets); got != 2 {
+		t.Errorf("scheduled targets = %v, want 2", got)
+	}
+	s.roundDone = make(chan struct{}, 10)
+	completed := promtest.ToFloat64(scheduledRounds.WithLabelValues("completed"))
+	reloadErrors := promtest.ToFloat64(scheduledRounds.WithLabelValues("reload_error"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	waitForRound := func() {
+		t.Helper()
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for scheduled round")
+		case <-s.roundDone:
+		}
+	}
+	tests := []struct {
+		targets    string // if not empty, new content of the target file
+		wantTraces int32
+		wantCached int32
+	}{
+		// The first round runs immediately.
+		{"", 2, 0},
+		// The next round fires after the interval and the
+		// traceroutes come from the cache.
+		{"", 2, 2},
+		// The target file is reloaded before every round.
+		{"2.2.2.2\n3.3.3.3\n", 3, 3},
+		// Invalid target files are ignored.
+		{"bad target\n", 3, 5},
+	}
+	for i, test := range tests {
+		if test.targets != "" {
+			writeTargets(test.targets)
+		}
+		waitForRound()
+		if n := tracer.Traces(); n != test.wantTraces {
+			t.Errorf("round %d: tracer.Traces() = %d, want %d", i, n, test.wantTraces)
+		}
+		if n := tracer.TracesCached(); n != test.wantCached {
+			t.Errorf("round %d: tracer.TracesCached() = %d, want %d", i, n, test.wantCached)
+		}
+	}
+	cancel()
+	if n := promtest.ToFloat64(scheduledRounds.WithLabelValues("completed")) - completed; n != 4 {
+		t.Errorf("got %v completed rounds, want 4", n)
+	}
+	if n := promtest.ToFloat64(scheduledRounds.WithLabelValues("reload_error")) - reloadErrors; n != 1 {
+		t.Errorf("got %v reload errors, want 1", n)
+	}
+}
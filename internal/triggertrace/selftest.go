@@ -0,0 +1,56 @@
+package triggertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/tracer"
+)
+
+// ErrSelfTest means that the self-test traceroute didn't make it
+// through the traceroute pipeline.
+var ErrSelfTest = errors.New("self-test failed")
+
+// selfTestCookie is the cookie of self-test traceroutes.  Real cookies
+// start at 1 so it can't be mistaken for the cookie of a connection.
+const selfTestCookie = 0
+
+// SelfTest runs a traceroute to target with tracetool and checks that
+// the handler's parser can parse it and extract its hops.  If annotate
+// is true and hop annotation is enabled, the hops are also annotated
+// but their annotations aren't archived, nor are the hops marked as
+// annotated for the day (see HopArchiver).  The traceroute isn't cached,
+// so tracetool should write it somewhere other than the archive.  This
+// is meant to be called once at startup to catch misconfigurations
+// (e.g., the wrong scamper binary or a parser that doesn't match its
+// output) before serving real triggers.
+func (h *Handler) SelfTest(ctx context.Context, tracetool ipcache.Tracer, target string, annotate bool) error {
+	start := time.Now()
+	rawData, err := tracetool.TraceContext(ctx, target, fmt.Sprint(selfTestCookie), tracer.UUIDFromCookie(selfTestCookie, h.cfg.CookieWidth), start)
+	if err != nil {
+		return fmt.Errorf("%w: traceroute to %q: %v", ErrSelfTest, target, err)
+	}
+	parsedData, err := h.Parser.ParseRawData(rawData)
+	if err != nil {
+		return fmt.Errorf("%w: parse: %v", ErrSelfTest, err)
+	}
+	hops := parsedData.ExtractHops()
+	if len(hops) == 0 && !sentProbes(parsedData) {
+		return fmt.Errorf("%w: no hops extracted from traceroute to %q", ErrSelfTest, target)
+	}
+	if annotate && h.HopAnnotator != nil && len(hops) > 0 {
+		ta, ok := h.HopAnnotator.(HopArchiver)
+		if !ok {
+			return fmt.Errorf("%w: annotate: hop annotator can't annotate without archiving (%T)", ErrSelfTest, h.HopAnnotator)
+		}
+		if _, allErrs := ta.AnnotateTrace(ctx, hops, nil); allErrs != nil {
+			return fmt.Errorf("%w: annotate: %v", ErrSelfTest, allErrs)
+		}
+	}
+	log.Printf("self-test traceroute to %q passed with %d hops in %v\n", target, len(hops), time.Since(start))
+	return nil
+}
@@ -0,0 +1,85 @@
+package triggertrace
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/ipcache"
+	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/m-lab/traceroute-caller/tracer"
+)
+
+func TestSelfTest(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	newScamper := func(binary string) ipcache.Tracer {
+		s, err := tracer.NewScamper(tracer.ScamperConfig{
+			Binary:           binary,
+			OutputPath:       t.TempDir(),
+			Timeout:          time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 25,
+		})
+		if err != nil {
+			t.Fatalf("NewScamper() = %v, want nil", err)
+		}
+		return s
+	}
+	// The hops of the traceroute that testdata/scamper emulates.
+	rawData, err := ioutil.ReadFile("testdata/valid.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newParser, err := parser.New("mda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedData, err := newParser.ParseRawData(rawData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := parsedData.ExtractHops()
+
+	tests := []struct {
+		name          string
+		tracetool     ipcache.Tracer
+		target        string
+		annotate      bool
+		wantErr       bool
+		wantAnnotates int32
+	}{
+		{"pass", newScamper("testdata/scamper"), "127.0.0.1", false, false, 0},
+		{"pass-annotate", newScamper("testdata/scamper"), "127.0.0.1", true, false, 1},
+		{"wrong-binary", newScamper("/bin/echo"), "127.0.0.1", false, true, 0},
+		{"trace-error", &fakeTracer{}, forceTracerouteErr, false, true, 0},
+		{"extract-error", &fakeTracer{}, forceExtractErr, false, true, 0},
+		{"annotate-error", &fakeTracer{}, forceAnnotateErr, true, true, 1},
+	}
+	for _, test := range tests {
+		fa := &fakeAnnotator{}
+		handler, err := newHandlerWithTracer(&fakeTracer{}, fa, "mda", Config{})
+		if err != nil {
+			t.Fatalf("%s: NewHandler() = %v, want nil", test.name, err)
+		}
+		err = handler.SelfTest(context.Background(), test.tracetool, test.target, test.annotate)
+		if test.wantErr != (err != nil) || (err != nil && !errors.Is(err, ErrSelfTest)) {
+			t.Errorf("%s: SelfTest() = %v, want error %v", test.name, err, test.wantErr)
+		}
+		if got := fa.Annotates(); got != test.wantAnnotates {
+			t.Errorf("%s: got %d annotations, want %d", test.name, got, test.wantAnnotates)
+		}
+		// The self-test hops are still new to the hop cache, so
+		// real traceroutes through them are archived.
+		if test.annotate && !test.wantErr {
+			annotations, allErrs := handler.HopAnnotator.Annotate(context.Background(), hops, parsedData.StartTime())
+			if allErrs != nil || len(annotations) != len(hops) {
+				t.Errorf("%s: Annotate() = %+v, %v, want %d annotations, nil", test.name, annotations, allErrs, len(hops))
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package triggertrace
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sinkWrites = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "triggertrace_sink_writes_total",
+		Help: "The number of traceroutes written to output sinks by sink and result (ok or failed)",
+	},
+	[]string{"sink", "result"},
+)
+
+// Sink is the interface for outputs that completed traceroutes are
+// written to in addition to their files (e.g., a Pub/Sub topic).  The
+// payload is the raw output of the traceroute tool.  Traceroute files
+// aren't written through sinks: the traceroute tools write them as
+// they run traceroutes (see TraceResult.FilePath).
+type Sink interface {
+	Write(ctx context.Context, result TraceResult, payload []byte) error
+}
+
+// SinkConfig describes an output sink of the handler.
+type SinkConfig struct {
+	Name string // name of the sink in logs and metrics
+	Sink Sink
+	// Required sinks fail the traceroute if they fail.  Failures of
+	// other sinks are only logged and metered.
+	Required bool
+}
+
+// validateSinks returns an error if a sink has no name, the same name
+// as another sink, or no sink.
+func validateSinks(sinks []SinkConfig) error {
+	names := make(map[string]bool)
+	for _, s := range sinks {
+		if s.Name == "" || names[s.Name] {
+			return fmt.Errorf("%q: invalid sink name", s.Name)
+		}
+		if s.Sink == nil {
+			return fmt.Errorf("%q: nil sink", s.Name)
+		}
+		names[s.Name] = true
+	}
+	return nil
+}
+
+// writeSinks writes the given traceroute to all sinks in order and
+// returns the error of the first required sink that failed, if any.
+func (h *Handler) writeSinks(ctx context.Context, result TraceResult, payload []byte) error {
+	var requiredErr error
+	for _, s := range h.cfg.Sinks {
+		err := s.Sink.Write(ctx, result, payload)
+		if err == nil {
+			sinkWrites.WithLabelValues(s.Name, "ok").Inc()
+			continue
+		}
+		sinkWrites.WithLabelValues(s.Name, "failed").Inc()
+		log.Printf("context %p: failed to write traceroute %s to sink %q (error: %v)\n", ctx, result.UUID, s.Name, err)
+		if s.Required && requiredErr == nil {
+			requiredErr = fmt.Errorf("required sink %q: %w", s.Name, err)
+		}
+	}
+	return requiredErr
+}
@@ -0,0 +1,110 @@
+package triggertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSink records the traceroutes written to it.  If err is not nil,
+// writes fail with it.
+type fakeSink struct {
+	mu       sync.Mutex
+	results  []TraceResult
+	payloads [][]byte
+	err      error
+}
+
+func (fs *fakeSink) Write(ctx context.Context, result TraceResult, payload []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.results = append(fs.results, result)
+	fs.payloads = append(fs.payloads, payload)
+	return fs.err
+}
+
+func TestSinks(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	for _, sinks := range [][]SinkConfig{
+		{{Name: "", Sink: &fakeSink{}}},
+		{{Name: "a", Sink: &fakeSink{}}, {Name: "a", Sink: &fakeSink{}}},
+		{{Name: "a"}},
+	} {
+		if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{Sinks: sinks}); err == nil {
+			t.Errorf("NewHandler(%+v) = nil, want error", sinks)
+		}
+	}
+
+	first, second := &fakeSink{}, &fakeSink{}
+	optional := &fakeSink{err: errors.New("forced sink error")}
+	var results []TraceResult
+	handler, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{
+		Sinks: []SinkConfig{
+			{Name: "first", Sink: first, Required: true},
+			{Name: "optional", Sink: optional},
+			{Name: "second", Sink: second, Required: true},
+		},
+		OnComplete: func(r TraceResult) { results = append(results, r) },
+	})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	failed := promtest.ToFloat64(sinkWrites.WithLabelValues("optional", "failed"))
+	// The second traceroute is cached and the third one fails so
+	// it's not written to the sinks.
+	for i, ip := range []string{"3.4.5.6", "3.4.5.6", forceTracerouteErr} {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: ip, Cookie: int64(i + 1)})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+	}
+	for _, fs := range []*fakeSink{first, optional, second} {
+		if len(fs.results) != 2 {
+			t.Fatalf("got %d traceroutes in sink, want 2", len(fs.results))
+		}
+		for i, want := range []string{OutcomeFresh, OutcomeCached} {
+			if fs.results[i].Outcome != want || len(fs.payloads[i]) == 0 {
+				t.Errorf("sink traceroute %d = %+v with %d bytes, want outcome %q with payload", i, fs.results[i], len(fs.payloads[i]), want)
+			}
+		}
+	}
+	if n := promtest.ToFloat64(sinkWrites.WithLabelValues("optional", "failed")) - failed; n != 2 {
+		t.Errorf("got %v failed writes to optional sink, want 2", n)
+	}
+	// Failures of optional sinks don't fail traceroutes.
+	if len(results) != 3 || results[0].Err != nil || results[1].Err != nil {
+		t.Errorf("got results %+v, want 3 and the first two without errors", results)
+	}
+
+	// Failures of required sinks do.
+	required := &fakeSink{err: errors.New("forced sink error")}
+	results = nil
+	handler, err = newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{
+		Sinks:      []SinkConfig{{Name: "required", Sink: required, Required: true}},
+		OnComplete: func(r TraceResult) { results = append(results, r) },
+	})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	sinkErrors := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcomeSinkError))
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00000", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: 1})
+	handler.Close(context.TODO(), time.Now(), "00000")
+	waitForTrace(t, handler)
+	if len(results) != 1 || results[0].Outcome != OutcomeError || !errors.Is(results[0].Err, required.err) {
+		t.Errorf("got results %+v, want one failed with %v", results, required.err)
+	}
+	if n := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcomeSinkError)) - sinkErrors; n != 1 {
+		t.Errorf("got %v sink errors, want 1", n)
+	}
+}
@@ -0,0 +1,35 @@
+package triggertrace
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the OpenTelemetry tracer of this package.
+// Spans are no-ops unless a tracer provider is registered with otel.
+const instrumentationName = "github.com/m-lab/traceroute-caller/internal/triggertrace"
+
+// startSpan starts a span with the given name for the traceroute with
+// the given UUID to the given IP address.
+func startSpan(ctx context.Context, name, uuid, remoteIP string) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(
+		attribute.String("uuid", uuid),
+		attribute.String("destination", remoteIP),
+	))
+}
+
+// endSpan ends the given span and records the given errors (if any) in
+// it.
+func endSpan(span trace.Span, errs ...error) {
+	for _, err := range errs {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
@@ -0,0 +1,66 @@
+package triggertrace
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSpans(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	sr := tracetest.NewSpanRecorder()
+	saveProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(saveProvider)
+
+	handler, err := newHandler(&fakeTracer{})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: 1})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+	handler.Wait()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range sr.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["triggertrace.Trace"]
+	if !ok {
+		t.Fatalf("got spans %v, want a triggertrace.Trace span", spans)
+	}
+	for _, name := range []string{"triggertrace.Parse", "triggertrace.ExtractHops", "triggertrace.Annotate"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("got no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the triggertrace.Trace span", name)
+		}
+	}
+	wantAttrs := map[attribute.Key]string{"uuid": uuid.FromCookie(1), "destination": "3.4.5.6"}
+	for _, attr := range root.Attributes() {
+		if want, ok := wantAttrs[attr.Key]; ok {
+			if got := attr.Value.AsString(); got != want {
+				t.Errorf("got attribute %s=%q, want %q", attr.Key, got, want)
+			}
+			delete(wantAttrs, attr.Key)
+		}
+	}
+	if len(wantAttrs) != 0 {
+		t.Errorf("got no attributes %v", wantAttrs)
+	}
+}
@@ -6,8 +6,10 @@ package triggertrace
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"strconv"
 	"sync"
@@ -17,26 +19,154 @@ import (
 	"github.com/m-lab/traceroute-caller/hopannotation"
 	"github.com/m-lab/traceroute-caller/internal/ipcache"
 	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/m-lab/traceroute-caller/tracer"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
+	tracesSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_traces_skipped_total",
+			Help: "The number of traceroutes that were skipped by the trigger handler",
+		},
+		[]string{"reason"},
+	)
+	triggersCollapsed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "triggertrace_triggers_collapsed_total",
+			Help: "The number of triggers that were collapsed into a pending traceroute to the same destination",
+		},
+	)
+	traceOutcomes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_trace_outcomes_total",
+			Help: "The number of processed triggers by traceroute outcome",
+		},
+		[]string{"outcome"},
+	)
+	hopsPerTrace = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "triggertrace_hops_per_trace",
+			Help:    "The number of responsive hops of fresh traceroutes (zero if none of the probes were answered)",
+			Buckets: prometheus.LinearBuckets(0, 2, 21),
+		},
+	)
+	annotationsSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "triggertrace_annotations_skipped_total",
+			Help: "The number of traceroutes whose hops were not annotated",
+		},
+		[]string{"reason"},
+	)
+
 	// Variables to aid in black-box testing.
 	netInterfaceAddrs = net.InterfaceAddrs
 )
 
+// Labels of the trace outcomes metric.  Each processed trigger is
+// counted exactly once.
+const (
+	outcomeCompleted     = "completed"      // the traceroute has responsive hops
+	outcomeAllTimeout    = "all_timeout"    // none of the probes were answered
+	outcomeCached        = "cached"         // the traceroute was obtained from the cache
+	outcomeTraceError    = "trace_error"    // the traceroute couldn't be obtained
+	outcomeParseError    = "parse_error"    // the traceroute output couldn't be parsed
+	outcomeExtractError  = "extract_error"  // no hops could be extracted from the output
+	outcomeAnnotateError = "annotate_error" // some or all hops couldn't be annotated
+	outcomeSinkError     = "sink_error"     // a required sink failed
+)
+
+// Annotation scopes (see Config.AnnotateScope).
+const (
+	annotateScopeAll       = "all"
+	annotateScopeEndpoints = "endpoints"
+)
+
+// Config contains configuration parameters of the handler.
+type Config struct {
+	MinUsefulHops      int    // archive only traceroutes with this many responsive hops (0 archives all)
+	DisableAnnotation  bool   // don't annotate and archive hops
+	CombinedOutput     bool   // append hop annotations to traceroute files (see HookedTracer)
+	AnnotateScope      string // hops to annotate: "all" (default) or "endpoints"
+	CookieWidth        int    // width of cookies in UUIDs (0 is tracer.DefaultCookieWidth)
+	DeadLetterDir      string // where unparsable traceroute output is kept (empty discards it)
+	DeadLetterMaxBytes int64  // size limit of DeadLetterDir (default 64 MiB)
+
+	CandidateTracers map[string]ipcache.Tracer // other traceroute tools run for each trigger, keyed by label
+	BreakerFailures  int                       // consecutive failures within BreakerWindow that open the breaker (0 disables it)
+	BreakerWindow    time.Duration             // see BreakerFailures
+	BreakerCooldown  time.Duration             // how long the breaker stays open
+	DailyProbeBudget int                       // probes per UTC day of all traceroute tools (0 is unlimited)
+	ProbeRate        int                       // average probes per second of all traceroute tools (0 is unlimited)
+	Workers          int                       // triggers processed at the same time (0 is unlimited)
+	QueueSize        int                       // triggers queued while all workers are busy
+	PreCheck         bool                      // ping destinations first and skip unreachable ones (see Pinger)
+	PreCheckTimeout  time.Duration             // ping timeout (0 leaves it to the traceroute tool)
+
+	TriggerDebounce time.Duration     // collapse triggers for a destination into its pending traceroute
+	DisableCache    bool              // run a new traceroute for every trigger (for debugging)
+	SampleRate      float64           // probability that an uncached destination is traced (0 means 1)
+	RecordSockID    bool              // record the socket ID of triggers in traceroute metadata
+	OnComplete      func(TraceResult) // called synchronously after each primary traceroute
+	Sinks           []SinkConfig      // outputs of primary traceroutes, written before OnComplete
+
+	// CookieFunc derives cookies (the socket cookie is used if it's
+	// nil or fails) and UUIDFunc UUIDs (derived from cookies if it's
+	// nil or returns an invalid UUID).
+	CookieFunc        func(uuid string, sockID *inetdiag.SockID) (string, error)
+	UUIDFunc          func(sockID *inetdiag.SockID, t time.Time) string
+	DualStackResolver func(ctx context.Context, remoteIP string) ([]string, error) // see LookupDualStack
+}
+
+// wrap returns the given traceroute tool wrapped in a circuit breaker,
+// a probe rate limiter, a probe budget, and a reachability pre-check
+// if they are enabled.
+func (cfg Config) wrap(tracetool ipcache.Tracer, label string, budget *probeBudget, limiter *rateLimiter) ipcache.Tracer {
+	if tracetool == nil {
+		return nil
+	}
+	pinger, _ := tracetool.(Pinger)
+	if cfg.BreakerFailures > 0 {
+		tracetool = newBreaker(tracetool, label, cfg.BreakerFailures, cfg.BreakerWindow, cfg.BreakerCooldown)
+	}
+	if limiter != nil {
+		tracetool = &rateTracer{Tracer: tracetool, limiter: limiter}
+	}
+	if budget != nil {
+		tracetool = &budgetTracer{Tracer: tracetool, budget: budget}
+	}
+	if cfg.PreCheck && pinger != nil {
+		tracetool = &preCheckTracer{Tracer: tracetool, pinger: pinger, timeout: cfg.PreCheckTimeout}
+	}
+	return tracetool
+}
+
 // Destination is the host to run a traceroute to.
 type Destination struct {
-	RemoteIP string
-	Cookie   string
+	RemoteIP   string
+	Cookie     string
+	SockID     *tracer.SockID // the triggering socket, if recorded
+	UUID       string         // generated by Config.UUIDFunc, if any
+	CampaignID string         // shared by dual-stack traceroutes, if any
+}
+
+// String returns the remote IP and cookie of the destination.
+func (d Destination) String() string {
+	return fmt.Sprintf("{%s %s}", d.RemoteIP, d.Cookie)
 }
 
 // FetchTracer is the interface for obtaining a traceroute.  The
 // implementation will return the traceroute from a recent entry in the
 // cache (if it exists) in order to avoid running multiple traceroutes to
-// the same destination in a short time.
+// the same destination in a short time.  Entries and Lookup query the
+// cache without obtaining a traceroute.
 type FetchTracer interface {
-	FetchTrace(remoteIP, cookie string) ([]byte, error)
+	FetchTrace(ctx context.Context, remoteIP, cookie string) ([]byte, error)
+	FetchTraceInfo(ctx context.Context, remoteIP, cookie string) ([]byte, ipcache.Fetch, error)
+	Entries() []ipcache.Entry
+	Lookup(ip string) (cachedUUID string, expiresAt time.Time, ok bool)
 }
 
 // ParseTracer is the interface for parsing raw traceroutes obtained
@@ -45,6 +175,16 @@ type ParseTracer interface {
 	ParseRawData(rawData []byte) (parser.ParsedData, error)
 }
 
+// HookedTracer is the interface for traceroute tools whose writes can be
+// hooked (e.g., tracer.Scamper).  The write filter is called with the
+// traceroute data and returns false if the traceroute should not be
+// written.  The trailer is called with the traceroute data and returns
+// additional JSONL lines to write after it in the same file.
+type HookedTracer interface {
+	SetWriteFilter(filter func(rawData []byte) bool)
+	SetTrailer(trailer func(ctx context.Context, rawData []byte) []byte)
+}
+
 // AnnotateAndArchiver is the interface for annotating IP addresses and
 // archiving them.
 type AnnotateAndArchiver interface {
@@ -52,42 +192,160 @@ type AnnotateAndArchiver interface {
 	WriteAnnotations(map[string]*annotator.ClientAnnotations, time.Time) []error
 }
 
+// HopArchiver is the interface for hop annotators that can also request
+// the annotations of only some of the hops they archive (the others are
+// archived without annotations), annotate all of the hops of a
+// traceroute whether or not they were already archived today and
+// marshal them as JSONL records, and archive the details (e.g., ICMP
+// extensions and round-trip times) of hops (e.g.,
+// hopannotation.HopCache).
+type HopArchiver interface {
+	AnnotateAndArchiver
+	AnnotateScoped(context.Context, []string, map[string]bool, time.Time) (map[string]*annotator.ClientAnnotations, []error)
+	AnnotateTrace(context.Context, []string, map[string]bool) (map[string]*annotator.ClientAnnotations, []error)
+	MarshalAnnotations(map[string]*annotator.ClientAnnotations, hopannotation.HopDetails, time.Time) ([]byte, []error)
+	WriteAnnotationsWithDetails(map[string]*annotator.ClientAnnotations, hopannotation.HopDetails, time.Time) []error
+}
+
 // Handler implements the tcp-info/eventsocket.Handler's interface.
 type Handler struct {
 	Destinations     map[string]Destination // key is UUID
 	DestinationsLock sync.Mutex
 	LocalIPs         []*net.IP
 	IPCache          FetchTracer
+	Candidates       map[string]FetchTracer // key is tracer label
 	Parser           ParseTracer
 	HopAnnotator     AnnotateAndArchiver
-	done             chan struct{} // For testing.
+	cfg              Config
+	tracetool        ipcache.Tracer           // primary traceroute tool (for copies and file names)
+	deadLetters      *deadLetters             // nil if DeadLetterDir is empty
+	writeFiltered    bool                     // the traceroute tool has a write filter
+	pending          map[string][]Destination // key is remote IP
+	pendingLock      sync.Mutex
+	inflight         sync.WaitGroup // traceroutes triggered by Close
+	pool             *workPool      // nil if the number of workers is unlimited
+	done             chan struct{}  // For testing.
 }
 
 // NewHandler returns a new instance of Handler.
-func NewHandler(ctx context.Context, tracetool ipcache.Tracer, ipcCfg ipcache.Config, newParser parser.TracerouteParser, haCfg hopannotation.Config) (*Handler, error) {
-	ipCache, err := ipcache.New(ctx, tracetool, ipcCfg)
-	if err != nil {
+func NewHandler(ctx context.Context, tracetool ipcache.Tracer, ipcCfg ipcache.Config, newParser parser.TracerouteParser, haCfg hopannotation.Config, hCfg Config) (*Handler, error) {
+	if hCfg.MinUsefulHops < 0 {
+		return nil, fmt.Errorf("%d: invalid minimum number of useful hops", hCfg.MinUsefulHops)
+	}
+	if hCfg.SampleRate < 0 || hCfg.SampleRate > 1 || math.IsNaN(hCfg.SampleRate) {
+		return nil, fmt.Errorf("%v: invalid sample rate", hCfg.SampleRate)
+	}
+	if hCfg.TriggerDebounce < 0 {
+		return nil, fmt.Errorf("%v: invalid trigger debounce", hCfg.TriggerDebounce)
+	}
+	if hCfg.Workers < 0 || hCfg.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid worker pool configuration: %d workers, %d queue size", hCfg.Workers, hCfg.QueueSize)
+	}
+	if err := validateSinks(hCfg.Sinks); err != nil {
 		return nil, err
 	}
-	myIPs, err := localIPs()
+	if err := tracer.ValidateCookieWidth(hCfg.CookieWidth); err != nil {
+		return nil, err
+	}
+	if hCfg.PreCheckTimeout < 0 {
+		return nil, fmt.Errorf("%v: invalid pre-check timeout", hCfg.PreCheckTimeout)
+	}
+	switch hCfg.AnnotateScope {
+	case "", annotateScopeAll, annotateScopeEndpoints:
+	default:
+		return nil, fmt.Errorf("%q: invalid annotation scope", hCfg.AnnotateScope)
+	}
+	if hCfg.PreCheck {
+		for label, tool := range hCfg.CandidateTracers {
+			if _, ok := tool.(Pinger); !ok {
+				return nil, fmt.Errorf("%q: candidate tracer doesn't support pre-checks (%T)", label, tool)
+			}
+		}
+		if _, ok := tracetool.(Pinger); !ok && tracetool != nil {
+			return nil, fmt.Errorf("traceroute tool doesn't support pre-checks (%T)", tracetool)
+		}
+	}
+	if hCfg.DailyProbeBudget < 0 {
+		return nil, fmt.Errorf("%d: invalid daily probe budget", hCfg.DailyProbeBudget)
+	}
+	if hCfg.ProbeRate < 0 {
+		return nil, fmt.Errorf("%d: invalid probe rate", hCfg.ProbeRate)
+	}
+	if hCfg.BreakerFailures < 0 || (hCfg.BreakerFailures > 0 && (hCfg.BreakerWindow <= 0 || hCfg.BreakerCooldown <= 0)) {
+		return nil, fmt.Errorf("invalid circuit breaker configuration: %d failures, %v window, %v cooldown", hCfg.BreakerFailures, hCfg.BreakerWindow, hCfg.BreakerCooldown)
+	}
+	var budget *probeBudget
+	if hCfg.DailyProbeBudget > 0 {
+		budget = &probeBudget{limit: hCfg.DailyProbeBudget, parser: newParser}
+	}
+	var limiter *rateLimiter
+	if hCfg.ProbeRate > 0 {
+		limiter = newRateLimiter(hCfg.ProbeRate, newParser)
+	}
+	primary := hCfg.wrap(tracetool, ipcCfg.Label, budget, limiter)
+	ipCache, err := hCfg.fetchTracer(ctx, primary, ipcCfg, tracetool)
 	if err != nil {
 		return nil, err
 	}
-	hopCache, err := hopannotation.New(ctx, haCfg)
+	myIPs, err := localIPs()
 	if err != nil {
 		return nil, err
 	}
-	return &Handler{
+	h := &Handler{
 		Destinations: make(map[string]Destination),
 		LocalIPs:     myIPs,
 		IPCache:      ipCache,
+		Candidates:   make(map[string]FetchTracer),
+		pending:      make(map[string][]Destination),
 		Parser:       newParser,
-		HopAnnotator: hopCache,
-	}, nil
+		cfg:          hCfg,
+		tracetool:    tracetool,
+	}
+	if hCfg.DeadLetterDir != "" {
+		if h.deadLetters, err = newDeadLetters(hCfg.DeadLetterDir, hCfg.DeadLetterMaxBytes); err != nil {
+			return nil, err
+		}
+	}
+	if hCfg.Workers > 0 {
+		h.pool = newWorkPool(ctx, hCfg.Workers, hCfg.QueueSize)
+	}
+	for label, candidate := range hCfg.CandidateTracers {
+		if label == "" || label == ipcCfg.Label {
+			return nil, fmt.Errorf("%q: invalid candidate tracer label", label)
+		}
+		candidateCfg := ipcCfg
+		candidateCfg.Label = label
+		candidateCache, err := hCfg.fetchTracer(ctx, hCfg.wrap(candidate, label, budget, limiter), candidateCfg, candidate)
+		if err != nil {
+			return nil, err
+		}
+		h.Candidates[label] = candidateCache
+	}
+	if !hCfg.DisableAnnotation {
+		hopCache, err := hopannotation.New(ctx, haCfg)
+		if err != nil {
+			return nil, err
+		}
+		h.HopAnnotator = hopCache
+		if hCfg.CombinedOutput {
+			ht, ok := tracetool.(HookedTracer)
+			if !ok {
+				return nil, fmt.Errorf("traceroute tool doesn't support combined output (%T)", tracetool)
+			}
+			ht.SetTrailer(h.annotationTrailer)
+		}
+	}
+	if hCfg.MinUsefulHops > 0 {
+		h.writeFiltered = h.setWriteFilter(tracetool)
+		for _, candidate := range hCfg.CandidateTracers {
+			h.setWriteFilter(candidate)
+		}
+	}
+	return h, nil
 }
 
 // Open is called when a network connection is opened.
-// Note that this function doesn't use timestamp.
+// Note that this function only passes timestamp to Config.UUIDFunc.
 func (h *Handler) Open(ctx context.Context, timestamp time.Time, uuid string, sockID *inetdiag.SockID) {
 	if sockID == nil {
 		log.Printf("warning: sockID is nil")
@@ -107,6 +365,33 @@ func (h *Handler) Open(ctx context.Context, timestamp time.Time, uuid string, so
 		// TODO(SaiedKazemi): Add a metric here.
 		log.Printf("warning: uuid for SockID %+v is empty\n", *sockID)
 	}
+	if h.cfg.CookieFunc != nil {
+		cookie, err := h.cfg.CookieFunc(uuid, sockID)
+		if err == nil {
+			err = tracer.ValidateCookie(cookie)
+		}
+		if err != nil {
+			log.Printf("context %p: failed to derive cookie for UUID %q, using socket cookie (error: %v)\n", ctx, uuid, err)
+		} else {
+			destination.Cookie = cookie
+		}
+	}
+	if h.cfg.UUIDFunc != nil {
+		u := h.cfg.UUIDFunc(sockID, timestamp)
+		if err := tracer.ValidateUUID(u); err != nil {
+			log.Printf("context %p: failed to generate UUID for SockID %+v, using default UUID (error: %v)\n", ctx, *sockID, err)
+		} else {
+			destination.UUID = u
+		}
+	}
+	if h.cfg.RecordSockID {
+		destination.SockID = &tracer.SockID{
+			SrcIP:   sockID.SrcIP,
+			SrcPort: sockID.SPort,
+			DstIP:   sockID.DstIP,
+			DstPort: sockID.DPort,
+		}
+	}
 	h.Destinations[uuid] = destination
 }
 
@@ -122,42 +407,234 @@ func (h *Handler) Close(ctx context.Context, timestamp time.Time, uuid string) {
 	}
 	delete(h.Destinations, uuid)
 	h.DestinationsLock.Unlock()
-	// This goroutine will live for a few minutes and terminate
+	// There's no point in tracing ourselves.
+	if ip := net.ParseIP(destination.RemoteIP); ip != nil && h.isLocalIP(ip) {
+		tracesSkipped.WithLabelValues("self_destination_skipped").Inc()
+		log.Printf("context %p: skipping traceroute to local address %q\n", ctx, destination.RemoteIP)
+		return
+	}
+	// Cached traceroutes are cheap so they aren't sampled.
+	if !h.cfg.sampled(destination.RemoteIP, timestamp) {
+		if _, _, cached := h.Lookup(destination.RemoteIP); !cached {
+			tracesSkipped.WithLabelValues("sampled_out").Inc()
+			return
+		}
+	}
+	if h.cfg.TriggerDebounce > 0 {
+		h.debounce(ctx, destination)
+		return
+	}
+	h.dispatch(ctx, destination)
+}
+
+// dispatch obtains, annotates, and archives the traceroute to the given
+// destination in the background.  If the number of workers is limited
+// and they are all busy and their queue is full, the trigger is dropped
+// so that pending work can't grow without bounds.
+func (h *Handler) dispatch(ctx context.Context, dest Destination, collapsed ...Destination) {
+	h.inflight.Add(1)
+	// This function will run for a few minutes and terminate
 	// after all hop annotations are archived.
-	go h.traceAnnotateAndArchive(ctx, destination)
+	run := func() {
+		defer h.inflight.Done()
+		h.traceDualStack(ctx, dest, collapsed...)
+	}
+	if h.pool == nil {
+		go run()
+		return
+	}
+	drop := func() {
+		defer h.inflight.Done()
+		tracesSkipped.WithLabelValues("dropped_shutdown").Add(float64(1 + len(collapsed)))
+		log.Printf("context %p: dropping traceroute to %q because the handler is shutting down\n", ctx, dest)
+	}
+	if !h.pool.submit(run, drop) {
+		h.inflight.Done()
+		tracesSkipped.WithLabelValues("dropped_overload").Add(float64(1 + len(collapsed)))
+		log.Printf("context %p: dropping traceroute to %q because all workers are busy\n", ctx, dest)
+	}
+}
+
+// Wait waits for the traceroutes triggered by Close so far (including
+// debounced ones) to be archived or dropped.
+func (h *Handler) Wait() {
+	h.inflight.Wait()
+}
+
+// debounce schedules a traceroute to the given destination after the
+// debounce time unless one is already pending, in which case the
+// destination is added to the pending traceroute.
+func (h *Handler) debounce(ctx context.Context, dest Destination) {
+	h.pendingLock.Lock()
+	defer h.pendingLock.Unlock()
+	if dests, ok := h.pending[dest.RemoteIP]; ok {
+		h.pending[dest.RemoteIP] = append(dests, dest)
+		triggersCollapsed.Inc()
+		return
+	}
+	h.pending[dest.RemoteIP] = []Destination{dest}
+	h.inflight.Add(1)
+	time.AfterFunc(h.cfg.TriggerDebounce, func() {
+		defer h.inflight.Done()
+		h.pendingLock.Lock()
+		dests := h.pending[dest.RemoteIP]
+		delete(h.pending, dest.RemoteIP)
+		h.pendingLock.Unlock()
+		h.dispatch(ctx, dests[0], dests[1:]...)
+	})
 }
 
 // traceAnnotateAndArchive runs a traceroute, annotates the hops
-// in the traceroute output, and archives the annotations.
-func (h *Handler) traceAnnotateAndArchive(ctx context.Context, dest Destination) {
+// in the traceroute output, and archives the annotations.  If there
+// is no hop annotator, hops are not annotated.  Collapsed destinations
+// (if any) get their copies of the traceroute afterwards.
+func (h *Handler) traceAnnotateAndArchive(ctx context.Context, dest Destination, collapsed ...Destination) {
+	tracesByFamily.WithLabelValues(ipFamily(dest.RemoteIP)).Inc()
+	traceUUID := dest.traceUUID(h.cfg.CookieWidth)
+	// Failures take precedence over the traceroute having been cached.
+	outcome, cached := outcomeCompleted, false
 	defer func() {
-		if h.done != nil {
-			close(h.done)
+		if cached && outcome == outcomeCompleted {
+			outcome = outcomeCached
 		}
+		traceOutcomes.WithLabelValues(outcome).Inc()
 	}()
-	rawData, err := h.IPCache.FetchTrace(dest.RemoteIP, dest.Cookie)
-	if err != nil {
+	traceCtx, span := startSpan(withDestination(ctx, dest), "triggertrace.Trace", traceUUID, dest.RemoteIP)
+	defer span.End()
+	// Candidate traceroutes are only written by their traceroute
+	// tools so there's nothing else to do with their results.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for label, candidate := range h.Candidates {
+		wg.Add(1)
+		go func(label string, candidate FetchTracer) {
+			defer wg.Done()
+			if _, err := candidate.FetchTrace(traceCtx, dest.RemoteIP, dest.Cookie); err != nil {
+				log.Printf("context %p: failed to run a %s traceroute to %q (error: %v)\n", ctx, label, dest, err)
+			}
+		}(label, candidate)
+	}
+	result := TraceResult{Destination: dest}
+	written := true
+	var rawData []byte
+	var fetch ipcache.Fetch
+	if h.cfg.OnComplete != nil || len(h.cfg.Sinks) > 0 {
+		result.UUID = traceUUID
+		defer func() {
+			if err := h.complete(ctx, &result, fetch, written, rawData); err != nil && outcome == outcomeCompleted {
+				outcome = outcomeSinkError
+			}
+		}()
+	}
+	start := time.Now()
+	rawData, fetch, err := h.IPCache.FetchTraceInfo(traceCtx, dest.RemoteIP, dest.Cookie)
+	result.Duration = time.Since(start)
+	if len(collapsed) > 0 {
+		defer h.copyTrace(ctx, rawData, err, collapsed)
+	}
+	switch {
+	case errors.Is(err, tracer.ErrTraceTruncated) && len(rawData) > 0:
+		// What's left of the traceroute was written and may still
+		// have hops but it isn't cached.
+		log.Printf("context %p: traceroute to %q was truncated (error: %v)\n", ctx, dest, err)
+	case err != nil:
 		log.Printf("context %p: failed to run a traceroute to %q (error: %v)\n", ctx, dest, err)
+		result.Err = err
+		outcome = outcomeTraceError
 		return
 	}
+	cached = fetch.Cached
+	_, parseSpan := startSpan(traceCtx, "triggertrace.Parse", traceUUID, dest.RemoteIP)
 	parsedData, err := h.Parser.ParseRawData(rawData)
+	endSpan(parseSpan, err)
 	if err != nil {
 		log.Printf("context %p: failed to parse traceroute output (error: %v)\n", ctx, err)
+		outcome = outcomeParseError
+		h.deadLetter(cached, traceUUID, dest.RemoteIP, "parse", err, rawData)
 		return
 	}
+	_, extractSpan := startSpan(traceCtx, "triggertrace.ExtractHops", traceUUID, dest.RemoteIP)
 	hops := parsedData.ExtractHops()
-	if len(hops) == 0 {
+	extractSpan.End()
+	// The write filter of the traceroute tool drops traceroutes with
+	// too few hops, whether or not they have any hops at all.
+	belowMinHops := len(hops) < h.cfg.MinUsefulHops
+	if belowMinHops {
+		tracesSkipped.WithLabelValues("below_min_hops").Inc()
+		written = !h.writeFiltered
+	}
+	if len(hops) == 0 && !sentProbes(parsedData) {
+		outcome = outcomeExtractError
 		log.Printf("context %p: failed to extract hops from traceroute %+v\n", ctx, string(rawData))
+		h.deadLetter(cached, traceUUID, dest.RemoteIP, "extract", errNoHops, rawData)
+		return
+	}
+	if !cached {
+		// Copies of cached traceroutes would skew the distribution
+		// towards popular destinations.
+		hopsPerTrace.Observe(float64(len(hops)))
+	}
+	if len(hops) == 0 {
+		// Probes were sent but none of them were answered.
+		outcome = outcomeAllTimeout
+		return
+	}
+	if belowMinHops {
+		log.Printf("context %p: skipping traceroute to %q with %d responsive hops (min: %d)\n", ctx, dest.RemoteIP, len(hops), h.cfg.MinUsefulHops)
+		return
+	}
+	if h.HopAnnotator == nil {
+		annotationsSkipped.WithLabelValues("disabled").Inc()
+		return
+	}
+	if h.cfg.CombinedOutput {
+		// The hops were annotated when the traceroute was written.
 		return
 	}
+	if !annotateAndArchive(ctx, traceCtx, h.HopAnnotator, parsedData, hops, h.cfg.AnnotateScope, traceUUID, dest.RemoteIP) {
+		outcome = outcomeAnnotateError
+	}
+}
+
+// copyTrace writes copies of the given traceroute, which failed with
+// traceErr if not nil, for the given collapsed destinations (see
+// Config.TriggerDebounce) without running or fetching traceroutes
+// again.  If the traceroute failed, so do the collapsed destinations.
+func (h *Handler) copyTrace(ctx context.Context, rawData []byte, traceErr error, collapsed []Destination) {
+	if errors.Is(traceErr, tracer.ErrTraceTruncated) && len(rawData) > 0 {
+		traceErr = nil
+	}
+	for _, d := range collapsed {
+		err := traceErr
+		if err == nil {
+			err = h.tracetool.CachedTraceContext(withDestination(ctx, d), d.Cookie, d.traceUUID(h.cfg.CookieWidth), time.Now(), rawData)
+		}
+		if err != nil {
+			log.Printf("context %p: failed to get a traceroute to %q (error: %v)\n", ctx, d, err)
+			traceOutcomes.WithLabelValues(outcomeTraceError).Inc()
+			continue
+		}
+		traceOutcomes.WithLabelValues(outcomeCached).Inc()
+	}
+}
 
+// annotateAndArchive annotates the given hops of the given parsed
+// traceroute that are in scope (see Config.AnnotateScope) with ha and
+// archives their annotations.  Errors are logged with ctx and the spans
+// are children of the span of spanCtx.  It returns false if some or all
+// hops couldn't be annotated.
+func annotateAndArchive(ctx, spanCtx context.Context, ha AnnotateAndArchiver, parsedData parser.ParsedData, hops []string, scope, traceUUID, remoteIP string) bool {
 	traceStartTime := parsedData.StartTime()
-	annotations, allErrs := h.HopAnnotator.Annotate(ctx, hops, traceStartTime)
+	annotateCtx, annotateSpan := startSpan(spanCtx, "triggertrace.Annotate", traceUUID, remoteIP)
+	annotations, allErrs := annotateScoped(annotateCtx, ha, parsedData, hops, scope, traceStartTime)
+	endSpan(annotateSpan, allErrs...)
 	if allErrs != nil {
 		log.Printf("context %p: failed to annotate some or all hops (errors: %+v)\n", ctx, allErrs)
 	}
 	if len(annotations) > 0 {
-		allErrs := h.HopAnnotator.WriteAnnotations(annotations, traceStartTime)
+		_, writeSpan := startSpan(spanCtx, "triggertrace.WriteAnnotations", traceUUID, remoteIP)
+		allErrs := writeAnnotations(ha, parsedData, annotations, traceStartTime)
+		endSpan(writeSpan, allErrs...)
 		if allErrs != nil {
 			log.Printf("context %p: failed to write some or all annotations due to the following error(s):\n", ctx)
 			for _, err := range allErrs {
@@ -165,11 +642,231 @@ func (h *Handler) traceAnnotateAndArchive(ctx context.Context, dest Destination)
 			}
 		}
 	}
+	return allErrs == nil
+}
+
+// sentProbes returns true if the given parsed traceroute reports that it
+// sent probes.
+func sentProbes(parsedData parser.ParsedData) bool {
+	pc, ok := parsedData.(parser.ProbeCounter)
+	return ok && pc.ProbeCount() > 0
+}
+
+// traceUUID returns the UUID of the traceroute to the given destination:
+// the UUID generated for it if any, and the UUID derived from its socket
+// cookie otherwise.
+func (d Destination) traceUUID(width int) string {
+	if d.UUID != "" {
+		return d.UUID
+	}
+	if c, err := strconv.ParseUint(d.Cookie, 16, 64); err == nil {
+		return tracer.UUIDFromCookie(c, width)
+	}
+	return ""
+}
+
+// annotationTrailer annotates all of the hops of the given traceroute,
+// including those already annotated today for other traceroutes, and
+// returns their annotations as JSONL records to be written at the end
+// of the traceroute file (see Config.CombinedOutput).
+func (h *Handler) annotationTrailer(ctx context.Context, rawData []byte) []byte {
+	am, ok := h.HopAnnotator.(HopArchiver)
+	if !ok {
+		return nil
+	}
+	parsedData, err := h.Parser.ParseRawData(rawData)
+	if err != nil {
+		log.Printf("context %p: failed to parse traceroute output (error: %v)\n", ctx, err)
+		return nil
+	}
+	hops := parsedData.ExtractHops()
+	if len(hops) == 0 {
+		return nil
+	}
+	var scope map[string]bool
+	if h.cfg.AnnotateScope == annotateScopeEndpoints {
+		scope = endpointHops(parsedData, hops)
+	}
+	annotations, allErrs := am.AnnotateTrace(ctx, hops, scope)
+	if allErrs != nil {
+		log.Printf("context %p: failed to annotate some or all hops (errors: %+v)\n", ctx, allErrs)
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	records, allErrs := am.MarshalAnnotations(annotations, hopDetails(parsedData), parsedData.StartTime())
+	if allErrs != nil {
+		log.Printf("context %p: failed to marshal some or all annotations (errors: %+v)\n", ctx, allErrs)
+	}
+	return records
+}
+
+// annotateScoped annotates the given hops of the given parsed traceroute
+// with ha.  If scope is "endpoints", only the annotations of its
+// endpoints are requested.  Annotators that don't implement
+// HopArchiver are only given the endpoints and the other hops are
+// returned without annotations.  Since such annotators can't tell
+// which of them were already archived, they're archived again for
+// every traceroute.
+func annotateScoped(ctx context.Context, ha AnnotateAndArchiver, parsedData parser.ParsedData, hops []string, scope string, traceStartTime time.Time) (map[string]*annotator.ClientAnnotations, []error) {
+	endpoints := endpointHops(parsedData, hops)
+	if scope != annotateScopeEndpoints || endpoints == nil {
+		return ha.Annotate(ctx, hops, traceStartTime)
+	}
+	if sa, ok := ha.(HopArchiver); ok {
+		return sa.AnnotateScoped(ctx, hops, endpoints, traceStartTime)
+	}
+	var scopedHops []string
+	for _, hop := range hops {
+		if endpoints[hop] {
+			scopedHops = append(scopedHops, hop)
+		}
+	}
+	var annotations map[string]*annotator.ClientAnnotations
+	var allErrs []error
+	if len(scopedHops) > 0 {
+		if annotations, allErrs = ha.Annotate(ctx, scopedHops, traceStartTime); allErrs != nil {
+			return nil, allErrs
+		}
+	}
+	for _, hop := range hops {
+		if !endpoints[hop] {
+			if annotations == nil {
+				annotations = make(map[string]*annotator.ClientAnnotations, len(hops))
+			}
+			annotations[hop] = nil
+		}
+	}
+	return annotations, nil
+}
+
+// endpointHops returns the set of the given hops of the given parsed
+// traceroute that are its destination or its farthest other responsive
+// hop, or nil if the parsed traceroute doesn't report them.
+func endpointHops(parsedData parser.ParsedData, hops []string) map[string]bool {
+	ee, ok := parsedData.(parser.EndpointExtractor)
+	if !ok {
+		return nil
+	}
+	dst, lastHop := ee.ExtractEndpoints()
+	endpoints := make(map[string]bool, 2)
+	for _, hop := range hops {
+		if hop == dst || hop == lastHop {
+			endpoints[hop] = true
+		}
+	}
+	return endpoints
+}
+
+// writeAnnotations writes out the given hop annotations with ha along
+// with the ICMP extensions and round-trip times of the hops that the
+// parsed traceroute reports if ha supports them.
+func writeAnnotations(ha AnnotateAndArchiver, parsedData parser.ParsedData, annotations map[string]*annotator.ClientAnnotations, traceStartTime time.Time) []error {
+	if dw, ok := ha.(HopArchiver); ok {
+		return dw.WriteAnnotationsWithDetails(annotations, hopDetails(parsedData), traceStartTime)
+	}
+	return ha.WriteAnnotations(annotations, traceStartTime)
+}
+
+// hopDetails returns the details of the hops that the given parsed
+// traceroute reports.
+func hopDetails(parsedData parser.ParsedData) hopannotation.HopDetails {
+	var details hopannotation.HopDetails
+	if ee, ok := parsedData.(parser.ExtensionExtractor); ok {
+		details.Extensions = ee.ExtractExtensions()
+	}
+	if re, ok := parsedData.(parser.RTTExtractor); ok {
+		details.RTTs = re.ExtractRTTs()
+	}
+	return details
+}
+
+// fetchTracer returns a traceroute cache for the given (wrapped)
+// traceroute tool or, if the cache is disabled, a FetchTracer that
+// always runs new traceroutes with it.
+func (cfg Config) fetchTracer(ctx context.Context, wrapped ipcache.Tracer, ipcCfg ipcache.Config, tracetool ipcache.Tracer) (FetchTracer, error) {
+	if cfg.DisableCache {
+		return newUncachedTracer(wrapped, ipcCfg.Label, cfg.CookieWidth), nil
+	}
+	cacheDisabled.WithLabelValues(ipcCfg.Label).Set(0)
+	ipcCfg.CookieWidth = cfg.CookieWidth
+	// Traceroutes are cached per configuration of the traceroute tool
+	// so that configuration changes take effect immediately.
+	if ch, ok := tracetool.(ipcache.ConfigHasher); ok && ipcCfg.ConfigHash == nil {
+		ipcCfg.ConfigHash = ch.ConfigHash
+	}
+	ipCache, err := ipcache.New(ctx, wrapped, ipcCfg)
+	if err != nil {
+		return nil, err
+	}
+	return ipCache, nil
+}
+
+// withDestination returns ctx carrying the socket ID (if recorded), the
+// UUID (if generated), and the campaign ID (if any) of the given
+// destination.
+func withDestination(ctx context.Context, dest Destination) context.Context {
+	if dest.SockID != nil {
+		ctx = tracer.WithSockID(ctx, *dest.SockID)
+	}
+	if dest.UUID != "" {
+		ctx = tracer.WithUUID(ctx, dest.UUID)
+	}
+	if dest.CampaignID != "" {
+		ctx = tracer.WithCampaignID(ctx, dest.CampaignID)
+	}
+	return ctx
+}
+
+// setWriteFilter prevents the given traceroute tool from writing
+// traceroutes that don't have enough responsive hops, if possible.
+// It returns true if the filter was set.
+func (h *Handler) setWriteFilter(tracetool ipcache.Tracer) bool {
+	if ht, ok := tracetool.(HookedTracer); ok {
+		ht.SetWriteFilter(h.isUseful)
+		return true
+	}
+	log.Printf("warning: traceroute tool doesn't support write filters (%T)\n", tracetool)
+	return false
+}
+
+// isUseful returns true if the given traceroute has at least the
+// configured minimum number of responsive hops.  Traceroutes that
+// cannot be parsed are considered useful so that they are archived
+// for later investigation.
+func (h *Handler) isUseful(rawData []byte) bool {
+	parsedData, err := h.Parser.ParseRawData(rawData)
+	if err != nil {
+		return true
+	}
+	return len(parsedData.ExtractHops()) >= h.cfg.MinUsefulHops
+}
+
+// CacheEntries returns a snapshot of the entries in the traceroute cache
+// or nil if there's no cache.
+func (h *Handler) CacheEntries() []ipcache.Entry {
+	if h.IPCache == nil {
+		return nil
+	}
+	return h.IPCache.Entries()
+}
+
+// Lookup returns the UUID and expiry time of the cached traceroute to
+// the given IP address, if any, so that external schedulers can decide
+// whether to trigger a traceroute.  It doesn't run a traceroute or
+// extend the lifetime of the cache entry.  It returns false if there's
+// no cache.
+func (h *Handler) Lookup(ip string) (cachedUUID string, expiresAt time.Time, ok bool) {
+	if h.IPCache == nil {
+		return "", time.Time{}, false
+	}
+	return h.IPCache.Lookup(ip)
 }
 
 // findDestination iterates through the local IPs to find which one of
 // the source and destination IPs specified in the given socket is indeed
-// the destination IP.
+// the destination IP.  If both are local, the destination IP is
+// returned and the traceroute is skipped by Close.
 func (h *Handler) findDestination(sockid *inetdiag.SockID) (Destination, error) {
 	srcIP := net.ParseIP(sockid.SrcIP)
 	if srcIP == nil {
@@ -197,6 +894,14 @@ func (h *Handler) findDestination(sockid *inetdiag.SockID) (Destination, error)
 			Cookie:   strconv.FormatUint(sockid.CookieUint64(), 16),
 		}, nil
 	}
+	if srcLocal && dstLocal {
+		// Loopback traffic or a misconfiguration.  The destination
+		// is recorded anyway so that Close skips it explicitly.
+		return Destination{
+			RemoteIP: sockid.DstIP,
+			Cookie:   strconv.FormatUint(sockid.CookieUint64(), 16),
+		}, nil
+	}
 	return Destination{}, fmt.Errorf("failed to find a local/remote IP pair in %+v", sockid)
 }
 
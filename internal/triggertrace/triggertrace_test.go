@@ -1,12 +1,19 @@
 package triggertrace
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -15,7 +22,11 @@ import (
 	"github.com/m-lab/traceroute-caller/hopannotation"
 	"github.com/m-lab/traceroute-caller/internal/ipcache"
 	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/m-lab/traceroute-caller/tracer"
+	"github.com/m-lab/uuid"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
@@ -32,10 +43,58 @@ func init() {
 type fakeTracer struct {
 	nTraces       int32
 	nCachedTraces int32
+	nWrites       int32
+	testdata      string // directory of traceroute files (default ./testdata)
+	writeFilter   func([]byte) bool
+	trailer       func(context.Context, []byte) []byte
+	lastWrite     []byte // last traceroute written, including its trailer
+	callsMu       sync.Mutex
+	sockIDs       []*tracer.SockID // socket IDs of traceroutes in call order
+	uuids         []string         // UUIDs of traceroutes in call order
+	campaignIDs   []string         // campaign IDs of traceroutes in call order
 }
 
-func (ft *fakeTracer) Trace(remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+func (ft *fakeTracer) recordCall(ctx context.Context, uuid string) {
+	ft.callsMu.Lock()
+	defer ft.callsMu.Unlock()
+	ft.sockIDs = append(ft.sockIDs, tracer.SockIDFromContext(ctx))
+	ft.uuids = append(ft.uuids, uuid)
+	ft.campaignIDs = append(ft.campaignIDs, tracer.CampaignIDFromContext(ctx))
+}
+
+func (ft *fakeTracer) SetWriteFilter(filter func([]byte) bool) {
+	ft.writeFilter = filter
+}
+
+func (ft *fakeTracer) SetTrailer(trailer func(context.Context, []byte) []byte) {
+	ft.trailer = trailer
+}
+
+func (ft *fakeTracer) write(ctx context.Context, data []byte) {
+	if ft.writeFilter == nil || ft.writeFilter(data) {
+		atomic.AddInt32(&ft.nWrites, 1)
+		if ft.trailer != nil {
+			data = append(append([]byte(nil), data...), ft.trailer(ctx, data)...)
+		}
+		ft.callsMu.Lock()
+		ft.lastWrite = data
+		ft.callsMu.Unlock()
+	}
+}
+
+func (ft *fakeTracer) LastWrite() []byte {
+	ft.callsMu.Lock()
+	defer ft.callsMu.Unlock()
+	return ft.lastWrite
+}
+
+func (ft *fakeTracer) Writes() int32 {
+	return atomic.LoadInt32(&ft.nWrites)
+}
+
+func (ft *fakeTracer) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
 	defer func() { atomic.AddInt32(&ft.nTraces, 1) }()
+	ft.recordCall(ctx, uuid)
 	var jsonl string
 	switch remoteIP {
 	case forceTracerouteErr:
@@ -43,25 +102,39 @@ func (ft *fakeTracer) Trace(remoteIP, cookie, uuid string, t time.Time) ([]byte,
 	case forceParseErr:
 		return []byte("forced parse error"), nil
 	case forceExtractErr:
-		jsonl = "./testdata/extract-error.jsonl"
+		jsonl = "extract-error.jsonl"
 	case forceAnnotateErr:
-		jsonl = "./testdata/annotate-error.jsonl"
+		jsonl = "annotate-error.jsonl"
 	default:
-		jsonl = "./testdata/valid.jsonl"
+		jsonl = "valid.jsonl"
+	}
+	dir := ft.testdata
+	if dir == "" {
+		dir = "./testdata"
 	}
-	content, err := ioutil.ReadFile(jsonl)
+	content, err := ioutil.ReadFile(filepath.Join(dir, jsonl))
 	if err != nil {
 		return nil, err
 	}
+	ft.write(ctx, content)
 	return content, nil
 }
 
-func (ft *fakeTracer) CachedTrace(cookie, uuid string, t time.Time, cachedTest []byte) error {
+func (ft *fakeTracer) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTest []byte) error {
 	defer func() { atomic.AddInt32(&ft.nCachedTraces, 1) }()
+	ft.recordCall(ctx, uuid)
+	ft.write(ctx, cachedTest)
 	fmt.Printf("\nCachedTrace()\n")
 	return nil
 }
 
+func (ft *fakeTracer) FilenameContext(ctx context.Context, cookie string, t time.Time) (string, error) {
+	if uuid := tracer.UUIDFromContext(ctx); uuid != "" {
+		return "/fake/" + uuid + ".jsonl", nil
+	}
+	return "/fake/" + cookie + ".jsonl", nil
+}
+
 func (ft *fakeTracer) DontTrace() {
 	log.Fatal("should not have called DontTrace()")
 }
@@ -78,6 +151,10 @@ type fakeAnnotator struct {
 	nAnnotates int32
 }
 
+func (fa *fakeAnnotator) Annotates() int32 {
+	return atomic.LoadInt32(&fa.nAnnotates)
+}
+
 func (fa *fakeAnnotator) Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error) {
 	defer func() { atomic.AddInt32(&fa.nAnnotates, 1) }()
 	annotations := make(map[string]*annotator.ClientAnnotations)
@@ -91,6 +168,11 @@ func (fa *fakeAnnotator) Annotate(ctx context.Context, ips []string) (map[string
 }
 
 func TestNewHandler(t *testing.T) {
+	// The interfaces of the handler are implemented by the real components.
+	var _ FetchTracer = &ipcache.IPCache{}
+	var _ HookedTracer = &tracer.Scamper{}
+	var _ HopArchiver = &hopannotation.HopCache{}
+
 	saveNetInterfaceAddrs := netInterfaceAddrs
 	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
 
@@ -121,12 +203,13 @@ func TestOpen(t *testing.T) {
 		sockID *inetdiag.SockID
 	}{
 		{"bad1", "", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "1.2.3.4"}}, // empty uuid
-		{"bad1", "00001", nil},                                                     // nil sockID
-		{"bad1", "00002", &inetdiag.SockID{SrcIP: "0.0.0.0"}},                      // DstIP empty
-		{"bad1", "00003", &inetdiag.SockID{SrcIP: "invalid IP"}},                   // SrcIP invalid
-		{"bad1", "00004", &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "4.3.2.1"}},    // no local IP
-		{"good1", "00005", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "1.2.3.4"}}, // SrcIP local
-		{"good2", "00006", &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "127.0.0.1"}}, // DstIP local
+		{"bad1", "00001", nil},                                                         // nil sockID
+		{"bad1", "00002", &inetdiag.SockID{SrcIP: "0.0.0.0"}},                          // DstIP empty
+		{"bad1", "00003", &inetdiag.SockID{SrcIP: "invalid IP"}},                       // SrcIP invalid
+		{"bad1", "00004", &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "4.3.2.1"}},        // no local IP
+		{"good1", "00005", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "1.2.3.4"}},     // SrcIP local
+		{"good2", "00006", &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "127.0.0.1"}},     // DstIP local
+		{"self1", "00007", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "11.22.33.44"}}, // both local
 	}
 	for _, test := range tests {
 		test := test
@@ -160,6 +243,9 @@ func TestClose(t *testing.T) {
 		{"bad6", "127.0.0.1", forceAnnotateErr, "00005", true, true, 1, 0},
 		{"good1", "127.0.0.1", "3.4.5.6", "00006", true, true, 1, 0},
 		{"good2", "4.5.6.7", "127.0.0.1", "00007", true, true, 1, 1},
+		{"self1", "127.0.0.1", "11.22.33.44", "00008", true, false, 0, 0},
+		{"self2", "11.22.33.44", "127.0.0.1", "00009", true, false, 0, 0},
+		{"self3", "::1", "::1", "00010", true, false, 0, 0},
 	}
 	for _, test := range tests {
 		test := test
@@ -202,21 +288,1153 @@ func TestClose(t *testing.T) {
 	}
 }
 
-func newHandler(tracer *fakeTracer) (*Handler, error) {
+func TestSelfDestination(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	tracer := &fakeTracer{}
+	handler, err := newHandler(tracer)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	skipped := promtest.ToFloat64(tracesSkipped.WithLabelValues("self_destination_skipped"))
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "11.22.33.44"})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	handler.Wait()
+	if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("self_destination_skipped")) - skipped; n != 1 {
+		t.Errorf("got %v skipped self destinations, want 1", n)
+	}
+	if n := tracer.Traces(); n != 0 {
+		t.Errorf("tracer.Traces() = %d, want 0", n)
+	}
+	if n := len(handler.Destinations); n != 0 {
+		t.Errorf("got %d destinations after Close(), want 0", n)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	handler, err := newHandler(&fakeTracer{})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	if entries := handler.CacheEntries(); len(entries) != 0 {
+		t.Fatalf("CacheEntries() = %+v, want none", entries)
+	}
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6"})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+	entries := handler.CacheEntries()
+	if len(entries) != 1 || entries[0].IP != "3.4.5.6" {
+		t.Fatalf("CacheEntries() = %+v, want one entry for 3.4.5.6", entries)
+	}
+
+	if uuid, expiresAt, ok := handler.Lookup("3.4.5.6"); !ok || uuid != entries[0].UUID || !expiresAt.Equal(entries[0].ExpiresAt) {
+		t.Errorf("Lookup() = %q, %v, %v, want %q, %v, true", uuid, expiresAt, ok, entries[0].UUID, entries[0].ExpiresAt)
+	}
+	if _, _, ok := handler.Lookup("4.5.6.7"); ok {
+		t.Error("Lookup(4.5.6.7) = true, want false")
+	}
+
+	// The cache entries are unavailable if the cache can't list them.
+	handler.IPCache = nil
+	if entries := handler.CacheEntries(); entries != nil {
+		t.Fatalf("CacheEntries() = %+v, want nil", entries)
+	}
+	if _, _, ok := handler.Lookup("3.4.5.6"); ok {
+		t.Error("Lookup() = true without a cache, want false")
+	}
+}
+
+func TestCloseParis(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	tests := []struct {
+		name           string
+		dstIP          string
+		wantNAnnotates int32
+	}{
+		{"bad1", forceParseErr, 0},
+		{"bad2", forceExtractErr, 0},
+		{"bad3", forceAnnotateErr, 1},
+		{"good1", "3.4.5.6", 1},
+	}
+	for i, test := range tests {
+		test := test
+		uuid := fmt.Sprintf("%05d", i)
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			tracer := &fakeTracer{testdata: "./testdata/paris"}
+			annotator := &fakeAnnotator{}
+			handler, err := newHandlerWithConfig(tracer, annotator, "paris", Config{})
+			if err != nil {
+				t.Fatalf("NewHandler() = %v, want nil", err)
+			}
+			handler.done = make(chan struct{})
+			sockID := &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP}
+			handler.Open(context.TODO(), time.Now(), uuid, sockID)
+			handler.Close(context.TODO(), time.Now(), uuid)
+			waitForTrace(t, handler)
+			if n := tracer.Traces(); n != 1 {
+				t.Fatalf("tracer.Traces() = %d, want 1", n)
+			}
+			if n := annotator.Annotates(); n != test.wantNAnnotates {
+				t.Fatalf("annotator.Annotates() = %d, want %d", n, test.wantNAnnotates)
+			}
+		})
+	}
+}
+
+func TestICMPExtensions(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// The traceroute in ./testdata/regular/valid.jsonl has an MPLS
+	// label stack in the replies of 4.69.140.198.
+	tracer := &fakeTracer{testdata: "./testdata/regular"}
+	handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "regular", Config{})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	dir := t.TempDir()
+	handler.HopAnnotator, err = hopannotation.New(context.TODO(), hopannotation.Config{AnnotatorClient: &fakeAnnotator{}, OutputPath: dir})
+	if err != nil {
+		t.Fatalf("hopannotation.New() = %v, want nil", err)
+	}
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "91.189.88.142"})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+
+	tests := []struct {
+		hop  string
+		want []parser.ICMPExt
+	}{
+		{"192.168.144.1", nil},
+		{"4.69.140.198", []parser.ICMPExt{{
+			ClassNum:  1,
+			ClassType: 1,
+			DataLen:   8,
+			MPLSLabels: []parser.MPLSLabel{
+				{TTL: 1, S: 0, Exp: 0, Label: 24015},
+				{TTL: 1, S: 1, Exp: 0, Label: 16},
+			},
+		}}},
+	}
+	for _, test := range tests {
+		files, err := filepath.Glob(filepath.Join(dir, "2019/08/25", "*_"+test.hop+".json"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("hop %v: got annotation files %v, want 1 (error: %v)", test.hop, files, err)
+		}
+		b, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got hopannotation.HopAnnotation1
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Extensions, test.want) {
+			t.Errorf("hop %v: extensions = %+v, want %+v", test.hop, got.Extensions, test.want)
+		}
+		if test.want == nil && strings.Contains(string(b), "Extensions") {
+			t.Errorf("hop %v: annotation %s has extensions, want none", test.hop, b)
+		}
+	}
+}
+
+func TestHopRTTs(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// The traceroute in ./testdata/rtt/valid.jsonl has no replies from
+	// its first hop and several replies from the other hops.
+	tracer := &fakeTracer{testdata: "./testdata/rtt"}
+	handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", Config{})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	dir := t.TempDir()
+	handler.HopAnnotator, err = hopannotation.New(context.TODO(), hopannotation.Config{AnnotatorClient: &fakeAnnotator{}, OutputPath: dir})
+	if err != nil {
+		t.Fatalf("hopannotation.New() = %v, want nil", err)
+	}
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "10.0.0.3"})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+
+	tests := []struct {
+		hop  string
+		want *parser.RTTStats
+	}{
+		{"10.0.0.1", nil},
+		{"10.0.0.2", &parser.RTTStats{Min: 1.5, Median: 2, Max: 3.25, Replies: 3}},
+		{"10.0.0.3", &parser.RTTStats{Min: 5, Median: 7, Max: 9, Replies: 4}},
+	}
+	for _, test := range tests {
+		files, err := filepath.Glob(filepath.Join(dir, "2019/08/25", "*_"+test.hop+".json"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("hop %v: got annotation files %v, want 1 (error: %v)", test.hop, files, err)
+		}
+		b, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got hopannotation.HopAnnotation1
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.RTT, test.want) {
+			t.Errorf("hop %v: RTT = %+v, want %+v", test.hop, got.RTT, test.want)
+		}
+	}
+}
+
+// recordingAnnotator records the IP addresses it's asked to annotate.
+type recordingAnnotator struct {
+	mu  sync.Mutex
+	ips []string
+}
+
+func (ra *recordingAnnotator) Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.ips = append(ra.ips, ips...)
+	return map[string]*annotator.ClientAnnotations{}, nil
+}
+
+func TestNonGlobalHops(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// The traceroute in ./testdata/linklocal/valid.jsonl has private,
+	// link-local, and shared hops followed by two public hops.  Only
+	// the link-local hop isn't globally routable.
+	nonGlobal := []string{"169.254.0.1"}
+	global := []string{"10.0.0.1", "100.64.0.1", "4.69.140.198", "91.189.88.142"}
+	tests := []struct {
+		mode          string
+		wantAnnotated []string
+		wantNonGlobal bool
+	}{
+		{"annotate", append(append([]string{}, nonGlobal...), global...), false},
+		{"skip", global, false},
+		{"tag", global, true},
+	}
+	for _, test := range tests {
+		tracer := &fakeTracer{testdata: "./testdata/linklocal"}
+		handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "regular", Config{})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		ra := &recordingAnnotator{}
+		dir := t.TempDir()
+		handler.HopAnnotator, err = hopannotation.New(context.TODO(), hopannotation.Config{AnnotatorClient: ra, OutputPath: dir, NonGlobalHops: test.mode})
+		if err != nil {
+			t.Fatalf("hopannotation.New() = %v, want nil", err)
+		}
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "91.189.88.142"})
+		handler.Close(context.TODO(), time.Now(), "00001")
+		waitForTrace(t, handler)
+
+		sort.Strings(ra.ips)
+		sort.Strings(test.wantAnnotated)
+		if !reflect.DeepEqual(ra.ips, test.wantAnnotated) {
+			t.Errorf("%s: annotated %v, want %v", test.mode, ra.ips, test.wantAnnotated)
+		}
+		// All hops are archived.
+		for _, hop := range append(append([]string{}, nonGlobal...), global...) {
+			files, err := filepath.Glob(filepath.Join(dir, "2019/08/25", "*_"+hop+".json"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("%s: hop %v: got annotation files %v, want 1 (error: %v)", test.mode, hop, files, err)
+			}
+			b, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got hopannotation.HopAnnotation1
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			wantNonGlobal := test.wantNonGlobal && !hopannotation.IsGlobal(hop)
+			if got.NonGlobal != wantNonGlobal {
+				t.Errorf("%s: hop %v: NonGlobal = %v, want %v", test.mode, hop, got.NonGlobal, wantNonGlobal)
+			}
+			if test.mode != "annotate" && !hopannotation.IsGlobal(hop) && got.Annotations != nil {
+				t.Errorf("%s: hop %v: Annotations = %+v, want nil", test.mode, hop, got.Annotations)
+			}
+		}
+	}
+}
+
+func TestAnnotateScope(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "regular", Config{AnnotateScope: "destination"}); err == nil {
+		t.Error("NewHandler() = nil, want error")
+	}
+	// The traceroute in ./testdata/linklocal/valid.jsonl reaches its
+	// destination (91.189.88.142) right after 4.69.140.198.
+	allHops := []string{"10.0.0.1", "169.254.0.1", "100.64.0.1", "4.69.140.198", "91.189.88.142"}
+	tests := []struct {
+		scope         string
+		wantAnnotated []string
+	}{
+		{"all", allHops},
+		{"endpoints", []string{"4.69.140.198", "91.189.88.142"}},
+	}
+	for _, test := range tests {
+		tracer := &fakeTracer{testdata: "./testdata/linklocal"}
+		handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "regular", Config{AnnotateScope: test.scope})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		ra := &recordingAnnotator{}
+		dir := t.TempDir()
+		handler.HopAnnotator, err = hopannotation.New(context.TODO(), hopannotation.Config{AnnotatorClient: ra, OutputPath: dir})
+		if err != nil {
+			t.Fatalf("hopannotation.New() = %v, want nil", err)
+		}
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "91.189.88.142"})
+		handler.Close(context.TODO(), time.Now(), "00001")
+		waitForTrace(t, handler)
+
+		sort.Strings(ra.ips)
+		wantAnnotated := append([]string{}, test.wantAnnotated...)
+		sort.Strings(wantAnnotated)
+		if !reflect.DeepEqual(ra.ips, wantAnnotated) {
+			t.Errorf("%s: annotated %v, want %v", test.scope, ra.ips, wantAnnotated)
+		}
+		// All hops are archived but only those in scope have
+		// annotations.
+		for _, hop := range allHops {
+			files, err := filepath.Glob(filepath.Join(dir, "2019/08/25", "*_"+hop+".json"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("%s: hop %v: got annotation files %v, want 1 (error: %v)", test.scope, hop, files, err)
+			}
+			b, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got hopannotation.HopAnnotation1
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			inScope := false
+			for _, h := range test.wantAnnotated {
+				inScope = inScope || h == hop
+			}
+			if (got.Annotations != nil) != inScope {
+				t.Errorf("%s: hop %v: Annotations = %+v, want annotations: %v", test.scope, hop, got.Annotations, inScope)
+			}
+		}
+	}
+}
+
+// unscopedAnnotator hides the AnnotateScoped method of the hop
+// annotator that it wraps.
+type unscopedAnnotator struct {
+	AnnotateAndArchiver
+}
+
+func TestAnnotateScopeUnscoped(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	handler, err := newHandlerWithConfig(&fakeTracer{testdata: "./testdata/linklocal"}, &fakeAnnotator{}, "regular", Config{AnnotateScope: "endpoints"})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	ra := &recordingAnnotator{}
+	dir := t.TempDir()
+	hopCache, err := hopannotation.New(context.TODO(), hopannotation.Config{AnnotatorClient: ra, OutputPath: dir})
+	if err != nil {
+		t.Fatalf("hopannotation.New() = %v, want nil", err)
+	}
+	handler.HopAnnotator = &unscopedAnnotator{hopCache}
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "91.189.88.142"})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+
+	sort.Strings(ra.ips)
+	if want := []string{"4.69.140.198", "91.189.88.142"}; !reflect.DeepEqual(ra.ips, want) {
+		t.Errorf("annotated %v, want %v", ra.ips, want)
+	}
+	// The other hops are still archived, without annotations.
+	for _, hop := range []string{"10.0.0.1", "169.254.0.1", "100.64.0.1"} {
+		files, err := filepath.Glob(filepath.Join(dir, "2019/08/25", "*_"+hop+".json"))
+		if err != nil || len(files) != 1 {
+			t.Errorf("hop %v: got annotation files %v, want 1 (error: %v)", hop, files, err)
+		}
+	}
+}
+
+func TestMinUsefulHops(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{MinUsefulHops: -1}); err == nil {
+		t.Fatalf("NewHandler() = nil, want error")
+	}
+
+	// The traceroute in ./testdata/valid.jsonl has 13 responsive hops
+	// and those of the all-timeout and extract error traceroutes none.
+	tests := []struct {
+		name           string
+		testdata       string
+		dstIP          string
+		minUsefulHops  int
+		wantNWrites    int32
+		wantNAnnotates int32
+		wantNSkipped   float64
+	}{
+		{"disabled", "", "3.4.5.6", 0, 1, 1, 0},
+		{"at-threshold", "", "3.4.5.6", 13, 1, 1, 0},
+		{"below-threshold", "", "3.4.5.6", 14, 0, 0, 1},
+		{"all-timeout-disabled", "./testdata/timeout", "3.4.5.6", 0, 1, 0, 0},
+		{"all-timeout-below-threshold", "./testdata/timeout", "3.4.5.6", 1, 0, 0, 1},
+		{"extract-error-below-threshold", "", forceExtractErr, 1, 0, 0, 1},
+	}
+	for i, test := range tests {
+		tracer := &fakeTracer{testdata: test.testdata}
+		annotator := &fakeAnnotator{}
+		var result TraceResult
+		hCfg := Config{
+			MinUsefulHops: test.minUsefulHops,
+			OnComplete:    func(r TraceResult) { result = r },
+		}
+		handler, err := newHandlerWithConfig(tracer, annotator, "mda", hCfg)
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		skipped := promtest.ToFloat64(tracesSkipped.WithLabelValues("below_min_hops"))
+		handler.done = make(chan struct{})
+		uuid := fmt.Sprintf("%05d", i)
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+		if (result.FilePath != "") != (test.wantNWrites > 0) {
+			t.Errorf("%s: result.FilePath = %q with %d writes", test.name, result.FilePath, test.wantNWrites)
+		}
+		if n := tracer.Writes(); n != test.wantNWrites {
+			t.Errorf("%s: tracer.Writes() = %d, want %d", test.name, n, test.wantNWrites)
+		}
+		if n := annotator.Annotates(); n != test.wantNAnnotates {
+			t.Errorf("%s: annotator.Annotates() = %d, want %d", test.name, n, test.wantNAnnotates)
+		}
+		if n := promtest.ToFloat64(tracesSkipped.WithLabelValues("below_min_hops")) - skipped; n != test.wantNSkipped {
+			t.Errorf("%s: got %v skipped traceroutes, want %v", test.name, n, test.wantNSkipped)
+		}
+	}
+}
+
+func TestTraceOutcomes(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	tests := []struct {
+		name     string
+		testdata string
+		dstIP    string
+		triggers int
+		want     map[string]float64
+	}{
+		{"completed", "", "3.4.5.6", 1, map[string]float64{outcomeCompleted: 1}},
+		{"cached", "", "3.4.5.6", 3, map[string]float64{outcomeCompleted: 1, outcomeCached: 2}},
+		{"all_timeout", "./testdata/timeout", "3.4.5.6", 1, map[string]float64{outcomeAllTimeout: 1}},
+		{"trace_error", "", forceTracerouteErr, 1, map[string]float64{outcomeTraceError: 1}},
+		{"parse_error", "", forceParseErr, 1, map[string]float64{outcomeParseError: 1}},
+		{"extract_error", "", forceExtractErr, 1, map[string]float64{outcomeExtractError: 1}},
+		{"annotate_error", "", forceAnnotateErr, 1, map[string]float64{outcomeAnnotateError: 1}},
+	}
+	outcomes := []string{outcomeCompleted, outcomeAllTimeout, outcomeCached, outcomeTraceError, outcomeParseError, outcomeExtractError, outcomeAnnotateError}
+	for _, test := range tests {
+		handler, err := newHandler(&fakeTracer{testdata: test.testdata})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		before := make(map[string]float64)
+		for _, outcome := range outcomes {
+			before[outcome] = promtest.ToFloat64(traceOutcomes.WithLabelValues(outcome))
+		}
+		for i := 0; i < test.triggers; i++ {
+			uuid := fmt.Sprintf("%05d", i)
+			handler.done = make(chan struct{})
+			handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP, Cookie: int64(i + 1)})
+			handler.Close(context.TODO(), time.Now(), uuid)
+			waitForTrace(t, handler)
+		}
+		for _, outcome := range outcomes {
+			if n := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcome)) - before[outcome]; n != test.want[outcome] {
+				t.Errorf("%s: got %v %q outcomes, want %v", test.name, n, outcome, test.want[outcome])
+			}
+		}
+	}
+}
+
+// staleLookupCache is a traceroute cache whose lookups always report a
+// traceroute cached by another connection, like a lookup that races
+// with the replacement of the entry.
+type staleLookupCache struct {
+	FetchTracer
+}
+
+func (c *staleLookupCache) Lookup(ip string) (string, time.Time, bool) {
+	return "other", time.Now().Add(time.Minute), true
+}
+
+func TestTraceOutcomeNotLookedUp(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	handler, err := newHandler(&fakeTracer{})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	handler.IPCache = &staleLookupCache{FetchTracer: handler.IPCache}
+	before := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcomeCompleted))
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: 1})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+	if n := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcomeCompleted)) - before; n != 1 {
+		t.Errorf("got %v %q outcomes, want 1", n, outcomeCompleted)
+	}
+}
+
+func TestHopsPerTrace(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// observations returns the number and the sum of the observations
+	// of the hops per trace histogram.
+	observations := func() (uint64, float64) {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatalf("Gather() = %v, want nil", err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == "triggertrace_hops_per_trace" {
+				h := mf.GetMetric()[0].GetHistogram()
+				return h.GetSampleCount(), h.GetSampleSum()
+			}
+		}
+		return 0, 0
+	}
+
+	tests := []struct {
+		name      string
+		testdata  string
+		dstIP     string
+		triggers  int
+		wantCount uint64
+		wantSum   float64
+	}{
+		{"valid", "", "3.4.5.6", 1, 1, 13},
+		{"cached", "", "3.4.5.6", 3, 1, 13},
+		{"rtt", "./testdata/rtt", "3.4.5.6", 1, 1, 3},
+		{"all_timeout", "./testdata/timeout", "3.4.5.6", 1, 1, 0},
+		{"empty", "", forceExtractErr, 1, 0, 0},
+		{"parse_error", "", forceParseErr, 1, 0, 0},
+	}
+	for _, test := range tests {
+		handler, err := newHandler(&fakeTracer{testdata: test.testdata})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		count, sum := observations()
+		for i := 0; i < test.triggers; i++ {
+			uuid := fmt.Sprintf("%05d", i)
+			handler.done = make(chan struct{})
+			handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP, Cookie: int64(i + 1)})
+			handler.Close(context.TODO(), time.Now(), uuid)
+			waitForTrace(t, handler)
+		}
+		gotCount, gotSum := observations()
+		if gotCount-count != test.wantCount || gotSum-sum != test.wantSum {
+			t.Errorf("%s: got %d observations of %v hops, want %d of %v", test.name, gotCount-count, gotSum-sum, test.wantCount, test.wantSum)
+		}
+	}
+}
+
+func TestDisableAnnotation(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// A disabled annotator doesn't need an annotator client.
 	ipcCfg := ipcache.Config{
 		EntryTimeout: 2 * time.Second,
 		ScanPeriod:   1 * time.Second,
 	}
+	newParser, err := parser.New("mda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHandler(context.TODO(), &fakeTracer{}, ipcCfg, newParser, hopannotation.Config{}, Config{}); err == nil {
+		t.Fatalf("NewHandler() = nil, want error")
+	}
+	tracer := &fakeTracer{}
+	handler, err := NewHandler(context.TODO(), tracer, ipcCfg, newParser, hopannotation.Config{}, Config{DisableAnnotation: true})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	if handler.HopAnnotator != nil {
+		t.Fatalf("handler.HopAnnotator = %v, want nil", handler.HopAnnotator)
+	}
+
+	skipped := promtest.ToFloat64(annotationsSkipped.WithLabelValues("disabled"))
+	handler.done = make(chan struct{})
+	handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: forceAnnotateErr})
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+	if n := tracer.Writes(); n != 1 {
+		t.Errorf("tracer.Writes() = %d, want 1", n)
+	}
+	if n := promtest.ToFloat64(annotationsSkipped.WithLabelValues("disabled")) - skipped; n != 1 {
+		t.Errorf("got %v skipped annotations, want 1", n)
+	}
+}
+
+func TestCandidateTracers(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	hCfg := Config{CandidateTracers: map[string]ipcache.Tracer{"": &fakeTracer{}}}
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", hCfg); err == nil {
+		t.Fatalf("NewHandler() = nil, want error")
+	}
+
+	tracer := &fakeTracer{}
+	candidate := &fakeTracer{}
 	annotator := &fakeAnnotator{}
+	hCfg = Config{
+		MinUsefulHops:    1,
+		CandidateTracers: map[string]ipcache.Tracer{"candidate": candidate},
+	}
+	handler, err := newHandlerWithConfig(tracer, annotator, "mda", hCfg)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	if candidate.writeFilter == nil {
+		t.Error("candidate tracer has no write filter")
+	}
+	for i, ip := range []string{"3.4.5.6", forceTracerouteErr} {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: ip})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+	}
+	if n := candidate.Traces(); n != 2 {
+		t.Errorf("candidate.Traces() = %d, want 2", n)
+	}
+	if n := tracer.Traces(); n != 2 {
+		t.Errorf("tracer.Traces() = %d, want 2", n)
+	}
+	if n := candidate.Writes(); n != 1 {
+		t.Errorf("candidate.Writes() = %d, want 1", n)
+	}
+	// Only the successful primary traceroute is annotated.
+	if n := annotator.Annotates(); n != 1 {
+		t.Errorf("annotator.Annotates() = %d, want 1", n)
+	}
+}
+
+func TestOnComplete(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	var results []TraceResult
+	hCfg := Config{
+		OnComplete: func(result TraceResult) {
+			results = append(results, result)
+			panic("callback panics should be ignored")
+		},
+	}
+	handler, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", hCfg)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	tests := []struct {
+		ip       string
+		cookie   int64
+		wantUUID string
+		want     string
+		wantPath string
+	}{
+		{"3.4.5.6", 0x1, "_0000000000000001", OutcomeFresh, "/fake/1.jsonl"},
+		{"3.4.5.6", 0xab, "_00000000000000AB", OutcomeCached, "/fake/ab.jsonl"},
+		{forceTracerouteErr, 0x2, "_0000000000000002", OutcomeError, ""},
+	}
+	for i, test := range tests {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.ip, Cookie: test.cookie})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+		if len(results) != i+1 {
+			t.Fatalf("got %d results, want %d", len(results), i+1)
+		}
+		got := results[i]
+		if got.Outcome != test.want || got.FilePath != test.wantPath || !strings.HasSuffix(got.UUID, test.wantUUID) {
+			t.Errorf("result = %+v, want outcome %q, path %q, and UUID suffix %q", got, test.want, test.wantPath, test.wantUUID)
+		}
+		if got.Destination.RemoteIP != test.ip {
+			t.Errorf("result.Destination.RemoteIP = %q, want %q", got.Destination.RemoteIP, test.ip)
+		}
+		if (got.Err != nil) != (test.want == OutcomeError) {
+			t.Errorf("result.Err = %v", got.Err)
+		}
+	}
+}
+
+func TestCookieFunc(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// External measurement IDs keyed by connection UUID.
+	externalIDs := map[string]string{
+		"00000": "12AB",
+		"00002": "not-hex",
+	}
+	var results []TraceResult
+	hCfg := Config{
+		CookieFunc: func(uuid string, sockID *inetdiag.SockID) (string, error) {
+			id, ok := externalIDs[uuid]
+			if !ok {
+				return "", errors.New("no external ID")
+			}
+			return id, nil
+		},
+		OnComplete: func(result TraceResult) {
+			results = append(results, result)
+		},
+	}
+	handler, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", hCfg)
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	tests := []struct {
+		cookie   int64
+		wantPath string
+		wantUUID string
+	}{
+		{0x1, "/fake/12AB.jsonl", "_00000000000012AB"},
+		{0x2, "/fake/2.jsonl", "_0000000000000002"}, // derivation fails
+		{0x3, "/fake/3.jsonl", "_0000000000000003"}, // invalid cookie
+	}
+	for i, test := range tests {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: test.cookie})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+		got := results[i]
+		if got.FilePath != test.wantPath || !strings.HasSuffix(got.UUID, test.wantUUID) {
+			t.Errorf("result = %+v, want path %q and UUID suffix %q", got, test.wantPath, test.wantUUID)
+		}
+	}
+}
+
+func TestRecordSockID(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	first := &inetdiag.SockID{SrcIP: "127.0.0.1", SPort: 443, DstIP: "3.4.5.6", DPort: 1111, Cookie: 1}
+	second := &inetdiag.SockID{SrcIP: "127.0.0.1", SPort: 443, DstIP: "3.4.5.6", DPort: 2222, Cookie: 2}
+	tests := []struct {
+		record bool
+		want   []*tracer.SockID
+	}{
+		{false, []*tracer.SockID{nil, nil}},
+		{true, []*tracer.SockID{
+			{SrcIP: "127.0.0.1", SrcPort: 443, DstIP: "3.4.5.6", DstPort: 1111},
+			{SrcIP: "127.0.0.1", SrcPort: 443, DstIP: "3.4.5.6", DstPort: 2222}, // cached
+		}},
+	}
+	for _, test := range tests {
+		ft := &fakeTracer{}
+		handler, err := newHandlerWithConfig(ft, &fakeAnnotator{}, "mda", Config{RecordSockID: test.record})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		for i, sockID := range []*inetdiag.SockID{first, second} {
+			uuid := fmt.Sprintf("%05d", i)
+			handler.done = make(chan struct{})
+			handler.Open(context.TODO(), time.Now(), uuid, sockID)
+			handler.Close(context.TODO(), time.Now(), uuid)
+			waitForTrace(t, handler)
+		}
+		if ft.Traces() != 1 || ft.TracesCached() != 1 {
+			t.Fatalf("got %d traceroutes and %d cached traceroutes, want 1 and 1", ft.Traces(), ft.TracesCached())
+		}
+		if len(ft.sockIDs) != len(test.want) {
+			t.Fatalf("got %d socket IDs, want %d", len(ft.sockIDs), len(test.want))
+		}
+		for i, want := range test.want {
+			got := ft.sockIDs[i]
+			if (got == nil) != (want == nil) || (want != nil && *got != *want) {
+				t.Errorf("record %v: socket ID %d = %+v, want %+v", test.record, i, got, want)
+			}
+		}
+	}
+}
+
+func TestUUIDFunc(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// The generator derives UUIDs from the destination port and the
+	// open time.  Invalid UUIDs fall back to cookie UUIDs.
+	opened := time.Date(2021, time.December, 1, 0, 0, 0, 0, time.UTC)
+	uuidFunc := func(sockID *inetdiag.SockID, t time.Time) string {
+		if sockID.DPort == 0 {
+			return "invalid/uuid"
+		}
+		return fmt.Sprintf("site1-%d-%d", t.Unix(), sockID.DPort)
+	}
+	var resultsMu sync.Mutex
+	var results []TraceResult
+	ft := &fakeTracer{}
+	handler, err := newHandlerWithConfig(ft, &fakeAnnotator{}, "mda", Config{
+		UUIDFunc: uuidFunc,
+		OnComplete: func(result TraceResult) {
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			results = append(results, result)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	sockIDs := []*inetdiag.SockID{
+		{SrcIP: "127.0.0.1", SPort: 443, DstIP: "3.4.5.6", DPort: 1111, Cookie: 1},
+		{SrcIP: "127.0.0.1", SPort: 443, DstIP: "3.4.5.6", DPort: 2222, Cookie: 2}, // cached
+		{SrcIP: "127.0.0.1", SPort: 443, DstIP: "4.5.6.7", DPort: 0, Cookie: 3},
+	}
+	for i, sockID := range sockIDs {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), opened, uuid, sockID)
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+	}
+	wantUUIDs := []string{"site1-1638316800-1111", "site1-1638316800-2222", uuid.FromCookie(3)}
+	if !reflect.DeepEqual(ft.uuids, wantUUIDs) {
+		t.Errorf("traceroute UUIDs = %v, want %v", ft.uuids, wantUUIDs)
+	}
+	wantPaths := []string{"/fake/site1-1638316800-1111.jsonl", "/fake/site1-1638316800-2222.jsonl", "/fake/3.jsonl"}
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	if len(results) != len(wantUUIDs) {
+		t.Fatalf("got %d results, want %d", len(results), len(wantUUIDs))
+	}
+	for i, result := range results {
+		if result.UUID != wantUUIDs[i] || result.FilePath != wantPaths[i] {
+			t.Errorf("result %d = %q, %q, want %q, %q", i, result.UUID, result.FilePath, wantUUIDs[i], wantPaths[i])
+		}
+	}
+}
+
+func TestTriggerDebounce(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	if _, err := newHandlerWithConfig(&fakeTracer{}, &fakeAnnotator{}, "mda", Config{TriggerDebounce: -1}); err == nil {
+		t.Fatalf("NewHandler() = nil, want error")
+	}
+	// Collapsed triggers get copies of the pending traceroute, or fail
+	// with it, without running traceroutes of their own.
+	tests := []struct {
+		dstIP           string
+		wantCached      int32
+		wantTraceErrors float64
+	}{
+		{"3.4.5.6", 2, 0},
+		{forceTracerouteErr, 0, 3},
+	}
+	for _, test := range tests {
+		tracer := &fakeTracer{}
+		handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", Config{TriggerDebounce: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		collapsed := promtest.ToFloat64(triggersCollapsed)
+		traceErrors := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcomeTraceError))
+		handler.done = make(chan struct{})
+		for i := 0; i < 3; i++ {
+			uuid := fmt.Sprintf("%05d", i)
+			handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP, Cookie: int64(i + 1)})
+			handler.Close(context.TODO(), time.Now(), uuid)
+		}
+		waitForTrace(t, handler)
+		if n := tracer.Traces(); n != 1 {
+			t.Errorf("%s: tracer.Traces() = %d, want 1", test.dstIP, n)
+		}
+		if n := tracer.TracesCached(); n != test.wantCached {
+			t.Errorf("%s: tracer.TracesCached() = %d, want %d", test.dstIP, n, test.wantCached)
+		}
+		if n := promtest.ToFloat64(triggersCollapsed) - collapsed; n != 2 {
+			t.Errorf("%s: got %v collapsed triggers, want 2", test.dstIP, n)
+		}
+		if n := promtest.ToFloat64(traceOutcomes.WithLabelValues(outcomeTraceError)) - traceErrors; n != test.wantTraceErrors {
+			t.Errorf("%s: got %v trace errors, want %v", test.dstIP, n, test.wantTraceErrors)
+		}
+	}
+}
+
+func TestDisableCache(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	tests := []struct {
+		disable      bool
+		wantTraces   int32
+		wantCached   int32
+		wantDisabled float64
+	}{
+		{false, 1, 2, 0},
+		{true, 3, 0, 1},
+	}
+	for _, test := range tests {
+		tracer := &fakeTracer{}
+		handler, err := newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", Config{DisableCache: test.disable})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		if got := promtest.ToFloat64(cacheDisabled.WithLabelValues("")); got != test.wantDisabled {
+			t.Errorf("disable %v: cache disabled = %v, want %v", test.disable, got, test.wantDisabled)
+		}
+		for i := 0; i < 3; i++ {
+			uuid := fmt.Sprintf("%05d", i)
+			handler.done = make(chan struct{})
+			handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: int64(i + 1)})
+			handler.Close(context.TODO(), time.Now(), uuid)
+			waitForTrace(t, handler)
+		}
+		if n := tracer.Traces(); n != test.wantTraces {
+			t.Errorf("disable %v: tracer.Traces() = %d, want %d", test.disable, n, test.wantTraces)
+		}
+		if n := tracer.TracesCached(); n != test.wantCached {
+			t.Errorf("disable %v: tracer.TracesCached() = %d, want %d", test.disable, n, test.wantCached)
+		}
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	// 3.4.5.6 is dual-stack, 4.5.6.7 only has local or invalid IPv6
+	// addresses, and 5.6.7.8 fails to resolve.
+	resolver := func(ctx context.Context, remoteIP string) ([]string, error) {
+		switch remoteIP {
+		case "3.4.5.6":
+			return []string{"3.4.5.6", "2001:db8::1"}, nil
+		case "4.5.6.7":
+			return []string{"::1", "fe80::1", "bad"}, nil
+		}
+		return nil, errors.New("forced lookup error")
+	}
+	tests := []struct {
+		resolver     func(context.Context, string) ([]string, error)
+		dstIP        string
+		wantUUIDs    []string
+		wantIPv6     float64
+		wantCampaign string
+	}{
+		{nil, "3.4.5.6", []string{uuid.FromCookie(1)}, 0, ""},
+		{resolver, "3.4.5.6", []string{uuid.FromCookie(1), uuid.FromCookie(1) + "_ipv6"}, 1, uuid.FromCookie(1)},
+		{resolver, "4.5.6.7", []string{uuid.FromCookie(1)}, 0, ""},
+		{resolver, "5.6.7.8", []string{uuid.FromCookie(1)}, 0, ""},
+	}
+	for i, test := range tests {
+		ft := &fakeTracer{}
+		handler, err := newHandlerWithConfig(ft, &fakeAnnotator{}, "mda", Config{DualStackResolver: test.resolver})
+		if err != nil {
+			t.Fatalf("NewHandler() = %v, want nil", err)
+		}
+		ipv4 := promtest.ToFloat64(tracesByFamily.WithLabelValues("ipv4"))
+		ipv6 := promtest.ToFloat64(tracesByFamily.WithLabelValues("ipv6"))
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), "00001", &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: test.dstIP, Cookie: 1})
+		handler.Close(context.TODO(), time.Now(), "00001")
+		waitForTrace(t, handler)
+		handler.Wait()
+		// The traceroutes run concurrently.
+		sort.Strings(ft.uuids)
+		if !reflect.DeepEqual(ft.uuids, test.wantUUIDs) {
+			t.Errorf("test %d: traceroute UUIDs = %v, want %v", i, ft.uuids, test.wantUUIDs)
+		}
+		for _, campaignID := range ft.campaignIDs {
+			if campaignID != test.wantCampaign {
+				t.Errorf("test %d: campaign ID = %q, want %q", i, campaignID, test.wantCampaign)
+			}
+		}
+		if n := promtest.ToFloat64(tracesByFamily.WithLabelValues("ipv4")) - ipv4; n != 1 {
+			t.Errorf("test %d: got %v IPv4 traceroutes, want 1", i, n)
+		}
+		if n := promtest.ToFloat64(tracesByFamily.WithLabelValues("ipv6")) - ipv6; n != test.wantIPv6 {
+			t.Errorf("test %d: got %v IPv6 traceroutes, want %v", i, n, test.wantIPv6)
+		}
+	}
+
+	// The addresses are cached independently: another trigger for the
+	// IPv4 address gets both traceroutes from the cache.
+	ft := &fakeTracer{}
+	handler, err := newHandlerWithConfig(ft, &fakeAnnotator{}, "mda", Config{DualStackResolver: resolver})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	for i := 0; i < 2; i++ {
+		uuid := fmt.Sprintf("%05d", i)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: int64(i + 1)})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+	}
+	if n := ft.Traces(); n != 2 {
+		t.Errorf("tracer.Traces() = %d, want 2", n)
+	}
+	if n := ft.TracesCached(); n != 2 {
+		t.Errorf("tracer.TracesCached() = %d, want 2", n)
+	}
+}
+
+func TestCombinedOutput(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	ft := &fakeTracer{}
+	fa := &fakeAnnotator{}
+	handler, err := newHandlerWithConfig(ft, fa, "mda", Config{CombinedOutput: true})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	handler.done = make(chan struct{})
+	sockID := &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "3.4.5.6", Cookie: 1}
+	handler.Open(context.TODO(), time.Now(), "00001", sockID)
+	handler.Close(context.TODO(), time.Now(), "00001")
+	waitForTrace(t, handler)
+	if n := fa.Annotates(); n != 1 {
+		t.Errorf("annotator.Annotates() = %d, want 1", n)
+	}
+
+	// The combined file has the metadata line, the scamper output, and
+	// the hop annotations, in this order, each line being valid JSON.
+	trace, err := ioutil.ReadFile("./testdata/valid.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := ft.LastWrite()
+	if !bytes.HasPrefix(written, trace) {
+		t.Fatalf("combined output doesn't start with the traceroute:\n%s", written)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(written, []byte("\n")), []byte("\n"))
+	var meta tracer.Metadata
+	if err := json.Unmarshal(lines[0], &meta); err != nil || meta.UUID == "" {
+		t.Errorf("got first line %s, want a metadata line (error: %v)", lines[0], err)
+	}
+	nTraceLines := bytes.Count(trace, []byte("\n"))
+	annotations := lines[nTraceLines:]
+	if len(annotations) == 0 {
+		t.Fatal("combined output has no hop annotations")
+	}
+	for _, line := range annotations {
+		var ha hopannotation.HopAnnotation1
+		if err := json.Unmarshal(line, &ha); err != nil || ha.ID == "" {
+			t.Errorf("got hop annotation %s, want a HopAnnotation1 (error: %v)", line, err)
+		}
+	}
+}
+
+func TestCombinedOutputSharedHops(t *testing.T) {
+	saveNetInterfaceAddrs := netInterfaceAddrs
+	netInterfaceAddrs = fakeInterfaceAddrs
+	defer func() { netInterfaceAddrs = saveNetInterfaceAddrs }()
+
+	ft := &fakeTracer{}
+	handler, err := newHandlerWithConfig(ft, &fakeAnnotator{}, "mda", Config{CombinedOutput: true})
+	if err != nil {
+		t.Fatalf("NewHandler() = %v, want nil", err)
+	}
+	// Both traceroutes have the same hops, so each file must have the
+	// annotations of all of them even though they were already
+	// annotated for the first one.
+	var nAnnotations []int
+	for i, dstIP := range []string{"3.4.5.6", "3.4.5.7"} {
+		uuid := fmt.Sprintf("%05d", i+1)
+		handler.done = make(chan struct{})
+		handler.Open(context.TODO(), time.Now(), uuid, &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: dstIP, Cookie: int64(i + 1)})
+		handler.Close(context.TODO(), time.Now(), uuid)
+		waitForTrace(t, handler)
+		n := 0
+		for _, line := range bytes.Split(ft.LastWrite(), []byte("\n")) {
+			var ha hopannotation.HopAnnotation1
+			if json.Unmarshal(line, &ha) == nil && ha.ID != "" {
+				n++
+			}
+		}
+		nAnnotations = append(nAnnotations, n)
+	}
+	if nAnnotations[0] == 0 || nAnnotations[1] != nAnnotations[0] {
+		t.Errorf("got %v hop annotations per file, want the same nonzero number", nAnnotations)
+	}
+}
+
+func newHandler(tracer *fakeTracer) (*Handler, error) {
+	return newHandlerWithConfig(tracer, &fakeAnnotator{}, "mda", Config{})
+}
+
+func newHandlerWithConfig(tracer *fakeTracer, annotator *fakeAnnotator, traceType string, hCfg Config) (*Handler, error) {
+	return newHandlerWithTracer(tracer, annotator, traceType, hCfg)
+}
+
+func newHandlerWithTracer(tracer ipcache.Tracer, annotator *fakeAnnotator, traceType string, hCfg Config) (*Handler, error) {
+	ipcCfg := ipcache.Config{
+		EntryTimeout: 2 * time.Second,
+		ScanPeriod:   1 * time.Second,
+	}
 	haCfg := hopannotation.Config{
 		AnnotatorClient: annotator,
 		OutputPath:      "/tmp/annotation1",
 	}
-	newParser, err := parser.New("mda")
+	newParser, err := parser.New(traceType)
 	if err != nil {
 		return nil, err
 	}
-	return NewHandler(context.TODO(), tracer, ipcCfg, newParser, haCfg)
+	return NewHandler(context.TODO(), tracer, ipcCfg, newParser, haCfg, hCfg)
 }
 
 func waitForTrace(t *testing.T, handler *Handler) {
@@ -0,0 +1,126 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/tracer"
+)
+
+// ParisReply describes a single reply to a paris-traceroute probe.
+type ParisReply struct {
+	Addr   string  `json:"addr" bigquery:"addr"`
+	Flowid int64   `json:"flowid" bigquery:"flowid"`
+	RTT    float64 `json:"rtt" bigquery:"rtt"`
+}
+
+// ParisHop describes the replies received for all probes sent with
+// the same TTL.
+type ParisHop struct {
+	TTL     int64        `json:"ttl" bigquery:"ttl"`
+	Replies []ParisReply `json:"replies" bigquery:"replies"`
+}
+
+// ParisLine contains paris-traceroute traceroute details.
+// Fields that are not defined here are ignored.
+type ParisLine struct {
+	Type      string     `json:"type" bigquery:"type"`
+	Version   string     `json:"version" bigquery:"version"`
+	Algorithm string     `json:"algorithm" bigquery:"algorithm"`
+	Protocol  string     `json:"protocol" bigquery:"protocol"`
+	Src       string     `json:"src" bigquery:"src"`
+	Dst       string     `json:"dst" bigquery:"dst"`
+	Start     TS         `json:"start" bigquery:"start"`
+	Hops      []ParisHop `json:"hops" bigquery:"hops"`
+}
+
+// Paris1 encapsulates the two lines of a paris-traceroute traceroute:
+//   {"UUID":...}
+//   {"type":"paris-traceroute"...}
+// Unlike scamper, paris-traceroute doesn't emit cycle-start and
+// cycle-stop lines.
+type Paris1 struct {
+	Metadata tracer.Metadata
+	Trace    ParisLine
+}
+
+type paris1Parser struct {
+}
+
+// ParseRawData parses paris-traceroute's traceroute in JSONL format.
+func (p1 *paris1Parser) ParseRawData(rawData []byte) (ParsedData, error) {
+	var paris1 Paris1
+
+	// First validate the traceroute data.  We account for the last
+	// newline because it's a lot faster than stripping it and creating
+	// a new slice.  We just confirm that the last line is empty.
+	lines := bytes.Split(rawData, []byte("\n"))
+	if len(lines) != 3 || len(lines[2]) != 0 {
+		return nil, ErrTracerouteFile
+	}
+
+	// Parse and validate the metadata line.
+	if err := json.Unmarshal(lines[0], &paris1.Metadata); err != nil {
+		return nil, ErrMetadata
+	}
+	if paris1.Metadata.UUID == "" {
+		return nil, fmt.Errorf("%w: %v", ErrMetadataUUID, paris1.Metadata.UUID)
+	}
+
+	// Parse and validate the trace line.
+	if err := json.Unmarshal(lines[1], &paris1.Trace); err != nil {
+		return nil, ErrTraceLine
+	}
+	if paris1.Trace.Type != "paris-traceroute" {
+		return nil, fmt.Errorf("%w: %v", ErrTraceType, paris1.Trace.Type)
+	}
+
+	return paris1, nil
+}
+
+// StartTime returns the start time of the traceroute.
+func (p1 Paris1) StartTime() time.Time {
+	return time.Unix(p1.Trace.Start.Sec, 0).UTC()
+}
+
+// ExtractHops parses the traceroute and extracts all hop addresses.
+func (p1 Paris1) ExtractHops() []string {
+	// We cannot use net.IP as key because it is a slice.
+	hops := make(map[string]struct{}, 100)
+	for i := range p1.Trace.Hops {
+		hop := &p1.Trace.Hops[i]
+		for j := range hop.Replies {
+			reply := &hop.Replies[j]
+			if net.ParseIP(reply.Addr) != nil {
+				hops[reply.Addr] = struct{}{}
+			}
+		}
+	}
+	hopStrings := make([]string, 0, len(hops))
+	for h := range hops {
+		hopStrings = append(hopStrings, h)
+	}
+	return hopStrings
+}
+
+// ExtractEndpoints returns the destination of the traceroute and its
+// farthest responsive hop other than the destination.
+func (p1 Paris1) ExtractEndpoints() (string, string) {
+	lastHop, max := "", int64(-1)
+	for i := range p1.Trace.Hops {
+		hop := &p1.Trace.Hops[i]
+		for j := range hop.Replies {
+			reply := &hop.Replies[j]
+			if reply.Addr == p1.Trace.Dst || net.ParseIP(reply.Addr) == nil {
+				continue
+			}
+			if hop.TTL > max {
+				lastHop, max = reply.Addr, hop.TTL
+			}
+		}
+	}
+	return p1.Trace.Dst, lastHop
+}
@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParis1Parser(t *testing.T) {
+	tests := []struct {
+		file     string
+		wantErr  error
+		wantHops []string
+	}{
+		{"invalid-num-lines", ErrTracerouteFile, nil},
+		{"invalid-last-line", ErrTracerouteFile, nil},
+		{"invalid-metadata", ErrMetadata, nil},
+		{"invalid-metadata-uuid", ErrMetadataUUID, nil},
+		{"invalid-trace", ErrTraceLine, nil},
+		{"invalid-trace-type", ErrTraceType, nil},
+		{"valid-simple", nil, []string{}},
+		{"valid-complex", nil, []string{ // contains fields that should be ignored
+			"192.168.144.1",
+			"100.97.99.252",
+			"100.97.99.253",
+			"91.189.88.142"},
+		},
+		{"valid-star", nil, []string{}}, // all "addr" values are either "*" or ""
+	}
+	for i, test := range tests {
+		// Read in the test traceroute output file.
+		f := filepath.Join("./testdata/paris1", test.file)
+		t.Logf("\nTest %v: file: %v", i, f)
+		content, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		parisOutput, gotErr := (&paris1Parser{}).ParseRawData(content)
+		if badErr(gotErr, test.wantErr) {
+			t.Fatalf("ParseRawData(): %v, want %v", gotErr, test.wantErr)
+		}
+
+		// If the test traceroute output file isn't valid,
+		// it won't have any hops to extract.
+		if !strings.HasPrefix(test.file, "valid") {
+			continue
+		}
+
+		// Extract the hops.
+		gotHops := parisOutput.ExtractHops()
+		if !isEqual(gotHops, test.wantHops) {
+			t.Fatalf("got %+v, want %+v", gotHops, test.wantHops)
+		}
+	}
+
+	// Test StartTime().
+	p1 := Paris1{
+		Trace: ParisLine{
+			Start: TS{Sec: 1638999963, Usec: 787829},
+		},
+	}
+	want := time.Unix(1638999963, 0).UTC()
+	if got := p1.StartTime(); got != want {
+		t.Fatalf("StartTime() = %v, want %v", got, want)
+	}
+
+	// Test ExtractEndpoints().
+	p1 = Paris1{
+		Trace: ParisLine{
+			Dst: "91.189.88.142",
+			Hops: []ParisHop{
+				{TTL: 1, Replies: []ParisReply{{Addr: "192.168.144.1"}}},
+				{TTL: 2, Replies: []ParisReply{{Addr: "100.97.99.252"}, {Addr: "*"}}},
+				{TTL: 3, Replies: []ParisReply{{Addr: "91.189.88.142"}}},
+			},
+		},
+	}
+	if dst, lastHop := p1.ExtractEndpoints(); dst != "91.189.88.142" || lastHop != "100.97.99.252" {
+		t.Errorf("ExtractEndpoints() = %q, %q, want %q, %q", dst, lastHop, "91.189.88.142", "100.97.99.252")
+	}
+}
@@ -1,9 +1,11 @@
-// Package parser handles parsing of scamper output in JSONL format.
+// Package parser handles parsing of scamper and paris-traceroute output
+// in JSONL format.
 package parser
 
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -53,6 +55,58 @@ type ParsedData interface {
 	ExtractHops() []string
 }
 
+// ProbeCounter is implemented by parsed traceroute data that reports
+// the number of probes the traceroute tool sent.
+type ProbeCounter interface {
+	ProbeCount() int
+}
+
+// ExtensionExtractor is implemented by parsed traceroute data that
+// reports the ICMP extensions (e.g., MPLS label stacks) of hop replies.
+// The returned map is keyed by hop address and only has hops whose
+// replies had extensions.
+type ExtensionExtractor interface {
+	ExtractExtensions() map[string][]ICMPExt
+}
+
+// RTTExtractor is implemented by parsed traceroute data that reports the
+// round-trip times of hop replies.  The returned map is keyed by hop
+// address and only has hops that replied to probes.
+type RTTExtractor interface {
+	ExtractRTTs() map[string]*RTTStats
+}
+
+// EndpointExtractor is implemented by parsed traceroute data that
+// can report the destination of the traceroute and its farthest
+// responsive hop other than the destination ("" if there's none).
+type EndpointExtractor interface {
+	ExtractEndpoints() (dst, lastHop string)
+}
+
+// RTTStats summarizes the round-trip times, in milliseconds, of the
+// replies of a hop.
+type RTTStats struct {
+	Min     float64
+	Median  float64
+	Max     float64
+	Replies int
+}
+
+// newRTTStats returns the statistics of the given round-trip times or
+// nil if there are none.  The given slice is sorted in place.
+func newRTTStats(rtts []float64) *RTTStats {
+	n := len(rtts)
+	if n == 0 {
+		return nil
+	}
+	sort.Float64s(rtts)
+	median := rtts[n/2]
+	if n%2 == 0 {
+		median = (rtts[n/2-1] + rtts[n/2]) / 2
+	}
+	return &RTTStats{Min: rtts[0], Median: median, Max: rtts[n-1], Replies: n}
+}
+
 // TracerouteParser defines the interface for raw traceroute data.
 type TracerouteParser interface {
 	ParseRawData(rawData []byte) (ParsedData, error)
@@ -65,6 +119,8 @@ func New(traceType string) (TracerouteParser, error) {
 		return &scamper1Parser{}, nil
 	case "regular":
 		return &scamper2Parser{}, nil
+	case "paris":
+		return &paris1Parser{}, nil
 	}
 	return nil, fmt.Errorf("%q: %v", traceType, ErrTracerouteType)
 }
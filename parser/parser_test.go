@@ -17,6 +17,7 @@ func TestNew(t *testing.T) {
 	}{
 		{"mda", nil},
 		{"regular", nil},
+		{"paris", nil},
 		{"", ErrTracerouteType},
 		{"bad", ErrTracerouteType},
 	}
@@ -28,6 +28,8 @@ type Reply struct {
 	IcmpCode int     `json:"icmp_code" bigquery:"icmp_code"`
 	IcmpQTos int     `json:"icmp_q_tos" bigquery:"icmp_q_tos"`
 	IcmpQTTL int     `json:"icmp_q_ttl" bigquery:"icmp_q_ttl"`
+	// ICMPExts are the ICMP extensions of the reply, if any.
+	ICMPExts []ICMPExt `json:"icmpext,omitempty" bigquery:"icmpext"`
 }
 
 // Probe describes a single probe message, and all the associated replies.
@@ -142,6 +144,7 @@ func (s1 *scamper1Parser) ParseRawData(rawData []byte) (ParsedData, error) {
 	if scamper1.CycleStop.Type != "cycle-stop" {
 		return nil, fmt.Errorf("%w: %v", ErrCycleStopType, scamper1.CycleStop.Type)
 	}
+	checkVersion("tracelb", scamper1.Tracelb.Version)
 
 	return scamper1, nil
 }
@@ -177,3 +180,110 @@ func (s1 Scamper1) ExtractHops() []string {
 	}
 	return hopStrings
 }
+
+// ExtractRTTs returns the round-trip time statistics of the replies of
+// each hop.  Replies to the probes of a link come from the far end of the
+// link, so hops that are only the near end of links (e.g., the first hop)
+// have no statistics.
+func (s1 Scamper1) ExtractRTTs() map[string]*RTTStats {
+	rtts := make(map[string][]float64)
+	for i := range s1.Tracelb.Nodes {
+		for _, links := range s1.Tracelb.Nodes[i].Links {
+			for j := range links {
+				link := &links[j]
+				if net.ParseIP(link.Addr) == nil {
+					continue
+				}
+				for _, probe := range link.Probes {
+					for _, reply := range probe.Replies {
+						rtts[link.Addr] = append(rtts[link.Addr], reply.RTT)
+					}
+				}
+			}
+		}
+	}
+	if len(rtts) == 0 {
+		return nil
+	}
+	stats := make(map[string]*RTTStats, len(rtts))
+	for hop, r := range rtts {
+		stats[hop] = newRTTStats(r)
+	}
+	return stats
+}
+
+// ExtractExtensions returns the ICMP extensions of the replies of each
+// hop that had any.  Like round-trip times (see ExtractRTTs), extensions
+// are those of the replies to the probes of links, which come from the
+// far end of the links.
+func (s1 Scamper1) ExtractExtensions() map[string][]ICMPExt {
+	var exts map[string][]ICMPExt
+	for i := range s1.Tracelb.Nodes {
+		for _, links := range s1.Tracelb.Nodes[i].Links {
+			for j := range links {
+				link := &links[j]
+				if net.ParseIP(link.Addr) == nil {
+					continue
+				}
+				for _, probe := range link.Probes {
+					for _, reply := range probe.Replies {
+						for _, ext := range reply.ICMPExts {
+							if exts == nil {
+								exts = make(map[string][]ICMPExt)
+							}
+							// Several probes can get replies from
+							// the same hop.
+							if !hasICMPExt(exts[link.Addr], ext) {
+								exts[link.Addr] = append(exts[link.Addr], ext)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return exts
+}
+
+// ProbeCount returns the number of probes sent by the traceroute.
+func (s1 Scamper1) ProbeCount() int {
+	return int(s1.Tracelb.Probec)
+}
+
+// ExtractEndpoints returns the destination of the traceroute and its
+// farthest responsive hop other than the destination.  Hops are as far
+// as the smallest TTL of the link probes they replied to.  Hops that
+// didn't reply to link probes (e.g., the first hop) are the nearest.
+func (s1 Scamper1) ExtractEndpoints() (string, string) {
+	tracelb := s1.Tracelb
+	distances := make(map[string]int64)
+	var hops []string
+	for i := range tracelb.Nodes {
+		node := &tracelb.Nodes[i]
+		hops = append(hops, node.Addr)
+		for j := range node.Links {
+			for k := range node.Links[j] {
+				link := &node.Links[j][k]
+				hops = append(hops, link.Addr)
+				for _, probe := range link.Probes {
+					if len(probe.Replies) == 0 {
+						continue
+					}
+					if d, ok := distances[link.Addr]; !ok || probe.TTL < d {
+						distances[link.Addr] = probe.TTL
+					}
+				}
+			}
+		}
+	}
+	lastHop, max := "", int64(-1)
+	for _, hop := range hops {
+		if hop == tracelb.Dst || net.ParseIP(hop) == nil {
+			continue
+		}
+		if d := distances[hop]; d > max {
+			lastHop, max = hop, d
+		}
+	}
+	return tracelb.Dst, lastHop
+}
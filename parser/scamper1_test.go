@@ -3,9 +3,12 @@ package parser
 import (
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestScamper1Parser(t *testing.T) {
@@ -35,6 +38,10 @@ func TestScamper1Parser(t *testing.T) {
 			"2600:803:150f::4a"},
 		},
 		{"valid-star", nil, []string{}}, // all "addr" values are either "*" or ""
+		{"valid-list-name", nil, []string{}},
+		{"valid-unknown-version", nil, []string{}},
+		{"valid-rtt", nil, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"valid-mpls", nil, []string{"192.168.144.1", "4.69.140.198", "91.189.88.142"}},
 	}
 	for i, test := range tests {
 		// Read in the test traceroute output file.
@@ -64,6 +71,21 @@ func TestScamper1Parser(t *testing.T) {
 		}
 	}
 
+	// Test that the list name configured in scamper is parsed.
+	content, err := ioutil.ReadFile("./testdata/scamper1/valid-list-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := (&scamper1Parser{}).ParseRawData(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []string{parsed.(Scamper1).CycleStart.ListName, parsed.(Scamper1).CycleStop.ListName} {
+		if got != "ndt-campaign" {
+			t.Errorf("ListName = %q, want %q", got, "ndt-campaign")
+		}
+	}
+
 	// Test StartTime().
 	s1 := Scamper1{
 		CycleStart: CyclestartLine{
@@ -74,4 +96,91 @@ func TestScamper1Parser(t *testing.T) {
 	if got := s1.StartTime(); got != want {
 		t.Fatalf("StartTime() = %v, want %v", got, want)
 	}
+
+	// Test ProbeCount().
+	var pc ProbeCounter = Scamper1{Tracelb: TracelbLine{Probec: 42}}
+	if got := pc.ProbeCount(); got != 42 {
+		t.Fatalf("ProbeCount() = %d, want 42", got)
+	}
+
+	// Test ExtractRTTs().  The first hop is only the near end of a link
+	// so it has no replies, and one probe of the second link has two.
+	content, err = ioutil.ReadFile("./testdata/scamper1/valid-rtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = (&scamper1Parser{}).ParseRawData(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRTTs := map[string]*RTTStats{
+		"10.0.0.2": {Min: 1.5, Median: 2, Max: 3.25, Replies: 3},
+		"10.0.0.3": {Min: 5, Median: 7, Max: 9, Replies: 4},
+	}
+	if gotRTTs := parsed.(RTTExtractor).ExtractRTTs(); !reflect.DeepEqual(gotRTTs, wantRTTs) {
+		t.Errorf("ExtractRTTs() = %+v, want %+v", gotRTTs, wantRTTs)
+	}
+	if gotRTTs := (Scamper1{}).ExtractRTTs(); gotRTTs != nil {
+		t.Errorf("ExtractRTTs() = %+v, want nil", gotRTTs)
+	}
+
+	// Test ExtractExtensions().  Both probes of the first link got the
+	// same extension from the far end of the link.
+	if gotExts := parsed.(ExtensionExtractor).ExtractExtensions(); gotExts != nil {
+		t.Errorf("ExtractExtensions() = %+v, want nil", gotExts)
+	}
+	content, err = ioutil.ReadFile("./testdata/scamper1/valid-mpls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpls, err := (&scamper1Parser{}).ParseRawData(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExts := map[string][]ICMPExt{
+		"4.69.140.198": {{
+			ClassNum:  1,
+			ClassType: 1,
+			DataLen:   8,
+			MPLSLabels: []MPLSLabel{
+				{TTL: 1, S: 0, Exp: 0, Label: 24015},
+				{TTL: 1, S: 1, Exp: 0, Label: 16},
+			},
+		}},
+	}
+	if gotExts := mpls.(ExtensionExtractor).ExtractExtensions(); !reflect.DeepEqual(gotExts, wantExts) {
+		t.Errorf("ExtractExtensions() = %+v, want %+v", gotExts, wantExts)
+	}
+
+	// Test ExtractEndpoints().  The destination didn't reply so the
+	// farthest hop is the far end of the last link.
+	if dst, lastHop := parsed.(EndpointExtractor).ExtractEndpoints(); dst != "::ffff:1.47.236.62" || lastHop != "10.0.0.3" {
+		t.Errorf("ExtractEndpoints() = %q, %q, want %q, %q", dst, lastHop, "::ffff:1.47.236.62", "10.0.0.3")
+	}
+
+	// Test that tracelb records of unknown versions are counted.
+	for _, test := range []struct {
+		file    string
+		version string
+		want    float64
+	}{
+		{"valid-simple", "0.1", 0},
+		{"valid-unknown-version", "0.2", 1},
+	} {
+		content, err := ioutil.ReadFile(filepath.Join("./testdata/scamper1", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := promtest.ToFloat64(unknownVersions.WithLabelValues("tracelb"))
+		parsed, err := (&scamper1Parser{}).ParseRawData(content)
+		if err != nil {
+			t.Fatalf("ParseRawData(%s) = %v, want nil", test.file, err)
+		}
+		if got := parsed.(Scamper1).Tracelb.Version; got != test.version {
+			t.Errorf("%s: Version = %q, want %q", test.file, got, test.version)
+		}
+		if got := promtest.ToFloat64(unknownVersions.WithLabelValues("tracelb")) - before; got != test.want {
+			t.Errorf("%s: got %v unknown versions, want %v", test.file, got, test.want)
+		}
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
 	"time"
 
 	"github.com/m-lab/traceroute-caller/tracer"
@@ -12,21 +13,39 @@ import (
 
 // ScamperHop describes a layer of hops.
 type ScamperHop struct {
-	Addr      string  `json:"addr" bigquery:"addr"`
-	ProbeTTL  int32   `json:"probe_ttl" bigquery:"probe_ttl"`
-	ProbeID   int32   `json:"probe_id" bigquery:"probe_id"`
-	ProbeSize int32   `json:"probe_size" bigquery:"probe_size"`
-	Tx        TS      `json:"tx" bigquery:"tx"`
-	RTT       float64 `json:"rtt" bigquery:"rtt"`
-	ReplyTTL  int32   `json:"reply_ttl" bigquery:"reply_ttl"`
-	ReplyTOS  int32   `json:"reply_tos" bigquery:"reply_tos"`
-	ReplyIPID int32   `json:"reply_ipid" bigquery:"reply_ipid"`
-	ReplySize int32   `json:"reply_size" bigquery:"reply_size"`
-	ICMPType  int32   `json:"icmp_type" bigquery:"icmp_type"`
-	ICMPCode  int32   `json:"icmp_code" bigquery:"icmp_code"`
-	ICMPQTTL  int32   `json:"icmp_q_ttl" bigquery:"icmp_q_ttl"`
-	ICMPQIPL  int32   `json:"icmp_q_ipl" bigquery:"icmp_q_ipl"`
-	ICMPQTOS  int32   `json:"icmp_q_tos" bigquery:"icmp_q_tos"`
+	Addr      string    `json:"addr" bigquery:"addr"`
+	ProbeTTL  int32     `json:"probe_ttl" bigquery:"probe_ttl"`
+	ProbeID   int32     `json:"probe_id" bigquery:"probe_id"`
+	ProbeSize int32     `json:"probe_size" bigquery:"probe_size"`
+	Tx        TS        `json:"tx" bigquery:"tx"`
+	RTT       float64   `json:"rtt" bigquery:"rtt"`
+	ReplyTTL  int32     `json:"reply_ttl" bigquery:"reply_ttl"`
+	ReplyTOS  int32     `json:"reply_tos" bigquery:"reply_tos"`
+	ReplyIPID int32     `json:"reply_ipid" bigquery:"reply_ipid"`
+	ReplySize int32     `json:"reply_size" bigquery:"reply_size"`
+	ICMPType  int32     `json:"icmp_type" bigquery:"icmp_type"`
+	ICMPCode  int32     `json:"icmp_code" bigquery:"icmp_code"`
+	ICMPQTTL  int32     `json:"icmp_q_ttl" bigquery:"icmp_q_ttl"`
+	ICMPQIPL  int32     `json:"icmp_q_ipl" bigquery:"icmp_q_ipl"`
+	ICMPQTOS  int32     `json:"icmp_q_tos" bigquery:"icmp_q_tos"`
+	ICMPExts  []ICMPExt `json:"icmpext,omitempty" bigquery:"icmpext"`
+}
+
+// ICMPExt describes an ICMP extension object (RFC 4884) attached to a
+// hop's reply.  Only MPLS label stack objects (RFC 4950) are decoded.
+type ICMPExt struct {
+	ClassNum   int32       `json:"ie_cn" bigquery:"ie_cn"`
+	ClassType  int32       `json:"ie_ct" bigquery:"ie_ct"`
+	DataLen    int32       `json:"ie_dl" bigquery:"ie_dl"`
+	MPLSLabels []MPLSLabel `json:"mpls_labels,omitempty" bigquery:"mpls_labels"`
+}
+
+// MPLSLabel describes an entry of an MPLS label stack.
+type MPLSLabel struct {
+	TTL   int32 `json:"mpls_ttl" bigquery:"mpls_ttl"`
+	S     int32 `json:"mpls_s" bigquery:"mpls_s"`
+	Exp   int32 `json:"mpls_exp" bigquery:"mpls_exp"`
+	Label int32 `json:"mpls_label" bigquery:"mpls_label"`
 }
 
 // Scamper2 encapsulates the four lines of a traceroute:
@@ -111,6 +130,7 @@ func (s2 *scamper2Parser) ParseRawData(rawData []byte) (ParsedData, error) {
 	if scamper2.CycleStop.Type != "cycle-stop" {
 		return nil, fmt.Errorf("%w: %v", ErrCycleStopType, scamper2.CycleStop.Type)
 	}
+	checkVersion("trace", scamper2.Trace.Version)
 
 	return scamper2, nil
 }
@@ -137,3 +157,57 @@ func (s2 Scamper2) ExtractHops() []string {
 	}
 	return hopStrings
 }
+
+// ExtractExtensions returns the ICMP extensions of the replies of each
+// hop that had any.
+func (s2 Scamper2) ExtractExtensions() map[string][]ICMPExt {
+	var exts map[string][]ICMPExt
+	for i := range s2.Trace.Hops {
+		hop := &s2.Trace.Hops[i]
+		if len(hop.ICMPExts) == 0 || net.ParseIP(hop.Addr) == nil {
+			continue
+		}
+		if exts == nil {
+			exts = make(map[string][]ICMPExt)
+		}
+		// Several probes can get replies from the same hop.
+		for _, ext := range hop.ICMPExts {
+			if !hasICMPExt(exts[hop.Addr], ext) {
+				exts[hop.Addr] = append(exts[hop.Addr], ext)
+			}
+		}
+	}
+	return exts
+}
+
+// hasICMPExt returns true if exts contains ext.
+func hasICMPExt(exts []ICMPExt, ext ICMPExt) bool {
+	for _, e := range exts {
+		if reflect.DeepEqual(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeCount returns the number of probes sent by the traceroute.
+func (s2 Scamper2) ProbeCount() int {
+	return int(s2.Trace.ProbeCount)
+}
+
+// ExtractEndpoints returns the destination of the traceroute and its
+// farthest responsive hop other than the destination.
+func (s2 Scamper2) ExtractEndpoints() (string, string) {
+	trace := s2.Trace
+	lastHop, max := "", int32(-1)
+	for i := range trace.Hops {
+		hop := &trace.Hops[i]
+		if hop.Addr == trace.Dst || net.ParseIP(hop.Addr) == nil {
+			continue
+		}
+		if hop.ProbeTTL > max {
+			lastHop, max = hop.Addr, hop.ProbeTTL
+		}
+	}
+	return trace.Dst, lastHop
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -40,6 +41,7 @@ func TestScamper2Parser(t *testing.T) {
 			"212.187.137.18",
 			"91.189.88.142"}},
 		{"valid-star", nil, []string{}}, // all "addr" values are either "*" or ""
+		{"valid-mpls", nil, []string{"192.168.144.1", "4.69.140.198", "91.189.88.142"}},
 	}
 	for i, test := range tests {
 		// Read in the test traceroute output file.
@@ -79,4 +81,42 @@ func TestScamper2Parser(t *testing.T) {
 	if got := s2.StartTime(); got != want {
 		t.Fatalf("StartTime() = %v, want %v", got, want)
 	}
+
+	// Test ExtractExtensions().
+	content, err := ioutil.ReadFile("./testdata/scamper2/valid-mpls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedData, err := (&scamper2Parser{}).ParseRawData(content)
+	if err != nil {
+		t.Fatalf("ParseRawData() = %v, want nil", err)
+	}
+	wantExts := map[string][]ICMPExt{
+		"4.69.140.198": {{
+			ClassNum:  1,
+			ClassType: 1,
+			DataLen:   8,
+			MPLSLabels: []MPLSLabel{
+				{TTL: 1, S: 0, Exp: 0, Label: 24015},
+				{TTL: 1, S: 1, Exp: 0, Label: 16},
+			},
+		}},
+	}
+	if gotExts := parsedData.(ExtensionExtractor).ExtractExtensions(); !reflect.DeepEqual(gotExts, wantExts) {
+		t.Fatalf("ExtractExtensions() = %+v, want %+v", gotExts, wantExts)
+	}
+	if gotExts := (Scamper2{}).ExtractExtensions(); gotExts != nil {
+		t.Fatalf("ExtractExtensions() = %+v, want nil", gotExts)
+	}
+
+	// Test ExtractEndpoints().
+	if dst, lastHop := parsedData.(EndpointExtractor).ExtractEndpoints(); dst != "91.189.88.142" || lastHop != "4.69.140.198" {
+		t.Errorf("ExtractEndpoints() = %q, %q, want %q, %q", dst, lastHop, "91.189.88.142", "4.69.140.198")
+	}
+
+	// Test ProbeCount().
+	var pc ProbeCounter = Scamper2{Trace: TraceLine{ProbeCount: 42}}
+	if got := pc.ProbeCount(); got != 42 {
+		t.Fatalf("ProbeCount() = %d, want 42", got)
+	}
 }
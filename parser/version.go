@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// knownVersions are the versions of scamper's output records that the
+// parser has been tested with.  Records of other versions are parsed
+// anyway but counted because they may be mishandled.
+var knownVersions = map[string]map[string]bool{
+	"tracelb": {"0.1": true},
+	"trace":   {"0.1": true},
+}
+
+// unknownVersions isn't labeled by version because the versions come
+// from the parsed records.  They're logged instead.
+var unknownVersions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "parser_unknown_versions_total",
+		Help: "The number of traceroutes whose record version isn't known to the parser",
+	},
+	[]string{"type"},
+)
+
+// loggedVersions are the unknown versions that have been logged, keyed
+// by record type and version, so that each one is only logged once.
+var loggedVersions sync.Map
+
+// checkVersion counts and logs the given version of the given record
+// type if it isn't known.
+func checkVersion(recordType, version string) {
+	if knownVersions[recordType][version] {
+		return
+	}
+	unknownVersions.WithLabelValues(recordType).Inc()
+	if _, logged := loggedVersions.LoadOrStore(recordType+" "+version, true); !logged {
+		log.Printf("warning: parsing %s records of unknown version %q\n", recordType, version)
+	}
+}
@@ -0,0 +1,90 @@
+package tracer
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Filename collision policies (see ScamperConfig.CollisionPolicy).
+const (
+	CollisionOverwrite = "overwrite" // replace the existing file
+	CollisionSkip      = "skip"      // don't write the new traceroute
+	CollisionSuffix    = "suffix"    // write the new traceroute to a uniquified filename
+)
+
+// maxCollisionSuffix is the largest suffix tried by CollisionSuffix.
+const maxCollisionSuffix = 100
+
+var filenameCollisions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "traces_filename_collisions_total",
+		Help: "The number of fresh traceroutes whose filename was already taken by another fresh traceroute, by action taken",
+	},
+	[]string{"type", "action"},
+)
+
+// validCollisionPolicy returns true if policy is a valid collision policy.
+func validCollisionPolicy(policy string) bool {
+	switch policy {
+	case "", CollisionOverwrite, CollisionSkip, CollisionSuffix:
+		return true
+	}
+	return false
+}
+
+// resolveCollision returns the filename that a fresh traceroute should
+// be written to according to the collision policy if filename is taken
+// by another fresh traceroute, and false if it shouldn't be written.
+// Files of cached traceroutes don't count as collisions and are replaced
+// like before.  replace is true if the returned filename exists and may
+// be replaced; other files must not be replaced if they are created in
+// the meantime.
+func (s *Scamper) resolveCollision(filename string) (name string, ok, replace bool, err error) {
+	if s.outputPath == StdoutPath {
+		return filename, true, false, nil
+	}
+	if !isFreshTraceFile(filename) {
+		_, err := os.Lstat(filename)
+		return filename, true, err == nil, nil
+	}
+	switch s.collision {
+	case CollisionSkip:
+		filenameCollisions.WithLabelValues(s.metricType, "skipped").Inc()
+		return filename, false, false, nil
+	case CollisionSuffix:
+		base := strings.TrimSuffix(filename, ".jsonl")
+		for i := 1; i <= maxCollisionSuffix; i++ {
+			name := base + "-" + strconv.Itoa(i) + ".jsonl"
+			if _, err := os.Lstat(name); os.IsNotExist(err) {
+				filenameCollisions.WithLabelValues(s.metricType, "suffixed").Inc()
+				return name, true, false, nil
+			}
+		}
+		filenameCollisions.WithLabelValues(s.metricType, "failed").Inc()
+		return "", false, false, newError(ErrWriteFile, nil, "%q: no free filename after %d collisions", filename, maxCollisionSuffix)
+	default:
+		filenameCollisions.WithLabelValues(s.metricType, "overwritten").Inc()
+		return filename, true, true, nil
+	}
+}
+
+// isFreshTraceFile returns true if the named file exists and holds a
+// traceroute that wasn't obtained from the cache.  Files whose metadata
+// line can't be read are considered fresh so that they aren't lost.
+func isFreshTraceFile(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	defer f.Close()
+	metaline, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(metaline) == 0 {
+		return true
+	}
+	return !extractMetadata(metaline).CachedResult
+}
@@ -0,0 +1,123 @@
+package tracer
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/uuid/prefix"
+)
+
+func TestCollisionPolicy(t *testing.T) {
+	if _, err := NewScamper(ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       StdoutPath,
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+		CollisionPolicy:  "rename",
+	}); !errors.Is(err, ErrInvalidCollision) {
+		t.Errorf("NewScamper() = %v, want %v", err, ErrInvalidCollision)
+	}
+
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	base := "2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000001"
+	tests := []struct {
+		policy string
+		want   map[string]string // UUID in the metadata line of each file
+	}{
+		{"", map[string]string{base + ".jsonl": "second"}},
+		{CollisionOverwrite, map[string]string{base + ".jsonl": "second"}},
+		{CollisionSkip, map[string]string{base + ".jsonl": "first"}},
+		{CollisionSuffix, map[string]string{base + ".jsonl": "first", base + "-1.jsonl": "second"}},
+	}
+	for _, test := range tests {
+		tempdir, err := ioutil.TempDir("", "TestCollisionPolicy")
+		rtx.Must(err, "failed to create tempdir")
+		defer os.RemoveAll(tempdir)
+		s, err := NewScamper(ScamperConfig{
+			Binary:           "testdata/jsonl",
+			OutputPath:       tempdir,
+			Timeout:          time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+			CollisionPolicy:  test.policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both traceroutes have the same cookie and start time and
+		// therefore the same filename.
+		for _, uuid := range []string{"first", "second"} {
+			if _, err := s.Trace("10.1.1.1", "1", uuid, faketime); err != nil {
+				t.Fatalf("%q: Trace() = %v, want nil", test.policy, err)
+			}
+		}
+		files, err := filepath.Glob(filepath.Join(tempdir, "2019/04/01/*.jsonl"))
+		rtx.Must(err, "failed to list traceroute files")
+		if len(files) != len(test.want) {
+			t.Errorf("%q: got files %v, want %d", test.policy, files, len(test.want))
+		}
+		for name, uuid := range test.want {
+			if got := fileMetadata(t, filepath.Join(tempdir, name)).UUID; got != uuid {
+				t.Errorf("%q: got UUID %q in %s, want %q", test.policy, got, name, uuid)
+			}
+		}
+	}
+}
+
+func TestCollisionCached(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "TestCollisionCached")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(tempdir)
+	s, err := NewScamper(ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       tempdir,
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+		CollisionPolicy:  CollisionSkip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	filename := tempdir + "/2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000001.jsonl"
+
+	// A cached traceroute replaces a fresh one and is replaced by a
+	// fresh one regardless of the collision policy.
+	out, err := s.Trace("10.1.1.1", "1", "fresh1", faketime)
+	if err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("1", "cached", faketime, out); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	if md := fileMetadata(t, filename); md.UUID != "cached" || !md.CachedResult {
+		t.Errorf("got metadata %+v, want cached traceroute", md)
+	}
+	if _, err := s.Trace("10.1.1.1", "1", "fresh2", faketime); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if md := fileMetadata(t, filename); md.UUID != "fresh2" {
+		t.Errorf("got metadata %+v, want fresh traceroute", md)
+	}
+}
+
+// fileMetadata returns the metadata of the named traceroute file.
+func fileMetadata(t *testing.T, filename string) Metadata {
+	t.Helper()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[:i]
+	}
+	return extractMetadata(b)
+}
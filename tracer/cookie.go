@@ -0,0 +1,57 @@
+package tracer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/m-lab/uuid"
+)
+
+const (
+	// DefaultCookieWidth is the number of hexadecimal digits that
+	// cookies are padded to in UUIDs (e.g., "00000000000012AB").  It's
+	// the smallest width that fits every 64-bit cookie.
+	DefaultCookieWidth = 16
+	// maxCookieWidth is the largest cookie width.  It keeps UUIDs well
+	// within the 128 characters allowed by ValidateUUID.
+	maxCookieWidth = 32
+)
+
+// ValidateCookieWidth returns an error if cookies can't be padded to
+// width hexadecimal digits in UUIDs.  Zero means DefaultCookieWidth.
+// Other widths must fit the largest cookie, so they are at least
+// DefaultCookieWidth (and at most 32).
+func ValidateCookieWidth(width int) error {
+	if width != 0 && (width < DefaultCookieWidth || width > maxCookieWidth) {
+		return fmt.Errorf("%w: %d (min: %d, max: %d)", ErrInvalidCookieWidth, width, DefaultCookieWidth, maxCookieWidth)
+	}
+	return nil
+}
+
+// UUIDFromCookie returns the UUID of the socket with the given cookie:
+// the UUID prefix of this host (see github.com/m-lab/uuid) followed by
+// the cookie padded with zeros to width hexadecimal digits.  Zero (or
+// DefaultCookieWidth) returns the same UUID as uuid.FromCookie.  Width
+// must be valid (see ValidateCookieWidth).
+//
+// UUIDs are part of traceroute filenames, so changing the width renames
+// the files of new traceroutes.  All the components that derive UUIDs
+// from cookies, and the consumers of their files, must agree on it.
+func UUIDFromCookie(cookie uint64, width int) string {
+	if width == 0 || width == DefaultCookieWidth {
+		return uuid.FromCookie(cookie)
+	}
+	// The UUID prefix isn't exported but it's what precedes the
+	// padded cookie.
+	prefix := strings.TrimSuffix(uuid.FromCookie(0), "_"+strings.Repeat("0", DefaultCookieWidth))
+	return prefix + "_" + formatCookie(cookie, width)
+}
+
+// formatCookie returns the given cookie in uppercase hexadecimal digits
+// padded with zeros to width digits (DefaultCookieWidth if zero).
+func formatCookie(cookie uint64, width int) string {
+	if width == 0 {
+		width = DefaultCookieWidth
+	}
+	return fmt.Sprintf("%0*X", width, cookie)
+}
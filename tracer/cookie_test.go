@@ -0,0 +1,58 @@
+package tracer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/uuid"
+)
+
+func TestUUIDFromCookie(t *testing.T) {
+	for _, width := range []int{0, DefaultCookieWidth} {
+		if got, want := UUIDFromCookie(0x12ab, width), uuid.FromCookie(0x12ab); got != want {
+			t.Errorf("UUIDFromCookie(0x12ab, %d) = %q, want %q", width, got, want)
+		}
+	}
+	for _, test := range []struct {
+		width   int
+		wantErr bool
+	}{
+		{0, false},
+		{16, false},
+		{32, false},
+		{-1, true},
+		{8, true},
+		{33, true},
+	} {
+		if err := ValidateCookieWidth(test.width); (err != nil) != test.wantErr || (err != nil && !errors.Is(err, ErrInvalidCookieWidth)) {
+			t.Errorf("ValidateCookieWidth(%d) = %v, want error %v", test.width, err, test.wantErr)
+		}
+	}
+
+	// The cookie is padded to the configured width in filenames.
+	s, err := NewScamper(ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       "/tmp",
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 25,
+		CookieWidth:      20,
+	})
+	if err != nil {
+		t.Fatalf("NewScamper() = %v, want nil", err)
+	}
+	u := UUIDFromCookie(0x12ab, 20)
+	if want := strings.TrimSuffix(uuid.FromCookie(0x12ab), "00000000000012AB") + "000000000000000012AB"; u != want {
+		t.Errorf("UUIDFromCookie(0x12ab, 20) = %q, want %q", u, want)
+	}
+	now := time.Date(2021, 10, 28, 6, 15, 0, 0, time.UTC)
+	filename, err := s.Filename("12ab", now)
+	if err != nil {
+		t.Fatalf("Filename() = %v, want nil", err)
+	}
+	if want := "/tmp/2021/10/28/20211028T061500Z_" + u + ".jsonl"; filename != want {
+		t.Errorf("Filename() = %q, want %q", filename, want)
+	}
+}
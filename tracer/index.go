@@ -0,0 +1,292 @@
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/traceroute-caller/internal/reopen"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// IndexFilename is the name of the index file in each date directory.
+const IndexFilename = "index.jsonl"
+
+// indexDays is the number of days whose indexed filenames are kept in
+// memory.  Two days are enough for traceroutes that start right before
+// midnight and are written right after it.
+const indexDays = 2
+
+var indexErrors = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "traces_index_errors_total",
+		Help: "The number of traceroute files that could not be added to the index",
+	},
+	[]string{"type"},
+)
+
+// IndexRotation configures the rotation of the index file of each day
+// when it grows too large or too old (see NewRotatingIndexer).
+type IndexRotation = reopen.Rotation
+
+// IndexRecord is the datatype that is written to the index for each
+// traceroute file.
+type IndexRecord struct {
+	Filename     string
+	UUID         string
+	Destination  string
+	Timestamp    time.Time
+	CachedResult bool
+}
+
+// Indexer maintains an append-only index of the traceroute files that
+// have been written so that they can be ingested without listing
+// directories.  The index of the traceroutes of each day is in the
+// file IndexFilename of the date directory (e.g., 2021/12/01) under
+// the index path, so it rotates daily alongside the traceroute files.
+// An Indexer can be shared by several Scamper instances.
+//
+// Each record is appended with a single write so that readers never
+// see interleaved records.  Filenames already in the index of a day,
+// including those indexed before a restart, are not indexed again.
+type Indexer struct {
+	path     string
+	rotation IndexRotation
+	mu       sync.Mutex
+	days     map[string]*indexDay // key is the index filename
+}
+
+// indexDay is the state of the index of a day.
+type indexDay struct {
+	filenames map[string]bool // filenames in the index
+	newline   bool            // the index doesn't end with a newline
+	file      *reopen.File    // open index file if the index is rotated
+}
+
+// NewIndexer returns a new Indexer that writes the index of each day
+// under the given path.
+func NewIndexer(path string) (*Indexer, error) {
+	return NewRotatingIndexer(path, IndexRotation{})
+}
+
+// NewRotatingIndexer is like NewIndexer but the index file of each day
+// is also rotated according to the given configuration.  Filenames in
+// rotated index files are not indexed again as long as their backups
+// are kept.
+func NewRotatingIndexer(path string, rotation IndexRotation) (*Indexer, error) {
+	if path == "" {
+		return nil, newError(ErrOutputPath, nil, "empty index path")
+	}
+	if err := rotation.Validate(); err != nil {
+		return nil, newError(ErrOutputPath, err, "%v", err)
+	}
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, newError(ErrOutputPath, err, "failed to create directory %q (error: %v)", path, err)
+	}
+	return &Indexer{
+		path:     path,
+		rotation: rotation,
+		days:     make(map[string]*indexDay),
+	}, nil
+}
+
+// Index appends the given record to the index of the day of its
+// timestamp unless its filename has already been indexed.
+func (ix *Indexer) Index(rec IndexRecord) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	filename := datePath(ix.path, rec.Timestamp) + IndexFilename
+	day, err := ix.day(filename)
+	if err != nil {
+		return err
+	}
+	if day.filenames[rec.Filename] {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if day.newline {
+		b = append([]byte{'\n'}, b...)
+	}
+	b = append(b, '\n')
+	if err := ix.write(filename, day, b); err != nil {
+		return err
+	}
+	day.filenames[rec.Filename] = true
+	day.newline = false
+	return nil
+}
+
+// Reopen reopens the index files that are kept open (see
+// NewRotatingIndexer) so that an external rotation tool can move them.
+func (ix *Indexer) Reopen() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	var firstErr error
+	for _, day := range ix.days {
+		if day.file == nil {
+			continue
+		}
+		if err := day.file.Reopen(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// write appends b to the named index file of the given day.  Rotated
+// index files are kept open while their day is in memory.
+func (ix *Indexer) write(filename string, day *indexDay, b []byte) error {
+	if ix.rotation == (IndexRotation{}) {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(b)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if day.file == nil {
+		f, err := reopen.OpenRotating(filename, 0644, ix.rotation)
+		if err != nil {
+			return err
+		}
+		day.file = f
+	}
+	_, err := day.file.Write(b)
+	return err
+}
+
+// day returns the state of the index in the named file, loading it
+// from the file if it's not in memory.  The state of the oldest days
+// is dropped to keep at most indexDays days in memory.
+func (ix *Indexer) day(filename string) (*indexDay, error) {
+	if day, ok := ix.days[filename]; ok {
+		return day, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return nil, err
+	}
+	day, err := loadIndexDay(filename)
+	if err != nil {
+		return nil, err
+	}
+	ix.days[filename] = day
+	if len(ix.days) > indexDays {
+		// Date paths sort chronologically.
+		names := make([]string, 0, len(ix.days))
+		for name := range ix.days {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[:len(names)-indexDays] {
+			if f := ix.days[name].file; f != nil {
+				// Close waits for the file's backups to be
+				// archived, which mustn't block indexing.
+				go f.Close()
+			}
+			delete(ix.days, name)
+		}
+	}
+	return day, nil
+}
+
+// loadIndexDay reads the filenames in the named index file and in its
+// rotated backups (if they exist).  Malformed records (e.g., a record
+// that was partially written before a crash) are ignored.
+func loadIndexDay(filename string) (*indexDay, error) {
+	day := &indexDay{filenames: make(map[string]bool)}
+	backups, err := reopen.Backups(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(backups, filename) {
+		b, err := readIndexFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range bytes.Split(b, []byte{'\n'}) {
+			var rec IndexRecord
+			if json.Unmarshal(line, &rec) == nil && rec.Filename != "" {
+				day.filenames[rec.Filename] = true
+			}
+		}
+		if name == filename {
+			day.newline = len(b) > 0 && b[len(b)-1] != '\n'
+		}
+	}
+	return day, nil
+}
+
+// readIndexFile returns the contents of the named index file, which is
+// decompressed if it's a compressed backup.
+func readIndexFile(name string) ([]byte, error) {
+	if !strings.HasSuffix(name, ".gz") {
+		return ioutil.ReadFile(name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// index adds the named traceroute file to the index (if any).  Failures
+// are counted and logged but don't fail the traceroute because it has
+// already been written.
+func (s *Scamper) index(filename, uuid, remoteIP string, t time.Time, cached bool) {
+	if s.indexer == nil || filename == "" {
+		return
+	}
+	rec := IndexRecord{
+		Filename:     filename,
+		UUID:         uuid,
+		Destination:  remoteIP,
+		Timestamp:    t,
+		CachedResult: cached,
+	}
+	if err := s.indexer.Index(rec); err != nil {
+		indexErrors.WithLabelValues(s.metricType).Inc()
+		log.Printf("failed to index traceroute file %q (error: %v)\n", filename, err)
+	}
+}
+
+// extractDestination returns the destination of the traceroute in the
+// given scamper output or an empty string if it's not found.
+func extractDestination(data []byte) string {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		var record struct {
+			Type string `json:"type"`
+			Dst  string `json:"dst"`
+		}
+		if json.Unmarshal(line, &record) != nil {
+			continue
+		}
+		if record.Type == "trace" || record.Type == "tracelb" {
+			return record.Dst
+		}
+	}
+	return ""
+}
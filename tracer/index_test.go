@@ -0,0 +1,241 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// readIndex returns the records in the named index file.
+func readIndex(t *testing.T, filename string) []IndexRecord {
+	t.Helper()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read index (error: %v)", err)
+	}
+	var recs []IndexRecord
+	for _, line := range bytes.Split(bytes.TrimSuffix(b, []byte{'\n'}), []byte{'\n'}) {
+		var rec IndexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestIndex(t *testing.T) {
+	if _, err := NewIndexer(""); err == nil {
+		t.Fatal("NewIndexer() = nil, want error")
+	}
+	tempdir := t.TempDir()
+	newScamper := func() *Scamper {
+		t.Helper()
+		ix, err := NewIndexer(tempdir)
+		if err != nil {
+			t.Fatalf("NewIndexer() = %v, want nil", err)
+		}
+		s, err := NewScamper(ScamperConfig{
+			Binary:           "testdata/jsonl",
+			OutputPath:       tempdir,
+			Timeout:          1 * time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+			Indexer:          ix,
+		})
+		if err != nil {
+			t.Fatalf("NewScamper() = %v, want nil", err)
+		}
+		// Traceroutes with UUIDs starting with "filtered" aren't written.
+		s.SetWriteFilter(func(rawData []byte) bool {
+			return !bytes.Contains(rawData, []byte(`"UUID":"filtered`))
+		})
+		return s
+	}
+
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	s := newScamper()
+	out, err := s.Trace("10.1.1.1", "1", "uuid1", faketime)
+	if err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("2", "uuid2", faketime, out); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	if _, err := s.Trace("10.1.1.1", "3", "filtered3", faketime); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	// The traceroute of the next day goes to the index of that day.
+	if _, err := s.Trace("10.1.1.1", "4", "uuid4", faketime.Add(24*time.Hour)); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+
+	// Simulate a crash in the middle of writing a record and a restart
+	// that rewrites a traceroute file that is already in the index.
+	index := filepath.Join(tempdir, "2019/04/01", IndexFilename)
+	f, err := os.OpenFile(index, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Filename":"partial`)
+	f.Close()
+	s = newScamper()
+	if err := s.CachedTrace("2", "uuid2", faketime, out); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("5", "uuid5", faketime, out); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+
+	// The indexes must list exactly the traceroute files.
+	var written []string
+	filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".jsonl") && filepath.Base(path) != IndexFilename {
+			written = append(written, path)
+		}
+		return nil
+	})
+	recs := readIndex(t, index)
+	recs = append(recs, readIndex(t, filepath.Join(tempdir, "2019/04/02", IndexFilename))...)
+	var indexed []string
+	for _, rec := range recs {
+		indexed = append(indexed, rec.Filename)
+	}
+	sort.Strings(written)
+	sort.Strings(indexed)
+	if strings.Join(indexed, "\n") != strings.Join(written, "\n") {
+		t.Errorf("indexed files:\n%s\nwant:\n%s", strings.Join(indexed, "\n"), strings.Join(written, "\n"))
+	}
+	wantUUIDs := map[string]bool{"uuid1": false, "uuid2": true, "uuid4": false, "uuid5": true}
+	for _, rec := range recs {
+		cached, ok := wantUUIDs[rec.UUID]
+		if !ok || rec.CachedResult != cached || rec.Destination != "10.1.1.1" {
+			t.Errorf("unexpected index record %+v", rec)
+		}
+		delete(wantUUIDs, rec.UUID)
+	}
+	if len(wantUUIDs) != 0 {
+		t.Errorf("missing index records for %v", wantUUIDs)
+	}
+
+	// Failures to index don't fail the traceroute.
+	s.indexer.path = filepath.Join(index, "not-a-dir")
+	errs := promtest.ToFloat64(indexErrors.WithLabelValues("scamper"))
+	if _, err := s.Trace("10.1.1.1", "6", "uuid6", faketime.Add(48*time.Hour)); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if got := promtest.ToFloat64(indexErrors.WithLabelValues("scamper")) - errs; got != 1 {
+		t.Errorf("got %v index errors, want 1", got)
+	}
+}
+
+func TestIndexRotation(t *testing.T) {
+	if _, err := NewRotatingIndexer(t.TempDir(), IndexRotation{MaxSize: -1}); err == nil {
+		t.Fatal("NewRotatingIndexer() = nil, want error")
+	}
+	tempdir := t.TempDir()
+	ix, err := NewRotatingIndexer(tempdir, IndexRotation{MaxSize: 1, Compress: true})
+	if err != nil {
+		t.Fatalf("NewRotatingIndexer() = %v, want nil", err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	for _, uuid := range []string{"uuid1", "uuid2", "uuid3"} {
+		if err := ix.Index(IndexRecord{Filename: uuid + ".jsonl", UUID: uuid, Timestamp: faketime}); err != nil {
+			t.Fatalf("Index() = %v, want nil", err)
+		}
+	}
+	// Every record is larger than the maximum size so each one but the
+	// first rotates the index into a compressed backup.
+	index := filepath.Join(tempdir, "2019/04/01", IndexFilename)
+	if recs := readIndex(t, index); len(recs) != 1 || recs[0].UUID != "uuid3" {
+		t.Errorf("got index records %+v, want uuid3 only", recs)
+	}
+	// Backups are compressed in the background until the file is
+	// closed.
+	if err := ix.days[index].file.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	backups, err := filepath.Glob(index + ".*.gz")
+	if err != nil || len(backups) != 2 {
+		t.Errorf("got index backups %v (error: %v), want 2", backups, err)
+	}
+
+	// After a restart, filenames in the backups aren't indexed again.
+	ix, err = NewRotatingIndexer(tempdir, IndexRotation{MaxSize: 1, Compress: true})
+	if err != nil {
+		t.Fatalf("NewRotatingIndexer() = %v, want nil", err)
+	}
+	for _, uuid := range []string{"uuid1", "uuid2", "uuid3", "uuid4"} {
+		if err := ix.Index(IndexRecord{Filename: uuid + ".jsonl", UUID: uuid, Timestamp: faketime}); err != nil {
+			t.Fatalf("Index() = %v, want nil", err)
+		}
+	}
+	if recs := readIndex(t, index); len(recs) != 1 || recs[0].UUID != "uuid4" {
+		t.Errorf("got index records %+v, want uuid4 only", recs)
+	}
+	if err := ix.days[index].file.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+	if backups, _ := filepath.Glob(index + ".*.gz"); len(backups) != 3 {
+		t.Errorf("got index backups %v, want 3", backups)
+	}
+}
+
+func TestIndexReopen(t *testing.T) {
+	tempdir := t.TempDir()
+	ix, err := NewRotatingIndexer(tempdir, IndexRotation{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("NewRotatingIndexer() = %v, want nil", err)
+	}
+	// Index files that aren't kept open don't need to be reopened.
+	if err := ix.Reopen(); err != nil {
+		t.Fatalf("Reopen() = %v, want nil", err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	index := filepath.Join(tempdir, "2019/04/01", IndexFilename)
+	moved := index + ".1"
+	for _, uuid := range []string{"uuid1", "uuid2"} {
+		if err := ix.Index(IndexRecord{Filename: uuid + ".jsonl", UUID: uuid, Timestamp: faketime}); err != nil {
+			t.Fatalf("Index() = %v, want nil", err)
+		}
+		// An external rotation tool moves the index file away.
+		if uuid == "uuid1" {
+			if err := os.Rename(index, moved); err != nil {
+				t.Fatal(err)
+			}
+			if err := ix.Reopen(); err != nil {
+				t.Fatalf("Reopen() = %v, want nil", err)
+			}
+		}
+	}
+	for filename, want := range map[string]string{moved: "uuid1", index: "uuid2"} {
+		if recs := readIndex(t, filename); len(recs) != 1 || recs[0].UUID != want {
+			t.Errorf("got index records %+v in %s, want %s only", recs, filename, want)
+		}
+	}
+}
+
+func TestExtractDestination(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"", ""},
+		{"not json\n{\"type\":\"cycle-start\"}\n", ""},
+		{"{\"type\":\"trace\", \"dst\":\"1.2.3.4\"}\n", "1.2.3.4"},
+		{"{}\n{\"type\":\"tracelb\", \"dst\":\"::1\"}\n", "::1"},
+	}
+	for _, test := range tests {
+		if got := extractDestination([]byte(test.data)); got != test.want {
+			t.Errorf("extractDestination(%q) = %q, want %q", test.data, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package tracer
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var legacyLinks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "traces_legacy_links_total",
+		Help: "The number of traceroute files made available under the legacy filename scheme, by result (linked, copied, or failed)",
+	},
+	[]string{"type", "result"},
+)
+
+// legacyFilename returns the name of the legacy link of the named
+// traceroute file: the same date directories under the legacy link path
+// and a dash instead of an underscore after the timestamp (e.g.,
+// 20190401T034551Z-<uuid>.jsonl).
+func (s *Scamper) legacyFilename(filename string, t time.Time) string {
+	return datePath(s.legacyPath, t) + strings.Replace(filepath.Base(filename), "_", "-", 1)
+}
+
+// linkLegacy makes the named traceroute file, whose content is data,
+// available under the legacy filename scheme (if configured) with a
+// hard link, or a copy if the legacy link path is on another device.
+// Failures are counted and logged but don't fail the traceroute because
+// it has already been written.
+func (s *Scamper) linkLegacy(filename string, data []byte, t time.Time) {
+	if s.legacyPath == "" || filename == "" {
+		return
+	}
+	legacy := s.legacyFilename(filename, t)
+	result, err := "linked", s.createDateDirs(s.legacyPath, t)
+	if err == nil {
+		// Cached traceroutes replace the files of earlier traceroutes
+		// so their links must be replaced too.
+		if err = os.Remove(legacy); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Link(filename, legacy)
+		if errors.Is(err, syscall.EXDEV) {
+			result, err = "copied", s.writeFile(legacy, data, true)
+		}
+	}
+	if err != nil {
+		legacyLinks.WithLabelValues(s.metricType, "failed").Inc()
+		log.Printf("failed to link traceroute file %q to %q (error: %v)\n", filename, legacy, err)
+		return
+	}
+	legacyLinks.WithLabelValues(s.metricType, result).Inc()
+}
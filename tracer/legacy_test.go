@@ -0,0 +1,89 @@
+package tracer
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/uuid/prefix"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLegacyLinks(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "output")
+	legacyPath := filepath.Join(dir, "legacy")
+	for _, cfg := range []ScamperConfig{
+		{OutputPath: StdoutPath, LegacyLinkPath: legacyPath},
+		{OutputPath: outputPath, LegacyLinkPath: outputPath + "/"},
+		{OutputPath: outputPath, LegacyLinkPath: "/dev/null/legacy"},
+	} {
+		cfg.Binary, cfg.Timeout, cfg.TraceType, cfg.TracelbWaitProbe = "testdata/jsonl", time.Minute, "mda", 39
+		if _, err := NewScamper(cfg); !errors.Is(err, ErrLegacyLinkPath) {
+			t.Errorf("NewScamper(%q, %q) = %v, want %v", cfg.OutputPath, cfg.LegacyLinkPath, err, ErrLegacyLinkPath)
+		}
+	}
+
+	s, err := NewScamper(ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       outputPath,
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+		LegacyLinkPath:   legacyPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked := promtest.ToFloat64(legacyLinks.WithLabelValues("scamper", "linked"))
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	data, err := s.Trace("10.1.1.1", "1", "0123456789", faketime)
+	if err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	// The cached traceroute replaces the file of the first one and
+	// its legacy link.
+	if err := s.CachedTrace("1", "9876543210", faketime, data); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("2", "9876543210", faketime, data); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+
+	for _, cookie := range []string{"0000000000000001", "0000000000000002"} {
+		name := "2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_" + cookie + ".jsonl"
+		legacyName := "2019/04/01/20190401T034551Z-" + prefix.UnsafeString() + "_" + cookie + ".jsonl"
+		fi, err := os.Stat(filepath.Join(outputPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacyFi, err := os.Stat(filepath.Join(legacyPath, legacyName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(fi, legacyFi) {
+			t.Errorf("%s and its legacy link %s are different files", name, legacyName)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(outputPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacyContent, err := ioutil.ReadFile(filepath.Join(legacyPath, legacyName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, legacyContent) {
+			t.Errorf("legacy link %s has content %q, want %q", legacyName, legacyContent, content)
+		}
+		if got := fileMetadata(t, filepath.Join(legacyPath, legacyName)); !got.CachedResult {
+			t.Errorf("legacy link %s has metadata %+v, want a cached traceroute", legacyName, got)
+		}
+	}
+	if n := promtest.ToFloat64(legacyLinks.WithLabelValues("scamper", "linked")) - linked; n != 3 {
+		t.Errorf("got %v legacy links, want 3", n)
+	}
+}
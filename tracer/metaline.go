@@ -0,0 +1,67 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// metalineVersion is the version of the layout of the metalines that
+// are written.  It's bumped whenever fields are added to metalineFields.
+const metalineVersion = 1
+
+// metalineField is a field of the metaline.
+type metalineField struct {
+	name    string
+	version int // first metaline version with the field
+	// value returns the value of the field in the given metadata.
+	value func(md Metadata) interface{}
+}
+
+// metalineFields are the fields of the metaline in the order that they
+// are written.  Some consumers parse metalines positionally so every
+// field of a version is written, even if it has a zero or null value,
+// and existing fields must never be reordered or removed.  New fields
+// are appended with the next metaline version (and to Metadata):
+//
+//	1: UUID, TracerouteCallerVersion, CachedResult, CachedUUID,
+//	   MetalineVersion, TracerLabel, SockID, Truncated, CampaignID,
+//	   ConfigHash
+var metalineFields = []metalineField{
+	{"UUID", 1, func(md Metadata) interface{} { return md.UUID }},
+	{"TracerouteCallerVersion", 1, func(md Metadata) interface{} { return md.TracerouteCallerVersion }},
+	{"CachedResult", 1, func(md Metadata) interface{} { return md.CachedResult }},
+	{"CachedUUID", 1, func(md Metadata) interface{} { return md.CachedUUID }},
+	{"MetalineVersion", 1, func(md Metadata) interface{} { return md.MetalineVersion }},
+	{"TracerLabel", 1, func(md Metadata) interface{} { return md.TracerLabel }},
+	{"SockID", 1, func(md Metadata) interface{} { return md.SockID }},
+	{"Truncated", 1, func(md Metadata) interface{} { return md.Truncated }},
+	{"CampaignID", 1, func(md Metadata) interface{} { return md.CampaignID }},
+	{"ConfigHash", 1, func(md Metadata) interface{} { return md.ConfigHash }},
+}
+
+// encodeMetaline returns the given metadata as a newline terminated
+// line of JSON with the layout of the given metaline version, which is
+// recorded in its MetalineVersion field.  Fields are written in the
+// order of metalineFields.
+func encodeMetaline(md Metadata, version int) []byte {
+	md.MetalineVersion = version
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, f := range metalineFields {
+		if f.version > version {
+			break
+		}
+		// Values are strings, booleans, integers, or a SockID so
+		// they always marshal.
+		value, _ := json.Marshal(f.value(md))
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,78 @@
+package tracer
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetalineFieldOrder(t *testing.T) {
+	full := Metadata{
+		UUID:                    "0000000000000ABC",
+		TracerouteCallerVersion: "v1",
+		CachedResult:            true,
+		CachedUUID:              "00EF",
+		TracerLabel:             "candidate",
+		SockID:                  &SockID{SrcIP: "10.0.0.1", SrcPort: 443, DstIP: "10.1.1.1", DstPort: 51234},
+		Truncated:               true,
+		CampaignID:              "campaign",
+		ConfigHash:              "0123456789abcdef",
+	}
+	// The field order of version 1 is locked and every field is
+	// written, even if it has a zero or null value.
+	tests := []struct {
+		md   Metadata
+		want string
+	}{
+		{Metadata{UUID: "0000000000000ABC"}, `{"UUID":"0000000000000ABC","TracerouteCallerVersion":"","CachedResult":false,"CachedUUID":"",` +
+			`"MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":"","ConfigHash":""}` + "\n"},
+		{full, `{"UUID":"0000000000000ABC","TracerouteCallerVersion":"v1","CachedResult":true,"CachedUUID":"00EF",` +
+			`"MetalineVersion":1,"TracerLabel":"candidate","SockID":{"SrcIP":"10.0.0.1","SrcPort":443,"DstIP":"10.1.1.1","DstPort":51234},` +
+			`"Truncated":true,"CampaignID":"campaign","ConfigHash":"0123456789abcdef"}` + "\n"},
+	}
+	for _, test := range tests {
+		if got := string(encodeMetaline(test.md, 1)); got != test.want {
+			t.Errorf("encodeMetaline(%+v, 1) = %q, want %q", test.md, got, test.want)
+		}
+		// The current version decodes like the metadata it encodes
+		// with its version.
+		want := test.md
+		want.MetalineVersion = metalineVersion
+		var md Metadata
+		if err := json.Unmarshal(marshalMetaline(test.md), &md); err != nil || !reflect.DeepEqual(md, want) {
+			t.Errorf("json.Unmarshal(marshalMetaline(%+v)) = %+v, %v", test.md, md, err)
+		}
+	}
+
+	// All fields of the metadata are written.
+	typ := reflect.TypeOf(Metadata{})
+	if typ.NumField() != len(metalineFields) {
+		t.Fatalf("Metadata has %d fields but the metaline has %d", typ.NumField(), len(metalineFields))
+	}
+	for i, f := range metalineFields {
+		if typ.Field(i).Name != f.name {
+			t.Errorf("metaline field %d = %q, want %q", i, f.name, typ.Field(i).Name)
+		}
+		if f.version > metalineVersion {
+			t.Errorf("metaline field %q has version %d, want at most %d", f.name, f.version, metalineVersion)
+		}
+	}
+
+	// Fields added in a later version are appended to the fields of
+	// earlier versions, which don't change.
+	saved := metalineFields
+	defer func() { metalineFields = saved }()
+	metalineFields = append(append([]metalineField(nil), saved...),
+		metalineField{"Added", 2, func(md Metadata) interface{} { return "new" }},
+	)
+	v1 := string(encodeMetaline(full, 1))
+	if want := tests[1].want; v1 != want {
+		t.Errorf("encodeMetaline(1) = %q, want %q", v1, want)
+	}
+	v2 := string(encodeMetaline(full, 2))
+	want := strings.Replace(strings.TrimSuffix(v1, "}\n"), `"MetalineVersion":1`, `"MetalineVersion":2`, 1) + `,"Added":"new"}` + "\n"
+	if v2 != want {
+		t.Errorf("encodeMetaline(2) = %q, want %q", v2, want)
+	}
+}
@@ -0,0 +1,59 @@
+package tracer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+)
+
+// pingAttempts is the number of ICMP echo requests sent by Ping.
+const pingAttempts = 3
+
+// pingRecord is the part of scamper's ping record that Ping uses.
+type pingRecord struct {
+	Type      string            `json:"type"`
+	Responses []json.RawMessage `json:"responses"`
+}
+
+// Ping sends a few ICMP echo requests to remoteIP with scamper and
+// returns whether any of them was answered.  It's a lightweight check
+// of whether a destination is reachable before running a traceroute
+// to it.  The scamper process is killed if ctx is done or the
+// configured timeout expires before it completes.
+func (s *Scamper) Ping(ctx context.Context, remoteIP string) (bool, error) {
+	if net.ParseIP(remoteIP) == nil {
+		return false, newError(ErrPingFailed, nil, "%q: invalid IP address", remoteIP)
+	}
+	params := s.traceParams()
+	ctx, cancel := context.WithTimeout(ctx, params.timeout)
+	defer cancel()
+	cmd := []string{s.binary, "-o-", "-O", "json"}
+	if params.probeRate != 0 {
+		cmd = append(cmd, "-p", strconv.Itoa(params.probeRate))
+	}
+	cmd = append(cmd, "-I", "ping -c "+strconv.Itoa(pingAttempts)+" "+remoteIP)
+	out, err := command(ctx, cmd, s.env).Output()
+	if err != nil {
+		return false, newError(ErrPingFailed, err, "failed to ping %s (error: %v)", remoteIP, err)
+	}
+	return pingReplied(out), nil
+}
+
+// pingReplied returns whether the ping record in the given scamper
+// output has any response.
+func pingReplied(out []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var rec pingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Type != "ping" {
+			continue
+		}
+		if len(rec.Responses) > 0 {
+			return true
+		}
+	}
+	return false
+}
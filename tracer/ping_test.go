@@ -0,0 +1,39 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	tests := []struct {
+		binary   string
+		remoteIP string
+		want     bool
+		wantErr  error
+	}{
+		{"testdata/ping", "10.1.1.1", true, nil},
+		{"testdata/ping", "192.0.2.1", false, nil},
+		{"testdata/ping", "10.1.1.1; reboot", false, ErrPingFailed},
+		{"testdata/fail", "10.1.1.1", false, ErrPingFailed},
+		{"testdata/jsonl", "10.1.1.1", false, nil}, // no ping record
+	}
+	for _, test := range tests {
+		s, err := NewScamper(ScamperConfig{
+			Binary:           test.binary,
+			OutputPath:       StdoutPath,
+			Timeout:          time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Ping(context.Background(), test.remoteIP)
+		if got != test.want || !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: Ping(%q) = %v, %v, want %v, %v", test.binary, test.remoteIP, got, err, test.want, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package tracer
+
+import (
+	"sort"
+)
+
+// profile is a named combination of traceroute options.  Zero values
+// leave the option to scamper.
+type profile struct {
+	Protocol   string // -P: probe method
+	Attempts   int    // -q: attempts per probe
+	Confidence int    // -c: confidence level (mda only)
+	WaitProbe  int    // -W: wait between probes in 1/100ths of seconds (mda only)
+	GapLimit   int    // -g: unresponsive hops before stopping
+}
+
+// profiles are the traceroute profiles of each traceroute type.  The
+// empty profile is the default, which doesn't set a wait probe for
+// mda traceroutes so that TracelbWaitProbe must be set.  The values
+// are pinned in TestProfiles.
+//
+//	mda         protocol   attempts  confidence  wait probe  gap limit
+//	(default)   icmp-echo  3         -           -           -
+//	fast        icmp-echo  2         95          15          3
+//	thorough    icmp-echo  3         99          25          5
+//	low-impact  icmp-echo  1         95          100         2
+//
+//	regular     protocol    attempts  gap limit
+//	(default)   icmp-paris  -         -
+//	fast        icmp-paris  1         3
+//	thorough    icmp-paris  3         8
+//	low-impact  icmp-paris  1         2
+var profiles = map[string]map[string]profile{
+	"mda": {
+		"":           {Protocol: "icmp-echo", Attempts: 3},
+		"fast":       {Protocol: "icmp-echo", Attempts: 2, Confidence: 95, WaitProbe: 15, GapLimit: 3},
+		"thorough":   {Protocol: "icmp-echo", Attempts: 3, Confidence: 99, WaitProbe: 25, GapLimit: 5},
+		"low-impact": {Protocol: "icmp-echo", Attempts: 1, Confidence: 95, WaitProbe: 100, GapLimit: 2},
+	},
+	"regular": {
+		"":           {Protocol: "icmp-paris"},
+		"fast":       {Protocol: "icmp-paris", Attempts: 1, GapLimit: 3},
+		"thorough":   {Protocol: "icmp-paris", Attempts: 3, GapLimit: 8},
+		"low-impact": {Protocol: "icmp-paris", Attempts: 1, GapLimit: 2},
+	},
+}
+
+// protocols are the probe methods supported by each traceroute type.
+var protocols = map[string][]string{
+	"mda":     {"icmp-echo", "udp-dport", "udp-sport", "tcp-sport", "tcp-ack-sport"},
+	"regular": {"icmp-paris", "udp-paris", "tcp", "tcp-ack", "udp", "icmp"},
+}
+
+// maxAttempts is the maximum number of attempts per probe of each
+// traceroute type.
+var maxAttempts = map[string]int{
+	"mda":     5,
+	"regular": 10,
+}
+
+// ProfileNames returns the names of the profiles of the given
+// traceroute type in alphabetical order.
+func ProfileNames(traceType string) []string {
+	var names []string
+	for name := range profiles[traceType] {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// traceOptions returns the options of the configured profile of the
+// configured traceroute type overridden by the options that are
+// explicitly set (i.e., not zero) in cfg.
+func (cfg ScamperConfig) traceOptions() (profile, error) {
+	typeProfiles, ok := profiles[cfg.TraceType]
+	if !ok {
+		return profile{}, newError(ErrInvalidTraceType, nil, "%s: invalid traceroute type", cfg.TraceType)
+	}
+	opts, ok := typeProfiles[cfg.Profile]
+	if !ok {
+		return profile{}, newError(ErrInvalidProfile, nil, "%q: invalid %s traceroute profile", cfg.Profile, cfg.TraceType)
+	}
+	if cfg.Protocol != "" {
+		if !contains(protocols[cfg.TraceType], cfg.Protocol) {
+			return profile{}, newError(ErrInvalidProtocol, nil, "%q: invalid %s traceroute protocol", cfg.Protocol, cfg.TraceType)
+		}
+		opts.Protocol = cfg.Protocol
+	}
+	if cfg.Attempts != 0 {
+		if cfg.Attempts < 1 || cfg.Attempts > maxAttempts[cfg.TraceType] {
+			return profile{}, newError(ErrInvalidAttempts, nil, "%d: invalid number of attempts (min: 1, max: %d)", cfg.Attempts, maxAttempts[cfg.TraceType])
+		}
+		opts.Attempts = cfg.Attempts
+	}
+	if cfg.TracelbConfidence != 0 {
+		if cfg.TraceType != "mda" || (cfg.TracelbConfidence != 95 && cfg.TracelbConfidence != 99) {
+			return profile{}, newError(ErrInvalidConfidence, nil, "%d: invalid %s traceroute confidence level (95 or 99)", cfg.TracelbConfidence, cfg.TraceType)
+		}
+		opts.Confidence = cfg.TracelbConfidence
+	}
+	if cfg.TracelbWaitProbe != 0 {
+		opts.WaitProbe = cfg.TracelbWaitProbe
+	}
+	if cfg.GapLimit != 0 {
+		if cfg.GapLimit < 1 || cfg.GapLimit > 255 {
+			return profile{}, newError(ErrInvalidGapLimit, nil, "%d: invalid gap limit (min: 1, max: 255)", cfg.GapLimit)
+		}
+		opts.GapLimit = cfg.GapLimit
+	}
+	return opts, nil
+}
+
+// contains returns whether s is in list.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package tracer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestProfiles pins the traceroute commands of the profiles so that
+// changes to their options are deliberate.
+func TestProfiles(t *testing.T) {
+	tests := []struct {
+		traceType string
+		modify    func(*ScamperConfig)
+		want      string
+		wantErr   error
+	}{
+		{"mda", func(c *ScamperConfig) { c.TracelbWaitProbe = 25 }, "tracelb -P icmp-echo -q 3 -W 25", nil},
+		{"mda", func(c *ScamperConfig) {}, "", ErrInvalidWaitProbe},
+		{"mda", func(c *ScamperConfig) { c.Profile = "fast" }, "tracelb -P icmp-echo -q 2 -W 15 -c 95 -g 3", nil},
+		{"mda", func(c *ScamperConfig) { c.Profile = "thorough" }, "tracelb -P icmp-echo -q 3 -W 25 -c 99 -g 5", nil},
+		{"mda", func(c *ScamperConfig) { c.Profile = "low-impact" }, "tracelb -P icmp-echo -q 1 -W 100 -c 95 -g 2", nil},
+		{"regular", func(c *ScamperConfig) {}, "trace -P icmp-paris", nil},
+		{"regular", func(c *ScamperConfig) { c.Profile = "fast" }, "trace -P icmp-paris -q 1 -g 3", nil},
+		{"regular", func(c *ScamperConfig) { c.Profile = "thorough" }, "trace -P icmp-paris -q 3 -g 8", nil},
+		{"regular", func(c *ScamperConfig) { c.Profile = "low-impact" }, "trace -P icmp-paris -q 1 -g 2", nil},
+		// Options that are set override those of the profile.
+		{"mda", func(c *ScamperConfig) {
+			c.Profile = "fast"
+			c.Protocol = "udp-dport"
+			c.Attempts = 5
+			c.TracelbConfidence = 99
+			c.TracelbWaitProbe = 50
+			c.GapLimit = 10
+		}, "tracelb -P udp-dport -q 5 -W 50 -c 99 -g 10", nil},
+		{"regular", func(c *ScamperConfig) {
+			c.Profile = "thorough"
+			c.Protocol = "udp-paris"
+			c.Attempts = 10
+			c.SourceAddr = "127.0.0.1"
+		}, "trace -P udp-paris -q 10 -S 127.0.0.1 -g 8", nil},
+		// Options are validated against the traceroute type.
+		{"regular", func(c *ScamperConfig) { c.Profile = "thorough"; c.TracelbConfidence = 95 }, "", ErrInvalidConfidence},
+		{"regular", func(c *ScamperConfig) { c.Protocol = "icmp-echo" }, "", ErrInvalidProtocol},
+		{"regular", func(c *ScamperConfig) { c.Attempts = 11 }, "", ErrInvalidAttempts},
+		{"mda", func(c *ScamperConfig) { c.Profile = "fast"; c.TracelbWaitProbe = 201 }, "", ErrInvalidWaitProbe},
+		{"mda", func(c *ScamperConfig) { c.Profile = "default" }, "", ErrInvalidProfile},
+	}
+	for i, test := range tests {
+		cfg := ScamperConfig{
+			Binary:     "/bin/echo",
+			OutputPath: t.TempDir(),
+			Timeout:    time.Minute,
+			TraceType:  test.traceType,
+		}
+		test.modify(&cfg)
+		s, err := NewScamper(cfg)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%d: NewScamper(%+v) = %v, want %v", i, cfg, err, test.wantErr)
+			continue
+		}
+		if err == nil && s.params.cmd != test.want {
+			t.Errorf("%d: command = %q, want %q", i, s.params.cmd, test.want)
+		}
+	}
+}
+
+func TestProfileNames(t *testing.T) {
+	want := []string{"fast", "low-impact", "thorough"}
+	for _, traceType := range []string{"mda", "regular"} {
+		if got := ProfileNames(traceType); !reflect.DeepEqual(got, want) {
+			t.Errorf("ProfileNames(%q) = %v, want %v", traceType, got, want)
+		}
+	}
+	if got := ProfileNames("bad"); got != nil {
+		t.Errorf("ProfileNames(\"bad\") = %v, want nil", got)
+	}
+}
@@ -3,35 +3,108 @@ package tracer
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/m-lab/uuid"
 )
 
 // ScamperConfig contains configuration parameters of scamper.
 type ScamperConfig struct {
 	Binary           string
-	OutputPath       string
+	OutputPath       string // StdoutPath writes traceroutes to stdout
 	Timeout          time.Duration
 	TraceType        string
-	TracelbPTR       bool
+	TracelbPTR       bool // alias for PTRMode "all" (mda traceroutes only)
 	TracelbWaitProbe int
+
+	Profile           string // fast, thorough, or low-impact (see profile.go); the options below override it
+	Protocol          string // scamper's -P option
+	Attempts          int    // attempts per probe (1 to 5 for mda, 1 to 10 for regular traceroutes)
+	TracelbConfidence int    // 95 or 99
+	GapLimit          int    // consecutive unresponsive hops that stop a traceroute (1 to 255)
+	PTRMode           string // "none" or "all" (overrides TracelbPTR)
+	SourceAddr        string // local source address of probes (regular traceroutes only)
+	ProbeRate         int    // scamper's -p option (1 to 10000, 0 is scamper's default)
+	ListName          string // name of the list in cycle records
+	ArgsTemplate      string // replaces the scamper arguments built from the options (see parseArgsTemplate)
+
+	FileMode          os.FileMode              // permission bits of traceroute files (default 0444)
+	FileGroup         int                      // group ID of traceroute files (0 leaves it unchanged)
+	Label             string                   // recorded in metadata and added to filenames and metrics
+	SlowTrace         time.Duration            // traceroutes this slow get trace time exemplars like failed ones
+	Indexer           *Indexer                 // indexes traceroute files (not those written to stdout)
+	MaxOutputBytes    int64                    // output that truncates traceroutes (see ErrTraceTruncated)
+	CollisionPolicy   string                   // "overwrite" (default), "skip", or "suffix"
+	Env               map[string]string        // added to the environment of scamper
+	LegacyLinkPath    string                   // where traceroute files are also linked with legacy filenames
+	TraceTypeTimeouts map[string]time.Duration // override Timeout by trace type
+	CookieWidth       int                      // width of cookies in UUIDs (0 is DefaultCookieWidth)
 }
 
+// StdoutPath is the OutputPath that writes traceroutes to stdout
+// instead of files.  Traceroutes are written one after the other so the
+// lines of different traceroutes are never interleaved.
+const StdoutPath = "-"
+
+// stdout is where traceroutes are written when OutputPath is StdoutPath.
+// It's a variable so it can be replaced in tests.
+var (
+	stdout   io.Writer = os.Stdout
+	stdoutMu sync.Mutex
+)
+
+// listNameRegexp matches valid list names.
+var listNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._:/@+-]{1,64}$`)
+
 // Scamper invokes an instance of the scamper tool for each traceroute.
 type Scamper struct {
-	binary     string
-	outputPath string
-	timeout    time.Duration
-	cmd        string
+	binary      string
+	outputPath  string
+	traceType   string
+	params      traceParams // see Reconfigure
+	paramsMu    sync.RWMutex
+	writeFilter func([]byte) bool
+	trailer     func(context.Context, []byte) []byte
+	fileMode    os.FileMode
+	dirMode     os.FileMode
+	fileGroup   int
+	label       string
+	metricType  string // value of the type label of metrics
+	listName    string
+	slowTrace   time.Duration
+	probeRate   int
+	indexer     *Indexer
+	maxOutput   int64
+	collision   string   // filename collision policy
+	env         []string // added to the inherited environment
+	legacyPath  string   // see ScamperConfig.LegacyLinkPath
+	cookieWidth int      // see ScamperConfig.CookieWidth
+	version     string   // as reported by scamper -v
+}
+
+// traceParams are the options of a Scamper instance that affect the
+// probes of its traceroutes.
+type traceParams struct {
+	timeout   time.Duration
+	cmd       string   // trace command built from the options
+	args      []string // ScamperConfig.ArgsTemplate split into arguments (if any)
+	probeRate int
+	hash      string // see configHash
 }
 
 // NewScamper validates the specified scamper configuration and, if successful,
@@ -39,60 +112,288 @@ type Scamper struct {
 func NewScamper(cfg ScamperConfig) (*Scamper, error) {
 	// Validate that the cfg.Binary exists and is an executable file.
 	if err := exec.Command("test", "-f", cfg.Binary, "-a", "-x", cfg.Binary).Run(); err != nil {
-		return nil, fmt.Errorf("%q: is not an executable file", cfg.Binary)
+		return nil, newError(ErrNotExecutable, err, "%q: is not an executable file", cfg.Binary)
 	}
 	// Validate that traceroute files can be saved in cfg.OutputPath.
-	if err := os.MkdirAll(cfg.OutputPath, 0777); err != nil {
-		return nil, fmt.Errorf("failed to create directory %q (error: %v)", cfg.OutputPath, err)
+	if cfg.OutputPath != StdoutPath {
+		if err := os.MkdirAll(cfg.OutputPath, 0777); err != nil {
+			return nil, newError(ErrOutputPath, err, "failed to create directory %q (error: %v)", cfg.OutputPath, err)
+		}
+		dir, err := ioutil.TempDir(cfg.OutputPath, "trc-testdir")
+		if err != nil {
+			return nil, newError(ErrOutputPath, err, "failed to create a directory inside %q (error: %v)", cfg.OutputPath, err)
+		}
+		defer os.RemoveAll(dir)
+		removeTempFiles(cfg.OutputPath)
+		if cfg.LegacyLinkPath != "" {
+			removeTempFiles(cfg.LegacyLinkPath)
+		}
+	}
+	params, err := cfg.newTraceParams()
+	if err != nil {
+		return nil, err
+	}
+	// Validate that the file mode (if any) only has permission bits and
+	// allows us to read our files and that the file group is valid.
+	if cfg.FileMode&^os.ModePerm != 0 || (cfg.FileMode != 0 && cfg.FileMode&0400 == 0) {
+		return nil, newError(ErrInvalidFileMode, nil, "%v: invalid file mode", cfg.FileMode)
+	}
+	if cfg.FileGroup < 0 {
+		return nil, newError(ErrInvalidFileGroup, nil, "%d: invalid file group", cfg.FileGroup)
+	}
+	if err := ValidateCookieWidth(cfg.CookieWidth); err != nil {
+		return nil, newError(ErrInvalidCookieWidth, nil, "%d: invalid cookie width (min: %d, max: %d)", cfg.CookieWidth, DefaultCookieWidth, maxCookieWidth)
+	}
+	// Validate that the list name (if any) is a single word.
+	if cfg.ListName != "" && !listNameRegexp.MatchString(cfg.ListName) {
+		return nil, newError(ErrInvalidListName, nil, "%q: invalid list name", cfg.ListName)
+	}
+	// Validate the maximum output size.
+	if cfg.MaxOutputBytes < 0 {
+		return nil, newError(ErrInvalidMaxOutput, nil, "%d: invalid maximum output size", cfg.MaxOutputBytes)
+	}
+	// Validate the filename collision policy.
+	if !validCollisionPolicy(cfg.CollisionPolicy) {
+		return nil, newError(ErrInvalidCollision, nil, "%q: invalid filename collision policy", cfg.CollisionPolicy)
+	}
+	// Validate that legacy links (if any) can be created.
+	if cfg.LegacyLinkPath != "" {
+		if cfg.OutputPath == StdoutPath || filepath.Clean(cfg.LegacyLinkPath) == filepath.Clean(cfg.OutputPath) {
+			return nil, newError(ErrLegacyLinkPath, nil, "%q: invalid legacy link path", cfg.LegacyLinkPath)
+		}
+		if err := os.MkdirAll(cfg.LegacyLinkPath, 0777); err != nil {
+			return nil, newError(ErrLegacyLinkPath, err, "failed to create directory %q (error: %v)", cfg.LegacyLinkPath, err)
+		}
 	}
-	dir, err := ioutil.TempDir(cfg.OutputPath, "trc-testdir")
+	// Validate the environment variables.
+	env, err := environ(cfg.Env)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create a directory inside %q (error: %v)", cfg.OutputPath, err)
+		return nil, err
+	}
+	metricType := "scamper"
+	if cfg.Label != "" {
+		if strings.ContainsAny(cfg.Label, "/_. ") {
+			return nil, newError(ErrInvalidLabel, nil, "%q: invalid label", cfg.Label)
+		}
+		metricType += "-" + cfg.Label
+	}
+	var dirMode os.FileMode
+	if cfg.FileMode != 0 {
+		dirMode = cfg.FileMode | 0700 | (cfg.FileMode&0044)>>2
+	}
+	return &Scamper{
+		binary:      cfg.Binary,
+		outputPath:  cfg.OutputPath,
+		traceType:   cfg.TraceType,
+		params:      params,
+		fileMode:    cfg.FileMode,
+		dirMode:     dirMode,
+		fileGroup:   cfg.FileGroup,
+		label:       cfg.Label,
+		metricType:  metricType,
+		listName:    cfg.ListName,
+		slowTrace:   cfg.SlowTrace,
+		indexer:     cfg.Indexer,
+		maxOutput:   cfg.MaxOutputBytes,
+		collision:   cfg.CollisionPolicy,
+		env:         env,
+		legacyPath:  cfg.LegacyLinkPath,
+		cookieWidth: cfg.CookieWidth,
+		version:     checkVersion(cfg.Binary, metricType),
+	}, nil
+}
+
+// newTraceParams validates the options of the given configuration that
+// affect the probes of traceroutes and returns them.
+func (cfg ScamperConfig) newTraceParams() (traceParams, error) {
+	// Validate that timeouts are at least one second and at most an hour.
+	if !validTimeout(cfg.Timeout) {
+		return traceParams{}, newError(ErrInvalidTimeout, nil, "%v: invalid timeout value (min: 1s, max 3600s)", cfg.Timeout)
 	}
-	defer os.RemoveAll(dir)
-	// Validate that timeout is at least one second and at most an hour.
-	if cfg.Timeout < 1*time.Second || cfg.Timeout > 3600*time.Second {
-		return nil, fmt.Errorf("%v: invalid timeout value (min: 1s, max 3600s)", cfg.Timeout)
+	for traceType, timeout := range cfg.TraceTypeTimeouts {
+		if traceType != "mda" && traceType != "regular" {
+			return traceParams{}, newError(ErrInvalidTraceType, nil, "%q: invalid trace type of timeout override", traceType)
+		}
+		if !validTimeout(timeout) {
+			return traceParams{}, newError(ErrInvalidTimeout, nil, "%v: invalid %s timeout value (min: 1s, max 3600s)", timeout, traceType)
+		}
+	}
+	// Validate that the source address (if any) is an IP address.
+	if cfg.SourceAddr != "" && net.ParseIP(cfg.SourceAddr) == nil {
+		return traceParams{}, newError(ErrInvalidSourceAddr, nil, "%q: invalid source address", cfg.SourceAddr)
+	}
+	// Validate the probe rate against scamper's limits.
+	if cfg.ProbeRate != 0 && (cfg.ProbeRate < 1 || cfg.ProbeRate > 10000) {
+		return traceParams{}, newError(ErrInvalidProbeRate, nil, "%d: invalid probe rate (min: 1, max: 10000)", cfg.ProbeRate)
+	}
+	// Validate the PTR mode.
+	switch cfg.PTRMode {
+	case "", "none", "all":
+	case "dst-only":
+		return traceParams{}, newError(ErrInvalidPTRMode, nil, "%q: PTR mode is not supported by scamper", cfg.PTRMode)
+	default:
+		return traceParams{}, newError(ErrInvalidPTRMode, nil, "%q: invalid PTR mode", cfg.PTRMode)
 	}
 	// See this package's documentation for descriptions of mda
 	// and regular traceroutes.
+	opts, err := cfg.traceOptions()
+	if err != nil {
+		return traceParams{}, err
+	}
 	var traceCmd string
 	switch cfg.TraceType {
 	case "mda":
-		if cfg.TracelbWaitProbe < 15 || cfg.TracelbWaitProbe > 200 {
-			return nil, fmt.Errorf("%d: invalid tracelb wait probe value", cfg.TracelbWaitProbe)
+		if cfg.SourceAddr != "" {
+			return traceParams{}, newError(ErrInvalidSourceAddr, nil, "%q: source address is not supported by mda traceroutes", cfg.SourceAddr)
 		}
-		traceCmd = "tracelb -P icmp-echo -q 3 -W " + strconv.Itoa(cfg.TracelbWaitProbe)
-		if cfg.TracelbPTR {
-			traceCmd += " -O ptr"
+		if opts.WaitProbe < 15 || opts.WaitProbe > 200 {
+			return traceParams{}, newError(ErrInvalidWaitProbe, nil, "%d: invalid tracelb wait probe value", opts.WaitProbe)
+		}
+		traceCmd = fmt.Sprintf("tracelb -P %s -q %d -W %d", opts.Protocol, opts.Attempts, opts.WaitProbe)
+		if opts.Confidence != 0 {
+			traceCmd += " -c " + strconv.Itoa(opts.Confidence)
 		}
 	case "regular":
-		traceCmd = "trace -P icmp-paris"
-	default:
-		return nil, fmt.Errorf("%s: invalid traceroute type", cfg.TraceType)
+		traceCmd = "trace -P " + opts.Protocol
+		if opts.Attempts != 0 {
+			traceCmd += " -q " + strconv.Itoa(opts.Attempts)
+		}
+		if cfg.SourceAddr != "" {
+			traceCmd += " -S " + cfg.SourceAddr
+		}
 	}
-	return &Scamper{
-		binary:     cfg.Binary,
-		outputPath: cfg.OutputPath,
-		timeout:    cfg.Timeout,
-		cmd:        traceCmd,
+	if opts.GapLimit != 0 {
+		traceCmd += " -g " + strconv.Itoa(opts.GapLimit)
+	}
+	if cfg.PTRMode == "all" || (cfg.PTRMode == "" && cfg.TracelbPTR && cfg.TraceType == "mda") {
+		traceCmd += " -O ptr"
+	}
+	var args []string
+	if cfg.ArgsTemplate != "" {
+		if args, err = parseArgsTemplate(cfg.ArgsTemplate); err != nil {
+			return traceParams{}, err
+		}
+	}
+	return traceParams{
+		timeout:   cfg.traceTimeout(),
+		cmd:       traceCmd,
+		args:      args,
+		probeRate: cfg.ProbeRate,
+		hash:      configHash(traceCmd, args, cfg.ProbeRate, cfg.traceTimeout()),
 	}, nil
 }
 
+// validTimeout returns true if the given timeout is at least one second
+// and at most an hour.
+func validTimeout(timeout time.Duration) bool {
+	return timeout >= 1*time.Second && timeout <= 3600*time.Second
+}
+
+// traceTimeout returns the timeout of the configured trace type: its
+// override in TraceTypeTimeouts if any and Timeout otherwise.
+func (cfg ScamperConfig) traceTimeout() time.Duration {
+	if timeout, ok := cfg.TraceTypeTimeouts[cfg.TraceType]; ok {
+		return timeout
+	}
+	return cfg.Timeout
+}
+
+// configHash returns a hash of the options that affect the probes of
+// traceroutes, so that the metadata of traceroutes tells which set of
+// parameters produced them: the traceroute command (trace type,
+// protocol, attempts, etc.), the arguments of the arguments template
+// if any, the probe rate, and the timeout.  Options that only affect
+// where and how traceroutes are written or run (e.g., the output path,
+// the scamper binary, file modes, or the environment) are left out so
+// that they don't change the hash.  Identical options have identical
+// hashes across processes.
+func configHash(traceCmd string, args []string, probeRate int, timeout time.Duration) string {
+	b, _ := json.Marshal(struct {
+		Command   string
+		Args      []string
+		ProbeRate int
+		Timeout   time.Duration
+	}{traceCmd, args, probeRate, timeout})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ConfigHash returns the hash of the options of this instance that
+// affect the probes of its traceroutes (see Reconfigure).
+func (s *Scamper) ConfigHash() string {
+	return s.traceParams().hash
+}
+
+// Reconfigure changes the options that affect the probes of the
+// traceroutes run from now on (those that go into ConfigHash) to those
+// of cfg.  The other options of cfg are ignored, and the trace type
+// can't change since traceroutes are parsed according to it.
+// Traceroutes in progress are not affected.
+func (s *Scamper) Reconfigure(cfg ScamperConfig) error {
+	if cfg.TraceType != s.traceType {
+		return newError(ErrInvalidTraceType, nil, "%s: traceroute type can't change from %s", cfg.TraceType, s.traceType)
+	}
+	params, err := cfg.newTraceParams()
+	if err != nil {
+		return err
+	}
+	s.paramsMu.Lock()
+	defer s.paramsMu.Unlock()
+	s.params = params
+	return nil
+}
+
+// traceParams returns the current options of this instance that affect
+// the probes of its traceroutes.
+func (s *Scamper) traceParams() traceParams {
+	s.paramsMu.RLock()
+	defer s.paramsMu.RUnlock()
+	return s.params
+}
+
+// Version returns the version of the scamper binary as reported by
+// scamper -v when the instance was created ("unknown" if it couldn't
+// be determined).
+func (s *Scamper) Version() string {
+	return s.version
+}
+
 // Trace starts a new scamper process to run a traceroute based on the
-// traceroute type and saves it in a file.
+// traceroute type and saves it in a file.  It is equivalent to calling
+// TraceContext with a background context and is kept for compatibility.
 func (s *Scamper) Trace(remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
-	tracesInProgress.WithLabelValues("scamper").Inc()
-	defer tracesInProgress.WithLabelValues("scamper").Dec()
-	return s.trace(remoteIP, cookie, uuid, t)
+	return s.TraceContext(context.Background(), remoteIP, cookie, uuid, t)
+}
+
+// TraceContext is like Trace but the scamper process is killed if ctx
+// is cancelled before the traceroute completes.  The process is also
+// killed when the configured timeout expires.
+func (s *Scamper) TraceContext(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+	if err := ValidateCookie(cookie); err != nil {
+		return nil, err
+	}
+	tracesInProgress.WithLabelValues(s.metricType).Inc()
+	defer tracesInProgress.WithLabelValues(s.metricType).Dec()
+	return s.trace(ctx, remoteIP, cookie, uuid, t)
 }
 
 // CachedTrace creates a traceroute from the traceroute cache and saves it in a file.
+// It is equivalent to calling CachedTraceContext with a background
+// context and is kept for compatibility.
 func (s *Scamper) CachedTrace(cookie, uuid string, t time.Time, cachedTrace []byte) error {
-	filename, err := generateFilename(s.outputPath, cookie, t)
+	return s.CachedTraceContext(context.Background(), cookie, uuid, t, cachedTrace)
+}
+
+// CachedTraceContext is like CachedTrace but the metadata of the
+// traceroute also records the socket ID carried by ctx (if any).
+func (s *Scamper) CachedTraceContext(ctx context.Context, cookie, uuid string, t time.Time, cachedTrace []byte) error {
+	if err := ValidateCookie(cookie); err != nil {
+		return err
+	}
+	filename, err := s.outputFilename(s.fileUUID(ctx, cookie), t)
 	if err != nil {
 		log.Printf("failed to generate filename (error: %v)\n", err)
-		tracerCacheErrors.WithLabelValues("scamper", err.Error()).Inc()
+		tracerCacheErrors.WithLabelValues(s.metricType, err.Error()).Inc()
 		return err
 	}
 
@@ -100,106 +401,501 @@ func (s *Scamper) CachedTrace(cookie, uuid string, t time.Time, cachedTrace []by
 	split := bytes.Index(cachedTrace, []byte{'\n'})
 	if split <= 0 || split == len(cachedTrace) {
 		log.Printf("failed to split cached traceroute (split: %v)\n", split)
-		tracerCacheErrors.WithLabelValues("scamper", "badcache").Inc()
-		return errors.New("invalid cached traceroute")
+		tracerCacheErrors.WithLabelValues(s.metricType, "badcache").Inc()
+		return ErrInvalidCachedTrace
 	}
 
 	// Create and add the first line to the cached traceroute.
-	newTrace := append(createMetaline(uuid, true, extractUUID(cachedTrace[:split])), cachedTrace[split+1:]...)
-	// Make the file readable so it won't be overwritten.
-	return ioutil.WriteFile(filename, []byte(newTrace), 0444)
+	cached := extractMetadata(cachedTrace[:split])
+	newTrace := append(s.metaline(ctx, uuid, true, cached.UUID, cached.Truncated, s.ConfigHash()), cachedTrace[split+1:]...)
+	if s.writeFilter != nil && !s.writeFilter(newTrace) {
+		log.Printf("not writing filtered cached traceroute %v\n", uuid)
+		return nil
+	}
+	// Cached traceroutes always replace existing files (see
+	// ScamperConfig.CollisionPolicy).
+	data := s.withTrailer(ctx, newTrace)
+	if err := s.write(filename, data, true); err != nil {
+		return err
+	}
+	s.index(filename, uuid, extractDestination(newTrace), t, true)
+	s.linkLegacy(filename, data, t)
+	return nil
+}
+
+// SetWriteFilter sets a function that is called with each traceroute
+// (including its metadata line) before it is written.  The traceroute
+// is not written if the function returns false.  It should be called
+// before any traceroutes are run.
+func (s *Scamper) SetWriteFilter(filter func(rawData []byte) bool) {
+	s.writeFilter = filter
+}
+
+// SetTrailer sets a function that is called with each traceroute
+// (including its metadata line) that passes the write filter.  The JSONL
+// lines it returns (e.g., hop annotations) are written after the
+// traceroute in the same file but are not part of the traceroute data
+// returned to the caller and cached.  It should be called before any
+// traceroutes are run.
+func (s *Scamper) SetTrailer(trailer func(ctx context.Context, rawData []byte) []byte) {
+	s.trailer = trailer
+}
+
+// withTrailer returns the given traceroute followed by its trailer (if
+// any).  The traceroute itself is not modified.
+func (s *Scamper) withTrailer(ctx context.Context, rawData []byte) []byte {
+	if s.trailer == nil {
+		return rawData
+	}
+	trailer := s.trailer(ctx, rawData)
+	if len(trailer) == 0 {
+		return rawData
+	}
+	data := make([]byte, 0, len(rawData)+len(trailer))
+	return append(append(data, rawData...), trailer...)
 }
 
 // DontTrace is called when a previous traceroute that we were waiting for
 // fails. It increments a counter that tracks the number of these failures.
-func (*Scamper) DontTrace() {
-	tracesNotPerformed.WithLabelValues("scamper").Inc()
+func (s *Scamper) DontTrace() {
+	tracesNotPerformed.WithLabelValues(s.metricType).Inc()
 }
 
 // trace runs a traceroute using scamper as a standalone binary. The
 // command line to invoke scamper varies depending on the traceroute type
 // and its options.
-func (s *Scamper) trace(remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
+func (s *Scamper) trace(ctx context.Context, remoteIP, cookie, uuid string, t time.Time) ([]byte, error) {
 	// Make sure a directory path based on the current date exists,
 	// generate a filename to save in that directory, and create
 	// a buffer to hold traceroute data.
-	filename, err := generateFilename(s.outputPath, cookie, t)
+	filename, err := s.outputFilename(s.fileUUID(ctx, cookie), t)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create a context, run a traceroute, and write the output to file.
-	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	params := s.traceParams()
+	ctx, cancel := context.WithTimeout(ctx, params.timeout)
 	defer cancel()
-	cmd := []string{s.binary, "-o-", "-O", "json", "-I", fmt.Sprintf("%s %s", s.cmd, remoteIP)}
-	return traceAndWrite(ctx, "scamper", filename, cmd, uuid)
+	if params.args != nil {
+		cmd := append([]string{s.binary}, expandArgs(params.args, remoteIP, params.timeout, uuid)...)
+		return s.traceAndWrite(ctx, s.metricType, filename, cmd, remoteIP, uuid, params.hash, t)
+	}
+	cmd := []string{s.binary, "-o-", "-O", "json"}
+	if params.probeRate != 0 {
+		cmd = append(cmd, "-p", strconv.Itoa(params.probeRate))
+	}
+	if s.listName != "" {
+		cmd = append(cmd, "-l", s.listName)
+	}
+	cmd = append(cmd, "-I", fmt.Sprintf("%s %s", params.cmd, remoteIP))
+	return s.traceAndWrite(ctx, s.metricType, filename, cmd, remoteIP, uuid, params.hash, t)
 }
 
-// traceAndWrite runs a traceroute and writes the result.
-func traceAndWrite(ctx context.Context, label string, filename string, cmd []string, uuid string) ([]byte, error) {
-	data, err := runCmd(ctx, label, cmd)
+// traceAndWrite runs a traceroute and writes the result unless the
+// write filter (if any) rejects it.  Written traceroutes are indexed.
+func (s *Scamper) traceAndWrite(ctx context.Context, label string, filename string, cmd []string, remoteIP, uuid, configHash string, t time.Time) ([]byte, error) {
+	spanCtx, span := startSpan(ctx, "scamper.Trace", uuid, remoteIP)
+	data, truncated, err := runCmd(spanCtx, label, cmd, s.env, uuid, s.slowTrace, s.maxOutput)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 	if len(data) == 0 {
-		return nil, fmt.Errorf("context %p: failed to obtain a traceroute (command: %v)", ctx, cmd)
+		return nil, newError(ErrEmptyTrace, nil, "context %p: failed to obtain a traceroute (command: %v)", ctx, cmd)
 	}
 
 	buff := bytes.Buffer{}
 	// It's OK to ignore the return values because err is always nil. If
 	// the buffer becomes too large, Write() will panic with ErrTooLarge.
-	_, _ = buff.Write(createMetaline(uuid, false, ""))
+	_, _ = buff.Write(s.metaline(ctx, uuid, false, "", truncated, configHash))
 	_, _ = buff.Write(data)
-	// Make the file readable so it won't be overwritten.
-	return buff.Bytes(), ioutil.WriteFile(filename, buff.Bytes(), 0444)
+	var result error
+	if truncated {
+		result = newError(ErrTraceTruncated, nil, "context %p: traceroute output exceeded %d bytes", ctx, s.maxOutput)
+	}
+	if s.writeFilter != nil && !s.writeFilter(buff.Bytes()) {
+		log.Printf("context %p: not writing filtered traceroute to %v\n", ctx, filename)
+		return buff.Bytes(), result
+	}
+	filename, ok, replace, err := s.resolveCollision(filename)
+	if err != nil {
+		return buff.Bytes(), err
+	}
+	if !ok {
+		log.Printf("context %p: not overwriting existing traceroute %v\n", ctx, filename)
+		return buff.Bytes(), result
+	}
+	written := s.withTrailer(ctx, buff.Bytes())
+	if err := s.write(filename, written, replace); err != nil {
+		return buff.Bytes(), err
+	}
+	s.index(filename, uuid, remoteIP, t, false)
+	s.linkLegacy(filename, written, t)
+	return buff.Bytes(), result
+}
+
+// Filename returns the name of the file that the traceroute with the
+// given cookie and start time is written to or an empty string if
+// traceroutes are written to stdout.  Unlike Trace, it doesn't create
+// any directories.  It is equivalent to calling FilenameContext with a
+// background context.
+func (s *Scamper) Filename(cookie string, t time.Time) (string, error) {
+	return s.FilenameContext(context.Background(), cookie, t)
+}
+
+// FilenameContext is like Filename but the filename has the UUID
+// carried by ctx (if any) like the traceroutes run with ctx.
+func (s *Scamper) FilenameContext(ctx context.Context, cookie string, t time.Time) (string, error) {
+	if err := ValidateCookie(cookie); err != nil {
+		return "", err
+	}
+	uuid := s.fileUUID(ctx, cookie)
+	if err := ValidateUUID(uuid); err != nil {
+		return "", err
+	}
+	if s.outputPath == StdoutPath {
+		return "", nil
+	}
+	return s.labeled(datePath(s.outputPath, t) + baseFilename(uuid, t)), nil
+}
+
+// labeled adds the label of this instance (if any) to the given
+// filename before its extension.
+func (s *Scamper) labeled(filename string) string {
+	if s.label == "" {
+		return filename
+	}
+	return strings.TrimSuffix(filename, ".jsonl") + "_" + s.label + ".jsonl"
+}
+
+// metaline returns the metadata line of a traceroute run by this
+// instance with the socket ID and campaign ID carried by ctx (if any).
+// See createMetaline for a description of the uuid, isCache, and
+// cachedUUID parameters.  truncated indicates whether the output of
+// the traceroute was truncated and configHash is the hash of the
+// options it was run with.
+func (s *Scamper) metaline(ctx context.Context, uuid string, isCache bool, cachedUUID string, truncated bool, configHash string) []byte {
+	meta := newMetadata(uuid, isCache, cachedUUID)
+	meta.TracerLabel = s.label
+	meta.SockID = SockIDFromContext(ctx)
+	meta.CampaignID = CampaignIDFromContext(ctx)
+	meta.ConfigHash = configHash
+	meta.Truncated = truncated
+	return marshalMetaline(meta)
+}
+
+// outputFilename returns the filename for storing the traceroute after
+// applying the configured permissions and ownership to the date
+// directories that contain it.  If this instance has a label, it's
+// added to the filename before the extension.
+func (s *Scamper) outputFilename(uuid string, t time.Time) (string, error) {
+	if s.outputPath == StdoutPath {
+		return "", nil
+	}
+	filename, err := generateFilename(s.outputPath, uuid, t)
+	if err != nil {
+		return "", err
+	}
+	filename = s.labeled(filename)
+	if err := s.createDateDirs(s.outputPath, t); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// createDateDirs creates the date directories of the given time under
+// the given path (if needed) and applies the configured permissions and
+// ownership to them.
+func (s *Scamper) createDateDirs(path string, t time.Time) error {
+	if _, err := createDatePath(path, t); err != nil {
+		return newError(ErrOutputPath, err, "failed to create output directory")
+	}
+	for _, layout := range []string{"2006", "2006/01", "2006/01/02"} {
+		if err := s.applyPerms(filepath.Join(path, t.Format(layout)), s.dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// runCmd runs the given command and returns its output.
-func runCmd(ctx context.Context, label string, cmd []string) ([]byte, error) {
+// write writes data to the named file or, if traceroutes are written to
+// stdout, to stdout.  An existing file is only replaced if replace is
+// true (see writeFile).
+func (s *Scamper) write(filename string, data []byte, replace bool) error {
+	if s.outputPath != StdoutPath {
+		return s.writeFile(filename, data, replace)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	if _, err := stdout.Write(data); err != nil {
+		return newError(ErrWriteFile, err, "failed to write traceroute to stdout (error: %v)", err)
+	}
+	return nil
+}
+
+// renameFile and linkFile are variables so they can be replaced in tests.
+var (
+	renameFile = os.Rename
+	linkFile   = os.Link
+)
+
+// tempFilePattern matches the names of the temporary files of writeFile.
+const tempFilePattern = ".*.jsonl.*.tmp"
+
+// writeFile atomically writes data to the named file with the
+// configured permissions and ownership.  Data is first written to a
+// temporary file in the same directory which is moved to filename
+// only after it has been flushed, so readers never see a partially
+// written file.  The temporary file name starts with a dot and doesn't
+// end in .jsonl so it won't be picked up if we are killed mid-write
+// (see removeTempFiles).  If replace is false, the temporary file is
+// hard linked rather than renamed to filename so that an existing file
+// (e.g., one written since the collision policy was applied) is never
+// replaced and an error is returned instead.  By default, the file is
+// made read-only.
+func (s *Scamper) writeFile(filename string, data []byte, replace bool) error {
+	mode := os.FileMode(0444)
+	if s.fileMode != 0 {
+		mode = s.fileMode
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return newError(ErrWriteFile, err, "%v", err)
+	}
+	tmpname := f.Name()
+	if err := writeAndSync(f, data, mode); err != nil {
+		os.Remove(tmpname)
+		return newError(ErrWriteFile, err, "%v", err)
+	}
+	if err := s.applyPerms(tmpname, 0); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if !replace {
+		// Unlike renaming, linking fails if filename exists.
+		err = linkFile(tmpname, filename)
+		os.Remove(tmpname)
+	} else if err = renameFile(tmpname, filename); err != nil {
+		os.Remove(tmpname)
+	}
+	if err != nil {
+		return newError(ErrWriteFile, err, "%v", err)
+	}
+	return nil
+}
+
+// removeTempFiles removes the temporary files that writeFile left under
+// the given path when it was killed mid-write.  It's called when an
+// instance is created, before any traceroute is written.
+func removeTempFiles(path string) {
+	n := 0
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if ok, _ := filepath.Match(tempFilePattern, info.Name()); ok && os.Remove(name) == nil {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to remove temporary files under %q (error: %v)\n", path, err)
+	}
+	if n > 0 {
+		log.Printf("removed %d temporary files under %q\n", n, path)
+	}
+}
+
+// writeAndSync writes data to f, sets its mode, flushes it to stable
+// storage, and closes it.
+func writeAndSync(f *os.File, data []byte, mode os.FileMode) error {
+	_, err := f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// applyPerms sets the mode (unaffected by umask) and the group of the
+// given path if they are configured.
+func (s *Scamper) applyPerms(path string, mode os.FileMode) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return newError(ErrWriteFile, err, "failed to set mode of %q (error: %v)", path, err)
+		}
+	}
+	if s.fileGroup != 0 {
+		if err := os.Chown(path, -1, s.fileGroup); err != nil {
+			return newError(ErrWriteFile, err, "failed to set group of %q (error: %v)", path, err)
+		}
+	}
+	return nil
+}
+
+// cappedBuffer is a buffer that holds at most max bytes (if max isn't
+// zero).  Writes beyond max are discarded and cancel the command that
+// writes to the buffer.  The buffer isn't embedded so that io.Copy
+// can't bypass Write with bytes.Buffer's ReadFrom.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+	cancel    context.CancelFunc
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if cb.truncated {
+		return len(p), nil
+	}
+	if cb.max > 0 && int64(cb.buf.Len()+len(p)) > cb.max {
+		_, _ = cb.buf.Write(p[:cb.max-int64(cb.buf.Len())])
+		cb.truncated = true
+		cb.cancel()
+		return len(p), nil
+	}
+	return cb.buf.Write(p)
+}
+
+// environ validates the given environment variables and returns them
+// as "name=value" strings sorted by name.
+func environ(vars map[string]string) ([]string, error) {
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.ContainsRune(value, 0) {
+			return nil, newError(ErrInvalidEnv, nil, "%q: invalid environment variable", name)
+		}
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// command returns the command to run the given command line with the
+// given environment variables (if any) added to the inherited
+// environment.
+func command(ctx context.Context, cmd []string, env []string) *exec.Cmd {
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	return c
+}
+
+// runCmd runs the given command and returns its output.  The latency
+// of failed commands and of commands that take at least slow (if not
+// zero) is observed with an exemplar carrying the given UUID.  If the
+// output exceeds maxOutput bytes (if not zero), the command is killed
+// and its output up to its last complete line is returned along with
+// true.
+func runCmd(ctx context.Context, label string, cmd, env []string, uuid string, slow time.Duration, maxOutput int64) ([]byte, bool, error) {
 	deadline, _ := ctx.Deadline()
 	timeout := time.Until(deadline)
 
-	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
-	var outb, errb bytes.Buffer
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := command(ctx, cmd, env)
+	outb := cappedBuffer{max: maxOutput, cancel: cancel}
+	var errb bytes.Buffer
 	c.Stdout = &outb
 	c.Stderr = &errb
 	log.Printf("context %p: command started: %s\n", ctx, strings.Join(cmd, " "))
 	start := time.Now()
-	err := c.Run()
-	latency := time.Since(start).Seconds()
+	// Failures to start the command (e.g., a missing binary or a failed
+	// fork) are told apart from failures of the command.
+	err := c.Start()
+	started := err == nil
+	if started {
+		err = c.Wait()
+	}
+	elapsed := time.Since(start)
+	latency := elapsed.Seconds()
 	log.Printf("context %p: command finished in %v seconds", ctx, latency)
 	tracesPerformed.WithLabelValues(label).Inc()
+	if outb.truncated {
+		// Unlike a timeout, the traceroute is still written.
+		log.Printf("context %p: command killed because its output exceeded %d bytes\n", ctx, maxOutput)
+		observeTraceTime("truncated_trace", latency, uuid)
+		data := outb.buf.Bytes()
+		return data[:bytes.LastIndexByte(data, '\n')+1], true, nil
+	}
 	if err != nil {
 		// TODO change to use a label within general traceroute counter.
 		// possibly just use the latency histogram?
 		crashedTraces.WithLabelValues(label).Inc()
-		traceTimeHistogram.WithLabelValues("error").Observe(latency)
-		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		observeTraceTime("error", latency, uuid)
+		kind, reason, cause := ErrTraceKilled, "nonzero_exit", err
+		var exitErr *exec.ExitError
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
 			log.Printf("context %p: command timed out after %v\n", ctx, timeout)
-		} else {
+			reason = "timeout"
+		case errors.Is(ctx.Err(), context.Canceled):
+			// Callers can tell cancelled traceroutes (e.g., on
+			// shutdown) apart from those that failed.
+			log.Printf("context %p: command cancelled\n", ctx)
+			reason, cause = "cancelled", ctx.Err()
+		case !started:
+			log.Printf("context %p: command not started (error: %v)\n", ctx, err)
+			kind, reason = ErrTraceNotStarted, "not_started"
+		default:
 			log.Printf("context %p: command failed (error: %v)\n", ctx, err)
+			kind = ErrTraceFailed
+			if errors.As(err, &exitErr) && !exitErr.Exited() {
+				reason = "signal"
+			}
 		}
+		tracesFailed.WithLabelValues(label, reason).Inc()
 		log.Println(errb.String())
-		return outb.Bytes(), err
+		return outb.buf.Bytes(), false, newError(kind, cause, "%v", err)
 	}
 
 	log.Printf("context %p: command succeeded\n", ctx)
-	traceTimeHistogram.WithLabelValues("success").Observe(latency)
-	return outb.Bytes(), nil
+	if slow > 0 && elapsed >= slow {
+		observeTraceTime("success", latency, uuid)
+	} else {
+		observeTraceTime("success", latency, "")
+	}
+	return outb.buf.Bytes(), false, nil
 }
 
 // generateFilename creates the string filename for storing the data.
-func generateFilename(path string, cookie string, t time.Time) (string, error) {
+func generateFilename(path string, uuid string, t time.Time) (string, error) {
 	dir, err := createDatePath(path, t)
 	if err != nil {
 		// TODO(SaiedKazemi): Add metric here.
-		return "", errors.New("failed to create output directory")
+		return "", newError(ErrOutputPath, err, "failed to create output directory")
 	}
-	c, err := strconv.ParseUint(cookie, 16, 64)
-	if err != nil {
-		log.Printf("failed to parse cookie %v (error: %v)\n", cookie, err)
-		tracerCacheErrors.WithLabelValues("scamper", "badcookie").Inc()
-		return "", errors.New("failed to parse cookie")
+	if err := ValidateUUID(uuid); err != nil {
+		log.Printf("failed to validate UUID %v (error: %v)\n", uuid, err)
+		tracerCacheErrors.WithLabelValues("scamper", "baduuid").Inc()
+		return "", newError(ErrInvalidUUID, err, "failed to validate UUID")
+	}
+	return dir + baseFilename(uuid, t), nil
+}
+
+// baseFilename returns the filename (without its directory) for storing
+// the traceroute with the given UUID.
+func baseFilename(uuid string, t time.Time) string {
+	return t.Format("20060102T150405Z") + "_" + uuid + ".jsonl"
+}
+
+// fileUUID returns the UUID in the filename of the traceroute with the
+// given (valid) cookie: the UUID carried by ctx if there is one and
+// the UUID derived from the cookie otherwise.
+func (s *Scamper) fileUUID(ctx context.Context, cookie string) string {
+	if u := UUIDFromContext(ctx); u != "" {
+		return u
 	}
-	return dir + t.Format("20060102T150405Z") + "_" + uuid.FromCookie(c) + ".jsonl", nil
+	c, _ := parseCookie(cookie)
+	return UUIDFromCookie(c, s.cookieWidth)
 }
@@ -2,10 +2,17 @@ package tracer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -13,6 +20,8 @@ import (
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/uuid/prefix"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func init() {
@@ -66,6 +75,326 @@ func TestNewScamper(t *testing.T) {
 	}
 }
 
+func TestTraceTypeTimeouts(t *testing.T) {
+	overrides := map[string]time.Duration{"mda": 900 * time.Second, "regular": 60 * time.Second}
+	tests := []struct {
+		traceType string
+		overrides map[string]time.Duration
+		want      time.Duration
+	}{
+		{"mda", overrides, 900 * time.Second},
+		{"regular", overrides, 60 * time.Second},
+		{"regular", map[string]time.Duration{"mda": 900 * time.Second}, 300 * time.Second},
+		{"mda", nil, 300 * time.Second},
+	}
+	for _, test := range tests {
+		s, err := NewScamper(ScamperConfig{
+			Binary:            "/bin/echo",
+			OutputPath:        "testdata",
+			Timeout:           300 * time.Second,
+			TraceType:         test.traceType,
+			TracelbWaitProbe:  25,
+			TraceTypeTimeouts: test.overrides,
+		})
+		if err != nil {
+			t.Fatalf("NewScamper() = %v, want nil", err)
+		}
+		if s.params.timeout != test.want {
+			t.Errorf("%s traceroutes with overrides %v: timeout = %v, want %v", test.traceType, test.overrides, s.params.timeout, test.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	valid := ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       "testdata",
+		Timeout:          900 * time.Second,
+		TraceType:        "mda",
+		TracelbWaitProbe: 25,
+	}
+	tests := []struct {
+		modify func(*ScamperConfig)
+		want   error
+	}{
+		{func(c *ScamperConfig) { c.Binary = "testdata/non-existent" }, ErrNotExecutable},
+		{func(c *ScamperConfig) { c.OutputPath = "/dev/null" }, ErrOutputPath},
+		{func(c *ScamperConfig) { c.Timeout = 0 }, ErrInvalidTimeout},
+		{func(c *ScamperConfig) { c.TraceTypeTimeouts = map[string]time.Duration{"mda": 3601 * time.Second} }, ErrInvalidTimeout},
+		{func(c *ScamperConfig) { c.TraceTypeTimeouts = map[string]time.Duration{"regular": 0} }, ErrInvalidTimeout},
+		{func(c *ScamperConfig) { c.TraceTypeTimeouts = map[string]time.Duration{"paris": time.Minute} }, ErrInvalidTraceType},
+		{func(c *ScamperConfig) { c.FileMode = 0044 }, ErrInvalidFileMode},
+		{func(c *ScamperConfig) { c.FileGroup = -1 }, ErrInvalidFileGroup},
+		{func(c *ScamperConfig) { c.CookieWidth = 12 }, ErrInvalidCookieWidth},
+		{func(c *ScamperConfig) { c.SourceAddr = "10.0.0.1" }, ErrInvalidSourceAddr},
+		{func(c *ScamperConfig) { c.ListName = "a b" }, ErrInvalidListName},
+		{func(c *ScamperConfig) { c.ProbeRate = 10001 }, ErrInvalidProbeRate},
+		{func(c *ScamperConfig) { c.MaxOutputBytes = -1 }, ErrInvalidMaxOutput},
+		{func(c *ScamperConfig) { c.PTRMode = "dst-only" }, ErrInvalidPTRMode},
+		{func(c *ScamperConfig) { c.TracelbWaitProbe = 0 }, ErrInvalidWaitProbe},
+		{func(c *ScamperConfig) { c.Profile = "slow" }, ErrInvalidProfile},
+		{func(c *ScamperConfig) { c.Protocol = "icmp-paris" }, ErrInvalidProtocol},
+		{func(c *ScamperConfig) { c.Attempts = 6 }, ErrInvalidAttempts},
+		{func(c *ScamperConfig) { c.TracelbConfidence = 90 }, ErrInvalidConfidence},
+		{func(c *ScamperConfig) { c.GapLimit = 256 }, ErrInvalidGapLimit},
+		{func(c *ScamperConfig) { c.TraceType = "bad" }, ErrInvalidTraceType},
+		{func(c *ScamperConfig) { c.Label = "a_b" }, ErrInvalidLabel},
+	}
+	for _, test := range tests {
+		cfg := valid
+		test.modify(&cfg)
+		if _, err := NewScamper(cfg); !errors.Is(err, test.want) {
+			t.Errorf("NewScamper(%+v) = %v, want %v", cfg, err, test.want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "TestErrors")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		binary   string
+		want     error
+		wantExit bool
+	}{
+		{"testdata/fail", ErrTraceFailed, true},
+		{"testdata/loop", ErrTraceKilled, false},
+	} {
+		cfg := valid
+		cfg.Binary = test.binary
+		cfg.OutputPath = dir
+		cfg.Timeout = time.Second
+		s, err := NewScamper(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Trace("10.1.1.1", "1", "", time.Now())
+		if !errors.Is(err, test.want) {
+			t.Errorf("Trace() = %v, want %v", err, test.want)
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Errorf("Trace() = %v, want an *exec.ExitError", err)
+		} else if exited := exitErr.Exited(); exited != test.wantExit {
+			t.Errorf("Trace() exited = %v, want %v", exited, test.wantExit)
+		}
+		if _, err := s.Trace("10.1.1.1", "not a cookie", "", time.Now()); !errors.Is(err, ErrInvalidCookie) {
+			t.Errorf("Trace() = %v, want %v", err, ErrInvalidCookie)
+		}
+		if err := s.CachedTrace("1", "", time.Now(), []byte("no newline")); !errors.Is(err, ErrInvalidCachedTrace) {
+			t.Errorf("CachedTrace() = %v, want %v", err, ErrInvalidCachedTrace)
+		}
+	}
+}
+
+func TestTraceFailures(t *testing.T) {
+	dir := t.TempDir()
+	// A binary whose interpreter doesn't exist can't be started.
+	badExec := filepath.Join(dir, "bad-exec")
+	rtx.Must(ioutil.WriteFile(badExec, []byte("#!/non-existent/interpreter\n"), 0755), "failed to write bad-exec")
+	// A binary that kills itself is killed by another signal than ours.
+	signal := filepath.Join(dir, "signal")
+	rtx.Must(ioutil.WriteFile(signal, []byte("#!/bin/bash\nkill -9 $$\n"), 0755), "failed to write signal")
+	tests := []struct {
+		binary string
+		want   error
+		reason string
+	}{
+		{badExec, ErrTraceNotStarted, "not_started"},
+		{"testdata/fail", ErrTraceFailed, "nonzero_exit"},
+		{"testdata/loop", ErrTraceKilled, "timeout"},
+		{signal, ErrTraceFailed, "signal"},
+	}
+	for _, test := range tests {
+		s, err := NewScamper(ScamperConfig{
+			Binary:           test.binary,
+			OutputPath:       dir,
+			Timeout:          time.Second,
+			TraceType:        "mda",
+			TracelbWaitProbe: 25,
+		})
+		if err != nil {
+			t.Fatalf("NewScamper() = %v, want nil", err)
+		}
+		before := map[string]float64{}
+		for _, reason := range []string{"not_started", "nonzero_exit", "timeout", "cancelled", "signal"} {
+			before[reason] = promtest.ToFloat64(tracesFailed.WithLabelValues("scamper", reason))
+		}
+		if _, err := s.Trace("10.1.1.1", "1", "", time.Now()); !errors.Is(err, test.want) {
+			t.Errorf("%s: Trace() = %v, want %v", test.binary, err, test.want)
+		}
+		for reason, n := range before {
+			want := n
+			if reason == test.reason {
+				want++
+			}
+			if got := promtest.ToFloat64(tracesFailed.WithLabelValues("scamper", reason)); got != want {
+				t.Errorf("%s: traces_failed_total{reason=%q} = %v, want %v", test.binary, reason, got, want)
+			}
+		}
+	}
+
+	// Cancelled traceroutes (e.g., on shutdown) can be told apart from
+	// those that failed.
+	s, err := NewScamper(ScamperConfig{Binary: "testdata/loop", OutputPath: dir, Timeout: time.Minute, TraceType: "mda", TracelbWaitProbe: 25})
+	if err != nil {
+		t.Fatalf("NewScamper() = %v, want nil", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := s.TraceContext(ctx, "10.1.1.1", "1", "", time.Now()); !errors.Is(err, ErrTraceKilled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("TraceContext() = %v, want %v and %v", err, ErrTraceKilled, context.Canceled)
+	}
+}
+
+func TestNewScamperListName(t *testing.T) {
+	for _, listName := range []string{"a b", "a;b", "a\nb", `"ab"`, strings.Repeat("a", 65)} {
+		scamperCfg := ScamperConfig{
+			Binary:           "/bin/echo",
+			OutputPath:       "testdata",
+			Timeout:          900 * time.Second,
+			TraceType:        "regular",
+			TracelbWaitProbe: 25,
+			ListName:         listName,
+		}
+		if _, err := NewScamper(scamperCfg); err == nil || !strings.Contains(err.Error(), "invalid list name") {
+			t.Errorf("NewScamper(%q) = %v, want invalid list name", listName, err)
+		}
+	}
+}
+
+func TestNewScamperPTRMode(t *testing.T) {
+	tests := []struct {
+		ptrMode string
+		want    string
+	}{
+		{"", ""},
+		{"none", ""},
+		{"all", ""},
+		{"dst-only", "PTR mode is not supported by scamper"},
+		{"some", "invalid PTR mode"},
+	}
+	for _, test := range tests {
+		scamperCfg := ScamperConfig{
+			Binary:           "/bin/echo",
+			OutputPath:       "testdata",
+			Timeout:          900 * time.Second,
+			TraceType:        "mda",
+			TracelbWaitProbe: 25,
+			PTRMode:          test.ptrMode,
+		}
+		_, err := NewScamper(scamperCfg)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("NewScamper(%q) = %v, want nil", test.ptrMode, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("NewScamper(%q) = %v, want %q", test.ptrMode, err, test.want)
+		}
+	}
+}
+
+func TestNewScamperSourceAddr(t *testing.T) {
+	tests := []struct {
+		traceType  string
+		sourceAddr string
+		want       string
+	}{
+		{"regular", "", ""},
+		{"regular", "10.0.0.1", ""},
+		{"regular", "2001:db8::1", ""},
+		{"regular", "not an address", "invalid source address"},
+		{"mda", "", ""},
+		{"mda", "10.0.0.1", "source address is not supported by mda traceroutes"},
+	}
+	for _, test := range tests {
+		scamperCfg := ScamperConfig{
+			Binary:           "/bin/echo",
+			OutputPath:       "testdata",
+			Timeout:          900 * time.Second,
+			TraceType:        test.traceType,
+			TracelbWaitProbe: 25,
+			SourceAddr:       test.sourceAddr,
+		}
+		_, err := NewScamper(scamperCfg)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("NewScamper(%q) = %v, want nil", test.sourceAddr, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("NewScamper(%q) = %v, want %q", test.sourceAddr, err, test.want)
+		}
+	}
+}
+
+func TestFilePerms(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "TestFilePerms")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	for _, test := range []struct {
+		mode  os.FileMode
+		group int
+		want  string
+	}{
+		{os.ModeDir | 0755, 0, "invalid file mode"},
+		{0044, 0, "invalid file mode"},
+		{0640, -1, "invalid file group"},
+	} {
+		scamperCfg := ScamperConfig{
+			Binary:           "/bin/echo",
+			OutputPath:       tempdir,
+			Timeout:          time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+			FileMode:         test.mode,
+			FileGroup:        test.group,
+		}
+		if _, err := NewScamper(scamperCfg); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("NewScamper() = %v, want %q", err, test.want)
+		}
+	}
+
+	scamperCfg := ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       tempdir,
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+		FileMode:         0640,
+		FileGroup:        os.Getgid(),
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	if _, err := s.Trace("1.2.3.4", "1", "0123456789", faketime); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("2", "0123456789", faketime, []byte("{}\n{}\n")); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	wantModes := map[string]os.FileMode{
+		tempdir + "/2019":       os.ModeDir | 0750,
+		tempdir + "/2019/04":    os.ModeDir | 0750,
+		tempdir + "/2019/04/01": os.ModeDir | 0750,
+		tempdir + "/2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000001.jsonl": 0640,
+		tempdir + "/2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000002.jsonl": 0640,
+	}
+	for path, want := range wantModes {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != want {
+			t.Errorf("Stat(%q).Mode() = %v, want %v", path, fi.Mode(), want)
+		}
+	}
+}
+
 func TestTrace(t *testing.T) {
 	dir, err := ioutil.TempDir("", "TestScamper")
 	if err != nil {
@@ -79,16 +408,38 @@ func TestTrace(t *testing.T) {
 		binary     string
 		traceType  string
 		tracelbPTR bool
+		ptrMode    string
+		sourceAddr string
+		listName   string
+		probeRate  int
 		shouldFail bool
 		want       string
 	}{
-		{"testdata/fail", "mda", true, true, "exit status 1"},
-		{"testdata/loop", "mda", true, true, "signal: killed"},
+		{"testdata/fail", "mda", true, "", "", "", 0, true, "exit status 1"},
+		{"testdata/loop", "mda", true, "", "", "", 0, true, "signal: killed"},
 
-		{"/bin/echo", "mda", true, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":""}
+		{"/bin/echo", "mda", true, "", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
 -o- -O json -I tracelb -P icmp-echo -q 3 -W 39 -O ptr 10.1.1.1`},
-		{"/bin/echo", "mda", false, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":""}
+		{"/bin/echo", "mda", false, "", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I tracelb -P icmp-echo -q 3 -W 39 10.1.1.1`},
+		{"/bin/echo", "regular", false, "", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I trace -P icmp-paris 10.1.1.1`},
+		{"/bin/echo", "regular", false, "", "10.0.0.1", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I trace -P icmp-paris -S 10.0.0.1 10.1.1.1`},
+		{"/bin/echo", "mda", true, "none", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
 -o- -O json -I tracelb -P icmp-echo -q 3 -W 39 10.1.1.1`},
+		{"/bin/echo", "mda", false, "all", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I tracelb -P icmp-echo -q 3 -W 39 -O ptr 10.1.1.1`},
+		{"/bin/echo", "regular", true, "", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I trace -P icmp-paris 10.1.1.1`},
+		{"/bin/echo", "regular", false, "none", "", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I trace -P icmp-paris 10.1.1.1`},
+		{"/bin/echo", "regular", false, "all", "10.0.0.1", "", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -I trace -P icmp-paris -S 10.0.0.1 -O ptr 10.1.1.1`},
+		{"/bin/echo", "regular", false, "", "", "ndt-campaign:1", 0, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -l ndt-campaign:1 -I trace -P icmp-paris 10.1.1.1`},
+		{"/bin/echo", "mda", false, "", "", "", 100, false, `{"UUID":"","TracerouteCallerVersion":"` + prometheusx.GitShortCommit + `","CachedResult":false,"CachedUUID":"","MetalineVersion":1,"TracerLabel":"","SockID":null,"Truncated":false,"CampaignID":""}
+-o- -O json -p 100 -I tracelb -P icmp-echo -q 3 -W 39 10.1.1.1`},
 	}
 	for _, test := range tests {
 		os.RemoveAll(path)
@@ -99,6 +450,10 @@ func TestTrace(t *testing.T) {
 			TraceType:        test.traceType,
 			TracelbWaitProbe: 39,
 			TracelbPTR:       test.tracelbPTR,
+			PTRMode:          test.ptrMode,
+			SourceAddr:       test.sourceAddr,
+			ListName:         test.listName,
+			ProbeRate:        test.probeRate,
 		}
 		s, err := NewScamper(scamperCfg)
 		if err != nil {
@@ -116,7 +471,13 @@ func TestTrace(t *testing.T) {
 			t.Errorf("Trace() = %v, want nil", err)
 			continue
 		}
-		got := string(out)
+		// The metaline ends with the hash of the configuration (see
+		// TestCreateMetaline).
+		traced := string(out)
+		if !configHashRegexp.MatchString(traced) {
+			t.Errorf("Trace() = %q, want a config hash", traced)
+		}
+		got := configHashRegexp.ReplaceAllString(traced, "")
 		if strings.TrimSpace(got) != strings.TrimSpace(test.want) {
 			t.Errorf("Trace() = %q, want %q", strings.TrimSpace(got), strings.TrimSpace(test.want))
 		}
@@ -125,13 +486,46 @@ func TestTrace(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		got = string(out)
-		if strings.TrimSpace(got) != strings.TrimSpace(test.want) {
-			t.Errorf("ReadFile(%v) = %q, want %q", path, got, test.want)
+		if got := string(out); got != traced {
+			t.Errorf("ReadFile(%v) = %q, want %q", path, got, traced)
 		}
 	}
 }
 
+func TestTraceContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTraceContext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scamperCfg := ScamperConfig{
+		Binary:           "testdata/loop",
+		OutputPath:       dir,
+		Timeout:          60 * time.Second,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = s.TraceContext(ctx, "10.1.1.1", "12AB", "", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "signal: killed") {
+		t.Errorf("TraceContext() = %v, want %q", err, "signal: killed")
+	}
+	// The timeout is a minute so the subprocess must have been killed
+	// because of the cancellation.
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("TraceContext() took %v after cancellation, want less than 5s", elapsed)
+	}
+}
+
 func TestTraceWritesMeta(t *testing.T) {
 	tempdir, err := ioutil.TempDir("", "TestTraceWritesUUID")
 	rtx.Must(err, "failed to create tempdir")
@@ -246,6 +640,560 @@ func TestCachedTrace(t *testing.T) {
 	}
 }
 
+func TestWriteFilter(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "TestWriteFilter")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	scamperCfg := ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       tempdir,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nFiltered int
+	s.SetWriteFilter(func(rawData []byte) bool {
+		nFiltered++
+		return false
+	})
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	filename := tempdir + "/2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000001.jsonl"
+
+	out, err := s.Trace("1.2.3.4", "1", "0123456789", faketime)
+	if err != nil || len(out) == 0 {
+		t.Errorf("Trace() = %q, %v, want data, nil", out, err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want %v", filename, err, os.ErrNotExist)
+	}
+	if err := s.CachedTrace("1", "0123456789", faketime, append([]byte("{}\n"), out...)); err != nil {
+		t.Errorf("CachedTrace() = %v, want nil", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want %v", filename, err, os.ErrNotExist)
+	}
+	if nFiltered != 2 {
+		t.Errorf("got %d calls to the write filter, want 2", nFiltered)
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "TestTrailer")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewScamper(ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       tempdir,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := []byte(`{"ID":"hop1"}` + "\n" + `{"ID":"hop2"}` + "\n")
+	s.SetTrailer(func(ctx context.Context, rawData []byte) []byte {
+		return trailer
+	})
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	filename := tempdir + "/2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000001.jsonl"
+
+	out, err := s.Trace("10.1.1.1", "1", "0123456789", faketime)
+	if err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if bytes.Contains(out, trailer) {
+		t.Errorf("Trace() = %q, want traceroute data without trailer", out)
+	}
+	// The file has the traceroute (metadata line and scamper output)
+	// followed by the trailer.
+	got, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), out...), trailer...); !bytes.Equal(got, want) {
+		t.Errorf("got file content %q, want %q", got, want)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "TestLabel")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	scamperCfg := ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       tempdir,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+		Label:            "a_b",
+	}
+	if _, err := NewScamper(scamperCfg); err == nil || !strings.Contains(err.Error(), "invalid label") {
+		t.Errorf("NewScamper() = %v, want invalid label", err)
+	}
+	scamperCfg.Label = "candidate"
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	if _, err := s.Trace("1.2.3.4", "1", "0123456789", faketime); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("2", "0123456789", faketime, []byte("{}\n{}\n")); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	for _, cookie := range []string{"1", "2"} {
+		filename := tempdir + "/2019/04/01/20190401T034551Z_" + prefix.UnsafeString() + "_000000000000000" + cookie + "_candidate.jsonl"
+		if got, err := s.Filename(cookie, faketime); got != filename || err != nil {
+			t.Errorf("Filename() = %q, %v, want %q, nil", got, err, filename)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var md Metadata
+		if err := json.Unmarshal(bytes.Split(data, []byte("\n"))[0], &md); err != nil {
+			t.Fatal(err)
+		}
+		if md.TracerLabel != "candidate" {
+			t.Errorf("TracerLabel = %q, want %q", md.TracerLabel, "candidate")
+		}
+	}
+}
+
+func TestCustomUUID(t *testing.T) {
+	tempdir := t.TempDir()
+	s, err := NewScamper(ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       tempdir,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	ctx := WithUUID(context.Background(), "site1-1554090351-1")
+	out, err := s.TraceContext(ctx, "10.1.1.1", "1", "site1-1554090351-1", faketime)
+	if err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+	ctx = WithUUID(context.Background(), "site1-1554090351-2")
+	if err := s.CachedTraceContext(ctx, "2", "site1-1554090351-2", faketime, out); err != nil {
+		t.Fatalf("CachedTraceContext() = %v, want nil", err)
+	}
+	// The files of traceroutes with custom UUIDs are named after them.
+	for _, uuid := range []string{"site1-1554090351-1", "site1-1554090351-2"} {
+		filename := tempdir + "/2019/04/01/20190401T034551Z_" + uuid + ".jsonl"
+		ctx := WithUUID(context.Background(), uuid)
+		if got, err := s.FilenameContext(ctx, "1", faketime); got != filename || err != nil {
+			t.Errorf("FilenameContext() = %q, %v, want %q, nil", got, err, filename)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := extractMetadata(bytes.Split(data, []byte("\n"))[0]).UUID; got != uuid {
+			t.Errorf("UUID = %q, want %q", got, uuid)
+		}
+	}
+	ctx = WithUUID(context.Background(), "invalid/uuid")
+	if _, err := s.TraceContext(ctx, "10.1.1.1", "3", "invalid/uuid", faketime); !errors.Is(err, ErrInvalidUUID) {
+		t.Errorf("TraceContext() = %v, want %v", err, ErrInvalidUUID)
+	}
+	if _, err := s.FilenameContext(ctx, "3", faketime); !errors.Is(err, ErrInvalidUUID) {
+		t.Errorf("FilenameContext() = %v, want %v", err, ErrInvalidUUID)
+	}
+	if got := UUIDFromContext(context.Background()); got != "" {
+		t.Errorf("UUIDFromContext() = %q, want \"\"", got)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "scamper")
+	if err := ioutil.WriteFile(binary, []byte("#!/bin/bash\n\necho \"$TRC_INHERITED $TRC_ENV\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TRC_INHERITED", "inherited")
+	t.Setenv("TRC_ENV", "parent")
+	scamperCfg := ScamperConfig{
+		Binary:           binary,
+		OutputPath:       dir,
+		Timeout:          time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	for _, env := range []map[string]string{{"": "x"}, {"A=B": "x"}, {"A\x00": "x"}, {"A": "x\x00"}} {
+		scamperCfg.Env = env
+		if _, err := NewScamper(scamperCfg); !errors.Is(err, ErrInvalidEnv) {
+			t.Errorf("NewScamper(Env: %q) = %v, want %v", env, err, ErrInvalidEnv)
+		}
+	}
+
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, "inherited parent\n"},
+		{map[string]string{"TRC_ENV": "child"}, "inherited child\n"},
+	}
+	for i, test := range tests {
+		scamperCfg.Env = test.env
+		s, err := NewScamper(scamperCfg)
+		if err != nil {
+			t.Fatalf("NewScamper() = %v, want nil", err)
+		}
+		got, err := s.Trace("1.2.3.4", strconv.Itoa(i+1), "0123456789", time.Now())
+		if err != nil {
+			t.Fatalf("Trace() = %v, want nil", err)
+		}
+		if !strings.HasSuffix(string(got), "\n"+test.want) {
+			t.Errorf("Trace(Env: %v) = %q, want traceroute %q", test.env, got, test.want)
+		}
+	}
+}
+
+func TestValidateUUID(t *testing.T) {
+	tests := []struct {
+		uuid  string
+		valid bool
+	}{
+		{"ndt-abcde_1633013267_unsafe_00000000004418BB", true},
+		{"site1-1554090351-1", true},
+		{"user@host:1+2", true},
+		{"", false},
+		{"a/b", false},
+		{"a b", false},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, test := range tests {
+		if err := ValidateUUID(test.uuid); (err == nil) != test.valid {
+			t.Errorf("ValidateUUID(%q) = %v, want valid %v", test.uuid, err, test.valid)
+		}
+	}
+}
+
+func TestStdout(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+	cwd, err := os.Getwd()
+	rtx.Must(err, "failed to get working directory")
+
+	scamperCfg := ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       StdoutPath,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	out, err := s.Trace("10.1.1.1", "1", "uuid1", faketime)
+	if err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("2", "uuid2", faketime, out); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+	if got, err := s.Filename("1", faketime); got != "" || err != nil {
+		t.Errorf("Filename() = %q, %v, want \"\", nil", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(cwd, StdoutPath)); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want %v", StdoutPath, err, os.ErrNotExist)
+	}
+
+	// Each traceroute is 4 JSON records, one per line.
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("got %d lines, want 8:\n%s", len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Errorf("line %d: %q is not a JSON record (error: %v)", i, line, err)
+		}
+	}
+	for i, want := range map[int]Metadata{
+		0: {UUID: "uuid1", TracerouteCallerVersion: prometheusx.GitShortCommit},
+		4: {UUID: "uuid2", TracerouteCallerVersion: prometheusx.GitShortCommit, CachedResult: true, CachedUUID: "uuid1"},
+	} {
+		want.MetalineVersion = metalineVersion
+		want.ConfigHash = "75907f919d7919cc" // see TestCreateMetaline
+		var got Metadata
+		if err := json.Unmarshal([]byte(lines[i]), &got); err != nil || got != want {
+			t.Errorf("line %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	stdout = ioutil.Discard
+	defer func() { stdout = os.Stdout }()
+
+	// exemplars returns the UUIDs of the exemplars of the trace time
+	// histogram with the given outcome.
+	exemplars := func(outcome string) map[string]bool {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		rtx.Must(err, "failed to gather metrics")
+		uuids := make(map[string]bool)
+		for _, mf := range mfs {
+			if mf.GetName() != "trace_time_seconds" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				if m.GetLabel()[0].GetValue() != outcome {
+					continue
+				}
+				for _, b := range m.GetHistogram().GetBucket() {
+					for _, l := range b.GetExemplar().GetLabel() {
+						uuids[l.GetValue()] = true
+					}
+				}
+			}
+		}
+		return uuids
+	}
+
+	tests := []struct {
+		binary    string
+		slowTrace time.Duration
+		uuid      string
+		outcome   string
+		want      bool
+	}{
+		{"testdata/jsonl", 0, "fast", "success", false},
+		{"testdata/jsonl", time.Hour, "fast", "success", false},
+		{"testdata/jsonl", time.Nanosecond, strings.Repeat("x", 64), "success", false},
+		{"testdata/jsonl", time.Nanosecond, "slow", "success", true},
+		{"testdata/fail", 0, "failed", "error", true},
+	}
+	for _, test := range tests {
+		scamperCfg := ScamperConfig{
+			Binary:           test.binary,
+			OutputPath:       StdoutPath,
+			Timeout:          1 * time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+			SlowTrace:        test.slowTrace,
+		}
+		s, err := NewScamper(scamperCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = s.Trace("10.1.1.1", "1", test.uuid, time.Now())
+		if got := exemplars(test.outcome)[test.uuid]; got != test.want {
+			t.Errorf("%v traceroute %q has exemplar = %v, want %v", test.outcome, test.uuid, got, test.want)
+		}
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	tempdir := t.TempDir()
+	// traceCount returns the number of traceroutes with the given outcome.
+	traceCount := func(outcome string) uint64 {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		rtx.Must(err, "failed to gather metrics")
+		for _, mf := range mfs {
+			if mf.GetName() != "trace_time_seconds" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				if m.GetLabel()[0].GetValue() == outcome {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+		return 0
+	}
+
+	tests := []struct {
+		binary        string
+		maxOutput     int64
+		wantTruncated bool
+	}{
+		{"testdata/jsonl", 0, false},
+		{"testdata/jsonl", 1 << 20, false},
+		{"testdata/flood", 1000, true},
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	for i, test := range tests {
+		scamperCfg := ScamperConfig{
+			Binary:           test.binary,
+			OutputPath:       tempdir,
+			Timeout:          1 * time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+			MaxOutputBytes:   test.maxOutput,
+		}
+		s, err := NewScamper(scamperCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		truncated := traceCount("truncated_trace")
+		cookie := strconv.Itoa(2*i + 1)
+		out, err := s.Trace("10.1.1.1", cookie, "uuid", faketime)
+		if test.wantTruncated != errors.Is(err, ErrTraceTruncated) || (err != nil && !test.wantTruncated) {
+			t.Fatalf("%v: Trace() = %v, want truncated: %v", test.binary, err, test.wantTruncated)
+		}
+		if test.maxOutput > 0 && int64(len(out)) > test.maxOutput+1000 {
+			t.Errorf("%v: got %d bytes of traceroute, want about %d", test.binary, len(out), test.maxOutput)
+		}
+		if got := traceCount("truncated_trace") - truncated; got != map[bool]uint64{false: 0, true: 1}[test.wantTruncated] {
+			t.Errorf("%v: got %d truncated traceroutes", test.binary, got)
+		}
+		// Cached copies of the traceroute keep the truncation marker.
+		cachedCookie := strconv.Itoa(2*i + 2)
+		if err := s.CachedTrace(cachedCookie, "cached", faketime, out); err != nil {
+			t.Fatalf("%v: CachedTrace() = %v, want nil", test.binary, err)
+		}
+		for _, c := range []string{cookie, cachedCookie} {
+			filename, _ := s.Filename(c, faketime)
+			b, err := ioutil.ReadFile(filename)
+			rtx.Must(err, "failed to read file")
+			// The file must be valid JSONL.
+			if !bytes.HasSuffix(b, []byte("\n")) {
+				t.Errorf("%v: traceroute doesn't end with a newline", test.binary)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			for _, line := range lines {
+				var v map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &v); err != nil {
+					t.Fatalf("%v: invalid JSON line %q (error: %v)", test.binary, line, err)
+				}
+			}
+			var md Metadata
+			rtx.Must(json.Unmarshal([]byte(lines[0]), &md), "failed to unmarshal metaline")
+			if md.Truncated != test.wantTruncated {
+				t.Errorf("%v: Truncated = %v, want %v", test.binary, md.Truncated, test.wantTruncated)
+			}
+		}
+	}
+}
+
+func TestAtomicWrite(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "TestAtomicWrite")
+	rtx.Must(err, "failed to create tempdir")
+	defer os.RemoveAll(tempdir)
+	defer func() {
+		renameFile = os.Rename
+		linkFile = os.Link
+	}()
+
+	scamperCfg := ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       tempdir,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	dir := tempdir + "/2019/04/01/"
+	filename := dir + "20190401T034551Z_" + prefix.UnsafeString() + "_0000000000000001.jsonl"
+
+	// Simulate a failed rename and link.  The temporary file should
+	// be removed.
+	renameFile = func(oldpath, newpath string) error {
+		return errors.New("rename failed")
+	}
+	linkFile = func(oldpath, newpath string) error {
+		return errors.New("link failed")
+	}
+	if _, err := s.Trace("1.2.3.4", "1", "0123456789", faketime); err == nil {
+		t.Error("Trace() = nil, want error")
+	}
+	if err := s.CachedTrace("1", "0123456789", faketime, []byte("{}\n{}\n")); err == nil {
+		t.Error("CachedTrace() = nil, want error")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got %d files in %q, want 0", len(files), dir)
+	}
+
+	// Simulate being killed after the data has been written but
+	// before it has been linked.  Only the temporary file should
+	// exist.
+	linkFile = func(oldpath, newpath string) error {
+		runtime.Goexit()
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Trace("1.2.3.4", "1", "0123456789", faketime)
+	}()
+	<-done
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want %v", filename, err, os.ErrNotExist)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), ".") || strings.HasSuffix(files[0].Name(), ".jsonl") {
+		t.Errorf("got %v in %q, want only a temporary file", files, dir)
+	}
+
+	// A new instance removes the temporary file but not other files.
+	other := filepath.Join(dir, ".other.tmp")
+	rtx.Must(ioutil.WriteFile(other, nil, 0644), "failed to write file")
+	if s, err = NewScamper(scamperCfg); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || files[0].Name() != ".other.tmp" {
+		t.Errorf("got %v in %q, want only %q", files, dir, other)
+	}
+	rtx.Must(os.Remove(other), "failed to remove file")
+
+	// A normal write should succeed.
+	renameFile = os.Rename
+	linkFile = os.Link
+	if _, err := s.Trace("1.2.3.4", "1", "0123456789", faketime); err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "0123456789") {
+		t.Errorf("ReadFile(%q) = %q, want the full traceroute", filename, data)
+	}
+
+	// Files are only replaced when asked to, e.g., by the collision
+	// policy.
+	if err := s.writeFile(filename, []byte("other"), false); !errors.Is(err, ErrWriteFile) {
+		t.Errorf("writeFile() = %v, want %v", err, ErrWriteFile)
+	}
+	if got, _ := ioutil.ReadFile(filename); !bytes.Equal(got, data) {
+		t.Errorf("ReadFile(%q) = %q, want %q", filename, got, data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %v in %q, want only %q", files, dir, filename)
+	}
+	if err := s.writeFile(filename, []byte("other"), true); err != nil {
+		t.Errorf("writeFile() = %v, want nil", err)
+	}
+	if got, _ := ioutil.ReadFile(filename); string(got) != "other" {
+		t.Errorf("ReadFile(%q) = %q, want %q", filename, got, "other")
+	}
+}
+
 func TestExtractUUID(t *testing.T) {
 	uuid := extractUUID([]byte("{\"UUID\": \"ndt-plh7v_1566050090_000000000004D64D\"}"))
 	if uuid != "ndt-plh7v_1566050090_000000000004D64D" {
@@ -274,6 +1222,9 @@ func TestDontTrace(t *testing.T) {
 	s.DontTrace()
 }
 
+// configHashRegexp matches the config hash field of metadata lines.
+var configHashRegexp = regexp.MustCompile(`,"ConfigHash":"[0-9a-f]{16}"`)
+
 func TestCreateMetaline(t *testing.T) {
 	prometheusx.GitShortCommit = "Fake Version"
 	gotMeta := createMetaline("0000000000000ABC", true, "00EF")
@@ -281,6 +1232,219 @@ func TestCreateMetaline(t *testing.T) {
 	if !bytes.Contains(gotMeta, wantMeta) {
 		t.Errorf("gotMeta %q does not contain wantMeta %q", gotMeta, wantMeta)
 	}
+	if !bytes.Contains(gotMeta, []byte(`"SockID":null`)) {
+		t.Errorf("gotMeta %q doesn't contain a null SockID", gotMeta)
+	}
+
+	// The socket ID is a nested object and the metaline is still a
+	// single line of valid JSON.
+	sockID := &SockID{SrcIP: "10.0.0.1", SrcPort: 443, DstIP: "10.1.1.1", DstPort: 51234}
+	meta := newMetadata("0000000000000ABC", false, "")
+	meta.SockID = sockID
+	gotMeta = marshalMetaline(meta)
+	if bytes.Count(gotMeta, []byte("\n")) != 1 || !bytes.HasSuffix(gotMeta, []byte("\n")) {
+		t.Errorf("gotMeta %q is not a single line", gotMeta)
+	}
+	wantMeta = []byte(`"SockID":{"SrcIP":"10.0.0.1","SrcPort":443,"DstIP":"10.1.1.1","DstPort":51234}`)
+	if !bytes.Contains(gotMeta, wantMeta) {
+		t.Errorf("gotMeta %q does not contain wantMeta %q", gotMeta, wantMeta)
+	}
+	var got Metadata
+	if err := json.Unmarshal(gotMeta, &got); err != nil {
+		t.Fatalf("json.Unmarshal() = %v, want nil", err)
+	}
+	if got.SockID == nil || *got.SockID != *sockID {
+		t.Errorf("got SockID %+v, want %+v", got.SockID, sockID)
+	}
+
+	// The configuration hash only depends on the options that affect
+	// probes, so it's the same across processes and output options.
+	newCfg := func() ScamperConfig {
+		return ScamperConfig{
+			Binary:           "/bin/echo",
+			OutputPath:       "/tmp",
+			Timeout:          1 * time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+		}
+	}
+	hashTests := []struct {
+		name string
+		edit func(*ScamperConfig)
+		want string
+	}{
+		{"fixed", func(*ScamperConfig) {}, "75907f919d7919cc"},
+		{"output-path", func(cfg *ScamperConfig) { cfg.OutputPath = "/var/tmp" }, "75907f919d7919cc"},
+		{"binary", func(cfg *ScamperConfig) { cfg.Binary = "testdata/jsonl" }, "75907f919d7919cc"},
+		{"file-mode", func(cfg *ScamperConfig) { cfg.FileMode = 0644 }, "75907f919d7919cc"},
+		{"slow-trace", func(cfg *ScamperConfig) { cfg.SlowTrace = time.Second }, "75907f919d7919cc"},
+		{"env", func(cfg *ScamperConfig) { cfg.Env = map[string]string{"TZ": "UTC"} }, "75907f919d7919cc"},
+		{"wait-probe", func(cfg *ScamperConfig) { cfg.TracelbWaitProbe = 40 }, "7b3531d09cf0d079"},
+		{"probe-rate", func(cfg *ScamperConfig) { cfg.ProbeRate = 100 }, "f996a736a95de4cd"},
+		{"timeout", func(cfg *ScamperConfig) { cfg.Timeout = 2 * time.Minute }, "7ee621dcc00245fb"},
+	}
+	for _, test := range hashTests {
+		scamperCfg := newCfg()
+		test.edit(&scamperCfg)
+		s, err := NewScamper(scamperCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var md Metadata
+		if err := json.Unmarshal(s.metaline(context.Background(), "uuid", false, "", false, s.ConfigHash()), &md); err != nil {
+			t.Fatalf("json.Unmarshal() = %v, want nil", err)
+		}
+		if md.ConfigHash != test.want {
+			t.Errorf("%s: got config hash %q, want %q", test.name, md.ConfigHash, test.want)
+		}
+	}
+	if !bytes.Contains(createMetaline("0000000000000ABC", false, ""), []byte(`"ConfigHash":""`)) {
+		t.Errorf("createMetaline() doesn't contain an empty ConfigHash")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+	scamperCfg := ScamperConfig{
+		Binary:           "/bin/echo",
+		OutputPath:       StdoutPath,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Invalid configurations and trace type changes are rejected and
+	// leave the configuration unchanged.
+	badCfg := scamperCfg
+	badCfg.TracelbWaitProbe = 1
+	if err := s.Reconfigure(badCfg); !errors.Is(err, ErrInvalidWaitProbe) {
+		t.Errorf("Reconfigure() = %v, want %v", err, ErrInvalidWaitProbe)
+	}
+	badCfg = scamperCfg
+	badCfg.TraceType = "regular"
+	if err := s.Reconfigure(badCfg); !errors.Is(err, ErrInvalidTraceType) {
+		t.Errorf("Reconfigure() = %v, want %v", err, ErrInvalidTraceType)
+	}
+	if got := s.ConfigHash(); got != "75907f919d7919cc" {
+		t.Errorf("ConfigHash() = %q, want %q", got, "75907f919d7919cc")
+	}
+
+	newCfg := scamperCfg
+	newCfg.TracelbWaitProbe = 40
+	if err := s.Reconfigure(newCfg); err != nil {
+		t.Fatalf("Reconfigure() = %v, want nil", err)
+	}
+	if got := s.ConfigHash(); got != "7b3531d09cf0d079" {
+		t.Errorf("ConfigHash() = %q, want %q", got, "7b3531d09cf0d079")
+	}
+	if _, err := s.TraceContext(context.Background(), "10.1.1.1", "1", "uuid1", time.Now()); err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+	for _, want := range []string{`"ConfigHash":"7b3531d09cf0d079"`, "-W 40 10.1.1.1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got traceroute %q, want it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestSockID(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+	scamperCfg := ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       StdoutPath,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SockIDFromContext(context.Background()); got != nil {
+		t.Errorf("SockIDFromContext() = %+v, want nil", got)
+	}
+	traced := SockID{SrcIP: "10.0.0.1", SrcPort: 443, DstIP: "10.1.1.1", DstPort: 1111}
+	cached := SockID{SrcIP: "10.0.0.1", SrcPort: 443, DstIP: "10.1.1.1", DstPort: 2222}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	out, err := s.TraceContext(WithSockID(context.Background(), traced), "10.1.1.1", "1", "uuid1", faketime)
+	if err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+	// Cached traceroutes record the socket that reused them.
+	if err := s.CachedTraceContext(WithSockID(context.Background(), cached), "2", "uuid2", faketime, out); err != nil {
+		t.Fatalf("CachedTraceContext() = %v, want nil", err)
+	}
+	if err := s.CachedTrace("3", "uuid3", faketime, out); err != nil {
+		t.Fatalf("CachedTrace() = %v, want nil", err)
+	}
+
+	// Each traceroute is 4 JSON records starting with the metaline.
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 12 {
+		t.Fatalf("got %d lines, want 12:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []*SockID{&traced, &cached, nil} {
+		var md Metadata
+		if err := json.Unmarshal([]byte(lines[4*i]), &md); err != nil {
+			t.Fatalf("failed to unmarshal metaline %q (error: %v)", lines[4*i], err)
+		}
+		if (md.SockID == nil) != (want == nil) || (want != nil && *md.SockID != *want) {
+			t.Errorf("%s: got SockID %+v, want %+v", md.UUID, md.SockID, want)
+		}
+	}
+}
+
+func TestCampaignID(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+	scamperCfg := ScamperConfig{
+		Binary:           "testdata/jsonl",
+		OutputPath:       StdoutPath,
+		Timeout:          1 * time.Minute,
+		TraceType:        "mda",
+		TracelbWaitProbe: 39,
+	}
+	s, err := NewScamper(scamperCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := CampaignIDFromContext(context.Background()); got != "" {
+		t.Errorf("CampaignIDFromContext() = %q, want empty", got)
+	}
+	faketime := time.Date(2019, time.April, 1, 3, 45, 51, 0, time.UTC)
+	ctx := WithCampaignID(context.Background(), "campaign1")
+	out, err := s.TraceContext(ctx, "10.1.1.1", "1", "campaign1", faketime)
+	if err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+	if err := s.CachedTraceContext(ctx, "1", "campaign1_ipv6", faketime, out); err != nil {
+		t.Fatalf("CachedTraceContext() = %v, want nil", err)
+	}
+	if _, err := s.TraceContext(context.Background(), "10.1.1.2", "2", "uuid2", faketime); err != nil {
+		t.Fatalf("TraceContext() = %v, want nil", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 12 {
+		t.Fatalf("got %d lines, want 12:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []string{"campaign1", "campaign1", ""} {
+		var md Metadata
+		if err := json.Unmarshal([]byte(lines[4*i]), &md); err != nil {
+			t.Fatalf("failed to unmarshal metaline %q (error: %v)", lines[4*i], err)
+		}
+		if md.CampaignID != want {
+			t.Errorf("%s: got campaign ID %q, want %q", md.UUID, md.CampaignID, want)
+		}
+	}
 }
 
 func TestInvalidCookie(t *testing.T) {
@@ -304,6 +1468,44 @@ func TestInvalidCookie(t *testing.T) {
 	}
 }
 
+func TestCookie(t *testing.T) {
+	tests := []struct {
+		cookie string
+		width  int
+		want   string
+	}{
+		{"12AB", 0, "00000000000012AB"},
+		{"12ab", 0, "00000000000012AB"},
+		{"0", 0, "0000000000000000"},
+		{"ffffffffffffffff", 0, "FFFFFFFFFFFFFFFF"},
+		{"00000000000012AB", 0, "00000000000012AB"},
+		{"12ab", 16, "00000000000012AB"},
+		{"12ab", 20, "000000000000000012AB"},
+		{"000000000000012AB", 0, ""}, // over-long
+		{"", 0, ""},                  // empty
+		{"an invalid cookie", 0, ""}, // non-hex
+		{"12g4", 0, ""},              // non-hex
+		{"-1", 0, ""},                // negative
+		{"0x12ab", 0, ""},            // prefix
+	}
+	for _, test := range tests {
+		err := ValidateCookie(test.cookie)
+		if (err == nil) != (test.want != "") {
+			t.Errorf("ValidateCookie(%q) = %v", test.cookie, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidCookie) {
+			t.Errorf("ValidateCookie(%q) = %v, want %v", test.cookie, err, ErrInvalidCookie)
+		}
+		got, err := NormalizeCookie(test.cookie, test.width)
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("NormalizeCookie(%q, %d) = %q, %v, want %q", test.cookie, test.width, got, err, test.want)
+		}
+	}
+	if _, err := NormalizeCookie("12ab", 8); !errors.Is(err, ErrInvalidCookieWidth) {
+		t.Errorf("NormalizeCookie(%q, 8) = %v, want %v", "12ab", err, ErrInvalidCookieWidth)
+	}
+}
+
 func TestGenerateFilename(t *testing.T) {
 	_, err := generateFilename("/var/empty", "0000", time.Now())
 	wantErrStr := "failed to create output directory"
@@ -0,0 +1,48 @@
+package tracer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSpans(t *testing.T) {
+	saveProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(saveProvider)
+
+	tests := []struct {
+		binary     string
+		wantStatus codes.Code
+	}{
+		{"testdata/jsonl", codes.Unset},
+		{"testdata/fail", codes.Error},
+	}
+	for _, test := range tests {
+		s, err := NewScamper(ScamperConfig{
+			Binary:           test.binary,
+			OutputPath:       StdoutPath,
+			Timeout:          time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 39,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+		_, _ = s.TraceContext(context.Background(), "10.1.1.1", "12AB", "", time.Now())
+		spans := sr.Ended()
+		if len(spans) != 1 || spans[0].Name() != "scamper.Trace" {
+			t.Errorf("%s: got %d spans, want one scamper.Trace span", test.binary, len(spans))
+			continue
+		}
+		if got := spans[0].Status().Code; got != test.wantStatus {
+			t.Errorf("%s: got span status %v, want %v", test.binary, got, test.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package tracer
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnterminated means that an arguments template ends within quotes
+// or after a backslash.
+var errUnterminated = errors.New("unterminated quote or escape")
+
+// placeholderRegexp matches the placeholders of arguments templates.
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// templatePlaceholders are the placeholders of arguments templates and
+// whether they're required.
+var templatePlaceholders = map[string]bool{
+	"{dst}":     true,  // destination IP address
+	"{timeout}": false, // timeout of the traceroute in seconds
+	"{uuid}":    false, // UUID of the traceroute
+}
+
+// parseArgsTemplate splits the given arguments template into arguments
+// and validates them.  Arguments are separated by white space and can be
+// grouped with quotes as in a shell (e.g., `-o- -O json -I "tracelb -P
+// udp-paris {dst}"`).  The arguments must write JSON to stdout but are
+// otherwise not checked.
+func parseArgsTemplate(template string) ([]string, error) {
+	args, err := splitArgs(template)
+	if err != nil {
+		return nil, newError(ErrInvalidTemplate, err, "%q: invalid arguments template (error: %v)", template, err)
+	}
+	found := map[string]bool{}
+	for _, arg := range args {
+		for _, p := range placeholderRegexp.FindAllString(arg, -1) {
+			if _, ok := templatePlaceholders[p]; !ok {
+				return nil, newError(ErrInvalidTemplate, nil, "%q: unknown placeholder %s in arguments template", template, p)
+			}
+			found[p] = true
+		}
+	}
+	for p, required := range templatePlaceholders {
+		if required && !found[p] {
+			return nil, newError(ErrInvalidTemplate, nil, "%q: arguments template lacks placeholder %s", template, p)
+		}
+	}
+	// The traceroute is read from stdout in JSON.
+	if !hasArgs(args, "-o-") && !hasArgs(args, "-o", "-") {
+		return nil, newError(ErrInvalidTemplate, nil, "%q: arguments template doesn't write to stdout (-o-)", template)
+	}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-o") && arg != "-o-" && (arg != "-o" || i+1 == len(args) || args[i+1] != "-") {
+			return nil, newError(ErrInvalidTemplate, nil, "%q: arguments template writes to another output than stdout", template)
+		}
+	}
+	if !hasArgs(args, "-O", "json") {
+		return nil, newError(ErrInvalidTemplate, nil, "%q: arguments template doesn't output JSON (-O json)", template)
+	}
+	return args, nil
+}
+
+// hasArgs returns true if args contains the given consecutive arguments.
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		match := true
+		for j, w := range want {
+			if args[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// expandArgs returns the given template arguments with their
+// placeholders replaced.
+func expandArgs(args []string, remoteIP string, timeout time.Duration, uuid string) []string {
+	r := strings.NewReplacer(
+		"{dst}", remoteIP,
+		"{timeout}", strconv.Itoa(int(timeout.Seconds())),
+		"{uuid}", uuid,
+	)
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = r.Replace(arg)
+	}
+	return expanded
+}
+
+// splitArgs splits s into arguments separated by white space like a
+// shell does, without any expansion.  Single and double quotes group
+// words into one argument (e.g., the command of scamper's -I option)
+// and a backslash escapes the next character outside single quotes.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errUnterminated
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
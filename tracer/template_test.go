@@ -0,0 +1,56 @@
+package tracer
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArgsTemplate(t *testing.T) {
+	for _, template := range []string{
+		`-o- -O json -I "tracelb -P icmp-echo"`,      // no {dst}
+		`-o- -O json -I "tracelb {dst} {src}"`,       // unknown placeholder
+		`-O json -I "tracelb {dst}"`,                 // no -o-
+		`-o- -O warts -I "tracelb {dst}"`,            // no -O json
+		`-o- -O json -I "tracelb {dst}`,              // unterminated quote
+		`-o- -I "tracelb -O json {dst}"`,             // -O json within -I
+		`-o- -O json -I "tracelb {dst}" -o out.json`, // also writes to a file
+	} {
+		if _, err := parseArgsTemplate(template); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("parseArgsTemplate(%q) = %v, want %v", template, err, ErrInvalidTemplate)
+		}
+	}
+
+	template := `-o - -O json -p 100 -I 'trace -P udp-paris -w {timeout} {dst}' -U {uuid} a\ b`
+	args, err := parseArgsTemplate(template)
+	if err != nil {
+		t.Fatalf("parseArgsTemplate(%q) = %v, want nil", template, err)
+	}
+	want := []string{"-o", "-", "-O", "json", "-p", "100", "-I", "trace -P udp-paris -w 60 10.1.1.1", "-U", "abc", "a b"}
+	if got := expandArgs(args, "10.1.1.1", time.Minute, "abc"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expandArgs() = %q, want %q", got, want)
+	}
+
+	// The template replaces the command line of traceroutes.
+	s, err := NewScamper(ScamperConfig{
+		Binary:       "/bin/echo",
+		OutputPath:   t.TempDir(),
+		Timeout:      time.Minute,
+		TraceType:    "regular",
+		ProbeRate:    10, // ignored
+		ArgsTemplate: template,
+	})
+	if err != nil {
+		t.Fatalf("NewScamper() = %v, want nil", err)
+	}
+	data, err := s.Trace("10.1.1.1", "1", "abc", time.Now())
+	if err != nil {
+		t.Fatalf("Trace() = %v, want nil", err)
+	}
+	lines := bytes.SplitN(data, []byte("\n"), 2)
+	if got, want := string(lines[1]), "-o - -O json -p 100 -I trace -P udp-paris -w 60 10.1.1.1 -U abc a b\n"; got != want {
+		t.Errorf("Trace() ran %q, want %q", got, want)
+	}
+}
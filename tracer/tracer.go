@@ -14,10 +14,16 @@
 package tracer
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
@@ -64,6 +70,18 @@ var (
 		},
 		[]string{"type"},
 	)
+	// tracesFailed tells why traces failed: their command couldn't be
+	// started (not_started), exited with a non-zero status
+	// (nonzero_exit), was killed when the trace timed out (timeout) or
+	// was cancelled (cancelled), or was killed by another signal
+	// (signal).
+	tracesFailed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "traces_failed_total",
+			Help: "The number of traces that have failed by reason",
+		},
+		[]string{"type", "reason"},
+	)
 	tracesNotPerformed = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "traces_skipped_total",
@@ -83,6 +101,121 @@ var (
 	hostname string
 )
 
+// Errors returned by tracer.  Errors returned by this package match one
+// of these with errors.Is and, if they were caused by another error,
+// wrap it.
+var (
+	ErrInvalidCookie      = errors.New("invalid cookie")
+	ErrInvalidUUID        = errors.New("invalid UUID")
+	ErrNotExecutable      = errors.New("not an executable file")
+	ErrOutputPath         = errors.New("invalid output path")
+	ErrInvalidTimeout     = errors.New("invalid timeout")
+	ErrInvalidFileMode    = errors.New("invalid file mode")
+	ErrInvalidFileGroup   = errors.New("invalid file group")
+	ErrInvalidSourceAddr  = errors.New("invalid source address")
+	ErrInvalidListName    = errors.New("invalid list name")
+	ErrInvalidProbeRate   = errors.New("invalid probe rate")
+	ErrInvalidMaxOutput   = errors.New("invalid maximum output size")
+	ErrInvalidPTRMode     = errors.New("invalid PTR mode")
+	ErrInvalidWaitProbe   = errors.New("invalid tracelb wait probe")
+	ErrInvalidProfile     = errors.New("invalid traceroute profile")
+	ErrInvalidProtocol    = errors.New("invalid traceroute protocol")
+	ErrInvalidAttempts    = errors.New("invalid number of attempts")
+	ErrInvalidConfidence  = errors.New("invalid tracelb confidence level")
+	ErrInvalidGapLimit    = errors.New("invalid gap limit")
+	ErrInvalidTraceType   = errors.New("invalid traceroute type")
+	ErrInvalidLabel       = errors.New("invalid label")
+	ErrInvalidCachedTrace = errors.New("invalid cached traceroute")
+	ErrEmptyTrace         = errors.New("empty traceroute")
+	ErrTraceKilled        = errors.New("traceroute killed")
+	ErrTraceFailed        = errors.New("traceroute failed")
+	ErrTraceNotStarted    = errors.New("traceroute not started")
+	ErrTraceTruncated     = errors.New("traceroute truncated")
+	ErrWriteFile          = errors.New("failed to write traceroute file")
+	ErrPingFailed         = errors.New("ping failed")
+	ErrInvalidCollision   = errors.New("invalid filename collision policy")
+	ErrInvalidEnv         = errors.New("invalid environment variable")
+	ErrLegacyLinkPath     = errors.New("invalid legacy link path")
+	ErrInvalidCookieWidth = errors.New("invalid cookie width")
+	ErrInvalidTemplate    = errors.New("invalid arguments template")
+)
+
+// tracerError is an error that matches one of the errors above with
+// errors.Is and wraps the error that caused it (if any).  Its message
+// is independent of both so that existing messages are preserved.
+type tracerError struct {
+	kind error
+	err  error
+	msg  string
+}
+
+// newError returns a new tracerError of the given kind that wraps err
+// (which can be nil) with a message formatted according to format.
+func newError(kind, err error, format string, a ...interface{}) error {
+	return &tracerError{kind: kind, err: err, msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *tracerError) Error() string {
+	return e.msg
+}
+
+func (e *tracerError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *tracerError) Unwrap() error {
+	return e.err
+}
+
+// ValidateCookie returns an error if cookie isn't a valid socket
+// cookie.  A valid cookie is a 64-bit number written as 1 to 16
+// hexadecimal digits in either case (e.g., "12ab" or "00000000000012AB").
+func ValidateCookie(cookie string) error {
+	_, err := parseCookie(cookie)
+	return err
+}
+
+// NormalizeCookie returns the normalized form of cookie as it appears
+// in UUIDs: uppercase hexadecimal digits padded with zeros to width
+// digits (e.g., "12ab" becomes "00000000000012AB" with the default
+// width).  Zero means DefaultCookieWidth.  It returns an error if
+// cookie or width isn't valid (see ValidateCookieWidth).
+func NormalizeCookie(cookie string, width int) (string, error) {
+	if err := ValidateCookieWidth(width); err != nil {
+		return "", err
+	}
+	c, err := parseCookie(cookie)
+	if err != nil {
+		return "", err
+	}
+	return formatCookie(c, width), nil
+}
+
+// uuidRegexp matches valid UUIDs.
+var uuidRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:@+-]{1,128}$`)
+
+// ValidateUUID returns an error if uuid can't be used in traceroute
+// filenames.  A valid UUID has 1 to 128 letters, digits, and any of
+// "_.:@+-" (e.g., "host_1633013267_unsafe_00000000004418BB").
+func ValidateUUID(uuid string) error {
+	if !uuidRegexp.MatchString(uuid) {
+		return fmt.Errorf("%w: %q", ErrInvalidUUID, uuid)
+	}
+	return nil
+}
+
+// parseCookie validates cookie and returns its numeric value.
+func parseCookie(cookie string) (uint64, error) {
+	if cookie == "" || len(cookie) > 16 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidCookie, cookie)
+	}
+	c, err := strconv.ParseUint(cookie, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidCookie, cookie)
+	}
+	return c, nil
+}
+
 // Metadata is the first line of the traceroute .jsonl file.
 //
 // TODO: move this struct to ETL parser.
@@ -91,6 +224,92 @@ type Metadata struct {
 	TracerouteCallerVersion string
 	CachedResult            bool
 	CachedUUID              string
+	// MetalineVersion is the version of the layout of the metadata
+	// line (see metalineFields).  It's zero in metadata lines written
+	// before the layout was versioned.
+	MetalineVersion int
+	// TracerLabel distinguishes the outputs of multiple traceroute
+	// tools that run side by side.  It's empty if there's only one.
+	TracerLabel string
+	// SockID is the socket of the connection that triggered the
+	// traceroute (or, for cached traceroutes, the reuse of a previous
+	// traceroute).  It's null when unknown.
+	SockID *SockID
+	// Truncated indicates that scamper was killed because its output
+	// was too large and the traceroute only has the complete lines of
+	// JSON that were captured.
+	Truncated bool
+	// CampaignID is shared by the traceroutes to the different
+	// addresses (e.g., IPv4 and IPv6) of the same destination.  It's
+	// empty if there's no campaign.
+	CampaignID string
+	// ConfigHash is a hash of the options of the traceroute tool that
+	// affect the probes of the traceroute (e.g., the trace type and
+	// the probe rate).  It's empty when unknown.
+	ConfigHash string
+}
+
+// SockID identifies the socket of a connection by its 4-tuple.
+type SockID struct {
+	SrcIP   string
+	SrcPort uint16
+	DstIP   string
+	DstPort uint16
+}
+
+// sockIDKey is the context key of socket IDs.
+type sockIDKey struct{}
+
+// WithSockID returns a copy of ctx that carries the given socket ID.
+// Traceroutes run or cached with the returned context record the
+// socket ID in their metadata.
+func WithSockID(ctx context.Context, sockID SockID) context.Context {
+	return context.WithValue(ctx, sockIDKey{}, sockID)
+}
+
+// SockIDFromContext returns the socket ID carried by ctx or nil if
+// there is none.
+func SockIDFromContext(ctx context.Context) *SockID {
+	if sockID, ok := ctx.Value(sockIDKey{}).(SockID); ok {
+		return &sockID
+	}
+	return nil
+}
+
+// campaignIDKey is the context key of campaign IDs.
+type campaignIDKey struct{}
+
+// WithCampaignID returns a copy of ctx that carries the given campaign
+// ID.  Traceroutes run or cached with the returned context record the
+// campaign ID in their metadata.
+func WithCampaignID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, campaignIDKey{}, id)
+}
+
+// CampaignIDFromContext returns the campaign ID carried by ctx or an
+// empty string if there is none.
+func CampaignIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(campaignIDKey{}).(string)
+	return id
+}
+
+// uuidKey is the context key of UUIDs.
+type uuidKey struct{}
+
+// WithUUID returns a copy of ctx that carries the given UUID.
+// Traceroutes run or cached with the returned context have this UUID
+// in their metadata and filename instead of the one derived from their
+// cookie (see ipcache.IPCache.FetchTrace).  The UUID must be valid per
+// ValidateUUID.
+func WithUUID(ctx context.Context, uuid string) context.Context {
+	return context.WithValue(ctx, uuidKey{}, uuid)
+}
+
+// UUIDFromContext returns the UUID carried by ctx or an empty string
+// if there is none.
+func UUIDFromContext(ctx context.Context) string {
+	uuid, _ := ctx.Value(uuidKey{}).(string)
+	return uuid
 }
 
 func init() {
@@ -100,16 +319,22 @@ func init() {
 }
 
 // extractUUID returns the UUID in the metadata line of a traceroute.
+func extractUUID(metaline []byte) string {
+	return extractMetadata(metaline).UUID
+}
+
+// extractMetadata returns the metadata in the metadata line of a
+// traceroute or empty metadata if the line can't be parsed.
 //
 // TODO: Eliminate the need to unmarshal data we marshaled in the first place.
-func extractUUID(metaline []byte) string {
+func extractMetadata(metaline []byte) Metadata {
 	var md Metadata
 	err := json.Unmarshal(metaline, &md)
 	if err != nil {
 		log.Println("failed to parse metaline:", string(metaline))
-		return ""
+		return Metadata{}
 	}
-	return md.UUID
+	return md
 }
 
 // createMetaline returns what the first line of the .jsonl output file
@@ -117,20 +342,47 @@ func extractUUID(metaline []byte) string {
 // original traceroute or a cached traceroute, and parameter cachedUUID is
 // the original traceroute if isCache is 1.
 func createMetaline(uuid string, isCache bool, cachedUUID string) []byte {
-	meta := Metadata{
+	return marshalMetaline(newMetadata(uuid, isCache, cachedUUID))
+}
+
+// newMetadata returns the metadata of a traceroute.  See createMetaline
+// for a description of the parameters.
+func newMetadata(uuid string, isCache bool, cachedUUID string) Metadata {
+	return Metadata{
 		UUID:                    uuid,
 		TracerouteCallerVersion: prometheusx.GitShortCommit,
 		CachedResult:            isCache,
 		CachedUUID:              cachedUUID,
 	}
-	metaJSON, _ := json.Marshal(meta)
-	return append(metaJSON, byte('\n'))
+}
+
+// marshalMetaline returns the given metadata as a newline terminated
+// line of JSON with the current metaline layout.
+func marshalMetaline(meta Metadata) []byte {
+	return encodeMetaline(meta, metalineVersion)
 }
 
 // createDatePath returns a string with date in format prefix/yyyy/mm/dd/ after
 // creating a directory of the same name.
 func createDatePath(outputPath string, t time.Time) (string, error) {
-	dir := outputPath + "/" + t.Format("2006/01/02") + "/"
+	dir := datePath(outputPath, t)
 	err := os.MkdirAll(dir, 0777)
 	return dir, err
 }
+
+// datePath returns a string with date in format prefix/yyyy/mm/dd/.
+func datePath(outputPath string, t time.Time) string {
+	return outputPath + "/" + t.Format("2006/01/02") + "/"
+}
+
+// observeTraceTime observes the latency of a traceroute with the given
+// outcome.  If uuid isn't empty, it's attached to the observation as
+// an exemplar unless it's too long for one.
+func observeTraceTime(outcome string, latency float64, uuid string) {
+	o := traceTimeHistogram.WithLabelValues(outcome)
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && uuid != "" && len("uuid")+utf8.RuneCountInString(uuid) <= prometheus.ExemplarMaxRunes {
+		eo.ObserveWithExemplar(latency, prometheus.Labels{"uuid": uuid})
+		return
+	}
+	o.Observe(latency)
+}
@@ -0,0 +1,117 @@
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The range of scamper versions whose output the parser has been tested
+// with.  Versions are dates so they compare as strings.
+const (
+	oldestScamperVersion = "20200717"
+	newestScamperVersion = "20211026"
+)
+
+// unknownVersion is the version of scamper binaries whose version
+// couldn't be determined.
+const unknownVersion = "unknown"
+
+var (
+	scamperVersionInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scamper_version_info",
+			Help: "The version of the scamper binary (always 1)",
+		},
+		[]string{"type", "version", "supported"},
+	)
+
+	// versionRegexp matches the version in the output of scamper -v
+	// (e.g., "scamper version 20211026").
+	versionRegexp = regexp.MustCompile(`version\s+v?(\d{8}\S*)`)
+
+	// versionTimeout is how long to wait for scamper -v.  It's a
+	// variable so it can be changed in tests.
+	versionTimeout = 5 * time.Second
+)
+
+// maxVersionOutput is the maximum number of bytes of the output of
+// scamper -v that are read.
+const maxVersionOutput = 4096
+
+// probeVersion returns the version of the given scamper binary or
+// unknownVersion if it can't be determined.
+func probeVersion(binary string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, binary, "-v")
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return unknownVersion
+	}
+	if err := c.Start(); err != nil {
+		return unknownVersion
+	}
+	// Binaries that misbehave (e.g., don't exit or write forever)
+	// are killed once the output is read or the timeout expires.
+	// Their children may keep the output open so it's read in the
+	// background.
+	done := make(chan []byte, 1)
+	go func() {
+		out, _ := ioutil.ReadAll(io.LimitReader(stdout, maxVersionOutput))
+		done <- out
+	}()
+	var out []byte
+	select {
+	case out = <-done:
+	case <-ctx.Done():
+	}
+	cancel()
+	c.Wait()
+	m := versionRegexp.FindSubmatch(bytes.TrimSpace(out))
+	if m == nil {
+		return unknownVersion
+	}
+	return string(m[1])
+}
+
+// isSupportedVersion returns whether the given scamper version is in
+// the range of versions that the parser has been tested with.
+func isSupportedVersion(version string) bool {
+	if len(version) < len(oldestScamperVersion) {
+		return false
+	}
+	date := version[:len(oldestScamperVersion)]
+	return date >= oldestScamperVersion && date <= newestScamperVersion
+}
+
+// checkVersion probes, logs, and exports the version of the given
+// scamper binary and warns if it's not supported.  Unsupported
+// versions are only warned about because their output may well parse.
+func checkVersion(binary, metricType string) string {
+	version := probeVersion(binary)
+	supported := version != unknownVersion && isSupportedVersion(version)
+	if supported {
+		log.Printf("%s: scamper version %s\n", binary, version)
+	} else {
+		log.Printf("warning: %s: scamper version %s is not in the supported range [%s, %s]\n", binary, version, oldestScamperVersion, newestScamperVersion)
+	}
+	scamperVersionInfo.WithLabelValues(metricType, version, boolLabel(supported)).Set(1)
+	return version
+}
+
+// boolLabel returns the value of a boolean metric label.
+func boolLabel(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
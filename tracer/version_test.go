@@ -0,0 +1,98 @@
+package tracer
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeVersion(t *testing.T) {
+	saveVersionTimeout := versionTimeout
+	versionTimeout = 100 * time.Millisecond
+	defer func() { versionTimeout = saveVersionTimeout }()
+
+	dir := t.TempDir()
+	script := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/bash\n\n"+content+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		binary string
+		want   string
+	}{
+		{"testdata/jsonl", "20211026"},
+		{script("old", `echo "scamper version 20190101"`), "20190101"},
+		{script("patched", `echo "scamper version v20211026-mlab"`), "20211026-mlab"},
+		{"/bin/echo", unknownVersion},
+		{"testdata/non-executable", unknownVersion},
+		{"testdata/non-existent", unknownVersion},
+		{script("hang", "sleep 10"), unknownVersion},
+		{script("flood", "yes"), unknownVersion},
+	}
+	for _, test := range tests {
+		start := time.Now()
+		if got := probeVersion(test.binary); got != test.want {
+			t.Errorf("probeVersion(%q) = %q, want %q", test.binary, got, test.want)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("probeVersion(%q) took %v, want less than a second", test.binary, d)
+		}
+	}
+}
+
+func TestIsSupportedVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"20211026", true},
+		{"20211026-mlab", true},
+		{"20200717", true},
+		{"20200716", false},
+		{"20211027", false},
+		{"2021", false},
+		{unknownVersion, false},
+	}
+	for _, test := range tests {
+		if got := isSupportedVersion(test.version); got != test.want {
+			t.Errorf("isSupportedVersion(%q) = %v, want %v", test.version, got, test.want)
+		}
+	}
+}
+
+func TestScamperVersion(t *testing.T) {
+	for _, test := range []struct {
+		binary    string
+		label     string
+		want      string
+		supported string
+	}{
+		{"testdata/jsonl", "versioned", "20211026", "true"},
+		{"/bin/echo", "unversioned", unknownVersion, "false"},
+	} {
+		s, err := NewScamper(ScamperConfig{
+			Binary:           test.binary,
+			OutputPath:       t.TempDir(),
+			Timeout:          time.Minute,
+			TraceType:        "mda",
+			TracelbWaitProbe: 25,
+			Label:            test.label,
+		})
+		if err != nil {
+			t.Fatalf("NewScamper() = %v, want nil", err)
+		}
+		if got := s.Version(); got != test.want {
+			t.Errorf("Version() = %q, want %q", got, test.want)
+		}
+		if got := promtest.ToFloat64(scamperVersionInfo.WithLabelValues("scamper-"+test.label, test.want, test.supported)); got != 1 {
+			t.Errorf("scamper_version_info{version=%q} = %v, want 1", test.want, got)
+		}
+	}
+}